@@ -0,0 +1,158 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"time"
+)
+
+// The companion agent runs on the user's workstation (the same binary with
+// -agent) and opens library files in a local viewer when the browser asks.
+// The server signs each request with the secret it shares with the agent:
+//
+//	GET /api/open-link?path=REL on the server returns
+//	    {"agent": URL, "path": REL, "expires": UNIX, "sig": HEX}
+//	the browser POSTs that object (minus "agent") to URL + "/open"
+//
+// sig is the hex HMAC-SHA256 of "open\n" + path + "\n" + expires. path is
+// relative to the library root, which the agent maps to its own -imagepath
+// (where the workstation mounts the library), so the server's paths never
+// have to make sense locally.
+var (
+	agentMode   bool   // -agent: run as the companion agent instead of the web UI
+	agentSecret string // -agent-secret, shared by server and agent
+	agentURL    string // -agent-url, where browsers reach the agent
+	agentListen string // -agent-listen
+	agentViewer string // -agent-viewer, default the desktop's opener
+)
+
+// Links stay valid this long, just enough for the browser to pass them on
+const agentLinkTTL = time.Minute
+
+type OpenLink struct {
+	Agent   string `json:"agent,omitempty"`
+	Path    string `json:"path"`
+	Expires int64  `json:"expires"`
+	Sig     string `json:"sig"`
+}
+
+func agentSignature(path string, expires int64) string {
+	mac := hmac.New(sha256.New, []byte(agentSecret))
+	fmt.Fprintf(mac, "open\n%s\n%d", path, expires)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// GET /api/open-link?path= signs a request for the companion agent to open
+// one library file. 404 when no agent is configured.
+func openLinkHandler(w http.ResponseWriter, r *http.Request) {
+	if agentSecret == "" {
+		http.Error(w, "No companion agent configured (-agent-secret)", 404)
+		return
+	}
+	path := absImagePath(r.URL.Query().Get("path"))
+	rel, err := filepath.Rel(imageRoot, path)
+	if err != nil || !withinImageRoot(path) {
+		http.Error(w, "File is outside allowed directory", 403)
+		return
+	}
+	if _, err := os.Stat(path); err != nil {
+		http.Error(w, "File does not exist", 404)
+		return
+	}
+	link := OpenLink{Agent: agentURL, Path: filepath.ToSlash(rel), Expires: time.Now().Add(agentLinkTTL).Unix()}
+	link.Sig = agentSignature(link.Path, link.Expires)
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(link)
+}
+
+// The command that opens a file with the desktop's default application
+func viewerCommand(path string) *exec.Cmd {
+	if agentViewer != "" {
+		return exec.Command(agentViewer, path)
+	}
+	switch runtime.GOOS {
+	case "darwin":
+		return exec.Command("open", path)
+	case "windows":
+		// Not through cmd's start, which would read &, | and the like in a
+		// file name as more commands
+		return exec.Command("rundll32", "url.dll,FileProtocolHandler", path)
+	}
+	return exec.Command("xdg-open", path)
+}
+
+// POST /open on the agent checks a signed link and opens the file below the
+// local library root
+func agentOpenHandler(w http.ResponseWriter, r *http.Request) {
+	// Pages served by the web UI call the agent from another origin; the
+	// signature is what authenticates them
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	w.Header().Set("Access-Control-Allow-Headers", "Content-Type")
+	w.Header().Set("Access-Control-Allow-Private-Network", "true")
+	switch r.Method {
+	case "OPTIONS":
+		w.WriteHeader(204)
+		return
+	case "POST":
+	default:
+		http.Error(w, "Method not allowed", 405)
+		return
+	}
+
+	var link OpenLink
+	if err := json.NewDecoder(r.Body).Decode(&link); err != nil {
+		http.Error(w, "Invalid JSON", 400)
+		return
+	}
+	if !hmac.Equal([]byte(link.Sig), []byte(agentSignature(link.Path, link.Expires))) {
+		http.Error(w, "Bad signature", 403)
+		return
+	}
+	if time.Now().Unix() > link.Expires {
+		http.Error(w, "Link expired", 403)
+		return
+	}
+	rel := filepath.FromSlash(link.Path)
+	if filepath.IsAbs(rel) || !filepath.IsLocal(rel) {
+		http.Error(w, "Path is outside the library", 403)
+		return
+	}
+	path := filepath.Join(imageRoot, rel)
+	if !withinImageRoot(path) {
+		http.Error(w, "Path is outside the library", 403)
+		return
+	}
+	if _, err := os.Stat(path); err != nil {
+		http.Error(w, "File does not exist here: "+path, 404)
+		return
+	}
+	cmd := viewerCommand(path)
+	if err := cmd.Start(); err != nil {
+		reqLog(r, "agent").Error("failed to open file", "path", path, "err", err)
+		http.Error(w, "Failed to open file: "+err.Error(), 500)
+		return
+	}
+	go cmd.Wait()
+	reqLog(r, "agent").Info("opened file", "path", path, "client", clientIP(r))
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]string{"opened": path})
+}
+
+// Run as the companion agent until the listener fails
+func runAgent() error {
+	if agentSecret == "" {
+		return fmt.Errorf("-agent needs -agent-secret, the same as the server's")
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/open", agentOpenHandler)
+	logFor("agent").Info("companion agent listening", "addr", agentListen, "root", imageRoot)
+	return http.ListenAndServe(agentListen, mux)
+}
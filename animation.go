@@ -0,0 +1,312 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"image"
+	"image/gif"
+	"image/png"
+	"io"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Frame count and running time of an animated GIF, APNG or WebP
+type AnimationInfo struct {
+	Format   string  `json:"format"` // gif, apng or webp
+	Frames   int     `json:"frames"`
+	Duration float64 `json:"duration"` // Seconds for one loop
+	Loops    int     `json:"loops"`    // 0 loops forever
+}
+
+type cachedAnimation struct {
+	size    int64
+	modTime time.Time
+	info    *AnimationInfo
+}
+
+var (
+	animationMu    sync.Mutex
+	animationCache = make(map[string]cachedAnimation)
+)
+
+func mayBeAnimated(path string) bool {
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".gif", ".png", ".apng", ".webp":
+		return true
+	}
+	return false
+}
+
+// Animation details of a file, or nil if it isn't animated. Only the
+// container structure is read, no frames are decoded.
+func animationInfo(path string) *AnimationInfo {
+	if !mayBeAnimated(path) {
+		return nil
+	}
+	stat, err := os.Stat(path)
+	if err != nil {
+		return nil
+	}
+	animationMu.Lock()
+	cached, ok := animationCache[path]
+	animationMu.Unlock()
+	if ok && cached.size == stat.Size() && cached.modTime.Equal(stat.ModTime()) {
+		return cached.info
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		return nil
+	}
+	defer f.Close()
+	r := bufio.NewReader(f)
+	magic, _ := r.Peek(12)
+	var info *AnimationInfo
+	switch {
+	case bytes.HasPrefix(magic, []byte("GIF8")):
+		info, err = gifAnimation(r)
+	case bytes.HasPrefix(magic, []byte("\x89PNG\r\n\x1a\n")):
+		info, err = apngAnimation(r)
+	case len(magic) == 12 && string(magic[:4]) == "RIFF" && string(magic[8:]) == "WEBP":
+		info, err = webpAnimation(r)
+	}
+	if err != nil || (info != nil && info.Frames < 2) {
+		info = nil
+	}
+
+	animationMu.Lock()
+	animationCache[path] = cachedAnimation{size: stat.Size(), modTime: stat.ModTime(), info: info}
+	animationMu.Unlock()
+	return info
+}
+
+// Skip a run of GIF data sub-blocks up to the zero-length terminator
+func skipGIFSubBlocks(r *bufio.Reader) error {
+	for {
+		n, err := r.ReadByte()
+		if err != nil || n == 0 {
+			return err
+		}
+		if _, err := r.Discard(int(n)); err != nil {
+			return err
+		}
+	}
+}
+
+func gifAnimation(r *bufio.Reader) (*AnimationInfo, error) {
+	var screen [13]byte // Header and logical screen descriptor
+	if _, err := io.ReadFull(r, screen[:]); err != nil {
+		return nil, err
+	}
+	if flags := screen[10]; flags&0x80 != 0 {
+		r.Discard(3 << ((flags & 7) + 1))
+	}
+	info := &AnimationInfo{Format: "gif", Loops: 1}
+	var delay int // Hundredths of a second, from the graphic control extension
+	for {
+		b, err := r.ReadByte()
+		if err != nil {
+			return nil, err
+		}
+		switch b {
+		case 0x21: // Extension
+			label, err := r.ReadByte()
+			if err != nil {
+				return nil, err
+			}
+			if label == 0xF9 {
+				var gce [6]byte // Size, flags, delay, transparent index, terminator
+				if _, err := io.ReadFull(r, gce[:]); err != nil {
+					return nil, err
+				}
+				delay = int(binary.LittleEndian.Uint16(gce[2:4]))
+				continue
+			}
+			if label == 0xFF {
+				var app [12]byte
+				if _, err := io.ReadFull(r, app[:]); err != nil {
+					return nil, err
+				}
+				if string(app[1:12]) == "NETSCAPE2.0" {
+					var loop [4]byte // Size, id, loop count
+					if _, err := io.ReadFull(r, loop[:]); err != nil {
+						return nil, err
+					}
+					info.Loops = int(binary.LittleEndian.Uint16(loop[2:4]))
+				}
+			}
+			if err := skipGIFSubBlocks(r); err != nil {
+				return nil, err
+			}
+		case 0x2C: // Image descriptor
+			var desc [9]byte
+			if _, err := io.ReadFull(r, desc[:]); err != nil {
+				return nil, err
+			}
+			if flags := desc[8]; flags&0x80 != 0 {
+				r.Discard(3 << ((flags & 7) + 1))
+			}
+			r.ReadByte() // LZW minimum code size
+			if err := skipGIFSubBlocks(r); err != nil {
+				return nil, err
+			}
+			info.Frames++
+			info.Duration += float64(delay) / 100
+			delay = 0
+		case 0x3B: // Trailer
+			return info, nil
+		default:
+			return nil, fmt.Errorf("unexpected GIF block 0x%02x", b)
+		}
+	}
+}
+
+func apngAnimation(r *bufio.Reader) (*AnimationInfo, error) {
+	r.Discard(8)
+	var info *AnimationInfo
+	for {
+		var head [8]byte // Length and type
+		if _, err := io.ReadFull(r, head[:]); err != nil {
+			return nil, err
+		}
+		length := int(binary.BigEndian.Uint32(head[:4]))
+		switch string(head[4:]) {
+		case "acTL":
+			var actl [8]byte
+			if _, err := io.ReadFull(r, actl[:]); err != nil {
+				return nil, err
+			}
+			info = &AnimationInfo{Format: "apng", Frames: int(binary.BigEndian.Uint32(actl[:4])), Loops: int(binary.BigEndian.Uint32(actl[4:]))}
+			r.Discard(length - 8 + 4)
+		case "fcTL":
+			var fctl [26]byte
+			if _, err := io.ReadFull(r, fctl[:]); err != nil {
+				return nil, err
+			}
+			num, den := binary.BigEndian.Uint16(fctl[20:22]), binary.BigEndian.Uint16(fctl[22:24])
+			if den == 0 {
+				den = 100
+			}
+			if info != nil {
+				info.Duration += float64(num) / float64(den)
+			}
+			r.Discard(length - 26 + 4)
+		case "IDAT":
+			if info == nil {
+				return nil, nil // acTL must come before the image data
+			}
+			r.Discard(length + 4)
+		case "IEND":
+			return info, nil
+		default:
+			if _, err := r.Discard(length + 4); err != nil {
+				return nil, err
+			}
+		}
+	}
+}
+
+func webpAnimation(r *bufio.Reader) (*AnimationInfo, error) {
+	r.Discard(12)
+	var info *AnimationInfo
+	for {
+		var head [8]byte // FourCC and little-endian size
+		if _, err := io.ReadFull(r, head[:]); err != nil {
+			if errors.Is(err, io.EOF) {
+				return info, nil
+			}
+			return nil, err
+		}
+		size := int(binary.LittleEndian.Uint32(head[4:]))
+		padded := size + size&1
+		switch string(head[:4]) {
+		case "VP8X":
+			flags, err := r.ReadByte()
+			if err != nil {
+				return nil, err
+			}
+			if flags&0x02 == 0 {
+				return nil, nil
+			}
+			info = &AnimationInfo{Format: "webp"}
+			r.Discard(padded - 1)
+		case "ANIM":
+			var anim [6]byte // Background colour and loop count
+			if _, err := io.ReadFull(r, anim[:]); err != nil {
+				return nil, err
+			}
+			if info != nil {
+				info.Loops = int(binary.LittleEndian.Uint16(anim[4:]))
+			}
+			r.Discard(padded - 6)
+		case "ANMF":
+			var frame [16]byte // Offsets, size, 24-bit duration in ms, flags
+			if _, err := io.ReadFull(r, frame[:]); err != nil {
+				return nil, err
+			}
+			if info != nil {
+				info.Frames++
+				ms := int(frame[12]) | int(frame[13])<<8 | int(frame[14])<<16
+				info.Duration += float64(ms) / 1000
+			}
+			r.Discard(padded - 16)
+		default:
+			if _, err := r.Discard(padded); err != nil {
+				return nil, err
+			}
+		}
+	}
+}
+
+// Serve the first frame of an animation as a PNG, for a still preview
+func serveStillFrame(w http.ResponseWriter, path string) {
+	var frame image.Image
+	var err error
+	switch info := animationInfo(path); {
+	case info == nil:
+		http.Error(w, "Not an animated image", 400)
+		return
+	case info.Format == "gif":
+		var f *os.File
+		if f, err = os.Open(path); err == nil {
+			frame, err = gif.Decode(f)
+			f.Close()
+		}
+	case info.Format == "apng":
+		// The default image of an APNG, which decoders without animation support show
+		var f *os.File
+		if f, err = os.Open(path); err == nil {
+			frame, err = png.Decode(f)
+			f.Close()
+		}
+	default:
+		cmdName, cerr := imageMagickCmd()
+		if cerr != nil {
+			http.Error(w, cerr.Error(), 503)
+			return
+		}
+		out, err := exec.Command(cmdName, path+"[0]", "png:-").Output()
+		if err != nil {
+			http.Error(w, "Failed to extract frame", 500)
+			return
+		}
+		w.Header().Set("Content-Type", "image/png")
+		w.Write(out)
+		return
+	}
+	if err != nil {
+		http.Error(w, "Failed to decode image", 500)
+		return
+	}
+	w.Header().Set("Content-Type", "image/png")
+	png.Encode(w, frame)
+}
@@ -0,0 +1,143 @@
+package main
+
+import "net/http"
+
+// Every endpoint is served under /api/v1, and under the unversioned /api
+// paths it had before as an alias. The responses of the review endpoints are
+// the V1 structs below rather than the internal types (czkawka's Image, the
+// EXIF and scoring results, ...), so those can change without breaking
+// scripts or other frontends: fields are only ever added to a V1 struct,
+// anything else needs a /api/v2.
+
+const apiV1 = "/api/v1"
+
+// Register a handler for /api/v1<path> and its unversioned alias /api<path>
+func handleAPI(mux *http.ServeMux, path string, handler http.HandlerFunc) {
+	mux.HandleFunc(apiV1+path, handler)
+	mux.HandleFunc("/api"+path, handler)
+}
+
+// GET /api/v1/group: one group, its images best keeper first
+type V1Group struct {
+	GroupSimilarityScore float64     `json:"group_similarity_score"`
+	Images               []V1Image   `json:"images"`
+	Moved                []MovedFile `json:"moved"` // Members moved to the quarantine, no longer listed
+	Progress             Progress    `json:"progress"`
+	Status               string      `json:"status,omitempty"` // resolved, skipped or flagged, if marked
+	Source               string      `json:"source,omitempty"` // Results file it came from, when several were merged
+
+	// Sizes of the images listed: all of them, the suggested keeper (the
+	// first one) and what deleting the rest would free
+	TotalBytes       int64 `json:"total_bytes"`
+	KeeperBytes      int64 `json:"keeper_bytes"`
+	ReclaimableBytes int64 `json:"reclaimable_bytes"`
+}
+
+type V1Image struct {
+	Path         string `json:"path"` // Relative to the image root
+	OriginalPath string `json:"original_path,omitempty"`
+	Size         int64  `json:"size"`
+	Width        int    `json:"width"`
+	Height       int    `json:"height"`
+	ModifiedDate int64  `json:"modified_date"` // Unix seconds
+	Hash         []int  `json:"hash,omitempty"`
+	Similarity   int    `json:"similarity"`
+	Original     bool   `json:"original,omitempty"` // rmlint's or dupeGuru's pick, or a czkawka reference
+
+	// Videos
+	Duration  float64 `json:"duration,omitempty"` // Seconds
+	Codec     string  `json:"codec,omitempty"`
+	Bitrate   int64   `json:"bitrate,omitempty"`
+	Framerate float64 `json:"framerate,omitempty"`
+
+	DateTaken       string `json:"date_taken"`
+	TakenOffset     string `json:"date_taken_offset,omitempty"`
+	CameraMake      string `json:"camera_make"`
+	CameraModel     string `json:"camera_model"`
+	FStop           string `json:"fstop"`
+	Subject         string `json:"subject"`
+	HasExif         bool   `json:"has_exif"`
+	ExifError       string `json:"exif_error,omitempty"`
+	ExifErrorDetail string `json:"exif_error_detail,omitempty"`
+
+	Kind      string   `json:"kind,omitempty"`    // "screenshot" or "messenger"
+	Corrupt   string   `json:"corrupt,omitempty"` // Why the file looks damaged
+	Score     int      `json:"score"`
+	Breakdown []string `json:"breakdown"`
+	ReadOnly  bool     `json:"read_only,omitempty"` // On a -readonly root, so it can't be deleted
+
+	Dates     *DateInfo       `json:"dates,omitempty"` // With ?tz= or ?locale=
+	Quality   *QualityMetrics `json:"quality,omitempty"`
+	Animation *AnimationInfo  `json:"animation,omitempty"`
+	Decided   *FileDecision   `json:"decided,omitempty"` // The last decision about this content, under any path
+}
+
+func v1Image(img ImageWithExif) V1Image {
+	return V1Image{
+		Path:            img.Path,
+		Size:            img.Size,
+		Width:           img.Width,
+		Height:          img.Height,
+		ModifiedDate:    img.ModifiedDate,
+		Hash:            img.Hash,
+		Similarity:      img.Similarity,
+		Original:        img.Original,
+		Duration:        img.Duration,
+		Codec:           img.Codec,
+		Bitrate:         img.Bitrate,
+		Framerate:       img.Framerate,
+		DateTaken:       img.DateTaken,
+		TakenOffset:     img.TakenOffset,
+		CameraMake:      img.CameraMake,
+		CameraModel:     img.CameraModel,
+		FStop:           img.FStop,
+		Subject:         img.Subject,
+		HasExif:         img.HasExif,
+		ExifError:       img.ExifError,
+		ExifErrorDetail: img.ExifErrorDetail,
+		Kind:            img.Kind,
+		Corrupt:         img.Corrupt,
+		Score:           img.Score,
+		Breakdown:       img.Breakdown,
+	}
+}
+
+// POST /api/v1/group/decide and /api/v1/resolve-group
+type V1DecideResult struct {
+	Success        bool     `json:"success"`
+	Error          string   `json:"error,omitempty"`
+	Kept           []string `json:"kept"`
+	Deleted        []string `json:"deleted"`
+	Hardlinked     []string `json:"hardlinked"`
+	ReclaimedBytes int64    `json:"reclaimed_bytes"`
+	UndoID         *int64   `json:"undo_id,omitempty"`       // Undo stack entry for the hardlinks
+	TrashUndoID    *int64   `json:"trash_undo_id,omitempty"` // And for the files moved to the trash
+}
+
+func v1DecideResult(result DecideResult) V1DecideResult {
+	return V1DecideResult{
+		Success:        result.Success,
+		Error:          result.Error,
+		Kept:           result.Kept,
+		Deleted:        result.Deleted,
+		Hardlinked:     result.Hardlinked,
+		ReclaimedBytes: result.ReclaimedBytes,
+		UndoID:         result.UndoID,
+		TrashUndoID:    result.TrashUndoID,
+	}
+}
+
+// POST /api/v1/delete and /api/v1/move
+type V1FileResult struct {
+	Success bool   `json:"success"`
+	Error   string `json:"error,omitempty"`
+	MovedTo string `json:"moved_to,omitempty"` // Where /api/v1/move put the file
+}
+
+// POST /api/v1/delete-batch
+type V1BatchResult struct {
+	Success bool           `json:"success"`
+	Deleted int            `json:"deleted"`
+	Failed  int            `json:"failed"`
+	Results []DeleteResult `json:"results"`
+}
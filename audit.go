@@ -0,0 +1,101 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Every file deleted, trashed or replaced by a hardlink is written to an
+// append-only JSON lines file, separate from the history so it can be kept
+// (or shipped elsewhere) as a record of exactly what was removed
+var (
+	auditLogPath string // -audit-log, default audit.jsonl in the state directory
+	auditMu      sync.Mutex
+	auditFile    *os.File
+)
+
+type AuditEntry struct {
+	Time   time.Time `json:"time"`
+	Action string    `json:"action"` // deleted, trashed, hardlinked or quarantined
+	Path   string    `json:"path"`
+	Size   int64     `json:"size"`
+	Group  int       `json:"group"`            // -1 if not removed as part of a group
+	SHA256 string    `json:"sha256,omitempty"` // Of the content that was removed
+	Client string    `json:"client,omitempty"` // IP address the request came from
+	Detail string    `json:"detail,omitempty"` // e.g. where a trashed file went
+}
+
+func auditPath() string {
+	if auditLogPath != "" {
+		return auditLogPath
+	}
+	return filepath.Join(stateDir, "audit.jsonl")
+}
+
+func openAuditLog() error {
+	f, err := os.OpenFile(auditPath(), os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0644)
+	if err != nil {
+		return fmt.Errorf("failed to open audit log %s: %v", auditPath(), err)
+	}
+	auditFile = f
+	return nil
+}
+
+func closeAuditLog() {
+	auditMu.Lock()
+	defer auditMu.Unlock()
+	if auditFile != nil {
+		auditFile.Close()
+		auditFile = nil
+	}
+}
+
+// IP address of the client that made a request, or "" without one
+func clientIP(r *http.Request) string {
+	if r == nil {
+		return ""
+	}
+	if host, _, err := net.SplitHostPort(r.RemoteAddr); err == nil {
+		return host
+	}
+	// On a unix socket the peer is always the reverse proxy, which says who
+	// it is forwarding for
+	if fwd := r.Header.Get("X-Forwarded-For"); fwd != "" && unixSocketPath() != "" {
+		first, _, _ := strings.Cut(fwd, ",")
+		return strings.TrimSpace(first)
+	}
+	return r.RemoteAddr
+}
+
+// Checksum of a file about to be removed, for its audit entry. Videos are
+// left out rather than read in full.
+func auditChecksum(path string) string {
+	if isVideoFile(path) {
+		return ""
+	}
+	hash, _ := contentHash(path)
+	return hash
+}
+
+// Write one removal to the audit log and flush it to disk
+func audit(r *http.Request, action, path, checksum string, size int64, group int, detail string) {
+	e := AuditEntry{Time: time.Now(), Action: action, Path: path, Size: size, Group: group, SHA256: checksum, Client: clientIP(r), Detail: detail}
+	line, _ := json.Marshal(e)
+	auditMu.Lock()
+	defer auditMu.Unlock()
+	if auditFile == nil {
+		return
+	}
+	if _, err := auditFile.Write(append(line, '\n')); err != nil {
+		reqLog(r, "audit").Error("failed to write audit log", "err", err)
+		return
+	}
+	auditFile.Sync()
+}
@@ -0,0 +1,75 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/hex"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// A single shared secret guarding every request, enough to put the UI behind
+// a reverse proxy without user management. "auto" makes one up at startup.
+var apiToken string // -api-token
+
+const tokenCookie = "dupe_delete_token"
+
+func generateAPIToken() (string, error) {
+	b := make([]byte, 24)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
+
+func validToken(token string) bool {
+	return token != "" && subtle.ConstantTimeCompare([]byte(token), []byte(apiToken)) == 1
+}
+
+// Require the token as "Authorization: Bearer <token>" or ?token=. A browser
+// opening the UI with ?token= once gets it as a cookie, so its own requests
+// and image loads carry it from then on. With OpenID Connect, a logged in
+// session will do too, and browsers without one are sent to log in.
+func requireAuth(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if apiToken == "" && !oidcEnabled() {
+			next.ServeHTTP(w, r)
+			return
+		}
+		if apiToken != "" {
+			if bearer, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer "); ok && validToken(bearer) {
+				next.ServeHTTP(w, r)
+				return
+			}
+			if token := r.URL.Query().Get("token"); validToken(token) {
+				http.SetCookie(w, &http.Cookie{Name: tokenCookie, Value: token, Path: "/", HttpOnly: true, SameSite: http.SameSiteStrictMode, Secure: r.TLS != nil || r.Header.Get("X-Forwarded-Proto") == "https"})
+				next.ServeHTTP(w, r)
+				return
+			}
+			if c, err := r.Cookie(tokenCookie); err == nil && validToken(c.Value) {
+				next.ServeHTTP(w, r)
+				return
+			}
+		}
+		if oidcEnabled() {
+			// The way in has to be open to get a session in the first place
+			if r.URL.Path == "/auth/login" || r.URL.Path == "/auth/callback" || r.URL.Path == "/auth/logout" {
+				next.ServeHTTP(w, r)
+				return
+			}
+			if _, ok := requestSession(r); ok {
+				next.ServeHTTP(w, r)
+				return
+			}
+			if r.Method == "GET" && !strings.HasPrefix(r.URL.Path, "/api/") {
+				http.Redirect(w, r, basePath(r)+"/auth/login?next="+url.QueryEscape(r.URL.RequestURI()), http.StatusFound)
+				return
+			}
+		}
+		if apiToken != "" {
+			w.Header().Set("WWW-Authenticate", `Bearer realm="dupe_delete"`)
+		}
+		http.Error(w, "Unauthorized: log in or send an API token", 401)
+	})
+}
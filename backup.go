@@ -0,0 +1,225 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+// Operations touching at least this many files snapshot the state first
+const largeBatch = 10
+
+var backupKeep int
+
+// Contents of one backup directory, saved as backup.json inside it
+type Backup struct {
+	Name   string            `json:"name"`
+	Time   time.Time         `json:"time"`
+	Reason string            `json:"reason"`
+	Files  map[string]string `json:"files"` // File in the backup -> where it was copied from
+	Bytes  int64             `json:"bytes"`
+}
+
+func backupsDir() string {
+	return filepath.Join(stateDir, "backups")
+}
+
+func copyFile(src, dst string) (int64, error) {
+	in, err := os.Open(src)
+	if err != nil {
+		return 0, err
+	}
+	defer in.Close()
+	out, err := os.Create(dst)
+	if err != nil {
+		return 0, err
+	}
+	n, err := io.Copy(out, in)
+	if cerr := out.Close(); err == nil {
+		err = cerr
+	}
+	return n, err
+}
+
+// The file the current groups were loaded from
+func currentGroupsFile() string {
+	datasetMu.Lock()
+	defer datasetMu.Unlock()
+	if datasetFormat.File != "" {
+		return datasetFormat.File
+	}
+	return duplicatesFile
+}
+
+// Snapshot the groups file and the state database into a timestamped
+// directory under backups/. The history and undo stack describe what was
+// done to the files themselves, which a restore doesn't undo, so they are
+// left out.
+func snapshotState(reason string) (Backup, error) {
+	b := Backup{Time: time.Now(), Reason: reason, Files: make(map[string]string)}
+	b.Name = b.Time.Format("20060102-150405.000") + "-" + reason
+	dir := filepath.Join(backupsDir(), b.Name)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return b, err
+	}
+
+	groupsFile := currentGroupsFile()
+	if _, err := os.Stat(groupsFile); err == nil {
+		name := "groups" + filepath.Ext(groupsFile)
+		n, err := copyFile(groupsFile, filepath.Join(dir, name))
+		if err != nil {
+			os.RemoveAll(dir)
+			return b, fmt.Errorf("failed to back up %s: %v", groupsFile, err)
+		}
+		b.Files[name] = groupsFile
+		b.Bytes += n
+	}
+	// The database is copied in a read transaction so the snapshot is consistent
+	if stateDB != nil {
+		err := stateDB.View(func(tx *bolt.Tx) error {
+			b.Bytes += tx.Size()
+			return tx.CopyFile(filepath.Join(dir, "state.db"), 0644)
+		})
+		if err != nil {
+			os.RemoveAll(dir)
+			return b, fmt.Errorf("failed to back up state database: %v", err)
+		}
+		b.Files["state.db"] = stateDB.Path()
+	}
+
+	data, _ := json.MarshalIndent(b, "", "  ")
+	if err := os.WriteFile(filepath.Join(dir, "backup.json"), data, 0644); err != nil {
+		os.RemoveAll(dir)
+		return b, err
+	}
+	logFor("backup").Info("backed up state", "dir", dir, "reason", reason)
+	return b, nil
+}
+
+// Drop the oldest backups beyond -backup-keep
+func pruneBackups() {
+	backups := listBackups()
+	for len(backups) > backupKeep {
+		os.RemoveAll(filepath.Join(backupsDir(), backups[len(backups)-1].Name))
+		backups = backups[:len(backups)-1]
+	}
+}
+
+// Snapshot before a mutation, logging rather than failing if it can't be done
+func backupBefore(reason string) {
+	if backupKeep <= 0 {
+		return
+	}
+	if _, err := snapshotState(reason); err != nil {
+		logFor("backup").Warn("could not back up state", "reason", reason, "err", err)
+	}
+	pruneBackups()
+}
+
+// All backups, newest first
+func listBackups() []Backup {
+	entries, _ := os.ReadDir(backupsDir())
+	backups := []Backup{}
+	for _, e := range entries {
+		data, err := os.ReadFile(filepath.Join(backupsDir(), e.Name(), "backup.json"))
+		if err != nil {
+			continue
+		}
+		var b Backup
+		if json.Unmarshal(data, &b) == nil {
+			backups = append(backups, b)
+		}
+	}
+	sort.Slice(backups, func(i, j int) bool { return backups[i].Time.After(backups[j].Time) })
+	return backups
+}
+
+// Put a backup's files back in place and reload everything from them. The
+// current state is backed up first, so a restore can itself be reverted.
+func restoreBackup(b Backup) error {
+	if _, err := snapshotState("pre-restore"); err != nil {
+		return err
+	}
+	dir := filepath.Join(backupsDir(), b.Name)
+
+	for name, dst := range b.Files {
+		src := filepath.Join(dir, name)
+		switch {
+		case name == "state.db":
+			closeStateDB()
+			_, err := copyFile(src, dst)
+			if oerr := openStateDB(); err == nil {
+				err = oerr
+			}
+			if err != nil {
+				return err
+			}
+		case strings.HasPrefix(name, "groups"):
+			if _, err := copyFile(src, dst); err != nil {
+				return err
+			}
+			loaded, err := openGroups(dst)
+			if err != nil {
+				return err
+			}
+			setGroups(loaded)
+		}
+	}
+	return nil
+}
+
+// GET lists backups (newest first); POST {"name": N} restores one
+func backupsHandler(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case "GET":
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(listBackups())
+	case "POST":
+		var req struct {
+			Name string `json:"name"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, "Invalid JSON", 400)
+			return
+		}
+		var found *Backup
+		for _, b := range listBackups() {
+			if b.Name == req.Name {
+				found = &b
+				break
+			}
+		}
+		if found == nil {
+			http.Error(w, "No backup "+req.Name, 404)
+			return
+		}
+
+		decideMu.Lock()
+		defer decideMu.Unlock()
+		err := restoreBackup(*found)
+		if backupKeep > 0 {
+			pruneBackups()
+		}
+		if err != nil {
+			reqLog(r, "backup").Error("failed to restore backup", "backup", found.Name, "err", err)
+			http.Error(w, "Restore failed: "+err.Error(), 500)
+			return
+		}
+		reqLog(r, "backup").Info("restored backup", "backup", found.Name)
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"success":  true,
+			"restored": found,
+		})
+	default:
+		http.Error(w, "Method not allowed", 405)
+	}
+}
@@ -0,0 +1,57 @@
+package main
+
+import (
+	"html"
+	"net/http"
+	"strings"
+)
+
+// The URL prefix the UI is reached under behind a reverse proxy, e.g.
+// "/dupes". With -base-path the proxy passes the prefix on and it is stripped
+// here; a proxy that strips it itself can say so in X-Forwarded-Prefix.
+var basePathFlag string // -base-path, normalised to "/dupes" or ""
+
+func normaliseBasePath(path string) string {
+	path = strings.Trim(path, "/")
+	if path == "" {
+		return ""
+	}
+	return "/" + path
+}
+
+// The prefix a request came in under, to put in front of links and redirects
+func basePath(r *http.Request) string {
+	if basePathFlag != "" {
+		return basePathFlag
+	}
+	return normaliseBasePath(r.Header.Get("X-Forwarded-Prefix"))
+}
+
+// Route requests below -base-path as if it were the root
+func withBasePath(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case basePathFlag == "":
+			next.ServeHTTP(w, r)
+		case r.URL.Path == basePathFlag:
+			target := basePathFlag + "/"
+			if r.URL.RawQuery != "" {
+				target += "?" + r.URL.RawQuery
+			}
+			http.Redirect(w, r, target, http.StatusMovedPermanently)
+		case strings.HasPrefix(r.URL.Path, basePathFlag+"/"):
+			http.StripPrefix(basePathFlag, next).ServeHTTP(w, r)
+		default:
+			http.NotFound(w, r)
+		}
+	})
+}
+
+// The UI page, with relative links resolved against the prefix it is served
+// under whatever the path in the address bar, and the CSRF token its script
+// sends along with changes
+func indexPage(r *http.Request) []byte {
+	head := `<base href="` + html.EscapeString(basePath(r)+"/") + `">` +
+		"\n    " + `<meta name="csrf-token" content="` + csrfToken() + `">`
+	return []byte(strings.Replace(string(indexHTML), "<head>", "<head>\n    "+head, 1))
+}
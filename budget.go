@@ -0,0 +1,98 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// Daily cap on files deleted, trashed or hardlinked, so runaway automation or
+// a hijacked browser tab can only do so much damage
+var (
+	maxDeletesPerDay    int    // -max-deletes-per-day, 0 for no limit
+	maxDeleteMBPerDay   int64  // -max-delete-mb-per-day, 0 for no limit
+	budgetOverrideToken string // -budget-override-token
+	budgetMu            sync.Mutex
+)
+
+var errBudgetExceeded = errors.New("daily deletion budget would be exceeded")
+
+// What was removed on one day, kept in the state database
+type BudgetUsage struct {
+	Day   string `json:"day"`
+	Files int    `json:"files"`
+	Bytes int64  `json:"bytes"`
+}
+
+type BudgetStatus struct {
+	BudgetUsage
+	MaxFiles    int   `json:"max_files"` // 0: no limit
+	MaxBytes    int64 `json:"max_bytes"`
+	Exceeded    bool  `json:"exceeded"`
+	Overridable bool  `json:"overridable"` // An override token is configured
+}
+
+func budgetDay() string {
+	return time.Now().Format("2006-01-02")
+}
+
+func budgetUsage() BudgetUsage {
+	usage := BudgetUsage{Day: budgetDay()}
+	dbGet(bucketBudget, usage.Day, &usage)
+	return usage
+}
+
+func budgetStatus() BudgetStatus {
+	budgetMu.Lock()
+	defer budgetMu.Unlock()
+	status := BudgetStatus{BudgetUsage: budgetUsage(), MaxFiles: maxDeletesPerDay, MaxBytes: maxDeleteMBPerDay << 20, Overridable: budgetOverrideToken != ""}
+	status.Exceeded = (status.MaxFiles > 0 && status.Files >= status.MaxFiles) || (status.MaxBytes > 0 && status.Bytes >= status.MaxBytes)
+	return status
+}
+
+// Check that removing that many more files, totalling bytes, stays within
+// today's budget. A request carrying the override token in X-Budget-Override
+// may exceed it.
+func checkBudget(r *http.Request, files int, bytes int64) error {
+	budgetMu.Lock()
+	usage := budgetUsage()
+	budgetMu.Unlock()
+	var err error
+	if maxDeletesPerDay > 0 && usage.Files+files > maxDeletesPerDay {
+		err = fmt.Errorf("%w (%d files allowed, %d used today, %d more requested)", errBudgetExceeded, maxDeletesPerDay, usage.Files, files)
+	} else if limit := maxDeleteMBPerDay << 20; limit > 0 && usage.Bytes+bytes > limit {
+		err = fmt.Errorf("%w (%d MB allowed, %d MB used today, %d MB more requested)", errBudgetExceeded, maxDeleteMBPerDay, usage.Bytes>>20, (bytes+1<<20-1)>>20)
+	}
+	if err == nil {
+		return nil
+	}
+	if budgetOverrideToken != "" && r.Header.Get("X-Budget-Override") == budgetOverrideToken {
+		reqLog(r, "delete").Warn("deletion budget overridden", "client", clientIP(r), "err", err)
+		return nil
+	}
+	return err
+}
+
+// Count a removed file against today's budget
+func spendBudget(bytes int64) {
+	if maxDeletesPerDay <= 0 && maxDeleteMBPerDay <= 0 {
+		return
+	}
+	budgetMu.Lock()
+	defer budgetMu.Unlock()
+	usage := budgetUsage()
+	usage.Files++
+	usage.Bytes += bytes
+	if err := dbPut(bucketBudget, usage.Day, usage); err != nil {
+		logFor("delete").Error("failed to record deletion budget", "err", err)
+	}
+}
+
+// GET /api/budget shows today's usage of the deletion budget
+func budgetHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(budgetStatus())
+}
@@ -0,0 +1,173 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// How long a claim on a group lasts unless renewed, and the longest allowed
+const (
+	defaultClaimTTL = 5 * time.Minute
+	maxClaimTTL     = 30 * time.Minute
+)
+
+// Header a frontend or script names its reviewer with when not logged in
+const reviewerHeader = "X-Reviewer"
+
+// A reviewer's short-lived hold on a group, so two people reviewing at once
+// don't resolve the same group with conflicting decisions
+type GroupClaim struct {
+	Idx      int       `json:"idx"` // Current index, -1 if the group is gone
+	Key      string    `json:"key"`
+	Reviewer string    `json:"reviewer"`
+	Expires  time.Time `json:"expires"`
+}
+
+var (
+	claimsMu sync.Mutex
+	claims   = make(map[string]GroupClaim) // By group key; only kept in memory
+)
+
+// Who is making a request: the -oidc-issuer login, else the X-Reviewer
+// header, else the client's address
+func reviewerOf(r *http.Request) string {
+	if session, ok := requestSession(r); ok {
+		return session.User
+	}
+	if name := r.Header.Get(reviewerHeader); name != "" {
+		return name
+	}
+	return clientIP(r)
+}
+
+// The live claim on a group, if any. Expired claims are dropped.
+func liveClaim(key string) (GroupClaim, bool) {
+	claimsMu.Lock()
+	defer claimsMu.Unlock()
+	c, ok := claims[key]
+	if ok && time.Now().After(c.Expires) {
+		delete(claims, key)
+		return GroupClaim{}, false
+	}
+	return c, ok
+}
+
+// An error if someone other than the requester holds the group
+func checkClaim(r *http.Request, group []Image) error {
+	if c, ok := liveClaim(groupKey(group)); ok && c.Reviewer != reviewerOf(r) {
+		return fmt.Errorf("group is claimed by %s until %s", c.Reviewer, c.Expires.Format(time.RFC3339))
+	}
+	return nil
+}
+
+// Drop the requester's own claim on a group, e.g. once it is decided
+func releaseClaim(r *http.Request, group []Image) {
+	key := groupKey(group)
+	claimsMu.Lock()
+	defer claimsMu.Unlock()
+	if c, ok := claims[key]; ok && c.Reviewer == reviewerOf(r) {
+		delete(claims, key)
+	}
+}
+
+// GET /api/claims lists the live claims, soonest to expire first
+func claimsHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		http.Error(w, "Method not allowed", 405)
+		return
+	}
+	now := time.Now()
+	list := []GroupClaim{}
+	claimsMu.Lock()
+	for key, c := range claims {
+		if now.After(c.Expires) {
+			delete(claims, key)
+			continue
+		}
+		list = append(list, c)
+	}
+	claimsMu.Unlock()
+	for i := range list {
+		list[i].Idx = groupIdxByKey(list[i].Key)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].Expires.Before(list[j].Expires) })
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(list)
+}
+
+// GET shows who holds group idx (404 if nobody), POST [{"ttl": seconds}]
+// claims it or renews the requester's claim, DELETE releases it. Claiming or
+// releasing a group someone else holds is refused with 409.
+func groupClaimHandler(w http.ResponseWriter, r *http.Request) {
+	idx, err := strconv.Atoi(r.PathValue("idx"))
+	store, release := acquireGroups()
+	defer release()
+	if err != nil || idx < 0 || idx >= store.Len() {
+		http.Error(w, "Group not found", 404)
+		return
+	}
+	group, err := store.Group(idx)
+	if err != nil {
+		http.Error(w, "Failed to read group", 500)
+		return
+	}
+	key, reviewer := groupKey(group), reviewerOf(r)
+
+	claimsMu.Lock()
+	defer claimsMu.Unlock()
+	c, held := claims[key]
+	if held && time.Now().After(c.Expires) {
+		delete(claims, key)
+		held = false
+	}
+	c.Idx = idx
+	writeClaim := func(status int, c GroupClaim) {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(status)
+		json.NewEncoder(w).Encode(c)
+	}
+
+	switch r.Method {
+	case "GET":
+		if !held {
+			http.Error(w, "Group is not claimed", 404)
+			return
+		}
+		writeClaim(200, c)
+	case "POST":
+		req := struct {
+			TTL int `json:"ttl"` // Seconds
+		}{}
+		if r.ContentLength != 0 {
+			if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.TTL < 0 {
+				http.Error(w, "Invalid JSON", 400)
+				return
+			}
+		}
+		if held && c.Reviewer != reviewer {
+			writeClaim(409, c)
+			return
+		}
+		ttl := defaultClaimTTL
+		if req.TTL > 0 {
+			ttl = min(time.Duration(req.TTL)*time.Second, maxClaimTTL)
+		}
+		c = GroupClaim{Idx: idx, Key: key, Reviewer: reviewer, Expires: time.Now().Add(ttl)}
+		claims[key] = c
+		writeClaim(200, c)
+	case "DELETE":
+		if held && c.Reviewer != reviewer {
+			writeClaim(409, c)
+			return
+		}
+		delete(claims, key)
+		w.WriteHeader(204)
+	default:
+		http.Error(w, "Method not allowed", 405)
+	}
+}
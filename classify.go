@@ -0,0 +1,185 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"path/filepath"
+	"regexp"
+	"strings"
+)
+
+// What kind of picture a file is, as far as the scoring cares
+const (
+	kindScreenshot = "screenshot"
+	kindMessenger  = "messenger" // Re-compressed by WhatsApp, Telegram, Signal and the like
+)
+
+var screenshotName = regexp.MustCompile(`(?i)(screenshot|screen[ _-]?shot|screen[ _-]?capture|bildschirmfoto|capture d.[ée]cran|schermata|captura de pantalla|スクリーンショット|屏幕截图)`)
+
+// How messengers name the pictures they save, e.g. IMG-20200101-WA0001.jpg
+// (WhatsApp), photo_2020-01-01_12-34-56.jpg (Telegram), signal-2020-01-01-123456.jpg
+var messengerName = regexp.MustCompile(`(?i)^(IMG-\d{8}-WA\d{4}|photo_\d{4}-\d{2}-\d{2}_\d{2}-\d{2}-\d{2}|signal-\d{4}-\d{2}-\d{2}-\d{6})`)
+
+// Messengers scale the long edge of a picture down to one of these
+var messengerEdges = map[int]bool{1280: true, 1600: true, 2560: true}
+
+// Screen resolutions of common phones, tablets and monitors, in either orientation
+var screenResolutions = map[[2]int]bool{}
+
+func init() {
+	for _, r := range [][2]int{
+		{640, 1136}, {750, 1334}, {828, 1792}, {1080, 1920}, {1080, 2220}, {1080, 2280},
+		{1080, 2340}, {1080, 2400}, {1125, 2436}, {1170, 2532}, {1179, 2556}, {1242, 2208},
+		{1242, 2688}, {1284, 2778}, {1290, 2796}, {1440, 2560}, {1440, 2960}, {1440, 3040},
+		{1440, 3120}, {1440, 3200}, {1536, 2048}, {1620, 2160}, {1668, 2388}, {2048, 2732},
+		{768, 1366}, {800, 1280}, {900, 1440}, {1050, 1680}, {1200, 1920}, {1600, 2560},
+		{1800, 2880}, {1964, 3024}, {2160, 3840}, {2234, 3456},
+	} {
+		screenResolutions[r] = true
+		screenResolutions[[2]int{r[1], r[0]}] = true
+	}
+}
+
+// Classify a file from its name, format, dimensions and EXIF. Screenshots
+// carry no camera make or model and are either named like one or a PNG at
+// a screen resolution. Messenger copies are JPEGs stripped of camera EXIF
+// and either named like one or with no EXIF at all and a long edge a
+// messenger scales to.
+func classifyImage(img ImageWithExif) string {
+	if img.CameraMake != "" || img.CameraModel != "" || isVideoFile(img.Path) {
+		return ""
+	}
+	if ext := strings.ToLower(filepath.Ext(img.Path)); ext == ".jpg" || ext == ".jpeg" {
+		if messengerName.MatchString(filepath.Base(img.Path)) {
+			return kindMessenger
+		}
+		if !img.HasExif && messengerEdges[max(img.Width, img.Height)] {
+			return kindMessenger
+		}
+	}
+	if screenshotName.MatchString(filepath.Base(img.Path)) {
+		return kindScreenshot
+	}
+	if strings.ToLower(filepath.Ext(img.Path)) == ".png" && screenResolutions[[2]int{img.Width, img.Height}] {
+		return kindScreenshot
+	}
+	return ""
+}
+
+// A group of screenshots whose files are byte-for-byte identical
+type ScreenshotGroup struct {
+	Idx    int      `json:"idx"`
+	Keep   string   `json:"keep"` // The earliest one
+	Delete []string `json:"delete"`
+	Bytes  int64    `json:"bytes"`
+}
+
+// Groups made up only of screenshots that are exact duplicates of each other
+func exactScreenshotGroups() (groups []ScreenshotGroup, screenshotGroups int) {
+	store, release := acquireGroups()
+	defer release()
+	for idx := 0; idx < store.Len(); idx++ {
+		group, err := store.Group(idx)
+		if err != nil || len(group) < 2 {
+			continue
+		}
+		imgs, originals := loadGroupImages(group)
+		if len(imgs) < 2 {
+			continue
+		}
+		all := true
+		for _, img := range imgs {
+			all = all && classifyImage(img) == kindScreenshot
+		}
+		if !all {
+			continue
+		}
+		screenshotGroups++
+
+		earliest := 0
+		hashes := make(map[string]bool)
+		for i, path := range originals {
+			hash, err := contentHash(path)
+			if err != nil {
+				hashes = nil
+				break
+			}
+			hashes[hash] = true
+			if imgs[i].ModifiedDate < imgs[earliest].ModifiedDate {
+				earliest = i
+			}
+		}
+		if len(hashes) != 1 {
+			continue // Only visually similar, or unreadable
+		}
+		sg := ScreenshotGroup{Idx: idx, Keep: originals[earliest], Delete: []string{}}
+		for i, path := range originals {
+			if i != earliest {
+				sg.Delete = append(sg.Delete, path)
+				sg.Bytes += imgs[i].Size
+			}
+		}
+		groups = append(groups, sg)
+	}
+	return groups, screenshotGroups
+}
+
+// GET /api/screenshots counts screenshot-only groups and lists those whose
+// files are identical. POST resolves the identical ones, keeping the
+// earliest screenshot of each; add ?dry_run=1 to only list what would go.
+func screenshotsHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" && r.Method != "POST" {
+		http.Error(w, "Method not allowed", 405)
+		return
+	}
+	exact, total := exactScreenshotGroups()
+	var bytes int64
+	files := 0
+	for _, sg := range exact {
+		bytes += sg.Bytes
+		files += len(sg.Delete)
+	}
+	resp := map[string]interface{}{
+		"screenshot_groups": total,
+		"exact_groups":      exact,
+		"files":             files,
+		"bytes":             bytes,
+	}
+	if exact == nil {
+		resp["exact_groups"] = []ScreenshotGroup{}
+	}
+	if r.Method == "POST" && r.URL.Query().Get("dry_run") != "1" {
+		if err := checkBudget(r, files, bytes); err != nil {
+			http.Error(w, err.Error(), 429)
+			return
+		}
+		decideMu.Lock()
+		defer decideMu.Unlock()
+		if files >= largeBatch {
+			backupBefore("screenshots")
+		}
+		resolved, failed := 0, []string{}
+		for _, sg := range exact {
+			group, err := currentGroups().Group(sg.Idx)
+			if err != nil {
+				continue
+			}
+			req := DecideRequest{Idx: sg.Idx, Keep: []string{sg.Keep}, Delete: sg.Delete}
+			if err := validateDecision(&req, group); err != nil {
+				failed = append(failed, fmt.Sprintf("group %d: %v", sg.Idx, err))
+				continue
+			}
+			if result := applyDecision(r, req); !result.Success {
+				failed = append(failed, fmt.Sprintf("group %d: %s", sg.Idx, result.Error))
+				continue
+			}
+			resolved++
+		}
+		reqLog(r, "delete").Info("resolved exact screenshot duplicates", "groups", resolved, "failed", len(failed))
+		resp["resolved"] = resolved
+		resp["failed"] = failed
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(resp)
+}
@@ -0,0 +1,252 @@
+package main
+
+import (
+	"crypto/md5"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"image"
+	"image/jpeg"
+	"net/http"
+	"net/url"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+)
+
+// A crop rectangle in normalized coordinates (0-1 of width and height)
+type cropRect struct {
+	X, Y, W, H float64
+}
+
+// Pixel rectangle of a crop within one image
+type PixelRect struct {
+	X int `json:"x"`
+	Y int `json:"y"`
+	W int `json:"w"`
+	H int `json:"h"`
+}
+
+func parseCropRect(q url.Values) (cropRect, error) {
+	var c cropRect
+	fields := []struct {
+		name string
+		dst  *float64
+	}{{"x", &c.X}, {"y", &c.Y}, {"w", &c.W}, {"h", &c.H}}
+	for _, f := range fields {
+		v, err := strconv.ParseFloat(q.Get(f.name), 64)
+		if err != nil || v < 0 || v > 1 {
+			return c, fmt.Errorf("%s must be a number between 0 and 1", f.name)
+		}
+		*f.dst = v
+	}
+	if c.W == 0 || c.H == 0 || c.X+c.W > 1 || c.Y+c.H > 1 {
+		return c, fmt.Errorf("crop rectangle must be non-empty and inside the image")
+	}
+	return c, nil
+}
+
+func (c cropRect) pixels(width, height int) PixelRect {
+	p := PixelRect{
+		X: int(c.X * float64(width)),
+		Y: int(c.Y * float64(height)),
+		W: int(c.W * float64(width)),
+		H: int(c.H * float64(height)),
+	}
+	p.W, p.H = max(p.W, 1), max(p.H, 1)
+	return p
+}
+
+func imageMagickCmd() (string, error) {
+	if _, err := exec.LookPath("magick"); err == nil {
+		return "magick", nil
+	}
+	if _, err := exec.LookPath("convert"); err == nil {
+		return "convert", nil
+	}
+	return "", fmt.Errorf("ImageMagick not found: neither 'magick' nor 'convert' command available")
+}
+
+// Full-resolution dimensions of an image, without decoding the pixels where possible
+func imageDimensions(path string) (int, int, error) {
+	if isCR2File(path) {
+		cmd, err := imageMagickCmd()
+		if err != nil {
+			return 0, 0, err
+		}
+		args := []string{"-format", "%w %h", path}
+		if cmd == "magick" {
+			args = append([]string{"identify"}, args...)
+		} else {
+			cmd = "identify"
+		}
+		out, err := exec.Command(cmd, args...).Output()
+		if err != nil {
+			return 0, 0, fmt.Errorf("failed to identify %s: %v", filepath.Base(path), err)
+		}
+		var w, h int
+		if _, err := fmt.Sscan(string(out), &w, &h); err != nil {
+			return 0, 0, err
+		}
+		return w, h, nil
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		return 0, 0, err
+	}
+	defer f.Close()
+	cfg, _, err := image.DecodeConfig(f)
+	if err != nil {
+		return 0, 0, err
+	}
+	return cfg.Width, cfg.Height, nil
+}
+
+// Render a 1:1 crop to a cached JPG in the temp directory and return its path
+func renderCrop(path string, rect PixelRect) (string, error) {
+	key := md5.Sum([]byte(fmt.Sprintf("%s|%d|%d|%d|%d", path, rect.X, rect.Y, rect.W, rect.H)))
+	out := filepath.Join(tempDir, "crop-"+hex.EncodeToString(key[:])+".jpg")
+	if _, err := os.Stat(out); err == nil {
+		return out, nil
+	}
+	if err := checkCacheSpace(); err != nil {
+		return "", err
+	}
+
+	if isCR2File(path) {
+		cmd, err := imageMagickCmd()
+		if err != nil {
+			return "", err
+		}
+		geometry := fmt.Sprintf("%dx%d+%d+%d", rect.W, rect.H, rect.X, rect.Y)
+		if err := exec.Command(cmd, path, "-crop", geometry, "+repage", "-quality", "92", out).Run(); err != nil {
+			return "", fmt.Errorf("failed to crop %s: %v", filepath.Base(path), err)
+		}
+		return out, nil
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	img, _, err := image.Decode(f)
+	if err != nil {
+		return "", fmt.Errorf("cannot decode %s: %v", filepath.Base(path), err)
+	}
+	sub, ok := img.(interface {
+		SubImage(r image.Rectangle) image.Image
+	})
+	if !ok {
+		return "", fmt.Errorf("cannot crop %s", filepath.Base(path))
+	}
+	b := img.Bounds()
+	r := image.Rect(b.Min.X+rect.X, b.Min.Y+rect.Y, b.Min.X+rect.X+rect.W, b.Min.Y+rect.Y+rect.H)
+
+	tmp, err := os.CreateTemp(tempDir, "crop-*.tmp")
+	if err != nil {
+		return "", err
+	}
+	defer os.Remove(tmp.Name())
+	if err := jpeg.Encode(tmp, sub.SubImage(r), &jpeg.Options{Quality: 92}); err != nil {
+		tmp.Close()
+		return "", err
+	}
+	tmp.Close()
+	return out, os.Rename(tmp.Name(), out)
+}
+
+// Resolve and check an image path parameter, which may be relative to imageRoot
+func requestedImage(w http.ResponseWriter, raw string) (string, bool) {
+	if raw == "" {
+		http.Error(w, "path is required", 400)
+		return "", false
+	}
+	path := absImagePath(raw)
+	if !withinImageRoot(path) {
+		http.Error(w, "File is outside allowed directory", 403)
+		return "", false
+	}
+	if _, err := os.Stat(path); err != nil {
+		http.Error(w, "File does not exist", 404)
+		return "", false
+	}
+	return path, true
+}
+
+// GET /api/crop?path=P&x=&y=&w=&h= serves a 1:1 crop of one image
+func cropHandler(w http.ResponseWriter, r *http.Request) {
+	path, ok := requestedImage(w, r.URL.Query().Get("path"))
+	if !ok {
+		return
+	}
+	rect, err := parseCropRect(r.URL.Query())
+	if err != nil {
+		http.Error(w, err.Error(), 400)
+		return
+	}
+	width, height, err := imageDimensions(path)
+	if err != nil {
+		http.Error(w, err.Error(), 500)
+		return
+	}
+	out, err := renderCrop(path, rect.pixels(width, height))
+	if errors.Is(err, errCacheFull) {
+		http.Error(w, err.Error(), 507)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), 500)
+		return
+	}
+	w.Header().Set("Content-Type", "image/jpeg")
+	http.ServeFile(w, r, out)
+}
+
+// One image of a /api/compare pair
+type CompareSide struct {
+	Path   string    `json:"path"`
+	Width  int       `json:"width"`
+	Height int       `json:"height"`
+	Crop   PixelRect `json:"crop"`
+	URL    string    `json:"url"`
+}
+
+// GET /api/compare?a=P&b=Q&x=&y=&w=&h= describes matching 1:1 crops of the
+// same normalized region of two images, with URLs for the crops themselves
+func compareHandler(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	rect, err := parseCropRect(q)
+	if err != nil {
+		http.Error(w, err.Error(), 400)
+		return
+	}
+
+	resp := make(map[string]CompareSide)
+	for _, name := range []string{"a", "b"} {
+		path, ok := requestedImage(w, q.Get(name))
+		if !ok {
+			return
+		}
+		width, height, err := imageDimensions(path)
+		if err != nil {
+			http.Error(w, err.Error(), 500)
+			return
+		}
+		params := url.Values{"path": {path}}
+		for _, k := range []string{"x", "y", "w", "h"} {
+			params.Set(k, q.Get(k))
+		}
+		resp[name] = CompareSide{
+			Path:   getRelativeImagePath(path),
+			Width:  width,
+			Height: height,
+			Crop:   rect.pixels(width, height),
+			URL:    apiV1 + "/crop?" + params.Encode(),
+		}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(resp)
+}
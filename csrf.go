@@ -0,0 +1,73 @@
+package main
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+)
+
+// Endpoints that delete, move or change files only take requests carrying
+// the CSRF token, so another page open in the same browser can't make it
+// send them to this server. The page gets the token embedded; scripts can
+// fetch it from /api/csrf (which other sites can't read) or authenticate
+// with -api-token instead, which browsers never attach by themselves.
+const csrfHeader = "X-CSRF-Token"
+
+var (
+	csrfOnce  sync.Once
+	csrfValue string
+)
+
+// Made up once per run, so a restart invalidates open pages
+func csrfToken() string {
+	csrfOnce.Do(func() {
+		token, err := generateAPIToken()
+		if err != nil {
+			fatal("failed to generate a CSRF token", "err", err)
+		}
+		csrfValue = token
+	})
+	return csrfValue
+}
+
+// Why a state-changing request may not be trusted, or "" if it may
+func csrfRejected(r *http.Request) string {
+	// A request another site makes the browser send says where it came from
+	if origin := r.Header.Get("Origin"); origin != "" && origin != "null" {
+		u, err := url.Parse(origin)
+		if err != nil || (u.Host != r.Host && u.Host != r.Header.Get("X-Forwarded-Host")) {
+			return "cross-origin request from " + origin
+		}
+	}
+	if bearer, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer "); ok && apiToken != "" && validToken(bearer) {
+		return ""
+	}
+	if subtle.ConstantTimeCompare([]byte(r.Header.Get(csrfHeader)), []byte(csrfToken())) != 1 {
+		return "missing or wrong " + csrfHeader + " header"
+	}
+	return ""
+}
+
+// Refuse state-changing requests without the CSRF token
+func requireCSRF(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "GET" && r.Method != "HEAD" && r.Method != "OPTIONS" {
+			if reason := csrfRejected(r); reason != "" {
+				reqLog(r, "auth").Warn("CSRF check failed", "method", r.Method, "path", r.URL.Path, "client", clientIP(r), "reason", reason)
+				http.Error(w, "CSRF check failed: "+reason, 403)
+				return
+			}
+		}
+		next(w, r)
+	}
+}
+
+// GET /api/csrf: the token to send in the X-CSRF-Token header
+func csrfHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	json.NewEncoder(w).Encode(map[string]string{"token": csrfToken(), "header": csrfHeader})
+}
@@ -0,0 +1,80 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"time"
+)
+
+// Date and time layouts per locale (language or language-region)
+var localeLayouts = map[string]string{
+	"en-us": "Jan 2, 2006 3:04:05 PM",
+	"en":    "2 Jan 2006 15:04:05",
+	"de":    "02.01.2006 15:04:05",
+	"fr":    "02/01/2006 15:04:05",
+	"es":    "02/01/2006 15:04:05",
+	"it":    "02/01/2006 15:04:05",
+	"nl":    "02-01-2006 15:04:05",
+	"pl":    "02.01.2006 15:04:05",
+	"ja":    "2006/01/02 15:04:05",
+	"zh":    "2006/01/02 15:04:05",
+	"iso":   "2006-01-02 15:04:05",
+}
+
+// Raw and formatted dates for one file, in the reviewer's timezone
+type DateInfo struct {
+	ModifiedEpoch int64  `json:"modified_epoch"`
+	ModifiedISO   string `json:"modified_iso"`
+	Modified      string `json:"modified"`
+	TakenRaw      string `json:"taken_raw,omitempty"` // As stored in EXIF
+	TakenISO      string `json:"taken_iso,omitempty"`
+	Taken         string `json:"taken,omitempty"`
+	TakenTZKnown  bool   `json:"taken_tz_known"` // false: camera wall-clock time, not converted
+}
+
+// Find the layout for a locale such as "de-AT", falling back to the language, then ISO
+func localeLayout(locale string) (string, error) {
+	locale = strings.ToLower(strings.ReplaceAll(locale, "_", "-"))
+	if locale == "" {
+		return localeLayouts["iso"], nil
+	}
+	if layout, ok := localeLayouts[locale]; ok {
+		return layout, nil
+	}
+	lang, _, _ := strings.Cut(locale, "-")
+	if layout, ok := localeLayouts[lang]; ok {
+		return layout, nil
+	}
+	return "", fmt.Errorf("unsupported locale %q", locale)
+}
+
+// Format a file's modification and capture dates for the given timezone and layout
+func formatDates(img ImageWithExif, loc *time.Location, layout string) *DateInfo {
+	modified := time.Unix(img.ModifiedDate, 0).In(loc)
+	info := &DateInfo{
+		ModifiedEpoch: img.ModifiedDate,
+		ModifiedISO:   modified.Format(time.RFC3339),
+		Modified:      modified.Format(layout),
+		TakenRaw:      img.DateTaken,
+	}
+	if img.DateTaken == "" {
+		return info
+	}
+
+	// With a recorded offset the capture time is an absolute instant and can be
+	// converted; without one it is the camera's wall clock and is shown as-is
+	if img.TakenOffset != "" {
+		if taken, err := time.Parse("2006:01:02 15:04:05-07:00", img.DateTaken+img.TakenOffset); err == nil {
+			taken = taken.In(loc)
+			info.TakenISO = taken.Format(time.RFC3339)
+			info.Taken = taken.Format(layout)
+			info.TakenTZKnown = true
+			return info
+		}
+	}
+	if taken, err := time.Parse("2006:01:02 15:04:05", img.DateTaken); err == nil {
+		info.TakenISO = taken.Format("2006-01-02T15:04:05")
+		info.Taken = taken.Format(layout)
+	}
+	return info
+}
@@ -0,0 +1,131 @@
+package main
+
+import (
+	"encoding/json"
+	"io/fs"
+	"net/http"
+	"net/http/pprof"
+	"path/filepath"
+	"runtime"
+	"time"
+)
+
+// -debug mounts net/http/pprof under /debug/pprof/ and /api/debug/stats, to
+// profile slow loading or memory use with huge duplicates files in place
+var debugMode bool
+
+var startedAt = time.Now()
+
+// Only serve a handler with -debug, else pretend it isn't there
+func debugOnly(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if !debugMode {
+			http.NotFound(w, r)
+			return
+		}
+		next(w, r)
+	}
+}
+
+func registerDebug(mux *http.ServeMux) {
+	handleAPI(mux, "/debug/stats", debugOnly(debugStatsHandler))
+	mux.HandleFunc("/debug/pprof/", debugOnly(pprof.Index))
+	mux.HandleFunc("/debug/pprof/cmdline", debugOnly(pprof.Cmdline))
+	mux.HandleFunc("/debug/pprof/profile", debugOnly(pprof.Profile))
+	mux.HandleFunc("/debug/pprof/symbol", debugOnly(pprof.Symbol))
+	mux.HandleFunc("/debug/pprof/trace", debugOnly(pprof.Trace))
+}
+
+type DebugStats struct {
+	Uptime     string         `json:"uptime"`
+	Goroutines int            `json:"goroutines"`
+	Memory     MemoryStats    `json:"memory"`
+	Groups     int            `json:"groups"`
+	Lazy       bool           `json:"lazy"`
+	Caches     map[string]int `json:"caches"` // Entries in each in-memory cache
+	TempDir    TempDirUsage   `json:"temp_dir"`
+}
+
+type MemoryStats struct {
+	HeapAlloc   uint64 `json:"heap_alloc_bytes"`
+	HeapObjects uint64 `json:"heap_objects"`
+	Sys         uint64 `json:"sys_bytes"`
+	NumGC       uint32 `json:"num_gc"`
+}
+
+// What the CR2 conversions, crops and stills take up in the temp directory
+type TempDirUsage struct {
+	Dir   string      `json:"dir"`
+	Files int         `json:"files"`
+	Bytes int64       `json:"bytes"`
+	Cache CacheStatus `json:"cache"`
+}
+
+func tempDirUsage() TempDirUsage {
+	usage := TempDirUsage{Dir: tempDir, Cache: cacheStatus()}
+	if tempDir == "" {
+		return usage
+	}
+	filepath.WalkDir(tempDir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil || d.IsDir() {
+			return nil
+		}
+		if info, err := d.Info(); err == nil {
+			usage.Files++
+			usage.Bytes += info.Size()
+		}
+		return nil
+	})
+	return usage
+}
+
+func cacheSizes() map[string]int {
+	sizes := map[string]int{
+		"cr2":     len(cr2Cache),
+		"video":   len(videoMetaCache),
+		"pending": len(videoPending),
+	}
+	animationMu.Lock()
+	sizes["animation"] = len(animationCache)
+	animationMu.Unlock()
+	hashMu.Lock()
+	sizes["hash"] = len(hashCache)
+	hashMu.Unlock()
+	exifFailuresMu.Lock()
+	sizes["exif_failures"] = len(exifFailures)
+	exifFailuresMu.Unlock()
+	camerasMu.Lock()
+	sizes["cameras"] = len(cameras)
+	camerasMu.Unlock()
+	keyIndexMu.Lock()
+	sizes["group_keys"] = len(keyIndex)
+	keyIndexMu.Unlock()
+	return sizes
+}
+
+// GET /api/debug/stats (with -debug) shows goroutines, memory, cache sizes
+// and temp dir usage
+func debugStatsHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		http.Error(w, "Method not allowed", 405)
+		return
+	}
+	var mem runtime.MemStats
+	runtime.ReadMemStats(&mem)
+	stats := DebugStats{
+		Uptime:     time.Since(startedAt).Round(time.Second).String(),
+		Goroutines: runtime.NumGoroutine(),
+		Memory: MemoryStats{
+			HeapAlloc:   mem.HeapAlloc,
+			HeapObjects: mem.HeapObjects,
+			Sys:         mem.Sys,
+			NumGC:       mem.NumGC,
+		},
+		Groups:  currentGroups().Len(),
+		Lazy:    lazyGroups,
+		Caches:  cacheSizes(),
+		TempDir: tempDirUsage(),
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(stats)
+}
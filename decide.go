@@ -0,0 +1,401 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// DecideRequest assigns every member of a group to exactly one action.
+// Hardlinked files are replaced by a hardlink to the first kept file.
+type DecideRequest struct {
+	Idx      int      `json:"idx"`
+	Keep     []string `json:"keep"`
+	Delete   []string `json:"delete"`
+	Hardlink []string `json:"hardlink"`
+}
+
+type DecideResult struct {
+	Success        bool     `json:"success"`
+	Error          string   `json:"error,omitempty"`
+	Kept           []string `json:"kept"`
+	Deleted        []string `json:"deleted"`
+	Hardlinked     []string `json:"hardlinked"`
+	ReclaimedBytes int64    `json:"reclaimed_bytes"`
+	UndoID         *int64   `json:"undo_id,omitempty"`       // Undo stack entry for the hardlinks
+	TrashUndoID    *int64   `json:"trash_undo_id,omitempty"` // And for the files moved to the trash
+}
+
+// A file moved out of the way while a decision is being applied
+type stagedFile struct {
+	path   string
+	staged string
+	size   int64
+	link   bool // Replaced by a hardlink to the keeper
+}
+
+// Decisions are applied one at a time so two requests can't interleave on a group
+var decideMu sync.Mutex
+
+func absImagePath(path string) string {
+	if !filepath.IsAbs(path) {
+		return filepath.Join(imageRoot, path)
+	}
+	return filepath.Clean(path)
+}
+
+// Check that the request accounts for every member of the group still on disk, exactly once
+func validateDecision(req *DecideRequest, group []Image) error {
+	members := make(map[string]bool)
+	for _, img := range group {
+		if _, err := os.Stat(img.Path); err == nil {
+			members[filepath.Clean(img.Path)] = false
+		}
+	}
+
+	for _, list := range []*[]string{&req.Keep, &req.Delete, &req.Hardlink} {
+		for i, path := range *list {
+			path = absImagePath(path)
+			seen, ok := members[path]
+			if !ok {
+				return fmt.Errorf("%s is not an existing member of group %d", path, req.Idx)
+			}
+			if seen {
+				return fmt.Errorf("%s is listed more than once", path)
+			}
+			members[path] = true
+			(*list)[i] = path
+		}
+	}
+
+	var missing []string
+	for path, seen := range members {
+		if !seen {
+			missing = append(missing, path)
+		}
+	}
+	if len(missing) > 0 {
+		return fmt.Errorf("not accounted for: %s", strings.Join(missing, ", "))
+	}
+	if len(req.Keep) == 0 {
+		return fmt.Errorf("at least one file must be kept")
+	}
+	for _, path := range append(append([]string{}, req.Delete...), req.Hardlink...) {
+		if !withinImageRoot(path) {
+			return fmt.Errorf("%s is outside the image root", path)
+		}
+	}
+	if err := checkWritable(append(append([]string{}, req.Delete...), req.Hardlink...)...); err != nil {
+		return err
+	}
+	// Hardlinks can't cross filesystems, so refuse before anything is touched
+	if keeperDev, err := deviceOf(req.Keep[0]); err == nil {
+		for _, path := range req.Hardlink {
+			if dev, err := deviceOf(path); err == nil && dev != keeperDev {
+				return fmt.Errorf("%s is on a different filesystem from %s and can't be hardlinked to it", path, req.Keep[0])
+			}
+		}
+	}
+	return nil
+}
+
+// Put staged files back after a failure
+func rollbackDecision(staged []*stagedFile) {
+	for i := len(staged) - 1; i >= 0; i-- {
+		s := staged[i]
+		// Atomically replaces the hardlink where there is one
+		if err := os.Rename(s.staged, s.path); err != nil {
+			logFor("delete").Error("failed to restore staged file", "path", s.path, "staged", s.staged, "err", err)
+		}
+	}
+}
+
+// Apply a decision. Every file that isn't kept is first renamed aside in its
+// own directory and hardlinks are created; only if all of that succeeded are
+// the staged files removed. Any failure puts everything back as it was.
+func applyDecision(r *http.Request, req DecideRequest) DecideResult {
+	result := DecideResult{Kept: req.Keep, Deleted: []string{}, Hardlinked: []string{}}
+	keeper := req.Keep[0]
+	hashes := decisionHashes(req)
+	suffix := fmt.Sprintf(".dedupe-%d", time.Now().UnixNano())
+
+	var staged []*stagedFile
+	stage := func(path string, link bool) error {
+		info, err := os.Stat(path)
+		if err != nil {
+			return err
+		}
+		s := &stagedFile{path: path, staged: path + suffix, size: info.Size(), link: link}
+		if !link {
+			if err := os.Rename(path, s.staged); err != nil {
+				return err
+			}
+			staged = append(staged, s)
+			return nil
+		}
+
+		// The keeper is linked in under a temporary name and renamed over the
+		// duplicate, so the path never goes missing; the duplicate's content
+		// stays reachable through a second link until the decision commits
+		tmp := path + suffix + ".link"
+		if err := os.Link(keeper, tmp); err != nil {
+			return fmt.Errorf("cannot hardlink %s to %s: %v", path, keeper, err)
+		}
+		if err := os.Link(path, s.staged); err != nil {
+			os.Remove(tmp)
+			return err
+		}
+		if err := os.Rename(tmp, path); err != nil {
+			os.Remove(tmp)
+			os.Remove(s.staged)
+			return err
+		}
+		staged = append(staged, s)
+		return nil
+	}
+
+	var err error
+	for _, path := range req.Delete {
+		if err = stage(path, false); err != nil {
+			break
+		}
+	}
+	for _, path := range req.Hardlink {
+		if err != nil {
+			break
+		}
+		err = stage(path, true)
+	}
+	if err != nil {
+		rollbackDecision(staged)
+		result.Error = err.Error()
+		return result
+	}
+
+	// Commit: deleted files go for good (or to the trash with -trash-dir or -xdg-trash),
+	// replaced originals go onto the undo stack
+	var changes, trashed []FileChange
+	var trashedThumbs []string
+	var trashedSizes []int64
+	backupDir := ""
+	for _, s := range staged {
+		if !s.link && trashEnabled() {
+			thumb := cacheThumbnail(s.path, s.staged)
+			change, err := trashFile(r, s.staged, s.path, req.Idx)
+			if err != nil {
+				// Never fall back to deleting: put the file back and keep it
+				reqLog(r, "delete").Error("failed to trash file, keeping it", "path", s.path, "err", err)
+				os.Remove(thumb)
+				if err := os.Rename(s.staged, s.path); err != nil {
+					logFor("delete").Error("failed to restore staged file", "path", s.path, "staged", s.staged, "err", err)
+				}
+				result.Kept = append(result.Kept, s.path)
+				continue
+			}
+			trashed = append(trashed, change)
+			trashedThumbs = append(trashedThumbs, thumb)
+			trashedSizes = append(trashedSizes, s.size)
+			pruneAfterRemoval(r, s.path)
+			result.Deleted = append(result.Deleted, s.path)
+			result.ReclaimedBytes += s.size
+			continue
+		}
+
+		noteSessionAction(req.Idx, s.size)
+		spendBudget(s.size)
+		if !s.link {
+			thumb := cacheThumbnail(s.path, s.staged)
+			checksum := auditChecksum(s.staged)
+			if err := os.Remove(s.staged); err != nil {
+				reqLog(r, "delete").Error("failed to remove staged file", "staged", s.staged, "err", err)
+			}
+			audit(r, actionDeleted, s.path, checksum, s.size, req.Idx, "")
+			forgetConverted(s.path)
+			recordAction(s.path, actionDeleted, req.Idx, fmt.Sprintf("%d bytes", s.size))
+			noteDeletion(s.path, s.size, actionDeleted, thumb, nil)
+			pruneAfterRemoval(r, s.path)
+			result.Deleted = append(result.Deleted, s.path)
+			result.ReclaimedBytes += s.size
+			continue
+		}
+
+		audit(r, actionHardlinked, s.path, auditChecksum(s.staged), s.size, req.Idx, "linked to "+keeper)
+		change := FileChange{Path: s.path}
+		if backupDir == "" {
+			backupDir, _ = newUndoBackupDir()
+		}
+		if backupDir != "" {
+			backup := filepath.Join(backupDir, filepath.Base(s.path)+suffix)
+			if err := moveFile(s.staged, backup); err == nil {
+				change.Backup = backup
+			}
+		}
+		if change.Backup == "" {
+			reqLog(r, "delete").Warn("could not keep a backup, the hardlink can't be undone", "path", s.path)
+			os.Remove(s.staged)
+		} else {
+			changes = append(changes, change)
+		}
+		recordAction(s.path, actionHardlinked, req.Idx, fmt.Sprintf("%d bytes, linked to %s", s.size, keeper))
+		result.Hardlinked = append(result.Hardlinked, s.path)
+		result.ReclaimedBytes += s.size
+	}
+	if len(trashed) > 0 {
+		entry := pushUndo("trash", fmt.Sprintf("trashed %d file(s) in group %d", len(trashed), req.Idx), trashed)
+		result.TrashUndoID = &entry.ID
+		for i, change := range trashed {
+			noteDeletion(change.MovedFrom, trashedSizes[i], actionTrashed, trashedThumbs[i], &entry.ID)
+		}
+	}
+	if len(changes) > 0 {
+		entry := pushUndo("hardlink", fmt.Sprintf("hardlinked %d file(s) in group %d to %s", len(changes), req.Idx, keeper), changes)
+		result.UndoID = &entry.ID
+	}
+	result.Success = true
+	journalDecision(req.Idx, result)
+	recordDecisions(req.Idx, result, hashes)
+	publishResolved(req.Idx, result)
+	if len(result.Hardlinked) > 0 {
+		scheduleWriteBack() // Deletions already did in noteDeletion
+	}
+	return result
+}
+
+// POST a DecideRequest to resolve a whole group in one step
+func decideHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		http.Error(w, "Method not allowed", 405)
+		return
+	}
+	var req DecideRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid JSON", 400)
+		return
+	}
+	store, release := acquireGroups()
+	defer release()
+	if req.Idx < 0 || req.Idx >= store.Len() {
+		http.Error(w, "Group not found", 404)
+		return
+	}
+	group, err := store.Group(req.Idx)
+	if err != nil {
+		http.Error(w, "Failed to read group", 500)
+		return
+	}
+
+	// The client may go away mid-request; everything below runs to completion regardless
+	decideMu.Lock()
+	defer decideMu.Unlock()
+	serveDecision(w, r, req, group)
+}
+
+// Validate, budget and apply a decision, and write the result (caller must hold decideMu)
+func serveDecision(w http.ResponseWriter, r *http.Request, req DecideRequest, group []Image) {
+	if err := checkClaim(r, group); err != nil {
+		http.Error(w, err.Error(), 423)
+		return
+	}
+	if err := validateDecision(&req, group); err != nil {
+		http.Error(w, err.Error(), 400)
+		return
+	}
+	var bytes int64
+	for _, path := range append(append([]string{}, req.Delete...), req.Hardlink...) {
+		if info, err := os.Stat(path); err == nil {
+			bytes += info.Size()
+		}
+	}
+	if err := checkBudget(r, len(req.Delete)+len(req.Hardlink), bytes); err != nil {
+		http.Error(w, err.Error(), 429)
+		return
+	}
+	if len(req.Delete)+len(req.Hardlink) >= largeBatch {
+		backupBefore("decide")
+	}
+	result := applyDecision(r, req)
+	if result.Success {
+		releaseClaim(r, group)
+		reqLog(r, "delete").Info("group decided", "group", req.Idx, "kept", len(result.Kept), "deleted", len(result.Deleted), "hardlinked", len(result.Hardlinked))
+	} else {
+		reqLog(r, "delete").Warn("group decision rolled back", "group", req.Idx, "err", result.Error)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if !result.Success {
+		w.WriteHeader(409)
+	}
+	json.NewEncoder(w).Encode(v1DecideResult(result))
+}
+
+// With -hardlink, groups resolved in one step have their duplicates replaced
+// by hardlinks to the keeper rather than deleted
+var hardlinkMode bool
+
+// POST /api/resolve-group {"idx": N, "keep": "path"} keeps one file of a group
+// and deletes (or trashes) every other member still on disk, all or nothing.
+// "mode": "hardlink" (the default with -hardlink) replaces them with
+// hardlinks to the keeper instead, so every path stays valid; "delete"
+// overrides -hardlink.
+func resolveGroupHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		http.Error(w, "Method not allowed", 405)
+		return
+	}
+	var req struct {
+		Idx  int    `json:"idx"`
+		Keep string `json:"keep"`
+		Mode string `json:"mode"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.Keep == "" {
+		http.Error(w, "Invalid JSON", 400)
+		return
+	}
+	link := hardlinkMode
+	switch req.Mode {
+	case "":
+	case "delete":
+		link = false
+	case "hardlink":
+		link = true
+	default:
+		http.Error(w, "mode must be delete or hardlink", 400)
+		return
+	}
+	store, release := acquireGroups()
+	defer release()
+	if req.Idx < 0 || req.Idx >= store.Len() {
+		http.Error(w, "Group not found", 404)
+		return
+	}
+	group, err := store.Group(req.Idx)
+	if err != nil {
+		http.Error(w, "Failed to read group", 500)
+		return
+	}
+
+	decideMu.Lock()
+	defer decideMu.Unlock()
+	keep := absImagePath(req.Keep)
+	decision := DecideRequest{Idx: req.Idx, Keep: []string{keep}, Delete: []string{}, Hardlink: []string{}}
+	keepInfo, _ := os.Stat(keep)
+	for _, img := range group {
+		path := filepath.Clean(img.Path)
+		info, err := os.Stat(path)
+		switch {
+		case err != nil || path == keep:
+		case !link:
+			decision.Delete = append(decision.Delete, path)
+		case keepInfo != nil && os.SameFile(info, keepInfo):
+			decision.Keep = append(decision.Keep, path) // Already a hardlink of the keeper
+		default:
+			decision.Hardlink = append(decision.Hardlink, path)
+		}
+	}
+	serveDecision(w, r, decision, group)
+}
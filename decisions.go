@@ -0,0 +1,123 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+// What a file was decided to be, beyond the removals in the history
+const (
+	decisionKeep     = "keep"
+	decisionDelete   = "delete"
+	decisionHardlink = "hardlink"
+	decisionResolved = "resolved" // Its group was marked resolved by hand
+)
+
+// What was decided about a file, kept in the state database by content hash
+// and path so it follows the file across renames, moves, rescans and
+// restarts, e.g. to show that a file turning up in a new group was already
+// kept once. Identical copies share the hash, so each has its own.
+type FileDecision struct {
+	Decision string    `json:"decision"`
+	Path     string    `json:"path"`  // Where the file was at the time
+	Group    string    `json:"group"` // Key of the group it was decided in
+	Time     time.Time `json:"time"`
+}
+
+func decisionKey(hash, path string) string {
+	return hash + "\x00" + filepath.Clean(path)
+}
+
+// The last decision about a file, if there was one: made on it where it is,
+// or else on the same content at a path it was since moved or renamed away
+// from (not one of its copies, still there or deleted)
+func decisionFor(path string) (FileDecision, bool) {
+	var d FileDecision
+	hash := knownContentHash(path)
+	if hash == "" {
+		return d, false
+	}
+	if dbGet(bucketDecisions, decisionKey(hash, path), &d) {
+		return d, true
+	}
+	found := false
+	prefix := []byte(hash + "\x00")
+	stateDB.View(func(tx *bolt.Tx) error {
+		c := tx.Bucket([]byte(bucketDecisions)).Cursor()
+		for k, v := c.Seek(prefix); k != nil && bytes.HasPrefix(k, prefix); k, v = c.Next() {
+			var moved FileDecision
+			if json.Unmarshal(v, &moved) != nil || moved.Decision == decisionDelete {
+				continue
+			}
+			if _, err := os.Lstat(moved.Path); err == nil {
+				continue
+			}
+			if !found || moved.Time.After(d.Time) {
+				d, found = moved, true
+			}
+		}
+		return nil
+	})
+	return d, found
+}
+
+// Content hashes of the files a decision is about, taken before it is
+// applied: a hardlinked file has the keeper's content afterwards, and a
+// deleted one none
+func decisionHashes(req DecideRequest) map[string]string {
+	hashes := make(map[string]string)
+	for _, paths := range [][]string{req.Keep, req.Delete, req.Hardlink} {
+		for _, path := range paths {
+			hashes[filepath.Clean(path)] = knownContentHash(path)
+		}
+	}
+	return hashes
+}
+
+// Keep what became of each file of an applied decision on group idx
+func recordDecisions(idx int, result DecideResult, hashes map[string]string) {
+	group, err := currentGroups().Group(idx)
+	if err != nil {
+		return
+	}
+	key, now := groupKey(group), time.Now()
+	record := func(paths []string, decision string) {
+		for _, path := range paths {
+			hash := hashes[filepath.Clean(path)]
+			if hash == "" {
+				continue // A video, or gone before it could be hashed
+			}
+			d := FileDecision{Decision: decision, Path: path, Group: key, Time: now}
+			if err := dbPut(bucketDecisions, decisionKey(hash, path), d); err != nil {
+				logFor("review").Warn("failed to save decision", "path", path, "err", err)
+			}
+		}
+	}
+	record(result.Kept, decisionKeep)
+	record(result.Deleted, decisionDelete)
+	record(result.Hardlinked, decisionHardlink)
+}
+
+// Flag a group's files as resolved along with the group, or take the flag
+// back. A file already kept or deleted keeps that decision.
+func markContentResolved(group []Image, key string, resolved bool) {
+	for _, img := range group {
+		hash := knownContentHash(img.Path)
+		if hash == "" {
+			continue
+		}
+		var d FileDecision
+		found := dbGet(bucketDecisions, decisionKey(hash, img.Path), &d)
+		switch {
+		case resolved && !found:
+			dbPut(bucketDecisions, decisionKey(hash, img.Path), FileDecision{Decision: decisionResolved, Path: img.Path, Group: key, Time: time.Now()})
+		case !resolved && found && d.Decision == decisionResolved && d.Group == key:
+			dbDelete(bucketDecisions, decisionKey(hash, img.Path))
+		}
+	}
+}
@@ -0,0 +1,212 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+)
+
+var errContentDiffers = errors.New("contents differ")
+
+// Whether the library's filesystem can share extents between files (btrfs,
+// XFS), found out by trying it on the first dedupe request, since that means
+// writing to the library
+var (
+	blockDedupeMu     sync.Mutex
+	blockDedupeProbed bool
+	blockDedupe       bool
+	blockDedupeReason string // Why not, when it isn't available
+)
+
+// Forget what was found out about the last dataset's library
+func resetBlockDedupe() {
+	blockDedupeMu.Lock()
+	blockDedupeProbed, blockDedupe, blockDedupeReason = false, false, ""
+	blockDedupeMu.Unlock()
+}
+
+// Try deduping two scratch files in a hidden directory under the image root,
+// unless that was done already. Called with blockDedupeMu held.
+func probeBlockDedupe() (bool, string) {
+	if blockDedupeProbed {
+		return blockDedupe, blockDedupeReason
+	}
+	ok, reason := false, ""
+	if readOnly(imageRoot) {
+		reason = "the image root is read-only"
+	} else if dir, err := os.MkdirTemp(imageRoot, ".dedupe-probe-*"); err != nil {
+		reason = "cannot write to the image root: " + err.Error()
+	} else {
+		data := bytes.Repeat([]byte("dedupe probe "), 10000) // A few blocks
+		a, b := filepath.Join(dir, "a"), filepath.Join(dir, "b")
+		err := os.WriteFile(a, data, 0644)
+		if err == nil {
+			err = os.WriteFile(b, data, 0644)
+		}
+		if err == nil {
+			_, err = dedupeRange(a, b)
+		}
+		if err != nil {
+			reason = err.Error()
+		} else {
+			ok = true
+		}
+		os.RemoveAll(dir)
+	}
+	blockDedupeProbed, blockDedupe, blockDedupeReason = true, ok, reason
+	if ok {
+		logFor("dedupe").Info("block-level dedupe is available", "root", imageRoot)
+	} else {
+		logFor("dedupe").Info("block-level dedupe is not available", "root", imageRoot, "reason", reason)
+	}
+	return ok, reason
+}
+
+// Whether block-level dedupe works here and, if not, why. Until a dedupe
+// request has tried it, going by the filesystem's type ("tried": false).
+func blockDedupeAvailable() map[string]interface{} {
+	blockDedupeMu.Lock()
+	ok, reason, tried := blockDedupe, blockDedupeReason, blockDedupeProbed
+	blockDedupeMu.Unlock()
+	if !tried {
+		err := dedupeFilesystem(imageRoot)
+		ok = err == nil
+		if err != nil {
+			reason = err.Error()
+		}
+	}
+	if ok {
+		return map[string]interface{}{"available": true, "tried": tried}
+	}
+	return map[string]interface{}{"available": false, "reason": reason, "tried": tried}
+}
+
+// Outcome of block-level deduping one group
+type BlockDedupeResult struct {
+	Idx     int      `json:"idx"`
+	Deduped []string `json:"deduped"` // Now sharing extents with an identical member
+	Skipped []string `json:"skipped"` // Not byte-identical to another member, or read-only
+	Bytes   int64    `json:"bytes"`   // Deduped; already shared extents count again
+	Errors  []string `json:"errors,omitempty"`
+}
+
+// Share extents between the byte-identical members of a group. Every file
+// stays where it is with the same content; read-only files are only ever
+// used as the source.
+func dedupeGroupBlocks(idx int, group []Image) BlockDedupeResult {
+	result := BlockDedupeResult{Idx: idx, Deduped: []string{}, Skipped: []string{}}
+	identical := make(map[string][]string)
+	var order []string
+	for _, img := range group {
+		info, err := os.Stat(img.Path)
+		if err != nil || !info.Mode().IsRegular() {
+			continue
+		}
+		hash, err := contentHash(img.Path)
+		if err != nil {
+			result.Errors = append(result.Errors, fmt.Sprintf("%s: %v", img.Path, err))
+			continue
+		}
+		if identical[hash] == nil {
+			order = append(order, hash)
+		}
+		identical[hash] = append(identical[hash], img.Path)
+	}
+
+	for _, hash := range order {
+		paths := identical[hash]
+		if len(paths) < 2 {
+			result.Skipped = append(result.Skipped, paths...)
+			continue
+		}
+		// Read-only files first, so they are the source rather than left out
+		sort.SliceStable(paths, func(i, j int) bool { return readOnly(paths[i]) && !readOnly(paths[j]) })
+		src := paths[0]
+		for _, dst := range paths[1:] {
+			if readOnly(dst) {
+				result.Skipped = append(result.Skipped, dst)
+				continue
+			}
+			n, err := dedupeRange(src, dst)
+			result.Bytes += n
+			if err != nil {
+				result.Errors = append(result.Errors, fmt.Sprintf("%s: %v", dst, err))
+				continue
+			}
+			recordAction(dst, actionDeduped, idx, fmt.Sprintf("%d bytes shared with %s", n, src))
+			result.Deduped = append(result.Deduped, dst)
+		}
+	}
+	return result
+}
+
+// POST {"idx": N} shares the disk blocks of the byte-identical files of one
+// group, or {"all": true} of every group, instead of deleting any of them.
+// 501 when the library's filesystem doesn't support it.
+func blockDedupeHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		http.Error(w, "Method not allowed", 405)
+		return
+	}
+	var req struct {
+		Idx *int `json:"idx"`
+		All bool `json:"all"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || (req.Idx == nil) == !req.All {
+		http.Error(w, `Give either "idx" or "all": true`, 400)
+		return
+	}
+	blockDedupeMu.Lock()
+	ok, reason := probeBlockDedupe()
+	blockDedupeMu.Unlock()
+	if !ok {
+		http.Error(w, "Block-level dedupe is not available: "+reason, 501)
+		return
+	}
+
+	store, release := acquireGroups()
+	defer release()
+	first, last := 0, store.Len()-1
+	if req.Idx != nil {
+		if *req.Idx < 0 || *req.Idx >= store.Len() {
+			http.Error(w, "Group not found", 404)
+			return
+		}
+		first, last = *req.Idx, *req.Idx
+	}
+
+	decideMu.Lock()
+	defer decideMu.Unlock()
+	results := []BlockDedupeResult{}
+	files, failed := 0, 0
+	var total int64
+	for idx := first; idx <= last; idx++ {
+		group, err := store.Group(idx)
+		if err != nil {
+			continue
+		}
+		result := dedupeGroupBlocks(idx, group)
+		files += len(result.Deduped)
+		failed += len(result.Errors)
+		total += result.Bytes
+		// In bulk, only the groups where something happened are worth listing
+		if req.Idx != nil || len(result.Deduped) > 0 || len(result.Errors) > 0 {
+			results = append(results, result)
+		}
+	}
+	reqLog(r, "dedupe").Info("block-level dedupe done", "files", files, "bytes", total, "errors", failed)
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"success": failed == 0,
+		"deduped": files,
+		"bytes":   total,
+		"results": results,
+	})
+}
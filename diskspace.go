@@ -0,0 +1,37 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+)
+
+// Conversions are refused while the cache filesystem has less free space than this (-min-cache-free-mb)
+var minCacheFreeMB int64
+
+var errCacheFull = errors.New("conversion cache is low on disk space")
+
+type CacheStatus struct {
+	Dir        string `json:"dir"`
+	FreeBytes  int64  `json:"free_bytes"` // -1 if unknown on this platform
+	MinFree    int64  `json:"min_free_bytes"`
+	Sufficient bool   `json:"sufficient"`
+}
+
+func cacheStatus() CacheStatus {
+	s := CacheStatus{Dir: tempDir, FreeBytes: -1, MinFree: minCacheFreeMB << 20, Sufficient: true}
+	if free, err := freeSpace(tempDir); err == nil {
+		s.FreeBytes = free
+		s.Sufficient = free >= s.MinFree
+	}
+	return s
+}
+
+// Check there is room in the cache before writing a conversion into it
+func checkCacheSpace() error {
+	s := cacheStatus()
+	if s.Sufficient {
+		return nil
+	}
+	logFor("convert").Warn("refusing conversion, cache space low", "dir", s.Dir, "free_mb", s.FreeBytes>>20, "min_free_mb", minCacheFreeMB)
+	return fmt.Errorf("%w (%d MB free in %s, at least %d MB required)", errCacheFull, s.FreeBytes>>20, s.Dir, minCacheFreeMB)
+}
@@ -0,0 +1,20 @@
+//go:build !unix
+
+package main
+
+import (
+	"errors"
+	"os"
+)
+
+func freeSpace(path string) (int64, error) {
+	return 0, errors.New("free space is not available on this platform")
+}
+
+func deviceOf(path string) (uint64, error) {
+	return 0, errors.New("devices are not available on this platform")
+}
+
+func fileOwner(info os.FileInfo) (string, bool) {
+	return "", false
+}
@@ -6,10 +6,12 @@ import (
 	_ "embed"
 	"encoding/hex"
 	"encoding/json"
+	"errors"
 	"flag"
 	"fmt"
 	"io"
-	"log"
+	"io/fs"
+	"net"
 	"net/http"
 	"os"
 	"os/exec"
@@ -17,6 +19,7 @@ import (
 	"sort"
 	"strconv"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/dsoprea/go-exif/v3"
@@ -38,8 +41,9 @@ type Image struct {
 	Width        int     `json:"width"`
 	Height       int     `json:"height"`
 	ModifiedDate int64   `json:"modified_date"`
-	Hash         []int   `json:"hash"`
+	Hash         []int   `json:"hash,omitempty"`
 	Similarity   int     `json:"similarity"`
+	Original     bool    `json:"original,omitempty"`  // Marked as the one to keep by the tool that found the group (rmlint, dupeGuru, a czkawka reference)
 	Duration     float64 `json:"duration,omitempty"`  // Video duration in seconds
 	Codec        string  `json:"codec,omitempty"`     // Video codec (h264, h265, etc.)
 	Bitrate      int64   `json:"bitrate,omitempty"`   // Video bitrate
@@ -48,17 +52,24 @@ type Image struct {
 
 type ExifData struct {
 	DateTaken   string `json:"date_taken"`
+	TakenOffset string `json:"date_taken_offset,omitempty"` // e.g. +02:00, when the camera recorded it
 	CameraMake  string `json:"camera_make"`
 	CameraModel string `json:"camera_model"`
 	FStop       string `json:"fstop"`
 	Subject     string `json:"subject"`
 	HasExif     bool   `json:"has_exif"`
+
+	ExifError       string `json:"exif_error,omitempty"`        // Why the EXIF couldn't be read, e.g. "truncated"; see exiferrors.go
+	ExifErrorDetail string `json:"exif_error_detail,omitempty"` // The parser's message
 }
 
 type ImageWithExif struct {
 	Image
 	ExifData
-	Score int `json:"score"`
+	Kind      string   `json:"kind,omitempty"`    // "screenshot" or "messenger", see classifyImage
+	Corrupt   string   `json:"corrupt,omitempty"` // Why the file looks damaged, see checkIntegrity
+	Score     int      `json:"score"`
+	Breakdown []string `json:"breakdown"` // Why it got its score, e.g. "has EXIF +1"
 }
 
 type VideoMetadata struct {
@@ -70,15 +81,13 @@ type VideoMetadata struct {
 	Height    int     `json:"height"`
 }
 
-type GroupResponse struct {
-	GroupSimilarityScore float64         `json:"group_similarity_score"`
-	Images               []ImageWithExif `json:"images"`
-}
-
 var (
-	groups         [][]Image
+	groups         groupStore
+	groupsMu       sync.RWMutex
+	lazyGroups     bool
 	imageRoot      string
 	duplicatesFile string
+	host           string
 	port           string
 	tempDir        string
 	cr2Cache       = make(map[string]string)             // Map CR2 path to JPG temp path
@@ -156,6 +165,16 @@ func extractXMPSubject(data []byte) string {
 	return ""
 }
 
+// Camera raw formats, preferred as keepers by the raw-first strategy
+var rawExtensions = map[string]bool{
+	".cr2": true, ".cr3": true, ".nef": true, ".arw": true, ".dng": true,
+	".raf": true, ".orf": true, ".rw2": true, ".pef": true, ".srw": true,
+}
+
+func isRawFile(path string) bool {
+	return rawExtensions[strings.ToLower(filepath.Ext(path))]
+}
+
 // CR2 to JPG conversion functions
 func isCR2File(path string) bool {
 	return strings.ToLower(filepath.Ext(path)) == ".cr2"
@@ -177,16 +196,15 @@ func convertCR2ToJPG(cr2Path string) (string, error) {
 		delete(cr2Cache, cr2Path)
 	}
 
+	if err := checkCacheSpace(); err != nil {
+		return "", err
+	}
 	jpgPath := generateTempJPGPath(cr2Path)
 
 	// Check if ImageMagick is available (try 'magick' first, then 'convert')
-	var cmdName string
-	if _, err := exec.LookPath("magick"); err == nil {
-		cmdName = "magick"
-	} else if _, err := exec.LookPath("convert"); err == nil {
-		cmdName = "convert"
-	} else {
-		return "", fmt.Errorf("ImageMagick not found: neither 'magick' nor 'convert' command available")
+	cmdName, err := imageMagickCmd()
+	if err != nil {
+		return "", err
 	}
 
 	// Convert CR2 to JPG using ImageMagick
@@ -197,11 +215,23 @@ func convertCR2ToJPG(cr2Path string) (string, error) {
 
 	// Cache the result
 	cr2Cache[cr2Path] = jpgPath
-	log.Printf("Converted CR2 to JPG: %s -> %s", filepath.Base(cr2Path), filepath.Base(jpgPath))
+	logFor("convert").Info("converted CR2 to JPG", "path", cr2Path, "jpg", filepath.Base(jpgPath))
+	publish(eventConverted, ConvertedEvent{Path: getRelativeImagePath(cr2Path)})
 
 	return jpgPath, nil
 }
 
+// If a deleted file was a CR2, clean up any cached JPG conversion
+func forgetConverted(path string) {
+	if isCR2File(path) {
+		if jpgPath, exists := cr2Cache[path]; exists {
+			os.Remove(jpgPath) // Best effort cleanup, ignore errors
+			delete(cr2Cache, path)
+			logFor("convert").Debug("removed cached JPG of deleted CR2", "path", path, "jpg", filepath.Base(jpgPath))
+		}
+	}
+}
+
 // Video detection and metadata functions
 func isVideoFile(path string) bool {
 	ext := strings.ToLower(filepath.Ext(path))
@@ -218,13 +248,13 @@ func isVideoFile(path string) bool {
 func getVideoMetadata(path string) (duration float64, codec string, bitrate int64, framerate float64, width int, height int) {
 	// Check cache first
 	if cached, exists := videoMetaCache[path]; exists {
-		log.Printf("Cache HIT for video: %s", filepath.Base(path))
+		logFor("video").Debug("metadata cache hit", "path", path)
 		return cached.Duration, cached.Codec, cached.Bitrate, cached.Framerate, cached.Width, cached.Height
 	}
 
 	// Check if extraction is already in progress
 	if ch, exists := videoPending[path]; exists {
-		log.Printf("Video metadata extraction in progress for: %s - waiting...", filepath.Base(path))
+		logFor("video").Debug("waiting for metadata extraction in progress", "path", path)
 		cached := <-ch
 		return cached.Duration, cached.Codec, cached.Bitrate, cached.Framerate, cached.Width, cached.Height
 	}
@@ -239,12 +269,12 @@ func getVideoMetadata(path string) (duration float64, codec string, bitrate int6
 			close(ch)
 		}()
 
-		log.Printf("Cache MISS for video: %s - extracting metadata in background", filepath.Base(path))
+		logFor("video").Debug("metadata cache miss, extracting in background", "path", path)
 		metadata := extractVideoMetadataSync(path)
 
 		// Cache the result
 		videoMetaCache[path] = metadata
-		log.Printf("Cached metadata for video: %s", filepath.Base(path))
+		logFor("video").Debug("cached metadata", "path", path)
 
 		// Send result to any waiters
 		ch <- metadata
@@ -347,26 +377,39 @@ func cleanupTempFiles() {
 	}
 }
 
-func loadGroups() {
-	f, err := os.Open(duplicatesFile)
+// EXIF of a file, cached in the state database by content so each distinct
+// file is parsed once, across restarts too. Failures aren't cached, so they
+// are still reported (see exiferrors.go); videos aren't hashed for it.
+func getExif(path string) ExifData {
+	if isVideoFile(path) {
+		return readExif(path)
+	}
+	hash, err := contentHash(path)
 	if err != nil {
-		log.Fatalf("Failed to open %s: %v", duplicatesFile, err)
+		return readExif(path)
 	}
-	defer f.Close()
-	if err := json.NewDecoder(f).Decode(&groups); err != nil {
-		log.Fatalf("Failed to decode %s: %v", duplicatesFile, err)
+	var data ExifData
+	if dbGet(bucketExif, hash, &data) {
+		return data
+	}
+	data = readExif(path)
+	if data.ExifError == "" {
+		if err := dbPut(bucketExif, hash, data); err != nil {
+			logFor("exif").Warn("failed to cache EXIF", "path", path, "err", err)
+		}
 	}
+	return data
 }
 
-func getExif(path string) ExifData {
+func readExif(path string) ExifData {
 	f, err := os.Open(path)
 	if err != nil {
-		return ExifData{HasExif: false}
+		return exifFailure(path, exifUnreadable, err)
 	}
 	defer f.Close()
 	data, err := io.ReadAll(f)
 	if err != nil {
-		return ExifData{HasExif: false}
+		return exifFailure(path, exifUnreadable, err)
 	}
 
 	// Try to extract Subject from XMP data first
@@ -374,29 +417,34 @@ func getExif(path string) ExifData {
 
 	rawExif, err := exif.SearchAndExtractExif(data)
 	if err != nil {
+		var result ExifData
+		if !errors.Is(err, exif.ErrNoExif) {
+			result = exifFailure(path, classifyExifError(err, data), err)
+		}
 		// If no EXIF but we found XMP subject, return that
 		if xmpSubject != "" {
-			return ExifData{HasExif: true, Subject: xmpSubject}
+			result.HasExif, result.Subject = true, xmpSubject
 		}
-		return ExifData{HasExif: false}
+		return result
 	}
 	ti := exif.NewTagIndex()
 	if err := exif.LoadStandardTags(ti); err != nil {
-		return ExifData{HasExif: false}
+		return exifFailure(path, exifInternal, err)
 	}
 
 	// Use the proper API for collecting EXIF data
 	ifdMapping, err := exifcommon.NewIfdMappingWithStandard()
 	if err != nil {
-		return ExifData{HasExif: false}
+		return exifFailure(path, exifInternal, err)
 	}
 
 	_, index, err := exif.Collect(ifdMapping, ti, rawExif)
 	if err != nil {
-		return ExifData{HasExif: false}
+		return exifFailure(path, classifyExifError(err, data), err)
 	}
+	forgetExifFailure(path)
 	rootIfd := index.RootIfd
-	var dateTaken, cameraMake, cameraModel, subject string
+	var dateTaken, takenOffset, cameraMake, cameraModel, subject string
 
 	// Helper to get first string value from tag entries
 	getFirst := func(entries []*exif.IfdTagEntry) string {
@@ -452,6 +500,12 @@ func getExif(path string) ExifData {
 			dateTaken = getFirst(entries)
 		}
 	}
+	// OffsetTimeOriginal (EXIF 2.31) - the UTC offset DateTimeOriginal was recorded in
+	if exifIfd != nil {
+		if entries, err := exifIfd.FindTagWithName("OffsetTimeOriginal"); err == nil {
+			takenOffset = getFirst(entries)
+		}
+	}
 	// Camera Make
 	if entries, err := rootIfd.FindTagWithName("Make"); err == nil {
 		cameraMake = getFirst(entries)
@@ -517,6 +571,7 @@ func getExif(path string) ExifData {
 
 	return ExifData{
 		DateTaken:   dateTaken,
+		TakenOffset: takenOffset,
 		CameraMake:  cameraMake,
 		CameraModel: cameraModel,
 		FStop:       "", // Not handled here, add if needed
@@ -563,24 +618,79 @@ func exifIdentical(a, b ExifData) bool {
 	return true
 }
 
-func scoreImages(imgs []ImageWithExif) []ImageWithExif {
+// ScoringRules weighs what makes a file the one to keep. The image with the
+// highest score is the keeper when a group is resolved automatically.
+type ScoringRules struct {
+	Exif               int  `json:"exif"`                // Having any EXIF data
+	Subject            int  `json:"subject"`             // A meaningful EXIF subject
+	HighestResolution  int  `json:"highest_resolution"`  // The largest resolution in the group
+	OldestFallback     int  `json:"oldest_fallback"`     // The oldest file, when no file has EXIF
+	Largest            int  `json:"largest"`             // The largest file in the group
+	Oldest             int  `json:"oldest"`              // The oldest file, EXIF or not
+	Raw                int  `json:"raw"`                 // A camera raw file
+	EarliestScreenshot int  `json:"earliest_screenshot"` // The oldest file, when all are screenshots
+	Messenger          int  `json:"messenger"`           // A copy re-compressed by a messenger app, usually negative
+	Corrupt            int  `json:"corrupt"`             // A file that fails to decode or is cut short, usually negative
+	Original           int  `json:"original"`            // The file the tool that found the group would keep (rmlint, dupeGuru, a czkawka reference)
+	SkipTies           bool `json:"skip_ties"`           // Leave groups with several top-scoring files unresolved
+}
+
+var defaultScoringRules = ScoringRules{Exif: 1, Subject: 2, HighestResolution: 1, OldestFallback: 1, Messenger: -3, Corrupt: -5, Original: strategyBonus}
+
+// Alternative keeper policies for ?strategy= on the group endpoint. Each adds
+// a bonus that outweighs all the default rules together, which then only
+// break ties.
+const strategyBonus = 10
+
+func keeperStrategy(name string) (ScoringRules, bool) {
+	rules := defaultScoringRules
+	switch name {
+	case "", "default":
+	case "largest":
+		rules.Largest = strategyBonus
+	case "oldest":
+		rules.Oldest = strategyBonus
+	case "raw-first":
+		rules.Raw = strategyBonus
+	case "earliest-screenshot":
+		rules.EarliestScreenshot = strategyBonus
+	default:
+		return rules, false
+	}
+	if name != "" && name != "default" {
+		rules.Original = 1 // rmlint's pick only breaks ties too
+	}
+	return rules, true
+}
+
+func scoreImages(imgs []ImageWithExif, rules ScoringRules) []ImageWithExif {
 	maxRes := 0
+	var maxSize int64
 	for _, img := range imgs {
 		res := img.Width * img.Height
 		if res > maxRes {
 			maxRes = res
 		}
+		maxSize = max(maxSize, img.Size)
 	}
 	allNoExif := true
+	allScreenshots := true
 	oldestIdx := 0
 	oldest := int64(1<<63 - 1)
+	award := func(i, points int, reason string) {
+		if points != 0 {
+			imgs[i].Score += points
+			imgs[i].Breakdown = append(imgs[i].Breakdown, fmt.Sprintf("%s %+d", reason, points))
+		}
+	}
 	for i := range imgs {
+		imgs[i].Score = 0
+		imgs[i].Breakdown = []string{}
+
 		// Base score for having EXIF data
 		if imgs[i].HasExif {
-			imgs[i].Score = 1
+			award(i, rules.Exif, "has EXIF")
 			allNoExif = false
-		} else {
-			imgs[i].Score = 0
 		}
 
 		// Bonus points for having a proper subject (higher priority)
@@ -588,15 +698,32 @@ func scoreImages(imgs []ImageWithExif) []ImageWithExif {
 			if !strings.Contains(imgs[i].Subject, "UserComment<") &&
 				imgs[i].Subject != "[ASCII]" &&
 				!strings.Contains(strings.ToUpper(imgs[i].Subject), "DIGITAL CAMERA") {
-				imgs[i].Score += 2 // Significant bonus for meaningful subject
+				award(i, rules.Subject, "meaningful subject") // Significant bonus
 			}
 		}
 
 		// Bonus for highest resolution
 		if imgs[i].Width*imgs[i].Height == maxRes {
-			imgs[i].Score++
+			award(i, rules.HighestResolution, "highest resolution")
+		}
+		if imgs[i].Size == maxSize {
+			award(i, rules.Largest, "largest file")
+		}
+		if isRawFile(imgs[i].Path) {
+			award(i, rules.Raw, "raw file")
+		}
+		if imgs[i].Kind == kindMessenger {
+			award(i, rules.Messenger, "messenger copy")
+		}
+		if imgs[i].Corrupt != "" {
+			award(i, rules.Corrupt, "suspected corrupt")
+		}
+		if imgs[i].Original {
+			award(i, rules.Original, "marked original")
 		}
 
+		allScreenshots = allScreenshots && imgs[i].Kind == kindScreenshot
+
 		// Track oldest for fallback
 		if imgs[i].ModifiedDate < oldest {
 			oldest = imgs[i].ModifiedDate
@@ -604,7 +731,11 @@ func scoreImages(imgs []ImageWithExif) []ImageWithExif {
 		}
 	}
 	if allNoExif {
-		imgs[oldestIdx].Score++
+		award(oldestIdx, rules.OldestFallback, "oldest file, no EXIF in group")
+	}
+	award(oldestIdx, rules.Oldest, "oldest file")
+	if allScreenshots {
+		award(oldestIdx, rules.EarliestScreenshot, "earliest screenshot")
 	}
 	return imgs
 }
@@ -616,37 +747,68 @@ func getRelativeImagePath(fullPath string) string {
 	return fullPath
 }
 
-func groupHandler(w http.ResponseWriter, r *http.Request) {
-	idx := 0
-	if v := r.URL.Query().Get("idx"); v != "" {
-		if n, err := strconv.Atoi(v); err == nil {
-			idx = n
-		}
+// Report whether an absolute path is imageRoot or below it, both before and
+// after resolving symlinks, so neither ../ nor a link pointing elsewhere can
+// reach outside the library. Every handler that touches a file by a path it
+// was given checks it here.
+func withinImageRoot(path string) bool {
+	root := filepath.Clean(imageRoot)
+	path = filepath.Clean(path)
+	if !isBelow(path, root) {
+		return false
 	}
-	if idx < 0 || idx >= len(groups) {
-		http.Error(w, "Group not found", 404)
-		return
+	realRoot, err := filepath.EvalSymlinks(root)
+	if err != nil {
+		return false
 	}
-	group := groups[idx]
-	// Create a combined structure that keeps original path with each image
-	type imageWithPaths struct {
-		ImageWithExif
-		OriginalPath string
+	realPath, err := resolveSymlinks(path)
+	if err != nil {
+		return false
 	}
+	return isBelow(realPath, realRoot)
+}
 
-	var imgsWithPaths []imageWithPaths
+func isBelow(path, root string) bool {
+	return path == root || strings.HasPrefix(path, root+string(filepath.Separator))
+}
+
+// EvalSymlinks for a path that may not exist (yet): its nearest existing
+// parent is resolved and the rest appended
+func resolveSymlinks(path string) (string, error) {
+	resolved, err := filepath.EvalSymlinks(path)
+	if !errors.Is(err, fs.ErrNotExist) {
+		return resolved, err
+	}
+	parent := filepath.Dir(path)
+	if parent == path {
+		return "", err
+	}
+	resolved, err = resolveSymlinks(parent)
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(resolved, filepath.Base(path)), nil
+}
+
+// Load the members of a group that are still on disk with their EXIF data
+// and relative paths, plus their original paths in the same order
+func loadGroupImages(group []Image) ([]ImageWithExif, []string) {
+	var imgs []ImageWithExif
+	var originals []string
 	for _, img := range group {
 		// Check if file still exists on disk before processing
-		if _, err := os.Stat(img.Path); os.IsNotExist(err) {
-			log.Printf("Skipping missing file: %s", img.Path)
+		if _, err := os.Stat(img.Path); os.IsNotExist(err) || fileGone(img.Path) {
+			logFor("groups").Debug("skipping missing file", "path", img.Path)
 			continue // Skip deleted files
 		}
 
 		exif := getExif(img.Path)
+		recordCamera(img.Path, exif)
 		relativePath := getRelativeImagePath(img.Path)
 
 		// Create a copy of the image to potentially add video metadata
 		imgCopy := img
+		applyRefreshed(&imgCopy)
 
 		// If this is a video file, extract video metadata
 		if isVideoFile(img.Path) {
@@ -660,6 +822,11 @@ func groupHandler(w http.ResponseWriter, r *http.Request) {
 				imgCopy.Width = width
 				imgCopy.Height = height
 			}
+		} else if imgCopy.Width == 0 && imgCopy.Height == 0 {
+			// Results that don't say, like fdupes'
+			if width, height, err := imageDimensions(img.Path); err == nil {
+				imgCopy.Width, imgCopy.Height = width, height
+			}
 		}
 
 		imgWithExif := ImageWithExif{
@@ -667,10 +834,45 @@ func groupHandler(w http.ResponseWriter, r *http.Request) {
 			ExifData: exif,
 		}
 		imgWithExif.Path = relativePath // override path to be relative
+		imgWithExif.Kind = classifyImage(imgWithExif)
 
+		imgs = append(imgs, imgWithExif)
+		originals = append(originals, img.Path)
+	}
+	return imgs, originals
+}
+
+func groupHandler(w http.ResponseWriter, r *http.Request) {
+	idx := 0
+	if v := r.URL.Query().Get("idx"); v != "" {
+		if n, err := strconv.Atoi(v); err == nil {
+			idx = n
+		}
+	}
+	store, release := acquireGroups()
+	defer release()
+	if idx < 0 || idx >= store.Len() {
+		http.Error(w, "Group not found", 404)
+		return
+	}
+	group, err := store.Group(idx)
+	if err != nil {
+		reqLog(r, "groups").Error("failed to read group", "group", idx, "err", err)
+		http.Error(w, "Failed to read group", 500)
+		return
+	}
+	// Create a combined structure that keeps original path with each image
+	type imageWithPaths struct {
+		ImageWithExif
+		OriginalPath string
+	}
+
+	imgs, originals := loadGroupImages(group)
+	var imgsWithPaths []imageWithPaths
+	for i := range imgs {
 		imgsWithPaths = append(imgsWithPaths, imageWithPaths{
-			ImageWithExif: imgWithExif,
-			OriginalPath:  img.Path,
+			ImageWithExif: imgs[i],
+			OriginalPath:  originals[i],
 		})
 	}
 
@@ -680,16 +882,29 @@ func groupHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	// Score the images
-	var imgs []ImageWithExif
-	for _, imgWithPath := range imgsWithPaths {
-		imgs = append(imgs, imgWithPath.ImageWithExif)
+	// Fully decode each file so a damaged copy isn't picked as the keeper
+	for i := range imgs {
+		imgs[i].Corrupt = checkIntegrity(originals[i])
+	}
+
+	// Score the images, with an alternative keeper policy if asked. Only
+	// scores under the default policy go into the history.
+	strategy := r.URL.Query().Get("strategy")
+	rules, ok := keeperStrategy(strategy)
+	if !ok {
+		http.Error(w, "Unknown strategy "+strategy+" (largest, oldest, raw-first, earliest-screenshot or default)", 400)
+		return
 	}
-	imgs = scoreImages(imgs)
+	imgs = scoreImages(imgs, rules)
 
 	// Update the scores back to our combined structure
 	for i := range imgsWithPaths {
 		imgsWithPaths[i].ImageWithExif.Score = imgs[i].Score
+		imgsWithPaths[i].ImageWithExif.Breakdown = imgs[i].Breakdown
+		imgsWithPaths[i].ImageWithExif.Corrupt = imgs[i].Corrupt
+		if rules == defaultScoringRules {
+			recordScore(imgsWithPaths[i].OriginalPath, idx, imgs[i].Score)
+		}
 	}
 
 	// Sort by score (highest first)
@@ -698,29 +913,133 @@ func groupHandler(w http.ResponseWriter, r *http.Request) {
 	})
 
 	score := groupSimilarityScore(imgs)
-	// Compose response with both images and original paths
-	type frontendImage struct {
-		ImageWithExif
-		OriginalPath string `json:"original_path"`
+
+	// Compact payloads (?compact=1 or ?fields=...) leave out the heavy fields
+	// (hash, original_path) unless they are explicitly listed in fields
+	query := r.URL.Query()
+	compact := query.Get("compact") == "1" || query.Has("fields")
+	wanted := make(map[string]bool)
+	for _, field := range strings.Split(query.Get("fields"), ",") {
+		wanted[strings.TrimSpace(field)] = true
+	}
+
+	// Formatted dates are added when the client asks for a timezone or locale
+	var loc *time.Location
+	var layout string
+	if query.Has("tz") || query.Has("locale") {
+		var err error
+		if loc, err = time.LoadLocation(query.Get("tz")); err != nil {
+			http.Error(w, "Unknown timezone: "+query.Get("tz"), 400)
+			return
+		}
+		if layout, err = localeLayout(query.Get("locale")); err != nil {
+			http.Error(w, err.Error(), 400)
+			return
+		}
 	}
-	var frontendImages []frontendImage
+
+	// Compose response with both images and original paths
+	var frontendImages []V1Image
 	for _, imgWithPath := range imgsWithPaths {
-		frontendImages = append(frontendImages, frontendImage{
-			ImageWithExif: imgWithPath.ImageWithExif,
-			OriginalPath:  imgWithPath.OriginalPath,
-		})
+		image := v1Image(imgWithPath.ImageWithExif)
+		image.OriginalPath = imgWithPath.OriginalPath
+		image.ReadOnly = readOnly(imgWithPath.OriginalPath)
+		image.Animation = animationInfo(imgWithPath.OriginalPath)
+		if compact && !wanted["hash"] {
+			image.Hash = nil
+		}
+		if compact && !wanted["original_path"] {
+			image.OriginalPath = ""
+		}
+		if loc != nil {
+			image.Dates = formatDates(imgWithPath.ImageWithExif, loc, layout)
+		}
+		// Formats Go can't decode simply go without quality metrics
+		image.Quality, _ = qualityFor(imgWithPath.OriginalPath)
+		if d, ok := decisionFor(imgWithPath.OriginalPath); ok {
+			image.Decided = &d
+		}
+		frontendImages = append(frontendImages, image)
 	}
-	resp := struct {
-		GroupSimilarityScore float64         `json:"group_similarity_score"`
-		Images               []frontendImage `json:"images"`
-	}{
+	resp := V1Group{
 		GroupSimilarityScore: score,
 		Images:               frontendImages,
+		Moved:                movedMembers(group),
+		Progress:             reviewProgress(&idx),
+		Source:               groupSource(group),
+	}
+	var status GroupStatus
+	if dbGet(bucketStatus, groupKey(group), &status) {
+		resp.Status = status.Status
 	}
+	for _, image := range frontendImages {
+		resp.TotalBytes += image.Size
+	}
+	resp.KeeperBytes = frontendImages[0].Size
+	resp.ReclaimableBytes = resp.TotalBytes - resp.KeeperBytes
 	w.Header().Set("Content-Type", "application/json")
 	json.NewEncoder(w).Encode(resp)
 }
 
+// Delete one file below the image root, recording it like every removal
+func deleteFile(r *http.Request, path string) error {
+	// Security check: ensure the path is within the image root directory
+	path = filepath.Clean(path)
+	if !withinImageRoot(path) {
+		reqLog(r, "delete").Warn("security violation: attempted to delete file outside image root", "path", path, "client", clientIP(r))
+		return errors.New("File is outside allowed directory")
+	}
+	if err := checkWritable(path); err != nil {
+		return err
+	}
+
+	// Check if file exists
+	info, err := os.Stat(path)
+	if os.IsNotExist(err) {
+		return errors.New("File does not exist")
+	}
+	if err != nil {
+		// Permissions, a stale NFS handle, ...: nothing to go on
+		return err
+	}
+	if err := checkBudget(r, 1, info.Size()); err != nil {
+		return err
+	}
+
+	thumb := cacheThumbnail(path, path)
+	if trashEnabled() {
+		change, err := moveToTrash(r, path, -1)
+		if err != nil {
+			os.Remove(thumb)
+			reqLog(r, "delete").Error("failed to trash file", "path", path, "err", err)
+			return err
+		}
+		entry := pushUndo("trash", "trashed "+path, []FileChange{change})
+		noteDeletion(path, info.Size(), actionTrashed, thumb, &entry.ID)
+		pruneAfterRemoval(r, path)
+		reqLog(r, "delete").Info("moved file to trash", "path", path, "to", change.Path)
+		return nil
+	}
+
+	// Delete the file
+	checksum := auditChecksum(path)
+	if err := os.Remove(path); err != nil {
+		os.Remove(thumb)
+		reqLog(r, "delete").Error("failed to delete file", "path", path, "err", err)
+		return err
+	}
+
+	audit(r, actionDeleted, path, checksum, info.Size(), -1, "")
+	forgetConverted(path)
+	recordAction(path, actionDeleted, -1, fmt.Sprintf("%d bytes", info.Size()))
+	noteDeletion(path, info.Size(), actionDeleted, thumb, nil)
+	noteSessionAction(-1, info.Size())
+	spendBudget(info.Size())
+	pruneAfterRemoval(r, path)
+	reqLog(r, "delete").Info("deleted file", "path", path)
+	return nil
+}
+
 func deleteHandler(w http.ResponseWriter, r *http.Request) {
 	if r.Method != "POST" {
 		http.Error(w, "Method not allowed", 405)
@@ -741,58 +1060,70 @@ func deleteHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	// Security check: ensure the path is within the image root directory
-	if !strings.HasPrefix(req.Path, imageRoot) {
-		log.Printf("Security violation: attempted to delete file outside image root: %s", req.Path)
-		w.Header().Set("Content-Type", "application/json")
-		json.NewEncoder(w).Encode(map[string]interface{}{
-			"success": false,
-			"error":   "File is outside allowed directory",
-		})
+	w.Header().Set("Content-Type", "application/json")
+	if err := deleteFile(r, req.Path); err != nil {
+		if errors.Is(err, errBudgetExceeded) {
+			w.WriteHeader(429)
+		}
+		json.NewEncoder(w).Encode(V1FileResult{Error: err.Error()})
 		return
 	}
+	json.NewEncoder(w).Encode(V1FileResult{Success: true})
+}
 
-	// Check if file exists
-	if _, err := os.Stat(req.Path); os.IsNotExist(err) {
-		w.Header().Set("Content-Type", "application/json")
-		json.NewEncoder(w).Encode(map[string]interface{}{
-			"success": false,
-			"error":   "File does not exist",
-		})
+// Outcome for one path of a batch delete
+type DeleteResult struct {
+	Path    string `json:"path"`
+	Success bool   `json:"success"`
+	Error   string `json:"error,omitempty"`
+}
+
+// POST a JSON array of paths to delete them all in one request. Every path
+// is attempted and gets its own result, in the order given.
+func deleteBatchHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		http.Error(w, "Method not allowed", 405)
 		return
 	}
-
-	// Delete the file
-	if err := os.Remove(req.Path); err != nil {
-		log.Printf("Error deleting file %s: %v", req.Path, err)
-		w.Header().Set("Content-Type", "application/json")
-		json.NewEncoder(w).Encode(map[string]interface{}{
-			"success": false,
-			"error":   err.Error(),
-		})
+	var paths []string
+	if err := json.NewDecoder(r.Body).Decode(&paths); err != nil {
+		http.Error(w, "Invalid JSON, expected an array of paths", 400)
 		return
 	}
 
-	// If this was a CR2 file, clean up any cached JPG conversion
-	if isCR2File(req.Path) {
-		if jpgPath, exists := cr2Cache[req.Path]; exists {
-			os.Remove(jpgPath) // Best effort cleanup, ignore errors
-			delete(cr2Cache, req.Path)
-			log.Printf("Cleaned up cached JPG for deleted CR2: %s", filepath.Base(jpgPath))
+	decideMu.Lock()
+	defer decideMu.Unlock()
+	if len(paths) >= largeBatch {
+		backupBefore("delete-batch")
+	}
+	results := make([]DeleteResult, len(paths))
+	deleted := 0
+	for i, path := range paths {
+		results[i] = DeleteResult{Path: path, Success: true}
+		if path == "" {
+			results[i] = DeleteResult{Path: path, Error: "Path is required"}
+		} else if err := deleteFile(r, path); err != nil {
+			results[i] = DeleteResult{Path: path, Error: err.Error()}
+		} else {
+			deleted++
 		}
 	}
+	reqLog(r, "delete").Info("batch delete done", "deleted", deleted, "requested", len(paths))
 
-	log.Printf("Successfully deleted file: %s", req.Path)
 	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(map[string]interface{}{
-		"success": true,
+	json.NewEncoder(w).Encode(V1BatchResult{
+		Success: deleted == len(paths),
+		Deleted: deleted,
+		Failed:  len(paths) - deleted,
+		Results: results,
 	})
 }
 
 // Static file handlers for embedded files
 func indexHandler(w http.ResponseWriter, r *http.Request) {
 	w.Header().Set("Content-Type", "text/html")
-	w.Write(indexHTML)
+	w.Header().Set("Cache-Control", "no-store") // Carries this run's CSRF token
+	w.Write(indexPage(r))
 }
 
 func styleHandler(w http.ResponseWriter, r *http.Request) {
@@ -810,6 +1141,11 @@ func imageHandler(w http.ResponseWriter, r *http.Request) {
 	// Extract the image path from URL
 	imagePath := strings.TrimPrefix(r.URL.Path, "/images/")
 	fullPath := filepath.Join(imageRoot, imagePath)
+	if !withinImageRoot(fullPath) {
+		reqLog(r, "server").Warn("security violation: attempted to serve file outside image root", "path", imagePath, "client", clientIP(r))
+		http.Error(w, "File is outside allowed directory", 403)
+		return
+	}
 
 	// Check if file exists
 	if _, err := os.Stat(fullPath); os.IsNotExist(err) {
@@ -817,11 +1153,21 @@ func imageHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	// ?still=1 gives the first frame of an animation instead of the animation
+	if r.URL.Query().Get("still") == "1" {
+		serveStillFrame(w, fullPath)
+		return
+	}
+
 	// If it's a CR2 file, convert to JPG and serve the converted version
 	if isCR2File(fullPath) {
 		jpgPath, err := convertCR2ToJPG(fullPath)
 		if err != nil {
-			log.Printf("Failed to convert CR2 file %s: %v", fullPath, err)
+			reqLog(r, "convert").Error("failed to convert CR2", "path", fullPath, "err", err)
+			if errors.Is(err, errCacheFull) {
+				http.Error(w, err.Error(), http.StatusInsufficientStorage)
+				return
+			}
 			http.Error(w, "Failed to process CR2 file", http.StatusInternalServerError)
 			return
 		}
@@ -835,40 +1181,262 @@ func imageHandler(w http.ResponseWriter, r *http.Request) {
 	http.ServeFile(w, r, fullPath)
 }
 
+// All routes of the web UI and API
+func newMux() *http.ServeMux {
+	mux := http.NewServeMux()
+
+	// OpenID Connect login
+	mux.HandleFunc("/auth/login", oidcLoginHandler)
+	mux.HandleFunc("/auth/callback", oidcCallbackHandler)
+	mux.HandleFunc("/auth/logout", oidcLogoutHandler)
+	mux.HandleFunc("/auth/me", oidcMeHandler)
+
+	// API endpoints
+	handleAPI(mux, "/health", healthHandler)
+	handleAPI(mux, "/version", versionHandler)
+	handleAPI(mux, "/csrf", csrfHandler)
+	handleAPI(mux, "/openapi.json", openAPIHandler)
+	handleAPI(mux, "/workspaces", requireCSRF(workspacesHandler))
+	handleAPI(mux, "/reload", requireCSRF(reloadHandler))
+	handleAPI(mux, "/write-back", requireStorage(destructive(writeBackHandler)))
+	handleAPI(mux, "/prune", requireStorage(pruneHandler))
+	handleAPI(mux, "/validation", validationHandler)
+	handleAPI(mux, "/exif-errors", exifErrorsHandler)
+	handleAPI(mux, "/group", requireStorage(groupHandler))
+	handleAPI(mux, "/groups", groupsHandler)
+	handleAPI(mux, "/progress", progressHandler)
+	handleAPI(mux, "/group/next", requireStorage(nextGroupHandler))
+	handleAPI(mux, "/refresh", requireStorage(refreshHandler))
+	handleAPI(mux, "/group/{idx}/status", groupStatusHandler)
+	handleAPI(mux, "/group/{idx}/claim", groupClaimHandler)
+	handleAPI(mux, "/claims", claimsHandler)
+	handleAPI(mux, "/events", eventsHandler)
+	handleAPI(mux, "/search", searchHandler)
+	handleAPI(mux, "/sample", sampleHandler)
+	handleAPI(mux, "/stats", requireStorage(statsHandler))
+	handleAPI(mux, "/simulate", requireStorage(simulateHandler))
+	handleAPI(mux, "/queues", queuesHandler)
+	handleAPI(mux, "/queues/{name}", queueHandler)
+	handleAPI(mux, "/queues/{name}/next", queueNextHandler)
+	handleAPI(mux, "/sessions/{name}", sessionHandler)
+	handleAPI(mux, "/sessions/{name}/next", sessionNextHandler)
+	handleAPI(mux, "/sessions/{name}/start", sessionStartHandler)
+	handleAPI(mux, "/sessions/{name}/stop", sessionStopHandler)
+	handleAPI(mux, "/delete", requireStorage(destructive(deleteHandler)))
+	handleAPI(mux, "/delete-batch", requireStorage(destructive(deleteBatchHandler)))
+	handleAPI(mux, "/move", requireStorage(destructive(moveHandler)))
+	handleAPI(mux, "/group/decide", requireStorage(destructive(decideHandler)))
+	handleAPI(mux, "/resolve-group", requireStorage(destructive(resolveGroupHandler)))
+	handleAPI(mux, "/dedupe", requireStorage(destructive(blockDedupeHandler)))
+	handleAPI(mux, "/stage", requireStorage(stageHandler))
+	handleAPI(mux, "/session/export", stateExportHandler)
+	handleAPI(mux, "/session/import", destructive(stateImportHandler))
+	handleAPI(mux, "/commit", requireStorage(destructive(commitHandler)))
+	handleAPI(mux, "/plan/export", requireStorage(planExportHandler))
+	handleAPI(mux, "/group/zip", requireStorage(groupZipHandler))
+	handleAPI(mux, "/group/merge-metadata", requireStorage(destructive(mergeMetadataHandler)))
+	handleAPI(mux, "/scan", requireStorage(requireCSRF(scanHandler)))
+	handleAPI(mux, "/history", historyHandler)
+	handleAPI(mux, "/redundant-dirs", requireStorage(destructive(redundantDirsHandler)))
+	handleAPI(mux, "/screenshots", requireStorage(destructive(screenshotsHandler)))
+	handleAPI(mux, "/snapshot-rules", requireStorage(destructive(snapshotRulesHandler)))
+	handleAPI(mux, "/empty-dirs", requireStorage(destructive(emptyDirsHandler)))
+	handleAPI(mux, "/crop", requireStorage(cropHandler))
+	handleAPI(mux, "/compare", requireStorage(compareHandler))
+	handleAPI(mux, "/hashes", requireStorage(hashesHandler))
+	handleAPI(mux, "/hashes/compare", requireStorage(hashCompareHandler))
+	handleAPI(mux, "/lookup", requireStorage(lookupHandler))
+	handleAPI(mux, "/open-link", requireStorage(openLinkHandler))
+	handleAPI(mux, "/recently-deleted", recentlyDeletedHandler)
+	handleAPI(mux, "/recently-deleted/{id}/thumbnail", recentThumbnailHandler)
+	handleAPI(mux, "/backups", destructive(backupsHandler))
+	handleAPI(mux, "/budget", budgetHandler)
+	handleAPI(mux, "/undo-stack", requireStorage(destructive(undoStackHandler)))
+	handleAPI(mux, "/undo", requireStorage(destructive(undoHandler)))
+	handleAPI(mux, "/restore", requireStorage(destructive(restoreHandler)))
+
+	// Profiling, with -debug
+	registerDebug(mux)
+
+	// Static file endpoints (embedded)
+	mux.HandleFunc("/", indexHandler)
+	mux.HandleFunc("/style.css", styleHandler)
+	mux.HandleFunc("/script.js", scriptHandler)
+
+	// Image serving with CR2 conversion support
+	mux.HandleFunc("/images/", requireStorage(imageHandler))
+	return mux
+}
+
 func main() {
 	flag.StringVar(&imageRoot, "imagepath", "", "Root path for images to serve")
-	flag.StringVar(&duplicatesFile, "duplicates", "groups.json", "Path to JSON file with duplicate groups")
+	duplicatesFile = "groups.json"
+	flag.Var(&duplicatesFlag{}, "duplicates", "Path to JSON file with duplicate groups (default groups.json), or - to read them from stdin (e.g. piped from czkawka_cli). Give it more than once, or a comma-separated list, to review several files as one, e.g. separate per-year scans")
+	flag.StringVar(&host, "host", "127.0.0.1", "Address to listen on; use 0.0.0.0 (or a LAN address) to let other machines in, ideally with -api-token or -oidc-issuer")
 	flag.StringVar(&port, "port", "8080", "Port to listen on")
+	flag.StringVar(&listenAddr, "listen", "", "Listen on this address instead of -host and -port: host:port, or unix:/path/to.sock for a reverse proxy on the same host")
+	flag.StringVar(&socketMode, "socket-mode", "0660", "File mode of the -listen unix socket, e.g. 0666 if the proxy runs as another user outside the socket's group")
+	flag.BoolVar(&lazyGroups, "lazy", false, "Index the duplicates file on disk and read groups on demand (for exports larger than memory)")
+	flag.StringVar(&czkawkaCmd, "czkawka", "czkawka_cli", "czkawka_cli binary used for rescans via /api/scan")
+	flag.StringVar(&stateDir, "state-dir", "", "Directory for persistent state such as the action history (default: the duplicates file's directory)")
+	flag.StringVar(&trashDirFlag, "trash-dir", "", "Move deleted files into this directory (keeping their paths below -imagepath) instead of deleting them for good")
+	flag.StringVar(&quarantineDirFlag, "quarantine-dir", "", "Directory /api/move puts files in, keeping their paths below -imagepath (default: quarantine in -state-dir)")
+	flag.BoolVar(&xdgTrash, "xdg-trash", false, "Move deleted files to the desktop trash (freedesktop.org Trash spec) instead of deleting them for good")
+	flag.BoolVar(&hardlinkMode, "hardlink", false, "Replace duplicates with hardlinks to the kept file instead of deleting them when de-duping a group")
+	flag.StringVar(&auditLogPath, "audit-log", "", "Append a JSON line for every file deleted, trashed or hardlinked to this file (default: audit.jsonl in -state-dir)")
+	flag.IntVar(&undoDepth, "undo-depth", 50, "Number of reversible operations kept on the undo stack")
+	flag.StringVar(&readOnlyFlag, "readonly", "", "Comma-separated directories (relative to -imagepath or absolute) whose files must never be deleted or changed, e.g. a mounted backup drive")
+	flag.IntVar(&backupKeep, "backup-keep", 10, "Number of automatic state backups to keep (0 = no backups)")
+	flag.Int64Var(&minCacheFreeMB, "min-cache-free-mb", 512, "Refuse CR2 conversions and crops while the temp directory's filesystem has less free space than this")
+	flag.StringVar(&validateMode, "validate", "sample", "Check on startup that the files in the duplicates file exist and are readable: none, sample or all")
+	flag.IntVar(&validateSample, "validate-sample", 1000, "Number of files checked with -validate sample")
+	flag.BoolVar(&dropMissing, "drop-missing", false, "Hide files found missing by the startup validation from the groups")
+	flag.IntVar(&maxDeletesPerDay, "max-deletes-per-day", 0, "Refuse to delete, trash or hardlink more files than this per day (0 = no limit)")
+	flag.Int64Var(&maxDeleteMBPerDay, "max-delete-mb-per-day", 0, "Refuse to delete, trash or hardlink more than this many MB per day (0 = no limit)")
+	flag.StringVar(&budgetOverrideToken, "budget-override-token", "", "Secret that lets a request exceed the daily deletion budget when sent in the X-Budget-Override header")
+	flag.BoolVar(&pruneEmptyDirs, "prune-empty-dirs", false, "Remove directories left empty after deleting or moving files")
+	flag.DurationVar(&exitAfterIdle, "exit-after-idle", 0, "Save state, clean up and exit after this long without requests, e.g. 30m (0 = never)")
+	flag.BoolVar(&agentMode, "agent", false, "Run as the companion agent on a workstation, opening files below -imagepath (the library's local mount) in a local viewer")
+	flag.StringVar(&agentSecret, "agent-secret", "", "Secret shared by the server and its companion agent; enables /api/open-link")
+	flag.StringVar(&agentURL, "agent-url", "http://127.0.0.1:8765", "Where browsers reach the companion agent")
+	flag.StringVar(&agentListen, "agent-listen", "127.0.0.1:8765", "Address the companion agent listens on (with -agent)")
+	flag.StringVar(&agentViewer, "agent-viewer", "", "Command the companion agent opens files with (default: open, xdg-open or start)")
+	flag.StringVar(&workspacesFile, "workspaces", "", "JSON file listing several datasets to serve, each with its own name, imagepath, duplicates file, state_dir, readonly and rules (replaces -imagepath and -duplicates)")
+	flag.StringVar(&backgroundHours, "background-hours", "", "Only run rescan hashing and file validation within these daily windows, e.g. 01:00-06:00,22:00-23:30 (default: any time)")
+	flag.Float64Var(&backgroundMaxLoad, "background-max-load", 0, "Pause rescan hashing and file validation while the 1-minute load average is above this (Linux only, 0 = no limit)")
+	flag.StringVar(&apiToken, "api-token", "", "Require this token on every request, as an \"Authorization: Bearer\" header or ?token= parameter; \"auto\" generates one and prints it at startup (default: no token)")
+	flag.StringVar(&tlsCert, "tls-cert", "", "Serve HTTPS with this PEM certificate (chain) file; needs -tls-key")
+	flag.StringVar(&tlsKey, "tls-key", "", "PEM private key for -tls-cert")
+	flag.StringVar(&redirectPort, "http-redirect-port", "", "With -tls-cert, also listen for plain HTTP on this port and redirect it to HTTPS, e.g. 80")
+	flag.StringVar(&oidcIssuer, "oidc-issuer", "", "Require logging in with this OpenID Connect provider, e.g. https://auth.example.com (Authelia, Keycloak, ...)")
+	flag.StringVar(&oidcClientID, "oidc-client-id", "", "Client ID registered with the -oidc-issuer")
+	flag.StringVar(&oidcClientSecret, "oidc-client-secret", "", "Client secret registered with the -oidc-issuer")
+	flag.StringVar(&oidcRedirectURL, "oidc-redirect-url", "", "Redirect URL registered with the -oidc-issuer (default: /auth/callback on the host the browser used)")
+	flag.StringVar(&oidcAllowed, "oidc-allowed", "", "Comma-separated emails or usernames allowed to log in with -oidc-issuer (default: anyone the provider lets in)")
+	flag.BoolVar(&readOnlyMode, "read-only", false, "Review mode: refuse every request that would delete, move or change files (403), while groups can still be browsed, scored, staged and exported")
+	flag.StringVar(&basePathFlag, "base-path", "", "URL prefix the UI is served under behind a reverse proxy that passes it on, e.g. /dupes (a proxy that strips the prefix can send X-Forwarded-Prefix instead)")
+	flag.IntVar(&rateLimit, "rate-limit", 0, "Refuse (429) requests that delete, move or change files beyond this many per minute from one client, after a burst of as many (0 = no limit)")
+	flag.IntVar(&maxConcurrent, "max-concurrent", 4, "Refuse (429) requests that delete, move or change files while this many are already running (0 = no limit)")
+	flag.StringVar(&logLevel, "log-level", "info", "Log entries at this level and above: debug, info, warn or error")
+	flag.StringVar(&logFormat, "log-format", "text", "Log as text (key=value) or json lines")
+	flag.BoolVar(&debugMode, "debug", false, "Serve Go profiling data under /debug/pprof/ and runtime stats (goroutines, cache sizes, temp dir usage) at /api/debug/stats")
+	flag.StringVar(&replayFile, "replay", "", "On startup, re-apply the decisions in this journal (journal.jsonl from a state directory) to the groups loaded, skipping those already carried out, e.g. after moving the library to a new machine")
+	flag.BoolVar(&watchFiles, "watch", true, "Watch the image root for files deleted or renamed outside the tool, leave them out of groups and announce them on /api/events")
+	flag.StringVar(&writeBackMode, "write-back", "", "As files are deleted, write the duplicates that are left, without them and without groups down to one file: \"remaining\" to <name>.remaining.json next to the duplicates file, \"in-place\" over the duplicates file itself")
+	flag.BoolVar(&forceLock, "force", false, "Start even if another instance holds the lock next to the duplicates file (<file>.lock), e.g. one on another machine that is gone")
 	flag.Parse()
-	if imageRoot == "" {
-		log.Fatal("-imagepath flag is required")
+	if err := setupLogging(); err != nil {
+		fatal(err.Error())
+	}
+	basePathFlag = normaliseBasePath(basePathFlag)
+	if imageRoot == "" && workspacesFile == "" {
+		fatal("-imagepath flag is required")
+	}
+	var err error
+	if backgroundWindows, err = parseBackgroundHours(backgroundHours); err != nil {
+		fatal("invalid -background-hours", "err", err)
+	}
+	if (tlsCert == "") != (tlsKey == "") {
+		fatal("-tls-cert and -tls-key must be given together")
+	}
+	if oidcEnabled() && oidcClientID == "" {
+		fatal("-oidc-issuer needs -oidc-client-id")
+	}
+	if writeBackMode != "" && writeBackMode != writeBackRemaining && writeBackMode != writeBackInPlace {
+		fatal("-write-back must be remaining or in-place")
+	}
+	if redirectPort != "" && !tlsEnabled() {
+		fatal("-http-redirect-port needs -tls-cert and -tls-key")
+	}
+	if agentMode {
+		fatal("companion agent stopped", "err", runAgent())
+	}
+	if apiToken == "auto" {
+		if apiToken, err = generateAPIToken(); err != nil {
+			fatal("failed to generate an API token", "err", err)
+		}
+		logFor("auth").Info("generated API token", "token", apiToken, "url", "http://"+net.JoinHostPort(host, port)+"/?token="+apiToken)
 	}
 
 	// Initialize temp directory for CR2 conversions
-	var err error
 	tempDir, err = os.MkdirTemp("", "dupedeleter_cr2_*")
 	if err != nil {
-		log.Fatalf("Failed to create temp directory: %v", err)
+		fatal("failed to create temp directory", "err", err)
 	}
-	log.Printf("Using temp directory for CR2 conversions: %s", tempDir)
+	logFor("convert").Info("using temp directory for CR2 conversions", "dir", tempDir)
 
 	// Cleanup temp files on exit
 	defer cleanupTempFiles()
 
-	loadGroups()
+	if duplicatesFile == stdinDuplicates && workspacesFile == "" {
+		if info, err := os.Stdin.Stat(); err == nil && info.Mode()&os.ModeCharDevice != 0 {
+			fatal("-duplicates - reads the groups from stdin, but nothing is piped in")
+		}
+		if stateDir == "" {
+			stateDir = "." // The duplicates file's directory would be a guess
+		}
+		if duplicatesFile, err = spoolDuplicates(os.Stdin, stateDir); err != nil {
+			fatal("failed to read duplicates from stdin", "err", err)
+		}
+	}
+	if err := loadWorkspaces(); err != nil {
+		fatal("failed to load workspaces", "err", err)
+	}
+	workspaces[0].apply()
+	if err := openDataset(); err != nil {
+		fatal("failed to open dataset", "err", err)
+	}
+	if replayFile != "" {
+		if readOnlyMode {
+			fatal("-replay can't be used with -read-only")
+		}
+		if _, err := replayJournal(replayFile); err != nil {
+			fatal("failed to replay decisions journal", "file", replayFile, "err", err)
+		}
+	}
 
-	// API endpoints
-	http.HandleFunc("/api/group", groupHandler)
-	http.HandleFunc("/api/delete", deleteHandler)
+	switch validateMode {
+	case "none":
+	case "sample", "all":
+		go validateGroups(validateMode)
+	default:
+		fatal("-validate must be none, sample or all")
+	}
+	resumeScan()
 
-	// Static file endpoints (embedded)
-	http.HandleFunc("/", indexHandler)
-	http.HandleFunc("/style.css", styleHandler)
-	http.HandleFunc("/script.js", scriptHandler)
+	ln, err := listen()
+	if err != nil {
+		fatal("failed to listen", "err", err)
+	}
+	addr := ln.Addr().String()
+	if tcp, ok := ln.Addr().(*net.TCPAddr); ok && !tcp.IP.IsLoopback() && apiToken == "" && !oidcEnabled() {
+		logFor("server").Warn("listening without -api-token or -oidc-issuer: anyone who can reach it can delete files", "addr", addr)
+	}
+	server := &http.Server{Handler: trackActivity(withRequestID(withBasePath(requireAuth(withWorkspace(newMux())))))}
+	server.RegisterOnShutdown(closeEventStreams)
+	if exitAfterIdle > 0 {
+		go exitWhenIdle(server)
+	}
+	go shutdownOnSignal(server)
+	go reloadOnSignal()
 
-	// Image serving with CR2 conversion support
-	http.HandleFunc("/images/", imageHandler)
+	if tlsEnabled() {
+		if redirectPort != "" {
+			go redirectToHTTPS()
+		}
+		logFor("server").Info("listening with TLS", "addr", addr, "root", imageRoot, "duplicates", duplicatesFile)
+		err = server.ServeTLS(ln, tlsCert, tlsKey)
+	} else {
+		logFor("server").Info("listening", "addr", addr, "root", imageRoot, "duplicates", duplicatesFile)
+		err = server.Serve(ln)
+	}
+	if err != http.ErrServerClosed {
+		fatal("server failed", "err", err)
+	}
 
-	log.Printf("Listening on :%s, serving images from %s and loading duplicates from %s", port, imageRoot, duplicatesFile)
-	log.Fatal(http.ListenAndServe(":"+port, nil))
+	// Clean shutdown: flush state to disk before the temp files are removed,
+	// once a write-back in progress is done
+	workspaceMu.Lock()
+	closeDataset()
+	logFor("server").Info("shut down cleanly")
 }
@@ -0,0 +1,183 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/csv"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// Whether a (decompressed) duplicates file is dupeGuru's saved results
+// (File > Save Results, XML)
+func isDupeguruXML(r *bufio.Reader) bool {
+	head, _ := r.Peek(textResultsSniff)
+	head = bytes.TrimLeft(head, "\ufeff \t\r\n")
+	return bytes.HasPrefix(head, []byte("<")) && bytes.Contains(head, []byte("<results"))
+}
+
+// Whether a (decompressed) duplicates file is dupeGuru's CSV export, whose
+// header names the group and the file of every row
+func isDupeguruCSV(r *bufio.Reader) bool {
+	head, _ := r.Peek(textResultsSniff)
+	head = bytes.TrimLeft(head, "\ufeff")
+	header, _, _ := bytes.Cut(head, []byte("\n"))
+	return bytes.HasPrefix(header, []byte("Group ID,")) &&
+		bytes.Contains(header, []byte("Filename")) && bytes.Contains(header, []byte("Folder"))
+}
+
+// A group of dupeGuru's saved results. Its reference, the file dupeGuru
+// keeps, comes first.
+type dupeguruGroup struct {
+	Files []struct {
+		Path string `xml:"path,attr"`
+	} `xml:"file"`
+	Matches []struct {
+		First      int `xml:"first,attr"`
+		Second     int `xml:"second,attr"`
+		Percentage int `xml:"percentage,attr"`
+	} `xml:"match"`
+}
+
+// Groups of dupeGuru's saved results. Only paths and match percentages are
+// in there, so size and modified date come from disk, the reference is
+// marked original and the similarity is 100 less the file's best match.
+type dupeguruXMLParser struct {
+	dec *xml.Decoder
+}
+
+func newDupeguruXMLParser(r io.Reader) *dupeguruXMLParser {
+	return &dupeguruXMLParser{dec: xml.NewDecoder(r)}
+}
+
+func (p *dupeguruXMLParser) group() ([]Image, error) {
+	for {
+		tok, err := p.dec.Token()
+		if err != nil {
+			return nil, err // io.EOF at the end
+		}
+		start, ok := tok.(xml.StartElement)
+		if !ok || start.Name.Local != "group" {
+			continue
+		}
+		var g dupeguruGroup
+		if err := p.dec.DecodeElement(&g, &start); err != nil {
+			return nil, err
+		}
+		if len(g.Files) < 2 {
+			continue
+		}
+		best := make([]int, len(g.Files))
+		for _, m := range g.Matches {
+			for _, i := range []int{m.First, m.Second} {
+				if i >= 0 && i < len(best) {
+					best[i] = max(best[i], m.Percentage)
+				}
+			}
+		}
+		group := make([]Image, len(g.Files))
+		for i, f := range g.Files {
+			group[i] = statImage(f.Path)
+			group[i].Original = i == 0
+			if i > 0 && best[i] > 0 {
+				group[i].Similarity = 100 - best[i]
+			}
+		}
+		return group, nil
+	}
+}
+
+// Groups of dupeGuru's CSV export: rows with the same group ID, the
+// reference first. Which columns there are depends on what was shown, so
+// only Group ID, Filename and Folder are relied on; Dimensions and Match %
+// are used when present.
+type dupeguruCSVParser struct {
+	rows    *csv.Reader
+	columns map[string]int
+	pending []string // First row of the next group, already read
+}
+
+func newDupeguruCSVParser(r io.Reader) *dupeguruCSVParser {
+	rows := csv.NewReader(r)
+	rows.FieldsPerRecord = -1
+	return &dupeguruCSVParser{rows: rows}
+}
+
+func (p *dupeguruCSVParser) group() ([]Image, error) {
+	if p.columns == nil {
+		header, err := p.rows.Read()
+		if err != nil {
+			return nil, err
+		}
+		p.columns = make(map[string]int)
+		for i, name := range header {
+			p.columns[strings.TrimPrefix(strings.TrimSpace(name), "\ufeff")] = i
+		}
+		for _, name := range []string{"Group ID", "Filename", "Folder"} {
+			if _, ok := p.columns[name]; !ok {
+				return nil, fmt.Errorf("dupeGuru CSV without a %q column", name)
+			}
+		}
+	}
+	var group []Image
+	id := ""
+	if p.pending != nil {
+		group = append(group, p.image(p.pending, true))
+		id = p.field(p.pending, "Group ID")
+		p.pending = nil
+	}
+	for {
+		row, err := p.rows.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		if rowID := p.field(row, "Group ID"); len(group) > 0 && rowID != id {
+			if len(group) > 1 {
+				p.pending = row
+				return group, nil
+			}
+			group = nil // A lone file is no duplicate
+		}
+		group = append(group, p.image(row, len(group) == 0))
+		id = p.field(row, "Group ID")
+	}
+	if len(group) > 1 {
+		return group, nil
+	}
+	return nil, io.EOF
+}
+
+func (p *dupeguruCSVParser) field(row []string, name string) string {
+	if i, ok := p.columns[name]; ok && i < len(row) {
+		return strings.TrimSpace(row[i])
+	}
+	return ""
+}
+
+func (p *dupeguruCSVParser) image(row []string, ref bool) Image {
+	img := statImage(filepath.Join(p.field(row, "Folder"), p.field(row, "Filename")))
+	img.Original = ref
+	fmt.Sscanf(p.field(row, "Dimensions"), "%d x %d", &img.Width, &img.Height)
+	if match, err := strconv.Atoi(p.field(row, "Match %")); err == nil && !ref {
+		img.Similarity = 100 - match
+	}
+	return img
+}
+
+// A file known only by its path, with its size and modified date from disk
+func statImage(path string) Image {
+	img := Image{Path: path}
+	if info, err := os.Stat(path); err == nil {
+		img.Size = info.Size()
+		img.ModifiedDate = info.ModTime().Unix()
+	}
+	return img
+}
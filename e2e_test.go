@@ -0,0 +1,2640 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"encoding/base64"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+// POST a JSON body as the UI does, decode the JSON reply into out (if given)
+// and return the status
+func postJSON(t *testing.T, url string, body, out interface{}) int {
+	t.Helper()
+	data, err := json.Marshal(body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req, err := http.NewRequest("POST", url, bytes.NewReader(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set(csrfHeader, csrfToken())
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if out != nil && resp.Header.Get("Content-Type") == "application/json" {
+		if err := json.NewDecoder(resp.Body).Decode(out); err != nil {
+			t.Fatalf("POST %s: %v", url, err)
+		}
+	}
+	return resp.StatusCode
+}
+
+func getJSON(t *testing.T, url string, out interface{}) int {
+	t.Helper()
+	resp, err := http.Get(url)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == 200 && out != nil {
+		if err := json.NewDecoder(resp.Body).Decode(out); err != nil {
+			t.Fatalf("GET %s: %v", url, err)
+		}
+	}
+	return resp.StatusCode
+}
+
+func exists(path string) bool {
+	_, err := os.Stat(path)
+	return err == nil
+}
+
+// A camera original, a smaller copy saved from WhatsApp and a raw file
+var holidayGroup = []fixtureImage{
+	{Name: "camera/DSC_0001.jpg", Width: 1200, Height: 900, Seed: 1, Make: "NIKON", Model: "D750", Taken: "2020:07:01 12:00:00", XMPSubject: "Holiday"},
+	{Name: "phone/IMG-20200702-WA0001.jpg", Width: 800, Height: 600, Seed: 1, Quality: 60},
+	{Name: "camera/DSC_0001.cr2", Width: 1200, Height: 900, Seed: 1, Make: "NIKON", Model: "D750", Raw: true},
+}
+
+var beachGroup = []fixtureImage{
+	{Name: "camera/DSC_0002.jpg", Width: 640, Height: 480, Seed: 2},
+	{Name: "backup/DSC_0002.jpg", Width: 640, Height: 480, Seed: 2},
+}
+
+func TestGroupScoresCameraOriginalFirst(t *testing.T) {
+	lib := newFixtureLibrary(t, [][]fixtureImage{holidayGroup})
+	server := newTestServer(t, lib)
+
+	var group struct {
+		Images []struct {
+			Path       string   `json:"path"`
+			Kind       string   `json:"kind"`
+			Subject    string   `json:"subject"`
+			CameraMake string   `json:"camera_make"`
+			Score      int      `json:"score"`
+			Breakdown  []string `json:"breakdown"`
+		} `json:"images"`
+	}
+	if status := getJSON(t, server.URL+"/api/group?idx=0", &group); status != 200 {
+		t.Fatalf("GET /api/group: status %d", status)
+	}
+	if len(group.Images) != 3 {
+		t.Fatalf("got %d images, want 3", len(group.Images))
+	}
+	best := group.Images[0]
+	if best.Path != "camera/DSC_0001.jpg" || best.CameraMake != "NIKON" || best.Subject != "Holiday" {
+		t.Errorf("keeper is %+v, want the camera original with its EXIF and XMP", best)
+	}
+	for _, img := range group.Images {
+		if img.Path == "phone/IMG-20200702-WA0001.jpg" && img.Kind != kindMessenger {
+			t.Errorf("WhatsApp copy has kind %q, want %q", img.Kind, kindMessenger)
+		}
+		if img.Score >= best.Score && img.Path != best.Path {
+			t.Errorf("%s scores %d, not below the original's %d (%v)", img.Path, img.Score, best.Score, img.Breakdown)
+		}
+	}
+
+	if status := getJSON(t, server.URL+"/api/group?idx=0&strategy=raw-first", &group); status != 200 {
+		t.Fatalf("GET /api/group?strategy=raw-first: status %d", status)
+	}
+	if group.Images[0].Path != "camera/DSC_0001.cr2" {
+		t.Errorf("raw-first keeper is %s, want the CR2", group.Images[0].Path)
+	}
+}
+
+func TestDeleteAndUndo(t *testing.T) {
+	lib := newFixtureLibrary(t, [][]fixtureImage{beachGroup})
+	server := newTestServer(t, lib)
+	trashDirFlag = t.TempDir()
+	path := lib.path("backup/DSC_0002.jpg")
+
+	var result struct {
+		Success bool   `json:"success"`
+		Error   string `json:"error"`
+	}
+	postJSON(t, server.URL+"/api/delete", map[string]string{"path": path}, &result)
+	if !result.Success || exists(path) {
+		t.Fatalf("delete failed: %+v", result)
+	}
+	if !exists(filepath.Join(trashDirFlag, "backup/DSC_0002.jpg")) {
+		t.Error("deleted file is not in the trash")
+	}
+
+	var restorable []Restorable
+	getJSON(t, server.URL+"/api/restore", &restorable)
+	if len(restorable) != 1 || restorable[0].Path != path {
+		t.Fatalf("restorable files: %+v", restorable)
+	}
+	if status := postJSON(t, server.URL+"/api/undo", nil, nil); status != 200 {
+		t.Fatalf("POST /api/undo: status %d", status)
+	}
+	if !exists(path) {
+		t.Error("undo did not put the file back")
+	}
+	if status := postJSON(t, server.URL+"/api/undo", nil, nil); status != 404 {
+		t.Errorf("second undo: status %d, want 404", status)
+	}
+}
+
+func TestMoveToQuarantine(t *testing.T) {
+	lib := newFixtureLibrary(t, [][]fixtureImage{holidayGroup})
+	server := newTestServer(t, lib)
+	quarantineDirFlag = t.TempDir()
+
+	var moved struct {
+		Success bool   `json:"success"`
+		MovedTo string `json:"moved_to"`
+	}
+	postJSON(t, server.URL+"/api/move", map[string]string{"path": "phone/IMG-20200702-WA0001.jpg"}, &moved)
+	if want := filepath.Join(quarantineDirFlag, "phone/IMG-20200702-WA0001.jpg"); !moved.Success || moved.MovedTo != want || !exists(want) {
+		t.Fatalf("move: %+v", moved)
+	}
+	var group struct {
+		Images []ImageWithExif `json:"images"`
+		Moved  []MovedFile     `json:"moved"`
+	}
+	getJSON(t, server.URL+"/api/group?idx=0", &group)
+	if len(group.Images) != 2 || len(group.Moved) != 1 || group.Moved[0].MovedTo != moved.MovedTo {
+		t.Errorf("group after move: %d images, moved %+v", len(group.Images), group.Moved)
+	}
+
+	postJSON(t, server.URL+"/api/undo", nil, nil)
+	getJSON(t, server.URL+"/api/group?idx=0", &group)
+	if !exists(lib.path("phone/IMG-20200702-WA0001.jpg")) || len(group.Images) != 3 || len(group.Moved) != 0 {
+		t.Errorf("undo did not bring the file back: %d images, moved %+v", len(group.Images), group.Moved)
+	}
+}
+
+func TestDeleteRefusesFilesOutsideLibrary(t *testing.T) {
+	lib := newFixtureLibrary(t, [][]fixtureImage{beachGroup})
+	server := newTestServer(t, lib)
+	outside := filepath.Join(t.TempDir(), "precious.jpg")
+	if err := os.WriteFile(outside, []byte("keep me"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	var result struct {
+		Success bool `json:"success"`
+	}
+	postJSON(t, server.URL+"/api/delete", map[string]string{"path": outside}, &result)
+	if result.Success || !exists(outside) {
+		t.Error("deleted a file outside the image root")
+	}
+	rel, _ := filepath.Rel(lib.Root, outside)
+	postJSON(t, server.URL+"/api/delete", map[string]string{"path": lib.Root + "/" + rel}, &result)
+	if result.Success || !exists(outside) {
+		t.Error("deleted a file outside the image root through ../")
+	}
+
+	// Nor through a symlink inside the library that points out of it
+	link := lib.path("link.jpg")
+	if err := os.Symlink(outside, link); err != nil {
+		t.Fatal(err)
+	}
+	postJSON(t, server.URL+"/api/delete", map[string]string{"path": link}, &result)
+	if result.Success || !exists(outside) {
+		t.Error("deleted a file outside the image root through a symlink")
+	}
+	resp, err := http.Get(server.URL + "/images/link.jpg")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != 403 {
+		t.Errorf("serving a symlink out of the library: status %d", resp.StatusCode)
+	}
+}
+
+func TestAPITokenIsRequired(t *testing.T) {
+	lib := newFixtureLibrary(t, [][]fixtureImage{beachGroup})
+	server := newTestServer(t, lib)
+	apiToken = "s3cret"
+
+	if status := getJSON(t, server.URL+"/api/group?idx=0", nil); status != 401 {
+		t.Errorf("without a token: status %d", status)
+	}
+	if status := getJSON(t, server.URL+"/api/group?idx=0&token=wrong", nil); status != 401 {
+		t.Errorf("with a wrong token: status %d", status)
+	}
+	req, _ := http.NewRequest("GET", server.URL+"/api/group?idx=0", nil)
+	req.Header.Set("Authorization", "Bearer s3cret")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != 200 {
+		t.Errorf("with a bearer token: status %d", resp.StatusCode)
+	}
+
+	// A browser passing ?token= once keeps it as a cookie
+	resp, err = http.Get(server.URL + "/?token=s3cret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	cookies := resp.Cookies()
+	if resp.StatusCode != 200 || len(cookies) != 1 {
+		t.Fatalf("with ?token=: status %d, cookies %v", resp.StatusCode, cookies)
+	}
+	req, _ = http.NewRequest("GET", server.URL+"/images/camera/DSC_0002.jpg", nil)
+	req.AddCookie(cookies[0])
+	if resp, err = http.DefaultClient.Do(req); err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != 200 {
+		t.Errorf("with the cookie: status %d", resp.StatusCode)
+	}
+}
+
+func TestOIDCLogin(t *testing.T) {
+	lib := newFixtureLibrary(t, [][]fixtureImage{beachGroup})
+	server := newTestServer(t, lib)
+
+	// A stand-in identity provider that logs everyone in as alice
+	var nonce string
+	provider := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/.well-known/openid-configuration":
+			json.NewEncoder(w).Encode(map[string]string{
+				"issuer":                 "http://" + r.Host,
+				"authorization_endpoint": "http://" + r.Host + "/authorize",
+				"token_endpoint":         "http://" + r.Host + "/token",
+			})
+		case "/token":
+			if id, secret, _ := r.BasicAuth(); id != "webui" || secret != "s3cret" || r.FormValue("code") != "the-code" || r.FormValue("code_verifier") == "" {
+				http.Error(w, `{"error":"invalid_grant"}`, 400)
+				return
+			}
+			claims, _ := json.Marshal(map[string]interface{}{"iss": "http://" + r.Host, "aud": "webui", "sub": "1", "email": "alice@example.com", "nonce": nonce, "exp": time.Now().Add(time.Hour).Unix()})
+			json.NewEncoder(w).Encode(map[string]string{"id_token": "e30." + base64.RawURLEncoding.EncodeToString(claims) + ".sig"})
+		}
+	}))
+	defer provider.Close()
+	oidcIssuer, oidcClientID, oidcClientSecret = provider.URL, "webui", "s3cret"
+
+	client := &http.Client{CheckRedirect: func(*http.Request, []*http.Request) error { return http.ErrUseLastResponse }}
+	if status := getJSON(t, server.URL+"/api/group?idx=0", nil); status != 401 {
+		t.Errorf("API without a session: status %d", status)
+	}
+	resp, err := client.Get(server.URL + "/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != 302 || resp.Header.Get("Location") != "/auth/login?next=%2F" {
+		t.Fatalf("UI without a session: status %d to %s", resp.StatusCode, resp.Header.Get("Location"))
+	}
+
+	resp, err = client.Get(server.URL + "/auth/login?next=%2F")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	authorize, _ := url.Parse(resp.Header.Get("Location"))
+	nonce = authorize.Query().Get("nonce")
+	if authorize.Path != "/authorize" || nonce == "" {
+		t.Fatalf("login redirected to %s", authorize)
+	}
+
+	// Coming back with the code logs the browser in
+	req, _ := http.NewRequest("GET", server.URL+"/auth/callback?code=the-code&state="+authorize.Query().Get("state"), nil)
+	for _, c := range resp.Cookies() {
+		req.AddCookie(c)
+	}
+	if resp, err = client.Do(req); err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	var session *http.Cookie
+	for _, c := range resp.Cookies() {
+		if c.Name == sessionCookie {
+			session = c
+		}
+	}
+	if resp.StatusCode != 302 || session == nil {
+		t.Fatalf("callback: status %d, cookies %v", resp.StatusCode, resp.Cookies())
+	}
+	req, _ = http.NewRequest("GET", server.URL+"/auth/me", nil)
+	req.AddCookie(session)
+	if resp, err = client.Do(req); err != nil {
+		t.Fatal(err)
+	}
+	var me LoginSession
+	json.NewDecoder(resp.Body).Decode(&me)
+	resp.Body.Close()
+	if me.User != "alice@example.com" {
+		t.Errorf("logged in as %+v", me)
+	}
+
+	// Someone not on the allowed list gets no session
+	oidcAllowed = "bob@example.com"
+	resp, _ = client.Get(server.URL + "/auth/login")
+	resp.Body.Close()
+	authorize, _ = url.Parse(resp.Header.Get("Location"))
+	nonce = authorize.Query().Get("nonce")
+	req, _ = http.NewRequest("GET", server.URL+"/auth/callback?code=the-code&state="+authorize.Query().Get("state"), nil)
+	for _, c := range resp.Cookies() {
+		req.AddCookie(c)
+	}
+	if resp, err = client.Do(req); err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != 403 {
+		t.Errorf("login outside -oidc-allowed: status %d", resp.StatusCode)
+	}
+}
+
+func TestReadOnlyModeRefusesDeletes(t *testing.T) {
+	lib := newFixtureLibrary(t, [][]fixtureImage{beachGroup})
+	server := newTestServer(t, lib)
+	readOnlyMode = true
+
+	if status := postJSON(t, server.URL+"/api/delete", map[string]string{"path": lib.path("backup/DSC_0002.jpg")}, nil); status != 403 {
+		t.Errorf("delete: status %d", status)
+	}
+	if status := postJSON(t, server.URL+"/api/resolve-group", map[string]interface{}{"idx": 0, "keep": "camera/DSC_0002.jpg"}, nil); status != 403 {
+		t.Errorf("resolve-group: status %d", status)
+	}
+	if status := postJSON(t, server.URL+"/api/undo-stack", map[string]int64{"id": 1}, nil); status != 403 {
+		t.Errorf("undo-stack: status %d", status)
+	}
+	if status := postJSON(t, server.URL+"/api/session/import?replace=1", map[string]interface{}{}, nil); status != 403 {
+		t.Errorf("session import: status %d", status)
+	}
+	if status := postJSON(t, server.URL+"/api/write-back", nil, nil); status != 403 {
+		t.Errorf("write-back: status %d", status)
+	}
+	if !exists(lib.path("backup/DSC_0002.jpg")) {
+		t.Fatal("a file was deleted in read-only mode")
+	}
+
+	// Reviewing still works, up to exporting the plan
+	if status := getJSON(t, server.URL+"/api/group?idx=0", nil); status != 200 {
+		t.Errorf("group: status %d", status)
+	}
+	if status := postJSON(t, server.URL+"/api/stage", map[string]interface{}{"idx": 0, "keep": []string{"camera/DSC_0002.jpg"}, "delete": []string{"backup/DSC_0002.jpg"}}, nil); status != 200 {
+		t.Errorf("stage: status %d", status)
+	}
+	var plan struct {
+		Groups []PlannedGroup `json:"groups"`
+	}
+	if getJSON(t, server.URL+"/api/plan/export?format=json", &plan); len(plan.Groups) != 1 {
+		t.Errorf("plan: %+v", plan)
+	}
+}
+
+func TestServedUnderBasePath(t *testing.T) {
+	lib := newFixtureLibrary(t, [][]fixtureImage{beachGroup})
+	server := newTestServer(t, lib)
+	basePathFlag = "/dupes"
+
+	if status := getJSON(t, server.URL+"/dupes/api/group?idx=0", nil); status != 200 {
+		t.Errorf("API under the base path: status %d", status)
+	}
+	if status := getJSON(t, server.URL+"/api/group?idx=0", nil); status != 404 {
+		t.Errorf("API outside the base path: status %d", status)
+	}
+	page := func(url, prefix string) string {
+		req, _ := http.NewRequest("GET", url, nil)
+		if prefix != "" {
+			req.Header.Set("X-Forwarded-Prefix", prefix)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		var body bytes.Buffer
+		body.ReadFrom(resp.Body)
+		return body.String()
+	}
+	if body := page(server.URL+"/dupes", ""); !strings.Contains(body, `<base href="/dupes/">`) {
+		t.Errorf("UI under the base path:\n%s", body)
+	}
+
+	// A proxy that strips the prefix itself says what it was
+	basePathFlag = ""
+	if body := page(server.URL+"/dupes/", "/photos/dupes/"); !strings.Contains(body, `<base href="/photos/dupes/">`) {
+		t.Errorf("UI with X-Forwarded-Prefix:\n%s", body)
+	}
+}
+
+func TestDeletesNeedCSRFToken(t *testing.T) {
+	lib := newFixtureLibrary(t, [][]fixtureImage{beachGroup})
+	server := newTestServer(t, lib)
+	victim := lib.path("backup/DSC_0002.jpg")
+
+	// What a form on another site could make the browser send
+	resp, err := http.Post(server.URL+"/api/delete", "text/plain", strings.NewReader(`{"path": "`+victim+`"}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != 403 || !exists(victim) {
+		t.Errorf("delete without a CSRF token: status %d", resp.StatusCode)
+	}
+	req, _ := http.NewRequest("POST", server.URL+"/api/delete", strings.NewReader(`{"path": "`+victim+`"}`))
+	req.Header.Set(csrfHeader, csrfToken())
+	req.Header.Set("Origin", "https://evil.example.com")
+	if resp, err = http.DefaultClient.Do(req); err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != 403 || !exists(victim) {
+		t.Errorf("delete from another origin: status %d", resp.StatusCode)
+	}
+	// Nor can it rescan, reload, switch workspaces or rewrite the duplicates file
+	for _, path := range []string{"/api/scan", "/api/reload", "/api/workspaces", "/api/write-back"} {
+		if resp, err = http.Post(server.URL+path, "text/plain", strings.NewReader(`{}`)); err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != 403 {
+			t.Errorf("%s without a CSRF token: status %d", path, resp.StatusCode)
+		}
+	}
+
+	// The page and /api/csrf hand out the token
+	var csrf struct {
+		Token string `json:"token"`
+	}
+	getJSON(t, server.URL+"/api/csrf", &csrf)
+	if resp, err = http.Get(server.URL + "/"); err != nil {
+		t.Fatal(err)
+	}
+	var page bytes.Buffer
+	page.ReadFrom(resp.Body)
+	resp.Body.Close()
+	if csrf.Token == "" || !strings.Contains(page.String(), `<meta name="csrf-token" content="`+csrf.Token+`">`) {
+		t.Errorf("token %q not in the page", csrf.Token)
+	}
+	var result struct {
+		Success bool `json:"success"`
+	}
+	if postJSON(t, server.URL+"/api/delete", map[string]string{"path": victim}, &result); !result.Success || exists(victim) {
+		t.Error("delete with the CSRF token failed")
+	}
+}
+
+func TestDeletesAreRateLimited(t *testing.T) {
+	lib := newFixtureLibrary(t, [][]fixtureImage{holidayGroup})
+	server := newTestServer(t, lib)
+	rateLimit = 2
+
+	for i, name := range []string{"phone/IMG-20200702-WA0001.jpg", "camera/DSC_0001.cr2"} {
+		if status := postJSON(t, server.URL+"/api/delete", map[string]string{"path": lib.path(name)}, nil); status != 200 {
+			t.Fatalf("delete %d: status %d", i, status)
+		}
+	}
+	body, _ := json.Marshal(map[string]string{"path": lib.path("camera/DSC_0001.jpg")})
+	req, _ := http.NewRequest("POST", server.URL+"/api/delete", bytes.NewReader(body))
+	req.Header.Set(csrfHeader, csrfToken())
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != 429 || resp.Header.Get("Retry-After") != "30" || !exists(lib.path("camera/DSC_0001.jpg")) {
+		t.Errorf("third delete within a minute: status %d, Retry-After %q", resp.StatusCode, resp.Header.Get("Retry-After"))
+	}
+}
+
+func TestResolveGroupKeepsOne(t *testing.T) {
+	lib := newFixtureLibrary(t, [][]fixtureImage{beachGroup, holidayGroup})
+	server := newTestServer(t, lib)
+
+	var result DecideResult
+	status := postJSON(t, server.URL+"/api/resolve-group", map[string]interface{}{"idx": 1, "keep": "camera/DSC_0001.jpg"}, &result)
+	if status != 200 || !result.Success {
+		t.Fatalf("resolve failed: status %d, %+v", status, result)
+	}
+	if len(result.Deleted) != 2 || result.ReclaimedBytes == 0 {
+		t.Errorf("resolve result: %+v", result)
+	}
+	if !exists(lib.path("camera/DSC_0001.jpg")) {
+		t.Error("keeper was removed")
+	}
+	for _, name := range []string{"phone/IMG-20200702-WA0001.jpg", "camera/DSC_0001.cr2"} {
+		if exists(lib.path(name)) {
+			t.Errorf("%s was not deleted", name)
+		}
+	}
+	if !exists(lib.path("camera/DSC_0002.jpg")) || !exists(lib.path("backup/DSC_0002.jpg")) {
+		t.Error("another group was touched")
+	}
+}
+
+func TestDeletionsAreAudited(t *testing.T) {
+	lib := newFixtureLibrary(t, [][]fixtureImage{beachGroup, holidayGroup})
+	server := newTestServer(t, lib)
+	path := lib.path("backup/DSC_0002.jpg")
+	checksum, err := contentHash(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	postJSON(t, server.URL+"/api/delete", map[string]string{"path": path}, nil)
+	postJSON(t, server.URL+"/api/resolve-group", map[string]interface{}{"idx": 1, "keep": "camera/DSC_0001.jpg"}, nil)
+
+	data, err := os.ReadFile(auditPath())
+	if err != nil {
+		t.Fatal(err)
+	}
+	var entries []AuditEntry
+	for dec := json.NewDecoder(bytes.NewReader(data)); dec.More(); {
+		var e AuditEntry
+		if err := dec.Decode(&e); err != nil {
+			t.Fatal(err)
+		}
+		entries = append(entries, e)
+	}
+	if len(entries) != 3 {
+		t.Fatalf("audit log has %d entries, want 3:\n%s", len(entries), data)
+	}
+	first := entries[0]
+	if first.Action != actionDeleted || first.Path != path || first.Group != -1 || first.SHA256 != checksum || first.Client != "127.0.0.1" || first.Size == 0 {
+		t.Errorf("audit entry for /api/delete: %+v", first)
+	}
+	for _, e := range entries[1:] {
+		if e.Group != 1 || e.SHA256 == "" {
+			t.Errorf("audit entry for the group decision: %+v", e)
+		}
+	}
+
+	// Directories removed for being empty are audited too
+	postJSON(t, server.URL+"/api/empty-dirs", nil, nil)
+	data, _ = os.ReadFile(auditPath())
+	audited := false
+	for _, line := range strings.Split(strings.TrimSpace(string(data)), "\n") {
+		var e AuditEntry
+		json.Unmarshal([]byte(line), &e)
+		if e.Action == actionDirRemoved && e.Path == lib.path("backup") && e.Client == "127.0.0.1" {
+			audited = true
+		}
+	}
+	if !audited {
+		t.Errorf("removing the empty backup directory wasn't audited:\n%s", data)
+	}
+}
+
+func TestResolveGroupIsAllOrNothing(t *testing.T) {
+	lib := newFixtureLibrary(t, [][]fixtureImage{beachGroup, holidayGroup})
+	server := newTestServer(t, lib)
+
+	// A keeper from another group must not delete anything
+	status := postJSON(t, server.URL+"/api/resolve-group", map[string]interface{}{"idx": 0, "keep": "camera/DSC_0001.jpg"}, nil)
+	if status != 400 {
+		t.Errorf("status %d, want 400", status)
+	}
+	for _, f := range append(beachGroup, holidayGroup...) {
+		if !exists(lib.path(f.Name)) {
+			t.Errorf("%s was deleted", f.Name)
+		}
+	}
+}
+
+func TestResolveGroupToTrashCanBeUndone(t *testing.T) {
+	lib := newFixtureLibrary(t, [][]fixtureImage{holidayGroup})
+	server := newTestServer(t, lib)
+	trashDirFlag = t.TempDir()
+
+	var result DecideResult
+	postJSON(t, server.URL+"/api/resolve-group", map[string]interface{}{"idx": 0, "keep": "camera/DSC_0001.jpg"}, &result)
+	if !result.Success || result.TrashUndoID == nil {
+		t.Fatalf("resolve to trash: %+v", result)
+	}
+	if status := postJSON(t, server.URL+"/api/undo-stack", map[string]int64{"id": *result.TrashUndoID}, nil); status != 200 {
+		t.Fatalf("POST /api/undo-stack: status %d", status)
+	}
+	for _, f := range holidayGroup {
+		if !exists(lib.path(f.Name)) {
+			t.Errorf("%s was not restored", f.Name)
+		}
+	}
+}
+
+func TestFailedUndoKeepsWhatIsLeft(t *testing.T) {
+	lib := newFixtureLibrary(t, [][]fixtureImage{holidayGroup})
+	server := newTestServer(t, lib)
+	trashDirFlag = t.TempDir()
+
+	var result DecideResult
+	postJSON(t, server.URL+"/api/resolve-group", map[string]interface{}{"idx": 0, "keep": "camera/DSC_0001.jpg"}, &result)
+	if !result.Success || result.TrashUndoID == nil {
+		t.Fatalf("resolve to trash: %+v", result)
+	}
+	var stack []UndoEntry
+	getJSON(t, server.URL+"/api/undo-stack", &stack)
+	if len(stack) != 1 || len(stack[0].Changes) < 2 {
+		t.Fatalf("undo stack after resolving: %+v", stack)
+	}
+	// Something new where the change put back last was: the rest goes back,
+	// and that one is left on the stack
+	blocked := stack[0].Changes[0].MovedFrom
+	if err := os.WriteFile(blocked, []byte("new"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	undo := map[string]int64{"id": *result.TrashUndoID}
+	if status := postJSON(t, server.URL+"/api/undo-stack", undo, nil); status != 409 {
+		t.Fatalf("undo over a new file: status %d, want 409", status)
+	}
+	getJSON(t, server.URL+"/api/undo-stack", &stack)
+	if len(stack) != 1 || len(stack[0].Changes) != 1 || stack[0].Changes[0].MovedFrom != blocked {
+		t.Fatalf("undo stack after the failed undo: %+v", stack)
+	}
+	os.Remove(blocked)
+	if status := postJSON(t, server.URL+"/api/undo-stack", undo, nil); status != 200 {
+		t.Fatalf("retried undo: status %d", status)
+	}
+	for _, f := range holidayGroup {
+		if !exists(lib.path(f.Name)) {
+			t.Errorf("%s was not restored", f.Name)
+		}
+	}
+}
+
+func TestRedundantDirKeepsUncheckedFiles(t *testing.T) {
+	lib := newFixtureLibrary(t, [][]fixtureImage{beachGroup})
+	server := newTestServer(t, lib)
+	trashDirFlag = t.TempDir()
+	notes := lib.path("backup/.notes")
+	if err := os.WriteFile(notes, []byte("only copy"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	var result struct {
+		Success bool     `json:"success"`
+		Kept    []string `json:"kept_files"`
+	}
+	if status := postJSON(t, server.URL+"/api/redundant-dirs", map[string]string{"dir": "backup"}, &result); status != 200 || !result.Success {
+		t.Fatalf("trash backup: status %d, %+v", status, result)
+	}
+	if exists(lib.path("backup/DSC_0002.jpg")) || !exists(lib.path("camera/DSC_0002.jpg")) {
+		t.Error("the duplicate wasn't trashed, or the original was")
+	}
+	if !exists(notes) || !reflect.DeepEqual(result.Kept, []string{".notes"}) {
+		t.Errorf("a hidden file without a copy was trashed: kept %v", result.Kept)
+	}
+}
+
+func TestResolveGroupWithHardlinks(t *testing.T) {
+	lib := newFixtureLibrary(t, [][]fixtureImage{holidayGroup})
+	server := newTestServer(t, lib)
+	keep := lib.path("camera/DSC_0001.jpg")
+	copyPath := lib.path("phone/IMG-20200702-WA0001.jpg")
+	original, err := os.ReadFile(copyPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var result DecideResult
+	postJSON(t, server.URL+"/api/resolve-group", map[string]interface{}{"idx": 0, "keep": keep, "mode": "hardlink"}, &result)
+	if !result.Success || len(result.Hardlinked) != 2 || len(result.Deleted) != 0 || result.UndoID == nil {
+		t.Fatalf("resolve with hardlinks: %+v", result)
+	}
+	keepInfo, _ := os.Stat(keep)
+	for _, name := range []string{"phone/IMG-20200702-WA0001.jpg", "camera/DSC_0001.cr2"} {
+		info, err := os.Stat(lib.path(name))
+		if err != nil || !os.SameFile(info, keepInfo) {
+			t.Errorf("%s is not a hardlink of the keeper", name)
+		}
+	}
+	entries, _ := os.ReadDir(filepath.Dir(copyPath))
+	if len(entries) != 1 {
+		t.Errorf("temporary files left behind: %v", entries)
+	}
+
+	if status := postJSON(t, server.URL+"/api/undo-stack", map[string]int64{"id": *result.UndoID}, nil); status != 200 {
+		t.Fatalf("POST /api/undo-stack: status %d", status)
+	}
+	if restored, _ := os.ReadFile(copyPath); !bytes.Equal(restored, original) {
+		t.Error("undo did not restore the duplicate's own content")
+	}
+}
+
+func TestStageThenCommit(t *testing.T) {
+	lib := newFixtureLibrary(t, [][]fixtureImage{beachGroup, holidayGroup})
+	server := newTestServer(t, lib)
+
+	stage := DecideRequest{Idx: 0, Keep: []string{"camera/DSC_0002.jpg"}, Delete: []string{"backup/DSC_0002.jpg"}}
+	if status := postJSON(t, server.URL+"/api/stage", stage, nil); status != 200 {
+		t.Fatalf("POST /api/stage: status %d", status)
+	}
+	if !exists(lib.path("backup/DSC_0002.jpg")) {
+		t.Fatal("staging deleted a file")
+	}
+	var listed struct {
+		Staged []StagedDecision `json:"staged"`
+		Files  int              `json:"files"`
+	}
+	getJSON(t, server.URL+"/api/stage", &listed)
+	if len(listed.Staged) != 1 || listed.Files != 1 {
+		t.Fatalf("staged: %+v", listed)
+	}
+
+	var committed struct {
+		Success   bool `json:"success"`
+		Committed int  `json:"committed"`
+	}
+	postJSON(t, server.URL+"/api/commit", nil, &committed)
+	if !committed.Success || committed.Committed != 1 {
+		t.Fatalf("commit: %+v", committed)
+	}
+	if exists(lib.path("backup/DSC_0002.jpg")) || !exists(lib.path("camera/DSC_0002.jpg")) {
+		t.Error("commit did not apply the staged decision")
+	}
+	getJSON(t, server.URL+"/api/stage", &listed)
+	if len(listed.Staged) != 0 {
+		t.Errorf("still staged after commit: %+v", listed.Staged)
+	}
+}
+
+func TestReloadKeepsReviewState(t *testing.T) {
+	lib := newFixtureLibrary(t, [][]fixtureImage{beachGroup, holidayGroup})
+	server := newTestServer(t, lib)
+	stage := DecideRequest{Idx: 1, Keep: []string{"camera/DSC_0001.jpg"}, Delete: []string{"phone/IMG-20200702-WA0001.jpg", "camera/DSC_0001.cr2"}}
+	if status := postJSON(t, server.URL+"/api/stage", stage, nil); status != 200 {
+		t.Fatalf("POST /api/stage: status %d", status)
+	}
+
+	// czkawka ran again: the beach photos are no longer listed
+	var loaded [][]Image
+	data, _ := os.ReadFile(lib.DuplicatesFile)
+	if err := json.Unmarshal(data, &loaded); err != nil {
+		t.Fatal(err)
+	}
+	data, _ = json.Marshal(loaded[1:])
+	if err := os.WriteFile(lib.DuplicatesFile, data, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	var reloaded ReloadResult
+	postJSON(t, server.URL+"/api/reload", map[string]int{"idx": 1}, &reloaded)
+	if reloaded.Previous != 2 || reloaded.Groups != 1 || reloaded.Unchanged != 1 || reloaded.Idx == nil || *reloaded.Idx != 0 {
+		t.Fatalf("reload: %+v", reloaded)
+	}
+	var listed struct {
+		Staged []StagedDecision `json:"staged"`
+	}
+	getJSON(t, server.URL+"/api/stage", &listed)
+	if len(listed.Staged) != 1 || groupIdxByKey(listed.Staged[0].Key) != 0 {
+		t.Errorf("staged after reload: %+v", listed.Staged)
+	}
+}
+
+func TestGroupReportsBrokenExif(t *testing.T) {
+	lib := newFixtureLibrary(t, [][]fixtureImage{holidayGroup})
+	server := newTestServer(t, lib)
+
+	// Cut the camera original off in the middle of its EXIF block
+	path := lib.path("camera/DSC_0001.jpg")
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(path, data[:60], 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	var group struct {
+		Images []struct {
+			Path      string `json:"path"`
+			ExifError string `json:"exif_error"`
+		} `json:"images"`
+	}
+	getJSON(t, server.URL+"/api/group?idx=0", &group)
+	for _, img := range group.Images {
+		want := ""
+		if img.Path == "camera/DSC_0001.jpg" {
+			want = exifTruncated
+		}
+		if img.ExifError != want {
+			t.Errorf("%s: exif_error %q, want %q", img.Path, img.ExifError, want)
+		}
+	}
+	var report struct {
+		Counts map[string]int `json:"counts"`
+	}
+	getJSON(t, server.URL+"/api/exif-errors", &report)
+	if report.Counts[exifTruncated] != 1 {
+		t.Errorf("exif error counts: %v", report.Counts)
+	}
+}
+
+func TestGroupPrefersIntactCopy(t *testing.T) {
+	lib := newFixtureLibrary(t, [][]fixtureImage{{
+		{Name: "camera/DSC_0003.jpg", Width: 1200, Height: 900, Seed: 3, Make: "NIKON", Model: "D750"},
+		{Name: "backup/DSC_0003.jpg", Width: 1200, Height: 900, Seed: 3, Make: "NIKON", Model: "D750"},
+	}})
+	server := newTestServer(t, lib)
+
+	// A copy interrupted half way through, as after a failed transfer
+	path := lib.path("camera/DSC_0003.jpg")
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(path, data[:len(data)/2], 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	var group struct {
+		Images []struct {
+			Path    string `json:"path"`
+			Corrupt string `json:"corrupt"`
+		} `json:"images"`
+	}
+	getJSON(t, server.URL+"/api/group?idx=0", &group)
+	if len(group.Images) != 2 {
+		t.Fatalf("got %d images, want 2", len(group.Images))
+	}
+	if group.Images[0].Path != "backup/DSC_0003.jpg" || group.Images[0].Corrupt != "" {
+		t.Errorf("keeper is %+v, want the intact backup", group.Images[0])
+	}
+	if group.Images[1].Corrupt == "" {
+		t.Error("truncated copy is not flagged as corrupt")
+	}
+}
+
+func TestWorkspacesKeepSeparateState(t *testing.T) {
+	photos := newFixtureLibrary(t, [][]fixtureImage{beachGroup})
+	server := newTestServer(t, photos)
+	holiday := newFixtureLibrary(t, [][]fixtureImage{holidayGroup})
+	workspaces = append(workspaces, Workspace{Name: "holiday", ImagePath: holiday.Root, Duplicates: holiday.DuplicatesFile, StateDir: t.TempDir()})
+
+	stage := DecideRequest{Idx: 0, Keep: []string{"camera/DSC_0002.jpg"}, Delete: []string{"backup/DSC_0002.jpg"}}
+	if status := postJSON(t, server.URL+"/api/stage", stage, nil); status != 200 {
+		t.Fatalf("POST /api/stage: status %d", status)
+	}
+	var staged struct {
+		Staged []StagedDecision `json:"staged"`
+	}
+	var switched struct {
+		Active string `json:"active"`
+	}
+	if status := postJSON(t, server.URL+"/api/workspaces", map[string]string{"name": "holiday"}, &switched); status != 200 || switched.Active != "holiday" {
+		t.Fatalf("switch to holiday: status %d, %+v", status, switched)
+	}
+	getJSON(t, server.URL+"/api/stage", &staged)
+	if len(staged.Staged) != 0 {
+		t.Errorf("holiday workspace sees another workspace's staged decisions: %+v", staged.Staged)
+	}
+	var result DecideResult
+	postJSON(t, server.URL+"/api/resolve-group", map[string]interface{}{"idx": 0, "keep": "camera/DSC_0001.jpg"}, &result)
+	if !result.Success || exists(holiday.path("camera/DSC_0001.cr2")) {
+		t.Fatalf("resolve in holiday workspace: %+v", result)
+	}
+
+	postJSON(t, server.URL+"/api/workspaces", map[string]string{"name": "default"}, &switched)
+	getJSON(t, server.URL+"/api/stage", &staged)
+	if switched.Active != "default" || len(staged.Staged) != 1 {
+		t.Errorf("back in default: active %s, staged %+v", switched.Active, staged.Staged)
+	}
+	if status := postJSON(t, server.URL+"/api/workspaces", map[string]string{"name": "music"}, nil); status != 404 {
+		t.Errorf("unknown workspace: status %d, want 404", status)
+	}
+}
+
+func TestStorageMonitorFollowsWorkspace(t *testing.T) {
+	photos := newFixtureLibrary(t, [][]fixtureImage{beachGroup})
+	server := newTestServer(t, photos)
+	holiday := newFixtureLibrary(t, [][]fixtureImage{holidayGroup})
+	// An empty image root, as a dropped mount leaves behind
+	workspaces = append(workspaces, Workspace{Name: "unmounted", ImagePath: t.TempDir(), Duplicates: holiday.DuplicatesFile, StateDir: t.TempDir()})
+
+	waitFor := func(available bool) {
+		t.Helper()
+		deadline := time.Now().Add(5 * time.Second)
+		for storageStatus().Available != available {
+			if time.Now().After(deadline) {
+				t.Fatalf("storage still reported as available %v", !available)
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+	}
+	if status := postJSON(t, server.URL+"/api/workspaces", map[string]string{"name": "unmounted"}, nil); status != 200 {
+		t.Fatalf("switch to unmounted: status %d", status)
+	}
+	waitFor(false)
+	// A check of the old root left hanging doesn't count against the new one
+	storageMu.Lock()
+	storageMonitor.inFlight = true
+	storageMu.Unlock()
+	if status := postJSON(t, server.URL+"/api/workspaces", map[string]string{"name": "default"}, nil); status != 200 {
+		t.Fatalf("switch back: status %d", status)
+	}
+	waitFor(true)
+	time.Sleep(100 * time.Millisecond) // The new root's first check
+	if status := storageStatus(); !status.Available {
+		t.Errorf("healthy root reported down: %+v", status)
+	}
+}
+
+func TestResponsesCarryRequestID(t *testing.T) {
+	lib := newFixtureLibrary(t, [][]fixtureImage{beachGroup})
+	server := newTestServer(t, lib)
+
+	get := func(id string) string {
+		req, _ := http.NewRequest("GET", server.URL+"/api/version", nil)
+		if id != "" {
+			req.Header.Set("X-Request-ID", id)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		return resp.Header.Get("X-Request-ID")
+	}
+	first, second := get(""), get("")
+	if first == "" || first == second {
+		t.Errorf("generated request IDs %q and %q", first, second)
+	}
+	// One assigned by a reverse proxy is kept
+	if id := get("proxy-42"); id != "proxy-42" {
+		t.Errorf("request ID %q, want the proxy's", id)
+	}
+}
+
+func TestDebugEndpointsNeedDebugFlag(t *testing.T) {
+	lib := newFixtureLibrary(t, [][]fixtureImage{beachGroup})
+	server := newTestServer(t, lib)
+
+	if status := getJSON(t, server.URL+"/api/debug/stats", nil); status != 404 {
+		t.Errorf("stats without -debug: status %d", status)
+	}
+	debugMode = true
+	var stats DebugStats
+	if status := getJSON(t, server.URL+"/api/debug/stats", &stats); status != 200 {
+		t.Fatalf("stats with -debug: status %d", status)
+	}
+	if stats.Goroutines == 0 || stats.Groups != 1 || stats.TempDir.Dir != tempDir {
+		t.Errorf("stats: %+v", stats)
+	}
+	resp, err := http.Get(server.URL + "/debug/pprof/goroutine?debug=1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != 200 {
+		t.Errorf("goroutine profile: status %d", resp.StatusCode)
+	}
+}
+
+func TestOpenAPIDocument(t *testing.T) {
+	lib := newFixtureLibrary(t, [][]fixtureImage{beachGroup})
+	server := newTestServer(t, lib)
+
+	var doc struct {
+		OpenAPI    string                                `json:"openapi"`
+		Paths      map[string]map[string]json.RawMessage `json:"paths"`
+		Components struct {
+			Schemas map[string]struct {
+				Properties map[string]json.RawMessage `json:"properties"`
+			} `json:"schemas"`
+		} `json:"components"`
+	}
+	if status := getJSON(t, server.URL+"/api/openapi.json", &doc); status != 200 {
+		t.Fatalf("status %d", status)
+	}
+	if doc.OpenAPI == "" || doc.Paths["/api/v1/group"]["get"] == nil || doc.Paths["/api/v1/queues/{name}"]["delete"] == nil {
+		t.Fatalf("paths: %v", doc.Paths)
+	}
+	image := doc.Components.Schemas["V1Image"].Properties
+	for _, field := range []string{"path", "date_taken", "score", "original_path"} {
+		if image[field] == nil {
+			t.Errorf("V1Image schema lacks %s: %v", field, image)
+		}
+	}
+}
+
+func TestUnversionedPathsAreAliases(t *testing.T) {
+	lib := newFixtureLibrary(t, [][]fixtureImage{beachGroup})
+	server := newTestServer(t, lib)
+
+	var v1, alias map[string]any
+	if status := getJSON(t, server.URL+"/api/v1/group?idx=0", &v1); status != 200 {
+		t.Fatalf("v1: status %d", status)
+	}
+	if status := getJSON(t, server.URL+"/api/group?idx=0", &alias); status != 200 {
+		t.Fatalf("alias: status %d", status)
+	}
+	delete(v1, "images") // Quality metrics are computed on the first request
+	delete(alias, "images")
+	if !reflect.DeepEqual(v1, alias) {
+		t.Errorf("v1 %v, alias %v", v1, alias)
+	}
+
+	var result V1FileResult
+	path := filepath.Join(lib.Root, "backup", "DSC_0002.jpg")
+	if status := postJSON(t, server.URL+"/api/v1/delete", map[string]string{"path": path}, &result); status != 200 || !result.Success {
+		t.Fatalf("v1 delete: status %d, %+v", status, result)
+	}
+	// Switching workspaces under /api/v1 doesn't wait for its own request
+	if status := postJSON(t, server.URL+"/api/v1/workspaces", map[string]string{"name": workspaces[0].Name}, nil); status != 200 {
+		t.Errorf("v1 workspace switch: status %d", status)
+	}
+}
+
+func TestGroupReportsProgress(t *testing.T) {
+	lib := newFixtureLibrary(t, [][]fixtureImage{beachGroup, holidayGroup})
+	server := newTestServer(t, lib)
+
+	var group V1Group
+	if status := getJSON(t, server.URL+"/api/v1/group?idx=1", &group); status != 200 {
+		t.Fatalf("status %d", status)
+	}
+	p := group.Progress
+	if p.TotalGroups != 2 || p.Idx == nil || *p.Idx != 1 || p.Resolved != 0 || p.Remaining != 2 || p.ReclaimedBytes != 0 {
+		t.Errorf("progress before deleting: %+v", p)
+	}
+	var total int64
+	for _, img := range group.Images {
+		total += img.Size
+	}
+	if group.TotalBytes != total || group.KeeperBytes != group.Images[0].Size || group.ReclaimableBytes != total-group.KeeperBytes {
+		t.Errorf("sizes don't add up: total %d, keeper %d, reclaimable %d for %d bytes of images", group.TotalBytes, group.KeeperBytes, group.ReclaimableBytes, total)
+	}
+
+	info, _ := os.Stat(lib.path("backup/DSC_0002.jpg"))
+	postJSON(t, server.URL+"/api/v1/delete", map[string]string{"path": lib.path("backup/DSC_0002.jpg")}, nil)
+	p = Progress{}
+	if status := getJSON(t, server.URL+"/api/v1/progress", &p); status != 200 {
+		t.Fatalf("status %d", status)
+	}
+	if p.Idx != nil || p.Resolved != 1 || p.Remaining != 1 || p.ReclaimedBytes != info.Size() {
+		t.Errorf("progress after deleting %d bytes: %+v", info.Size(), p)
+	}
+}
+
+func TestNextGroupSkipsResolved(t *testing.T) {
+	lib := newFixtureLibrary(t, [][]fixtureImage{beachGroup, holidayGroup})
+	server := newTestServer(t, lib)
+
+	var next struct{ Idx, Skipped int }
+	if status := getJSON(t, server.URL+"/api/v1/group/next", &next); status != 200 || next.Idx != 0 {
+		t.Fatalf("status %d, next %+v", status, next)
+	}
+
+	postJSON(t, server.URL+"/api/v1/delete", map[string]string{"path": lib.path("backup/DSC_0002.jpg")}, nil)
+	if status := getJSON(t, server.URL+"/api/v1/group/next?after=-1", &next); status != 200 || next.Idx != 1 || next.Skipped != 1 {
+		t.Errorf("after deleting from group 0: status %d, next %+v", status, next)
+	}
+	if status := getJSON(t, server.URL+"/api/v1/group/next?after=1&reverse=1", nil); status != 404 {
+		t.Errorf("expected 404 going back from the last unresolved group, got %d", status)
+	}
+	if status := getJSON(t, server.URL+"/api/v1/group/next?after=1", nil); status != 404 {
+		t.Errorf("expected 404 past the last group, got %d", status)
+	}
+}
+
+func TestGroupStatusPersists(t *testing.T) {
+	lib := newFixtureLibrary(t, [][]fixtureImage{beachGroup, holidayGroup})
+	server := newTestServer(t, lib)
+
+	var s GroupStatus
+	if status := postJSON(t, server.URL+"/api/v1/group/0/status", map[string]string{"status": "bogus"}, nil); status != 400 {
+		t.Errorf("expected 400 for an unknown status, got %d", status)
+	}
+	if status := postJSON(t, server.URL+"/api/v1/group/0/status", map[string]string{"status": "resolved"}, &s); status != 200 || s.Status != statusResolved {
+		t.Fatalf("status %d, %+v", status, s)
+	}
+	postJSON(t, server.URL+"/api/v1/group/1/status", map[string]string{"status": "flagged", "note": "check dates"}, nil)
+
+	// Reloading the same file keeps the statuses
+	postJSON(t, server.URL+"/api/v1/reload", nil, nil)
+	var group V1Group
+	getJSON(t, server.URL+"/api/v1/group?idx=1", &group)
+	if group.Status != statusFlagged || group.Progress.Resolved != 1 {
+		t.Errorf("after reload: status %q, progress %+v", group.Status, group.Progress)
+	}
+	var next struct{ Idx int }
+	if status := getJSON(t, server.URL+"/api/v1/group/next", &next); status != 200 || next.Idx != 1 {
+		t.Errorf("next should pass by the resolved group: status %d, idx %d", status, next.Idx)
+	}
+
+	req, _ := http.NewRequest("DELETE", server.URL+"/api/v1/group/0/status", nil)
+	req.Header.Set(csrfHeader, csrfToken())
+	if resp, err := http.DefaultClient.Do(req); err != nil || resp.StatusCode != 204 {
+		t.Fatalf("clearing status: %v %v", resp, err)
+	}
+	s = GroupStatus{}
+	getJSON(t, server.URL+"/api/v1/group/0/status", &s)
+	if s.Status != "" || s.Idx != 0 {
+		t.Errorf("status after clearing: %+v", s)
+	}
+}
+
+func TestGroupsListingFilters(t *testing.T) {
+	lib := newFixtureLibrary(t, [][]fixtureImage{beachGroup, holidayGroup})
+	server := newTestServer(t, lib)
+	postJSON(t, server.URL+"/api/v1/group/0/status", map[string]string{"status": "resolved"}, nil)
+
+	list := func(query string) []int {
+		t.Helper()
+		resp, err := http.Get(server.URL + "/api/v1/groups?" + query)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		if resp.StatusCode != 200 {
+			t.Fatalf("%s: status %d", query, resp.StatusCode)
+		}
+		idxs := []int{}
+		dec := json.NewDecoder(resp.Body)
+		for {
+			var s GroupSummary
+			if err := dec.Decode(&s); err != nil {
+				break
+			}
+			idxs = append(idxs, s.Idx)
+		}
+		return idxs
+	}
+	for query, want := range map[string][]int{
+		"":                          {0, 1},
+		"status=unresolved":         {1},
+		"status=resolved":           {0},
+		"min_count=3":               {1},
+		"extension=CR2":             {1},
+		"path=backup":               {0},
+		"path=" + lib.path("phone"): {1},
+		"extension=jpg&path=camera": {0, 1},
+		"status=flagged":            {},
+		"min_savings=1000000000":    {},
+		"sort=size":                 {1, 0},
+		"sort=size&cursor=1":        {0},
+		"sort=size&status=resolved": {0},
+	} {
+		if got := list(query); !reflect.DeepEqual(got, want) {
+			t.Errorf("%q: got %v, want %v", query, got, want)
+		}
+	}
+	if status := getJSON(t, server.URL+"/api/v1/groups?status=done", nil); status != 400 {
+		t.Errorf("expected 400 for an unknown status, got %d", status)
+	}
+	if status := getJSON(t, server.URL+"/api/v1/groups?sort=random", nil); status != 400 {
+		t.Errorf("expected 400 for an unknown sort, got %d", status)
+	}
+}
+
+func TestSearchPaths(t *testing.T) {
+	lib := newFixtureLibrary(t, [][]fixtureImage{beachGroup, holidayGroup})
+	server := newTestServer(t, lib)
+
+	var res struct {
+		Groups    []SearchResult
+		Truncated bool
+	}
+	if status := getJSON(t, server.URL+"/api/v1/search?q=dsc_0001", &res); status != 200 {
+		t.Fatalf("status %d", status)
+	}
+	if len(res.Groups) != 1 || res.Groups[0].Idx != 1 || len(res.Groups[0].Matches) != 2 {
+		t.Fatalf("unexpected results: %+v", res)
+	}
+	m := res.Groups[0].Matches[0]
+	if m.Path != "camera/DSC_0001.jpg" || !reflect.DeepEqual(m.Offsets, [][2]int{{7, 15}}) {
+		t.Errorf("unexpected match: %+v", m)
+	}
+
+	res.Groups = nil
+	getJSON(t, server.URL+"/api/v1/search?q=.jpg&limit=1", &res)
+	if len(res.Groups) != 1 || res.Groups[0].Idx != 0 || !res.Truncated {
+		t.Errorf("limit=1: %+v", res)
+	}
+	if status := getJSON(t, server.URL+"/api/v1/search", nil); status != 400 {
+		t.Errorf("expected 400 without q, got %d", status)
+	}
+}
+
+func TestStatsBreakdown(t *testing.T) {
+	lib := newFixtureLibrary(t, [][]fixtureImage{beachGroup, holidayGroup})
+	server := newTestServer(t, lib)
+
+	// Reviewing the holiday group reads its EXIF
+	getJSON(t, server.URL+"/api/v1/group?idx=1", nil)
+
+	var stats struct {
+		Groups      int
+		Total       WasteShare
+		ByExtension []WasteShare `json:"by_extension"`
+		ByCamera    []WasteShare `json:"by_camera"`
+	}
+	if status := getJSON(t, server.URL+"/api/v1/stats", &stats); status != 200 {
+		t.Fatalf("status %d", status)
+	}
+	if stats.Groups != 2 || stats.Total.Files != 5 || stats.Total.WastedFiles != 3 {
+		t.Errorf("unexpected totals: %d groups, %+v", stats.Groups, stats.Total)
+	}
+	exts := map[string]int{}
+	for _, s := range stats.ByExtension {
+		exts[s.Name] = s.Files
+	}
+	if exts["jpg"] != 4 || exts["cr2"] != 1 {
+		t.Errorf("unexpected extensions: %v", exts)
+	}
+	cameras := map[string]int{}
+	cameraFiles := 0
+	for _, s := range stats.ByCamera {
+		cameras[s.Name] = s.Files
+		cameraFiles += s.Files
+	}
+	if cameras["NIKON D750"] == 0 {
+		t.Errorf("no files for the D750: %v", cameras)
+	}
+	if cameraFiles != 3 {
+		t.Errorf("expected the 3 holiday files by camera, got %d: %+v", cameraFiles, stats.ByCamera)
+	}
+}
+
+func TestHistorySummary(t *testing.T) {
+	lib := newFixtureLibrary(t, [][]fixtureImage{beachGroup, holidayGroup})
+	server := newTestServer(t, lib)
+
+	var before HistorySummary
+	getJSON(t, server.URL+"/api/v1/history?tz=UTC", &before)
+	info, _ := os.Stat(lib.path("backup/DSC_0002.jpg"))
+	postJSON(t, server.URL+"/api/v1/delete", map[string]string{"path": lib.path("backup/DSC_0002.jpg")}, nil)
+
+	var after HistorySummary
+	if status := getJSON(t, server.URL+"/api/v1/history?tz=UTC", &after); status != 200 {
+		t.Fatalf("status %d", status)
+	}
+	if after.FilesRemoved != before.FilesRemoved+1 || after.BytesReclaimed != before.BytesReclaimed+info.Size() {
+		t.Errorf("expected one more file of %d bytes: before %+v, after %+v", info.Size(), before, after)
+	}
+	today := after.Days[len(after.Days)-1]
+	if today.Day != time.Now().UTC().Format("2006-01-02") || today.CumulativeBytes != after.BytesReclaimed {
+		t.Errorf("unexpected last day: %+v", today)
+	}
+	if s := after.Sessions[len(after.Sessions)-1]; s.FilesRemoved < 1 || s.BytesReclaimed < info.Size() {
+		t.Errorf("unexpected last session: %+v", s)
+	}
+	if status := getJSON(t, server.URL+"/api/v1/history?tz=Nowhere/Special", nil); status != 400 {
+		t.Errorf("expected 400 for an unknown timezone, got %d", status)
+	}
+}
+
+func TestHistoryIndexCatchesUp(t *testing.T) {
+	lib := newFixtureLibrary(t, [][]fixtureImage{beachGroup, holidayGroup})
+	server := newTestServer(t, lib)
+	deleted, other := lib.path("backup/DSC_0002.jpg"), lib.path("phone/IMG-20200702-WA0001.jpg")
+	postJSON(t, server.URL+"/api/v1/delete", map[string]string{"path": deleted}, nil)
+
+	actionsFor := func(path string) []Action {
+		var history struct{ Actions []Action }
+		getJSON(t, server.URL+"/api/v1/history?path="+url.QueryEscape(path), &history)
+		return history.Actions
+	}
+	reopen := func() {
+		closeDataset()
+		if err := openDataset(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	count := func(actions []Action, kind string) int {
+		n := 0
+		for _, a := range actions {
+			if a.Action == kind {
+				n++
+			}
+		}
+		return n
+	}
+
+	// Written while the server was down, e.g. by an older version
+	closeDataset()
+	f, err := os.OpenFile(historyPath(), os.O_APPEND|os.O_WRONLY, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	line, _ := json.Marshal(Action{Time: time.Now(), Path: other, Action: actionTrashed, Group: 1})
+	f.Write(append(line, '\n'))
+	f.Close()
+	if err := openDataset(); err != nil {
+		t.Fatal(err)
+	}
+	if n := count(actionsFor(other), actionTrashed); n != 1 {
+		t.Errorf("expected the added action to be indexed once, got %d", n)
+	}
+	if n := count(actionsFor(deleted), actionDeleted); n != 1 {
+		t.Errorf("expected the deletion to be indexed once, got %d", n)
+	}
+
+	// Nothing new to index on a plain restart
+	reopen()
+	if n := count(actionsFor(deleted), actionDeleted); n != 1 {
+		t.Errorf("expected the deletion to be indexed once after a restart, got %d", n)
+	}
+
+	// A shorter history, e.g. restored from a backup, replaces the index
+	closeDataset()
+	if err := os.WriteFile(historyPath(), append(line, '\n'), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := openDataset(); err != nil {
+		t.Fatal(err)
+	}
+	if n := count(actionsFor(deleted), actionDeleted); n != 0 {
+		t.Errorf("expected the deletion to be gone with the old history, got %d", n)
+	}
+	if n := count(actionsFor(other), actionTrashed); n != 1 {
+		t.Errorf("expected the restored history's action, got %d", n)
+	}
+}
+
+func TestPruneDropsStaleGroups(t *testing.T) {
+	lib := newFixtureLibrary(t, [][]fixtureImage{beachGroup, holidayGroup})
+	server := newTestServer(t, lib)
+	postJSON(t, server.URL+"/api/v1/group/1/status", map[string]string{"status": "flagged"}, nil)
+
+	// Cleaned up outside the UI
+	os.Remove(lib.path("backup/DSC_0002.jpg"))
+
+	var result PruneResult
+	if status := postJSON(t, server.URL+"/api/v1/prune", map[string]int{"idx": 1}, &result); status != 200 {
+		t.Fatalf("status %d", status)
+	}
+	if result.Checked != 2 || result.Pruned != 1 || result.Groups != 1 || result.Idx == nil || *result.Idx != 0 {
+		t.Fatalf("unexpected result: %+v", result)
+	}
+	var group V1Group
+	if status := getJSON(t, server.URL+"/api/v1/group?idx=0", &group); status != 200 || len(group.Images) != 3 || group.Status != statusFlagged {
+		t.Errorf("expected the holiday group, still flagged, at 0: status %d, %d images, %q", status, len(group.Images), group.Status)
+	}
+	if group.Progress.TotalGroups != 1 {
+		t.Errorf("progress still counts pruned groups: %+v", group.Progress)
+	}
+}
+
+func TestRefreshRereadsFiles(t *testing.T) {
+	lib := newFixtureLibrary(t, [][]fixtureImage{beachGroup})
+	server := newTestServer(t, lib)
+	path := lib.path("backup/DSC_0002.jpg")
+
+	// Edited after the scan: grown and touched
+	f, err := os.OpenFile(path, os.O_APPEND|os.O_WRONLY, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.Write(make([]byte, 1000))
+	f.Close()
+	modified := time.Now().Add(-time.Hour).Truncate(time.Second)
+	os.Chtimes(path, modified, modified)
+	info, _ := os.Stat(path)
+
+	var res struct {
+		Changed int
+		Files   []RefreshedFile
+	}
+	if status := postJSON(t, server.URL+"/api/v1/refresh?idx=0", nil, &res); status != 200 {
+		t.Fatalf("status %d", status)
+	}
+	if res.Changed != 1 || len(res.Files) != 2 {
+		t.Fatalf("unexpected result: %+v", res)
+	}
+	var group V1Group
+	getJSON(t, server.URL+"/api/v1/group?idx=0", &group)
+	for _, img := range group.Images {
+		if img.Path == "backup/DSC_0002.jpg" && (img.Size != info.Size() || img.ModifiedDate != modified.Unix() || img.Width != 640) {
+			t.Errorf("group still shows stale metadata: %+v", img)
+		}
+	}
+	if status := postJSON(t, server.URL+"/api/v1/refresh?idx=5", nil, nil); status != 404 {
+		t.Errorf("expected 404 for a missing group, got %d", status)
+	}
+}
+
+func TestExifCachedByContent(t *testing.T) {
+	lib := newFixtureLibrary(t, [][]fixtureImage{holidayGroup})
+	newTestServer(t, lib)
+	path := lib.path("camera/DSC_0001.jpg")
+
+	first := getExif(path)
+	hash, err := contentHash(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var cached ExifData
+	if !dbGet(bucketExif, hash, &cached) || cached != first {
+		t.Fatalf("EXIF not cached by content: %+v", cached)
+	}
+
+	// A renamed copy is served from the cache
+	renamed := lib.path("camera/renamed.jpg")
+	if err := os.Rename(path, renamed); err != nil {
+		t.Fatal(err)
+	}
+	cached.Subject = "from the cache"
+	dbPut(bucketExif, hash, cached)
+	if got := getExif(renamed); got.Subject != "from the cache" {
+		t.Errorf("renamed file's EXIF was read again: %+v", got)
+	}
+}
+
+func TestDecisionsFollowContent(t *testing.T) {
+	lib := newFixtureLibrary(t, [][]fixtureImage{holidayGroup})
+	server := newTestServer(t, lib)
+	getJSON(t, server.URL+"/api/group?idx=0", nil) // Scores go into the history
+	keep := map[string]interface{}{"idx": 0, "keep": "camera/DSC_0001.jpg"}
+	if status := postJSON(t, server.URL+"/api/resolve-group", keep, nil); status != 200 {
+		t.Fatalf("resolve-group: status %d", status)
+	}
+
+	// Renamed, and the state read back after a restart with the history
+	// index thrown away
+	kept, renamed := lib.path("camera/DSC_0001.jpg"), lib.path("camera/renamed.jpg")
+	if err := os.Rename(kept, renamed); err != nil {
+		t.Fatal(err)
+	}
+	closeDataset()
+	if err := openDataset(); err != nil {
+		t.Fatal(err)
+	}
+	dbDelete(bucketMeta, "history_indexed")
+	closeDataset()
+	if err := openDataset(); err != nil {
+		t.Fatal(err)
+	}
+
+	if d, ok := decisionFor(renamed); !ok || d.Decision != decisionKeep || d.Path != kept {
+		t.Errorf("decision for the renamed keeper: %+v, %v", d, ok)
+	}
+	var history struct {
+		Actions []Action `json:"actions"`
+	}
+	getJSON(t, server.URL+"/api/history?path="+url.QueryEscape(renamed), &history)
+	scored := 0
+	for _, a := range history.Actions {
+		if a.Path == kept && a.Action == actionScored {
+			scored++
+		}
+	}
+	if scored != 1 {
+		t.Errorf("history under the old path: %+v", history.Actions)
+	}
+}
+
+func TestDecisionsAreKeptPerCopy(t *testing.T) {
+	lib := newFixtureLibrary(t, [][]fixtureImage{beachGroup})
+	server := newTestServer(t, lib)
+	keeper, copy := lib.path("camera/DSC_0002.jpg"), lib.path("backup/DSC_0002.jpg")
+	keep := map[string]interface{}{"idx": 0, "keep": keeper}
+	if status := postJSON(t, server.URL+"/api/v1/resolve-group", keep, nil); status != 200 {
+		t.Fatalf("resolve-group: status %d", status)
+	}
+	if exists(copy) {
+		t.Fatal("the identical copy wasn't deleted")
+	}
+
+	var group V1Group
+	if status := getJSON(t, server.URL+"/api/v1/group?idx=0", &group); status != 200 {
+		t.Fatalf("status %d", status)
+	}
+	for _, img := range group.Images {
+		if img.OriginalPath != keeper {
+			continue
+		}
+		if img.Decided == nil || img.Decided.Decision != decisionKeep || img.Decided.Path != keeper {
+			t.Errorf("keeper's decision: %+v", img.Decided)
+		}
+		return
+	}
+	t.Errorf("keeper not in the group: %+v", group.Images)
+}
+
+func TestResolvedFlagsAreKeptPerCopy(t *testing.T) {
+	// Identical to beachGroup's files, in a group of its own
+	archiveGroup := []fixtureImage{
+		{Name: "archive/DSC_0002.jpg", Width: 640, Height: 480, Seed: 2},
+		{Name: "old/DSC_0002.jpg", Width: 640, Height: 480, Seed: 2},
+	}
+	lib := newFixtureLibrary(t, [][]fixtureImage{beachGroup, archiveGroup})
+	server := newTestServer(t, lib)
+	resolved := func(name string) bool {
+		d, ok := decisionFor(lib.path(name))
+		return ok && d.Decision == decisionResolved
+	}
+
+	postJSON(t, server.URL+"/api/v1/group/0/status", map[string]string{"status": "resolved"}, nil)
+	postJSON(t, server.URL+"/api/v1/group/1/status", map[string]string{"status": "resolved"}, nil)
+	if !resolved("camera/DSC_0002.jpg") || !resolved("archive/DSC_0002.jpg") {
+		t.Fatal("expected the files of both groups to be flagged resolved")
+	}
+
+	req, _ := http.NewRequest("DELETE", server.URL+"/api/v1/group/0/status", nil)
+	req.Header.Set(csrfHeader, csrfToken())
+	if resp, err := http.DefaultClient.Do(req); err != nil || resp.StatusCode != 204 {
+		t.Fatalf("clearing status: %v %v", resp, err)
+	}
+	if resolved("camera/DSC_0002.jpg") || resolved("backup/DSC_0002.jpg") {
+		t.Error("the cleared group's files are still flagged resolved")
+	}
+	if !resolved("archive/DSC_0002.jpg") || !resolved("old/DSC_0002.jpg") {
+		t.Error("clearing one group took the flag from the identical copies in the other")
+	}
+}
+
+func TestHistoryLeavesIdenticalCopiesApart(t *testing.T) {
+	lib := newFixtureLibrary(t, [][]fixtureImage{beachGroup})
+	server := newTestServer(t, lib)
+	keeper, copy := lib.path("camera/DSC_0002.jpg"), lib.path("backup/DSC_0002.jpg")
+	if status := postJSON(t, server.URL+"/api/v1/delete", map[string]string{"path": copy}, nil); status != 200 {
+		t.Fatalf("delete: status %d", status)
+	}
+
+	var history struct {
+		Actions []Action `json:"actions"`
+	}
+	getJSON(t, server.URL+"/api/v1/history?path="+url.QueryEscape(keeper), &history)
+	if len(history.Actions) != 0 {
+		t.Errorf("the keeper has the deleted copy's history: %+v", history.Actions)
+	}
+}
+
+func TestDedupeProbeWaitsForRequest(t *testing.T) {
+	lib := newFixtureLibrary(t, [][]fixtureImage{beachGroup})
+	// Any directory created and removed under the root would touch it
+	old := time.Now().Add(-time.Hour).Truncate(time.Second)
+	os.Chtimes(lib.Root, old, old)
+	server := newTestServer(t, lib)
+
+	if info, err := os.Stat(lib.Root); err != nil || !info.ModTime().Equal(old) {
+		t.Errorf("opening the dataset wrote to the library: %v", err)
+	}
+	var version struct {
+		Features struct {
+			BlockDedupe struct {
+				Tried bool `json:"tried"`
+			} `json:"block_dedupe"`
+		} `json:"features"`
+	}
+	getJSON(t, server.URL+"/api/version", &version)
+	if version.Features.BlockDedupe.Tried {
+		t.Error("block-level dedupe tried before anything asked for it")
+	}
+
+	// Whether or not this filesystem can, asking finds out
+	postJSON(t, server.URL+"/api/dedupe", map[string]int{"idx": 0}, nil)
+	getJSON(t, server.URL+"/api/version", &version)
+	if !version.Features.BlockDedupe.Tried {
+		t.Error("a dedupe request didn't try block-level dedupe")
+	}
+}
+
+func TestReplayJournalOnNewLibrary(t *testing.T) {
+	lib := newFixtureLibrary(t, [][]fixtureImage{beachGroup, holidayGroup})
+	server := newTestServer(t, lib)
+	if status := postJSON(t, server.URL+"/api/v1/resolve-group", map[string]interface{}{"idx": 0, "keep": lib.path("camera/DSC_0002.jpg")}, nil); status != 200 {
+		t.Fatalf("resolve-group: status %d", status)
+	}
+	postJSON(t, server.URL+"/api/v1/group/1/status", map[string]string{"status": "skipped"}, nil)
+	journal := journalPath()
+	server.Close()
+	closeDataset()
+
+	// The same photos on another machine, with a fresh state directory
+	moved := newFixtureLibrary(t, [][]fixtureImage{beachGroup, holidayGroup})
+	server = newTestServer(t, moved)
+	result, err := replayJournal(journal)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.Entries != 2 || result.Applied != 2 || result.Failed != 0 {
+		t.Fatalf("unexpected replay: %+v", result)
+	}
+	if _, err := os.Stat(moved.path("backup/DSC_0002.jpg")); !os.IsNotExist(err) {
+		t.Errorf("replay didn't delete the duplicate: %v", err)
+	}
+	if _, err := os.Stat(moved.path("camera/DSC_0002.jpg")); err != nil {
+		t.Errorf("replay removed the keeper: %v", err)
+	}
+	var s GroupStatus
+	getJSON(t, server.URL+"/api/v1/group/1/status", &s)
+	if s.Status != statusSkipped {
+		t.Errorf("status not replayed: %+v", s)
+	}
+
+	// Everything in it is done now
+	if result, _ = replayJournal(journal); result.Applied != 0 || result.Satisfied != 2 {
+		t.Errorf("second replay: %+v", result)
+	}
+}
+
+func TestReviewStateExportImport(t *testing.T) {
+	lib := newFixtureLibrary(t, [][]fixtureImage{beachGroup, holidayGroup})
+	server := newTestServer(t, lib)
+	postJSON(t, server.URL+"/api/v1/group/1/status", map[string]string{"status": "flagged"}, nil)
+	postJSON(t, server.URL+"/api/v1/queues/later", map[string]int{"idx": 0}, nil)
+
+	var export StateExport
+	if status := getJSON(t, server.URL+"/api/v1/session/export", &export); status != 200 {
+		t.Fatalf("status %d", status)
+	}
+	if len(export.Buckets[bucketStatus]) != 1 || len(export.Buckets[bucketQueues]) != 1 || len(export.Journal) != 1 {
+		t.Fatalf("unexpected export: %+v", export)
+	}
+	server.Close()
+	closeDataset()
+
+	// A rebuilt container with an empty state directory
+	server = newTestServer(t, lib)
+	var res struct {
+		Imported map[string]int
+	}
+	if status := postJSON(t, server.URL+"/api/v1/session/import", export, &res); status != 200 {
+		t.Fatalf("import: status %d", status)
+	}
+	if res.Imported[bucketStatus] != 1 || res.Imported["journal"] != 1 {
+		t.Errorf("unexpected counts: %v", res.Imported)
+	}
+	var group V1Group
+	getJSON(t, server.URL+"/api/v1/group?idx=1", &group)
+	if group.Status != statusFlagged {
+		t.Errorf("status not restored: %q", group.Status)
+	}
+	var queue Queue
+	getJSON(t, server.URL+"/api/v1/queues/later", &queue)
+	if len(queue.Entries) != 1 || queue.Entries[0].Idx != 0 {
+		t.Errorf("queue not restored: %+v", queue)
+	}
+
+	// Importing again adds no journal entries twice, and replace drops what isn't in the file
+	postJSON(t, server.URL+"/api/v1/group/0/status", map[string]string{"status": "skipped"}, nil)
+	res.Imported = nil
+	postJSON(t, server.URL+"/api/v1/session/import?replace=1", export, &res)
+	if res.Imported["journal"] != 0 {
+		t.Errorf("journal entries imported twice: %v", res.Imported)
+	}
+	var s GroupStatus
+	getJSON(t, server.URL+"/api/v1/group/0/status", &s)
+	if s.Status != "" {
+		t.Errorf("replace kept a status not in the export: %+v", s)
+	}
+	export.Version = 99
+	if status := postJSON(t, server.URL+"/api/v1/session/import", export, nil); status != 400 {
+		t.Errorf("expected 400 for an unknown version, got %d", status)
+	}
+}
+
+func TestGroupClaims(t *testing.T) {
+	lib := newFixtureLibrary(t, [][]fixtureImage{beachGroup, holidayGroup})
+	server := newTestServer(t, lib)
+
+	as := func(reviewer, method, path string, body interface{}, out interface{}) int {
+		t.Helper()
+		data, _ := json.Marshal(body)
+		req, _ := http.NewRequest(method, server.URL+path, bytes.NewReader(data))
+		req.Header.Set(csrfHeader, csrfToken())
+		req.Header.Set(reviewerHeader, reviewer)
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		if out != nil && resp.Header.Get("Content-Type") == "application/json" {
+			json.NewDecoder(resp.Body).Decode(out)
+		}
+		return resp.StatusCode
+	}
+
+	var claim GroupClaim
+	if status := as("alice", "POST", "/api/v1/group/0/claim", map[string]int{"ttl": 7200}, &claim); status != 200 || claim.Reviewer != "alice" {
+		t.Fatalf("claim: status %d, %+v", status, claim)
+	}
+	if left := time.Until(claim.Expires); left > maxClaimTTL || left < maxClaimTTL-time.Minute {
+		t.Errorf("ttl should be capped at %v, expires in %v", maxClaimTTL, left)
+	}
+
+	// Bob can neither take the group over nor resolve it
+	claim = GroupClaim{}
+	if status := as("bob", "POST", "/api/v1/group/0/claim", nil, &claim); status != 409 || claim.Reviewer != "alice" {
+		t.Errorf("expected 409 with alice's claim, got %d, %+v", status, claim)
+	}
+	keep := map[string]interface{}{"idx": 0, "keep": lib.path("camera/DSC_0002.jpg")}
+	if status := as("bob", "POST", "/api/v1/resolve-group", keep, nil); status != 423 {
+		t.Errorf("expected 423 resolving a claimed group, got %d", status)
+	}
+	if _, err := os.Stat(lib.path("backup/DSC_0002.jpg")); err != nil {
+		t.Fatalf("duplicate removed despite the claim: %v", err)
+	}
+	if status := as("bob", "DELETE", "/api/v1/group/0/claim", nil, nil); status != 409 {
+		t.Errorf("expected 409 releasing alice's claim, got %d", status)
+	}
+	// Other groups are free
+	if status := as("bob", "POST", "/api/v1/group/1/claim", nil, nil); status != 200 {
+		t.Errorf("claiming a free group: %d", status)
+	}
+	var list []GroupClaim
+	getJSON(t, server.URL+"/api/v1/claims", &list)
+	if len(list) != 2 || list[0].Reviewer != "bob" || list[0].Idx != 1 {
+		t.Errorf("claims: %+v", list)
+	}
+
+	// Alice resolves her group, which releases her claim
+	if status := as("alice", "POST", "/api/v1/resolve-group", keep, nil); status != 200 {
+		t.Fatalf("resolving own claimed group: %d", status)
+	}
+	if status := getJSON(t, server.URL+"/api/v1/group/0/claim", nil); status != 404 {
+		t.Errorf("claim should be released once decided, got %d", status)
+	}
+	if status := as("bob", "DELETE", "/api/v1/group/1/claim", nil, nil); status != 204 {
+		t.Errorf("releasing own claim: %d", status)
+	}
+}
+
+func TestEventsStream(t *testing.T) {
+	lib := newFixtureLibrary(t, [][]fixtureImage{beachGroup, holidayGroup})
+	server := newTestServer(t, lib)
+
+	resp, err := http.Get(server.URL + "/api/v1/events")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if ct := resp.Header.Get("Content-Type"); ct != "text/event-stream" {
+		t.Fatalf("content type %q", ct)
+	}
+	lines := bufio.NewReader(resp.Body)
+	if line, _ := lines.ReadString('\n'); line != ": connected\n" {
+		t.Fatalf("first line %q", line)
+	}
+
+	postJSON(t, server.URL+"/api/v1/group/1/status", map[string]string{"status": "flagged"}, nil)
+	keep := map[string]interface{}{"idx": 0, "keep": lib.path("camera/DSC_0002.jpg")}
+	if status := postJSON(t, server.URL+"/api/v1/resolve-group", keep, nil); status != 200 {
+		t.Fatalf("resolve-group: %d", status)
+	}
+
+	// Read events until the group is resolved
+	got := make(map[string]string)
+	deadline := time.AfterFunc(5*time.Second, func() { resp.Body.Close() })
+	defer deadline.Stop()
+	event := ""
+	for got[eventResolved] == "" {
+		line, err := lines.ReadString('\n')
+		if err != nil {
+			t.Fatalf("stream ended after %v: %v", got, err)
+		}
+		if v, ok := strings.CutPrefix(line, "event: "); ok {
+			event = strings.TrimSpace(v)
+		} else if v, ok := strings.CutPrefix(line, "data: "); ok {
+			got[event] = strings.TrimSpace(v)
+		}
+	}
+	var status StatusEvent
+	json.Unmarshal([]byte(got[eventStatus]), &status)
+	if status.Idx != 1 || status.Status != statusFlagged {
+		t.Errorf("status event %s", got[eventStatus])
+	}
+	var deleted DeletedEvent
+	json.Unmarshal([]byte(got[eventDeleted]), &deleted)
+	if deleted.Path != "backup/DSC_0002.jpg" || deleted.Action == "" {
+		t.Errorf("deleted event %s", got[eventDeleted])
+	}
+	var resolved ResolvedEvent
+	json.Unmarshal([]byte(got[eventResolved]), &resolved)
+	if resolved.Idx != 0 || !reflect.DeepEqual(resolved.Kept, []string{"camera/DSC_0002.jpg"}) || !reflect.DeepEqual(resolved.Deleted, []string{"backup/DSC_0002.jpg"}) {
+		t.Errorf("resolved event %s", got[eventResolved])
+	}
+}
+
+func TestWatcherNoticesExternalRemovals(t *testing.T) {
+	lib := newFixtureLibrary(t, [][]fixtureImage{beachGroup, holidayGroup})
+	watchFiles = true
+	t.Cleanup(func() { watchFiles = false })
+	server := newTestServer(t, lib)
+
+	for deadline := time.Now().Add(5 * time.Second); ; time.Sleep(10 * time.Millisecond) {
+		watchMu.Lock()
+		ready := watchedDirs[lib.path("phone")]
+		watchMu.Unlock()
+		if ready {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("image root never watched")
+		}
+	}
+	resp, err := http.Get(server.URL + "/api/v1/events")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	lines := bufio.NewReader(resp.Body)
+	lines.ReadString('\n')
+
+	// A file renamed away and a whole directory removed behind the tool's back
+	if err := os.Rename(lib.path("backup/DSC_0002.jpg"), filepath.Join(t.TempDir(), "DSC_0002.jpg")); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.RemoveAll(lib.path("phone")); err != nil {
+		t.Fatal(err)
+	}
+	deadline := time.AfterFunc(5*time.Second, func() { resp.Body.Close() })
+	defer deadline.Stop()
+	removed := make(map[string]bool)
+	for len(removed) < 2 {
+		line, err := lines.ReadString('\n')
+		if err != nil {
+			t.Fatalf("stream ended after %v: %v", removed, err)
+		}
+		if data, ok := strings.CutPrefix(line, "data: "); ok {
+			var e DeletedEvent
+			json.Unmarshal([]byte(data), &e)
+			if e.Action != removedExternally {
+				t.Errorf("unexpected event %s", data)
+			}
+			removed[e.Path] = true
+		}
+	}
+	if !removed["backup/DSC_0002.jpg"] || !removed["phone/IMG-20200702-WA0001.jpg"] {
+		t.Errorf("removals announced: %v", removed)
+	}
+	if !fileGone(lib.path("phone/IMG-20200702-WA0001.jpg")) {
+		t.Error("file in the removed directory not marked gone")
+	}
+
+	var next struct{ Idx int }
+	if status := getJSON(t, server.URL+"/api/v1/group/next?after=-1", &next); status != 200 || next.Idx != 1 {
+		t.Errorf("next should pass by the group with one file left: status %d, idx %d", status, next.Idx)
+	}
+}
+
+func TestWriteBackRemainingDuplicates(t *testing.T) {
+	lib := newFixtureLibrary(t, [][]fixtureImage{beachGroup, holidayGroup})
+	server := newTestServer(t, lib)
+	if status := postJSON(t, server.URL+"/api/v1/write-back", nil, nil); status != 409 {
+		t.Errorf("expected 409 without -write-back, got %d", status)
+	}
+
+	writeBackMode = writeBackRemaining
+	t.Cleanup(func() { writeBackMode = "" })
+	keep := map[string]interface{}{"idx": 0, "keep": lib.path("camera/DSC_0002.jpg")}
+	if status := postJSON(t, server.URL+"/api/v1/resolve-group", keep, nil); status != 200 {
+		t.Fatalf("resolve-group: %d", status)
+	}
+	if status := postJSON(t, server.URL+"/api/v1/delete", map[string]string{"path": lib.path("phone/IMG-20200702-WA0001.jpg")}, nil); status != 200 {
+		t.Fatalf("delete: %d", status)
+	}
+
+	var result WriteBackResult
+	if status := postJSON(t, server.URL+"/api/v1/write-back", nil, &result); status != 200 {
+		t.Fatalf("write-back: %d", status)
+	}
+	want := filepath.Join(filepath.Dir(lib.DuplicatesFile), "duplicates.remaining.json")
+	if result.File != want || result.Groups != 1 || result.Files != 2 {
+		t.Errorf("result %+v, want 1 group of 2 files in %s", result, want)
+	}
+	written, err := readGroups(want)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var paths []string
+	for _, img := range written[0] {
+		paths = append(paths, getRelativeImagePath(img.Path))
+	}
+	if len(written) != 1 || !reflect.DeepEqual(paths, []string{"camera/DSC_0001.jpg", "camera/DSC_0001.cr2"}) {
+		t.Errorf("remaining groups: %v", paths)
+	}
+
+	// The remaining file is what the next run opens
+	if format := detectFormat(want); format.Schema != 1 {
+		t.Errorf("remaining file not a czkawka export: %+v", format)
+	}
+}
+
+func TestInstanceLock(t *testing.T) {
+	lib := newFixtureLibrary(t, [][]fixtureImage{beachGroup})
+	newTestServer(t, lib)
+	path := instanceLockPath(lib.DuplicatesFile)
+	held, err := readInstanceLock(path)
+	if err != nil || held.PID != os.Getpid() {
+		t.Fatalf("lock %+v: %v", held, err)
+	}
+
+	// A second instance is refused while this one runs
+	if err := acquireInstanceLock(lib.DuplicatesFile); err == nil || !strings.Contains(err.Error(), "-force") {
+		t.Errorf("expected a refusal mentioning -force, got %v", err)
+	}
+
+	// A lock left behind by an instance that died is taken over
+	gone := exec.Command("true")
+	if err := gone.Run(); err != nil {
+		t.Skip("no true command:", err)
+	}
+	stale := held
+	stale.PID = gone.Process.Pid
+	data, _ := json.Marshal(stale)
+	os.WriteFile(path, data, 0644)
+	closeDataset()
+	if _, err := os.Stat(path); err != nil {
+		t.Errorf("another instance's lock removed on close: %v", err)
+	}
+	if err := openDataset(); err != nil {
+		t.Fatalf("stale lock not taken over: %v", err)
+	}
+	if held, _ := readInstanceLock(path); held.PID != os.Getpid() {
+		t.Errorf("lock after takeover: %+v", held)
+	}
+
+	closeDataset()
+	if _, err := os.Stat(path); !os.IsNotExist(err) {
+		t.Errorf("lock left behind after closing: %v", err)
+	}
+	openDataset() // For the test server's cleanup
+}
+
+func TestDuplicatesFromStdin(t *testing.T) {
+	lib := newFixtureLibrary(t, [][]fixtureImage{beachGroup, holidayGroup})
+	data, err := os.ReadFile(lib.DuplicatesFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dir := t.TempDir()
+	spooled, err := spoolDuplicates(bytes.NewReader(data), dir)
+	if err != nil || spooled != filepath.Join(dir, stdinSpool) {
+		t.Fatalf("spooled to %s: %v", spooled, err)
+	}
+
+	// Compressed input keeps its compression, so it's read back as such
+	var packed bytes.Buffer
+	zw := gzip.NewWriter(&packed)
+	zw.Write(data)
+	zw.Close()
+	if spooled, err = spoolDuplicates(&packed, dir); err != nil || filepath.Ext(spooled) != ".gz" {
+		t.Fatalf("spooled gzip to %s: %v", spooled, err)
+	}
+	loaded, err := readGroups(spooled)
+	if err != nil || len(loaded) != 2 {
+		t.Fatalf("read back %d groups: %v", len(loaded), err)
+	}
+
+	if _, err := spoolDuplicates(strings.NewReader(""), dir); err == nil {
+		t.Error("expected an error for empty input")
+	}
+	if entries, _ := os.ReadDir(dir); len(entries) != 2 {
+		t.Errorf("temp files left behind: %v", entries)
+	}
+
+	lib.DuplicatesFile = spooled
+	server := newTestServer(t, lib)
+	var group V1Group
+	if status := getJSON(t, server.URL+"/api/v1/group?idx=1", &group); status != 200 || len(group.Images) != 3 {
+		t.Errorf("group from stdin: status %d, %d images", status, len(group.Images))
+	}
+}
+
+func TestReplacedLazyGroupsStayOpenForReaders(t *testing.T) {
+	lib := newFixtureLibrary(t, [][]fixtureImage{beachGroup, holidayGroup})
+	data, err := os.ReadFile(lib.DuplicatesFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var gz bytes.Buffer
+	zw := gzip.NewWriter(&gz)
+	zw.Write(data)
+	zw.Close()
+	path := filepath.Join(t.TempDir(), "duplicates.json.gz")
+	if err := os.WriteFile(path, gz.Bytes(), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	lazyGroups = true
+	defer func() { lazyGroups = false }()
+	tempDir = t.TempDir()
+	loaded, err := openGroups(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	setGroups(loaded)
+	store, release := acquireGroups()
+
+	// A reload meanwhile leaves the store held above readable
+	setGroups(memGroups(nil))
+	if group, err := store.Group(1); err != nil || len(group) != 3 {
+		t.Errorf("replaced store while held: %v: %v", group, err)
+	}
+	release()
+	if _, err := store.Group(1); err == nil {
+		t.Error("replaced store still open after its last reader")
+	}
+	// Neither the index nor the unpacked copy of the file is left behind
+	if left, _ := os.ReadDir(tempDir); len(left) != 0 {
+		t.Errorf("left in the temp directory: %v", left)
+	}
+}
+
+func TestCompressedDuplicatesFiles(t *testing.T) {
+	lib := newFixtureLibrary(t, [][]fixtureImage{beachGroup, holidayGroup})
+	data, err := os.ReadFile(lib.DuplicatesFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dir := t.TempDir()
+	var gz bytes.Buffer
+	zw := gzip.NewWriter(&gz)
+	zw.Write(data)
+	zw.Close()
+	enc, _ := zstd.NewWriter(nil)
+	files := map[string][]byte{
+		"duplicates.json.zst": enc.EncodeAll(data, nil),
+		"duplicates.json":     gz.Bytes(), // Compressed despite the name
+	}
+	want := map[string]string{"duplicates.json.zst": "zstd", "duplicates.json": "gzip"}
+
+	for name, content := range files {
+		path := filepath.Join(dir, name)
+		if err := os.WriteFile(path, content, 0644); err != nil {
+			t.Fatal(err)
+		}
+		if got := duplicatesCompression(path); got != want[name] {
+			t.Errorf("%s detected as %q, want %q", name, got, want[name])
+		}
+		for _, lazy := range []bool{false, true} {
+			lazyGroups = lazy
+			tempDir = t.TempDir()
+			store, err := openGroups(path)
+			if err != nil {
+				t.Fatalf("%s (lazy %v): %v", name, lazy, err)
+			}
+			group, err := store.Group(1)
+			if store.Len() != 2 || err != nil || len(group) != 3 {
+				t.Errorf("%s (lazy %v): %d groups, group 1 %v: %v", name, lazy, store.Len(), group, err)
+			}
+			if closer, ok := store.(io.Closer); ok {
+				closer.Close()
+			}
+		}
+	}
+	lazyGroups = false
+	if got := duplicatesCompression(lib.DuplicatesFile); got != "" {
+		t.Errorf("plain JSON detected as %q", got)
+	}
+}
+
+func TestMergeDuplicatesFiles(t *testing.T) {
+	lib := newFixtureLibrary(t, [][]fixtureImage{beachGroup, holidayGroup})
+	export, err := readGroups(lib.DuplicatesFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Two scans that both found the holiday group, one of them gzipped
+	dir := filepath.Dir(lib.DuplicatesFile)
+	first, second := filepath.Join(dir, "2019.json"), filepath.Join(dir, "2020.json.gz")
+	data, _ := json.Marshal(export)
+	os.WriteFile(first, data, 0644)
+	data, _ = json.Marshal([][]Image{export[1], {export[0][0], export[1][0]}})
+	var gz bytes.Buffer
+	zw := gzip.NewWriter(&gz)
+	zw.Write(data)
+	zw.Close()
+	os.WriteFile(second, gz.Bytes(), 0644)
+
+	// The flag can be repeated as well as given a list
+	flags := flag.NewFlagSet("test", flag.ContinueOnError)
+	flags.Var(&duplicatesFlag{}, "duplicates", "")
+	defer func(old string) { duplicatesFile = old }(duplicatesFile)
+	if err := flags.Parse([]string{"-duplicates", first, "-duplicates", second}); err != nil || duplicatesFile != first+","+second {
+		t.Fatalf("-duplicates given twice: %q, %v", duplicatesFile, err)
+	}
+
+	lib.DuplicatesFile = first + "," + second
+	server := newTestServer(t, lib)
+	var progress Progress
+	getJSON(t, server.URL+"/api/v1/progress", &progress)
+	if progress.TotalGroups != 3 {
+		t.Errorf("expected the holiday group once among 3 groups, got %d", progress.TotalGroups)
+	}
+	var group V1Group
+	if status := getJSON(t, server.URL+"/api/v1/group?idx=2", &group); status != 200 || len(group.Images) != 2 {
+		t.Errorf("group from the second file: status %d, %d images", status, len(group.Images))
+	}
+	for _, file := range []string{first, second} {
+		if !exists(instanceLockPath(file)) {
+			t.Errorf("%s not locked", file)
+		}
+	}
+	if !exists(filepath.Join(stateDir, mergedDuplicates)) {
+		t.Error("merged file not in the state directory")
+	}
+}
+
+func TestDuplicatesDirectory(t *testing.T) {
+	lib := newFixtureLibrary(t, [][]fixtureImage{beachGroup, holidayGroup})
+	export, err := readGroups(lib.DuplicatesFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Per-folder results from a cron job, next to files that aren't results
+	dir := t.TempDir()
+	write := func(name string, v interface{}) {
+		data, _ := json.Marshal(v)
+		if err := os.WriteFile(filepath.Join(dir, name), data, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	write("beach.json", export[:1])
+	write("holiday.json", export[1:])
+	write("beach.remaining.json", export)
+	write("settings.json", map[string]string{"not": "results"})
+
+	files, err := duplicatesSources(dir)
+	if err != nil || !reflect.DeepEqual(files, []string{filepath.Join(dir, "beach.json"), filepath.Join(dir, "holiday.json")}) {
+		t.Fatalf("results files %v: %v", files, err)
+	}
+	if _, err := duplicatesSources(t.TempDir()); err == nil {
+		t.Error("expected an error for a directory without results")
+	}
+
+	lib.DuplicatesFile = dir
+	server := newTestServer(t, lib)
+	var group V1Group
+	getJSON(t, server.URL+"/api/v1/group?idx=1", &group)
+	if group.Source != "holiday.json" || len(group.Images) != 3 {
+		t.Errorf("group 1 from %q with %d images", group.Source, len(group.Images))
+	}
+	resp, err := http.Get(server.URL + "/api/v1/groups?source=beach.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	var summaries []GroupSummary
+	for dec := json.NewDecoder(resp.Body); ; {
+		var s GroupSummary
+		if dec.Decode(&s) != nil {
+			break
+		}
+		summaries = append(summaries, s)
+	}
+	if len(summaries) != 1 || summaries[0].Idx != 0 || summaries[0].Source != "beach.json" {
+		t.Errorf("groups from beach.json: %+v", summaries)
+	}
+}
+
+func TestPrettyAndTextResults(t *testing.T) {
+	lib := newFixtureLibrary(t, [][]fixtureImage{beachGroup, holidayGroup})
+	export, err := readGroups(lib.DuplicatesFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dir := t.TempDir()
+	pretty, _ := json.MarshalIndent(export, "", "  ")
+	// --file-to-save, older versions printing paths as they are and newer
+	// ones quoting them
+	var text strings.Builder
+	fmt.Fprintf(&text, "Results of searching [%q] with excluded directories [] and excluded items []\n", lib.Root)
+	fmt.Fprintf(&text, "%d images which have similar friends\n\n", len(export))
+	for i, group := range export {
+		fmt.Fprintf(&text, "Found %d images which have similar friends\n", len(group))
+		for j, img := range group {
+			path := img.Path
+			if i == 1 {
+				path = fmt.Sprintf("%q", path)
+			}
+			level := "Very High"
+			if j == 0 {
+				level = "Original"
+			}
+			fmt.Fprintf(&text, "%s - %dx%d - 1.00 KiB - %s\n", path, img.Width, img.Height, level)
+		}
+		text.WriteString("\n")
+	}
+	files := map[string][]byte{"pretty.json": pretty, "results.txt": []byte(text.String())}
+	wantFormat := map[string]string{"pretty.json": "czkawka-similar-images", "results.txt": "czkawka-similar-images-text"}
+
+	for name, content := range files {
+		path := filepath.Join(dir, name)
+		if err := os.WriteFile(path, content, 0644); err != nil {
+			t.Fatal(err)
+		}
+		if format := detectFormat(path); format.Format != wantFormat[name] || format.Schema != 1 {
+			t.Errorf("%s detected as %+v", name, format)
+		}
+		for _, lazy := range []bool{false, true} {
+			lazyGroups = lazy
+			tempDir = t.TempDir()
+			store, err := openGroups(path)
+			if err != nil {
+				t.Fatalf("%s (lazy %v): %v", name, lazy, err)
+			}
+			if store.Len() != len(export) {
+				t.Errorf("%s (lazy %v): %d groups", name, lazy, store.Len())
+			}
+			for idx := 0; idx < store.Len(); idx++ {
+				group, err := store.Group(idx)
+				if err != nil || len(group) != len(export[idx]) {
+					t.Fatalf("%s (lazy %v): group %d %v: %v", name, lazy, idx, group, err)
+				}
+				for j, img := range group {
+					want := export[idx][j]
+					if img.Path != want.Path || img.Width != want.Width || img.Height != want.Height || img.Size != want.Size {
+						t.Errorf("%s (lazy %v): group %d image %d is %+v, want %+v", name, lazy, idx, j, img, want)
+					}
+				}
+			}
+			if closer, ok := store.(io.Closer); ok {
+				closer.Close()
+			}
+		}
+	}
+	lazyGroups = false
+	if !isResultsFile(filepath.Join(dir, "results.txt")) {
+		t.Error("text results not taken from a directory")
+	}
+	notes := filepath.Join(dir, "notes.txt")
+	os.WriteFile(notes, []byte("remember to back up\n"), 0644)
+	if isResultsFile(notes) {
+		t.Error("notes.txt taken for results")
+	}
+
+	if got, err := unquoteRust(`"/photos/caf\u{e9} \"2020\"/a\\b.jpg"`); err != nil || got != `/photos/café "2020"/a\b.jpg` {
+		t.Errorf("unquoted %q: %v", got, err)
+	}
+}
+
+func TestFdupesResults(t *testing.T) {
+	lib := newFixtureLibrary(t, [][]fixtureImage{beachGroup, holidayGroup})
+	export, err := readGroups(lib.DuplicatesFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// jdupes -S for the first group, fdupes run inside the library (so with
+	// relative paths) for the second
+	var out strings.Builder
+	fmt.Fprintf(&out, "%d bytes each:\n", export[0][0].Size)
+	for _, img := range export[0] {
+		out.WriteString(img.Path + "\n")
+	}
+	out.WriteString("\n")
+	for _, img := range export[1] {
+		rel, _ := filepath.Rel(lib.Root, img.Path)
+		out.WriteString("./" + filepath.ToSlash(rel) + "\n")
+	}
+	out.WriteString("\n" + lib.path("camera/DSC_0001.jpg") + "\n") // A lone file isn't a group
+	path := filepath.Join(t.TempDir(), "fdupes.txt")
+	if err := os.WriteFile(path, []byte(out.String()), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if format := detectFormat(path); format.Format != formatFdupes {
+		t.Errorf("detected as %+v", format)
+	}
+
+	lib.DuplicatesFile = path
+	server := newTestServer(t, lib)
+	for idx, want := range export {
+		var group V1Group
+		getJSON(t, fmt.Sprintf("%s/api/v1/group?idx=%d", server.URL, idx), &group)
+		if len(group.Images) != len(want) {
+			t.Fatalf("group %d has %d images, want %d", idx, len(group.Images), len(want))
+		}
+		byPath := make(map[string]Image)
+		for _, img := range want {
+			byPath[getRelativeImagePath(img.Path)] = img
+		}
+		for _, img := range group.Images {
+			w, ok := byPath[img.Path]
+			if !ok {
+				t.Errorf("group %d has %s", idx, img.Path)
+				continue
+			}
+			info, err := os.Stat(w.Path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if img.Size != info.Size() || img.ModifiedDate != info.ModTime().Unix() {
+				t.Errorf("%s is %d bytes from %d, want %d from %d", img.Path, img.Size, img.ModifiedDate, info.Size(), info.ModTime().Unix())
+			}
+			if !strings.HasSuffix(img.Path, ".cr2") && (img.Width != w.Width || img.Height != w.Height) {
+				t.Errorf("%s is %dx%d, want %dx%d", img.Path, img.Width, img.Height, w.Width, w.Height)
+			}
+		}
+	}
+	resp, err := http.Get(server.URL + "/api/v1/group?idx=2")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != 404 {
+		t.Errorf("a third group: %s", resp.Status)
+	}
+}
+
+func TestRmlintResults(t *testing.T) {
+	lib := newFixtureLibrary(t, [][]fixtureImage{beachGroup, holidayGroup})
+	// rmlint -o json: a header, the duplicates set by set with the one it
+	// would keep marked original, other lint and a footer
+	entries := []map[string]interface{}{
+		{"description": "rmlint json-dump of lint files", "cwd": lib.Root, "args": "rmlint " + lib.Root + " -o json", "version": "2.10.2"},
+		{"id": 1, "type": "duplicate_file", "digest": "aa", "path": lib.path("camera/DSC_0002.jpg"), "size": 100, "mtime": 1577836800.5, "is_original": false},
+		{"id": 2, "type": "duplicate_file", "digest": "aa", "path": lib.path("backup/DSC_0002.jpg"), "size": 100, "mtime": 1577836900.5, "is_original": true},
+		{"id": 3, "type": "emptyfile", "path": lib.path("empty.txt"), "size": 0},
+		{"id": 4, "type": "duplicate_file", "digest": "bb", "path": lib.path("camera/DSC_0001.jpg"), "size": 200, "mtime": 1577836800, "is_original": true},
+		{"id": 5, "type": "duplicate_file", "digest": "bb", "path": lib.path("phone/IMG-20200702-WA0001.jpg"), "size": 200, "mtime": 1577836800, "is_original": false},
+		{"aborted": false, "progress": 100, "total_files": 5, "duplicates": 2, "duplicate_sets": 2},
+	}
+	data, _ := json.MarshalIndent(entries, "", "  ")
+	path := filepath.Join(t.TempDir(), "rmlint.json")
+	if err := os.WriteFile(path, data, 0644); err != nil {
+		t.Fatal(err)
+	}
+	if format := detectFormat(path); format.Format != formatRmlint || format.Warning != "" {
+		t.Errorf("detected as %+v", format)
+	}
+
+	lib.DuplicatesFile = path
+	server := newTestServer(t, lib)
+	var group V1Group
+	getJSON(t, server.URL+"/api/v1/group?idx=0", &group)
+	if len(group.Images) != 2 || group.Images[0].Path != "backup/DSC_0002.jpg" || !group.Images[0].Original {
+		t.Fatalf("keeper of rmlint's first set is %+v, want its original", group.Images)
+	}
+	if breakdown := group.Images[0].Breakdown; breakdown[len(breakdown)-1] != "marked original +10" {
+		t.Errorf("breakdown %v", group.Images[0].Breakdown)
+	}
+	if group.Images[1].ModifiedDate != 1577836800 || group.Images[1].Original {
+		t.Errorf("duplicate is %+v", group.Images[1])
+	}
+	getJSON(t, server.URL+"/api/v1/group?idx=1", &group)
+	if len(group.Images) != 2 || group.Images[0].Path != "camera/DSC_0001.jpg" {
+		t.Errorf("keeper of rmlint's second set is %+v", group.Images)
+	}
+	resp, err := http.Get(server.URL + "/api/v1/group?idx=2")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != 404 {
+		t.Errorf("a third group: %s", resp.Status)
+	}
+}
+
+func TestDupeguruResults(t *testing.T) {
+	lib := newFixtureLibrary(t, [][]fixtureImage{beachGroup, holidayGroup})
+	dir := t.TempDir()
+	// File > Save Results, references (the files dupeGuru keeps) first
+	xmlResults := fmt.Sprintf(`<?xml version='1.0' encoding='utf-8'?>
+<results>
+  <group>
+    <file path=%q words="" is_ref="n" marked="n" />
+    <file path=%q words="" is_ref="n" marked="y" />
+    <match first="0" second="1" percentage="100" />
+  </group>
+  <group>
+    <file path=%q words="" is_ref="n" marked="n" />
+    <file path=%q words="" is_ref="n" marked="y" />
+    <file path=%q words="" is_ref="n" marked="n" />
+    <match first="0" second="1" percentage="96" />
+    <match first="0" second="2" percentage="91" />
+    <match first="1" second="2" percentage="93" />
+  </group>
+</results>
+`, lib.path("backup/DSC_0002.jpg"), lib.path("camera/DSC_0002.jpg"),
+		lib.path("phone/IMG-20200702-WA0001.jpg"), lib.path("camera/DSC_0001.jpg"), lib.path("camera/DSC_0001.cr2"))
+	// Export to CSV, with the columns of picture mode
+	csvResults := "Group ID,Filename,Folder,Size (KB),Kind,Dimensions,Modification,Match %\r\n" +
+		fmt.Sprintf("0,DSC_0002.jpg,%s,12,jpg,640 x 480,2020/01/01 00:00,100\r\n", lib.path("backup")) +
+		fmt.Sprintf("0,DSC_0002.jpg,%s,12,jpg,640 x 480,2020/01/01 00:00,100\r\n", lib.path("camera")) +
+		fmt.Sprintf("1,DSC_0001.jpg,%s,20,jpg,1200 x 900,2020/01/01 00:00,100\r\n", lib.path("camera")) +
+		fmt.Sprintf("1,IMG-20200702-WA0001.jpg,%s,20,jpg,800 x 600,2020/01/01 00:00,94\r\n", lib.path("phone"))
+	files := map[string]string{"results.dupeguru": xmlResults, "export.csv": csvResults}
+	wantFormat := map[string]string{"results.dupeguru": formatDupeguruXML, "export.csv": formatDupeguruCSV}
+
+	for name, content := range files {
+		path := filepath.Join(dir, name)
+		if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+		if format := detectFormat(path); format.Format != wantFormat[name] || format.Warning != "" {
+			t.Errorf("%s detected as %+v", name, format)
+		}
+		loaded, err := readGroups(path)
+		if err != nil || len(loaded) != 2 {
+			t.Fatalf("%s: %d groups: %v", name, len(loaded), err)
+		}
+		for _, group := range loaded {
+			for i, img := range group {
+				info, err := os.Stat(img.Path)
+				if err != nil || img.Size != info.Size() || img.ModifiedDate != info.ModTime().Unix() {
+					t.Errorf("%s: %+v doesn't match the file on disk (%v)", name, img, err)
+				}
+				if img.Original != (i == 0) {
+					t.Errorf("%s: %s marked original %v", name, img.Path, img.Original)
+				}
+			}
+		}
+		if first := loaded[0][0]; first.Path != lib.path("backup/DSC_0002.jpg") {
+			t.Errorf("%s: first reference is %s", name, first.Path)
+		}
+	}
+	csvGroups, _ := readGroups(filepath.Join(dir, "export.csv"))
+	if phone := csvGroups[1][1]; phone.Width != 800 || phone.Height != 600 || phone.Similarity != 6 {
+		t.Errorf("CSV row read as %+v", phone)
+	}
+
+	lib.DuplicatesFile = filepath.Join(dir, "results.dupeguru")
+	server := newTestServer(t, lib)
+	var group V1Group
+	getJSON(t, server.URL+"/api/v1/group?idx=1", &group)
+	if len(group.Images) != 3 || group.Images[0].Path != "phone/IMG-20200702-WA0001.jpg" || !group.Images[0].Original {
+		t.Fatalf("keeper is %+v, want dupeGuru's reference", group.Images)
+	}
+	for _, img := range group.Images[1:] {
+		if want := map[string]int{"camera/DSC_0001.jpg": 4, "camera/DSC_0001.cr2": 7}[img.Path]; img.Similarity != want {
+			t.Errorf("%s has similarity %d, want %d", img.Path, img.Similarity, want)
+		}
+	}
+}
+
+func TestCzkawkaSchemas(t *testing.T) {
+	lib := newFixtureLibrary(t, [][]fixtureImage{beachGroup, holidayGroup})
+	export, err := readGroups(lib.DuplicatesFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dir := t.TempDir()
+	write := func(name string, v interface{}) string {
+		path := filepath.Join(dir, name)
+		data, _ := json.MarshalIndent(v, "", "  ")
+		if err := os.WriteFile(path, data, 0644); err != nil {
+			t.Fatal(err)
+		}
+		return path
+	}
+	// With reference folders, each group is a reference and its matches
+	var referenced []interface{}
+	for _, group := range export {
+		referenced = append(referenced, []interface{}{group[0], group[1:]})
+	}
+	refPath := write("referenced.json", referenced)
+	if format := detectFormat(refPath); format.Schema != 2 || format.Warning != "" {
+		t.Errorf("reference layout detected as %+v", format)
+	}
+	for _, lazy := range []bool{false, true} {
+		lazyGroups = lazy
+		tempDir = t.TempDir()
+		store, err := openGroups(refPath)
+		if err != nil {
+			t.Fatalf("lazy %v: %v", lazy, err)
+		}
+		for idx := 0; idx < store.Len(); idx++ {
+			group, err := store.Group(idx)
+			if err != nil || len(group) != len(export[idx]) || group[0].Path != export[idx][0].Path || !group[0].Original || group[1].Original {
+				t.Errorf("lazy %v: group %d is %+v: %v", lazy, idx, group, err)
+			}
+		}
+		if closer, ok := store.(io.Closer); ok {
+			closer.Close()
+		}
+	}
+	lazyGroups = false
+
+	// Merged with a file of the older layout, everything ends up in that one
+	stateDir = t.TempDir()
+	plain := write("plain.json", [][]Image{export[0]})
+	merged := filepath.Join(stateDir, mergedDuplicates)
+	if _, err := mergeDuplicatesFiles([]string{plain, refPath}, merged); err != nil {
+		t.Fatal(err)
+	}
+	if format := detectFormat(merged); format.Schema != 1 {
+		t.Errorf("merge detected as %+v", format)
+	}
+	if loaded, err := readGroups(merged); err != nil || len(loaded) != 2 {
+		t.Errorf("merge has %d groups: %v", len(loaded), err)
+	}
+
+	// Renamed fields are an error naming what is supported, not groups of
+	// files that are never there
+	renamed := write("renamed.json", [][]map[string]interface{}{{{"file_path": export[0][0].Path, "size": 1}, {"file_path": export[0][1].Path, "size": 1}}})
+	if format := detectFormat(renamed); format.Schema != 0 || !strings.Contains(format.Warning, `no "path" field`) {
+		t.Errorf("renamed fields detected as %+v", format)
+	}
+	for _, lazy := range []bool{false, true} {
+		lazyGroups = lazy
+		tempDir = t.TempDir()
+		_, err := openGroups(renamed)
+		if err == nil || !strings.Contains(err.Error(), "schema 1 (") || !strings.Contains(err.Error(), "schema 2 (") {
+			t.Errorf("lazy %v: loading renamed fields gave %v", lazy, err)
+		}
+	}
+	lazyGroups = false
+
+	server := newTestServer(t, lib)
+	var version struct {
+		SupportedSchema  int             `json:"supported_schema"`
+		SupportedSchemas []czkawkaSchema `json:"supported_schemas"`
+	}
+	getJSON(t, server.URL+"/api/v1/version", &version)
+	if version.SupportedSchema != 2 || len(version.SupportedSchemas) != 2 || version.SupportedSchemas[1].Description == "" {
+		t.Errorf("version reports %+v", version)
+	}
+}
+
+func TestFailedScanCarriesOn(t *testing.T) {
+	lib := newFixtureLibrary(t, [][]fixtureImage{beachGroup})
+	server := newTestServer(t, lib)
+	// A czkawka that logs its hashing passes and fails the first final pass
+	dir := t.TempDir()
+	script := filepath.Join(dir, "czkawka_cli")
+	os.WriteFile(script, []byte(`#!/bin/sh
+for out; do :; done
+case "$out" in *scan-pass.json) echo "$3" >>`+dir+`/passes; exit 0;; esac
+[ -e `+dir+`/failed ] || { touch `+dir+`/failed; echo out of memory >&2; exit 1; }
+cp `+lib.DuplicatesFile+` "$out"
+`), 0755)
+	old := czkawkaCmd
+	czkawkaCmd = script
+	t.Cleanup(func() { czkawkaCmd = old })
+
+	scan := func() ScanJob {
+		t.Helper()
+		if status := postJSON(t, server.URL+"/api/scan", ScanParams{}, nil); status != 202 {
+			t.Fatalf("POST /api/scan: status %d", status)
+		}
+		var job ScanJob
+		for deadline := time.Now().Add(5 * time.Second); time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+			if getJSON(t, server.URL+"/api/scan", &job); job.Status != "running" {
+				break
+			}
+		}
+		return job
+	}
+	if job := scan(); job.Status != "failed" || len(job.Completed) != 2 {
+		t.Fatalf("first scan: %+v", job)
+	}
+	if _, err := os.Stat(scanCheckpointPath()); err != nil {
+		t.Errorf("checkpoint of the failed scan removed: %v", err)
+	}
+	if job := scan(); job.Status != "completed" || !job.Resumed {
+		t.Fatalf("second scan: %+v", job)
+	}
+	passes, _ := os.ReadFile(filepath.Join(dir, "passes"))
+	if n := strings.Count(string(passes), "\n"); n != 2 {
+		t.Errorf("directories hashed again after the failure:\n%s", passes)
+	}
+	if _, err := os.Stat(scanCheckpointPath()); !os.IsNotExist(err) {
+		t.Errorf("checkpoint left after the scan completed: %v", err)
+	}
+}
+
+func TestScanOfSomeDirectoriesKeepsOtherGroups(t *testing.T) {
+	backups := []fixtureImage{
+		{Name: "backup/IMG_0001.jpg", Width: 640, Height: 480, Seed: 5},
+		{Name: "backup/IMG_0001 (1).jpg", Width: 640, Height: 480, Seed: 5},
+	}
+	lib := newFixtureLibrary(t, [][]fixtureImage{beachGroup, holidayGroup, backups})
+	server := newTestServer(t, lib)
+	// A czkawka that finds nothing: the copies in backup/ were cleaned up
+	script := filepath.Join(t.TempDir(), "czkawka_cli")
+	os.WriteFile(script, []byte("#!/bin/sh\nfor out; do :; done\necho '[]' >\"$out\"\n"), 0755)
+	old := czkawkaCmd
+	czkawkaCmd = script
+	t.Cleanup(func() { czkawkaCmd = old })
+	var before []string
+	for idx := 0; idx < 2; idx++ {
+		group, _ := currentGroups().Group(idx)
+		before = append(before, groupKey(group))
+	}
+
+	if status := postJSON(t, server.URL+"/api/scan", ScanParams{Directories: []string{"backup"}}, nil); status != 202 {
+		t.Fatalf("POST /api/scan: status %d", status)
+	}
+	var job ScanJob
+	for deadline := time.Now().Add(5 * time.Second); time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+		if getJSON(t, server.URL+"/api/scan", &job); job.Status != "running" {
+			break
+		}
+	}
+	// The beach group also has a file in camera/, so it stays
+	if job.Status != "completed" || job.Groups != 2 || job.Kept != 2 {
+		t.Fatalf("scan of backup/: %+v", job)
+	}
+	for idx := 0; idx < 2; idx++ {
+		if group, err := currentGroups().Group(idx); err != nil || groupKey(group) != before[idx] {
+			t.Errorf("group %d after the scan: %+v, %v", idx, group, err)
+		}
+	}
+}
@@ -0,0 +1,135 @@
+package main
+
+import (
+	"encoding/json"
+	"io/fs"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+)
+
+// Remove directories left empty by deletions and moves (-prune-empty-dirs)
+var pruneEmptyDirs bool
+
+// Remove dir and its parents for as long as they are empty, stopping at the
+// image root. Returns what was removed.
+func removeEmptyParents(r *http.Request, dir string) []string {
+	var removed []string
+	root := filepath.Clean(imageRoot)
+	for d := filepath.Clean(dir); withinImageRoot(d) && d != root && !readOnly(d); d = filepath.Dir(d) {
+		if os.Remove(d) != nil { // Fails unless the directory is empty
+			break
+		}
+		audit(r, actionDirRemoved, d, "", 0, -1, "empty directory")
+		recordAction(d, actionDirRemoved, -1, "empty directory")
+		removed = append(removed, d)
+	}
+	return removed
+}
+
+// Remove dir if it holds nothing but empty directories, then any parents left
+// empty by that. Returns what was removed.
+func removeEmptyDirs(r *http.Request, dir string) []string {
+	var removed []string
+	var prune func(string) bool
+	prune = func(d string) bool {
+		entries, err := os.ReadDir(d)
+		if err != nil {
+			return false
+		}
+		empty := true
+		for _, e := range entries {
+			if !e.IsDir() || !prune(filepath.Join(d, e.Name())) {
+				empty = false
+			}
+		}
+		if !empty || d == filepath.Clean(dir) {
+			return empty
+		}
+		if os.Remove(d) != nil {
+			return false
+		}
+		audit(r, actionDirRemoved, d, "", 0, -1, "empty directory")
+		recordAction(d, actionDirRemoved, -1, "empty directory")
+		removed = append(removed, d)
+		return true
+	}
+	if prune(filepath.Clean(dir)) {
+		removed = append(removed, removeEmptyParents(r, dir)...)
+	}
+	return removed
+}
+
+// Called after a file was deleted or moved away
+func pruneAfterRemoval(r *http.Request, path string) {
+	if !pruneEmptyDirs {
+		return
+	}
+	for _, d := range removeEmptyParents(r, filepath.Dir(path)) {
+		logFor("delete").Info("removed empty directory", "dir", d)
+	}
+}
+
+// Topmost directories under the image root that contain no files at all
+func findEmptyDirs() []string {
+	empty := make(map[string]bool)
+	var dirs []string
+	root := filepath.Clean(imageRoot)
+	filepath.WalkDir(root, func(path string, d fs.DirEntry, err error) error {
+		if err == nil && d.IsDir() {
+			if readOnly(path) {
+				return filepath.SkipDir
+			}
+			dirs = append(dirs, path)
+		}
+		return nil
+	})
+	// Deepest first, so a directory is known to be empty once all its children are
+	sort.Slice(dirs, func(i, j int) bool { return len(dirs[i]) > len(dirs[j]) })
+	for _, dir := range dirs {
+		entries, err := os.ReadDir(dir)
+		if err != nil {
+			continue
+		}
+		isEmpty := true
+		for _, e := range entries {
+			if !e.IsDir() || !empty[filepath.Join(dir, e.Name())] {
+				isEmpty = false
+				break
+			}
+		}
+		empty[dir] = isEmpty
+	}
+
+	found := []string{}
+	for dir, isEmpty := range empty {
+		if isEmpty && dir != root && !empty[filepath.Dir(dir)] {
+			found = append(found, dir)
+		}
+	}
+	sort.Strings(found)
+	return found
+}
+
+// GET lists empty directories under the image root; POST removes them all
+func emptyDirsHandler(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case "GET":
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(findEmptyDirs())
+	case "POST":
+		removed := []string{}
+		for _, dir := range findEmptyDirs() {
+			removed = append(removed, removeEmptyDirs(r, dir)...)
+		}
+		reqLog(r, "delete").Info("removed empty directories", "count", len(removed))
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"success": true,
+			"removed": removed,
+		})
+	default:
+		http.Error(w, "Method not allowed", 405)
+	}
+}
@@ -0,0 +1,159 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// Kinds of events sent on /api/events
+const (
+	eventDeleted   = "deleted"   // A file was deleted, trashed or quarantined, or removed outside the tool
+	eventResolved  = "resolved"  // A group was decided
+	eventStatus    = "status"    // A group's review status was set or cleared
+	eventConverted = "converted" // A CR2 finished converting to JPG
+)
+
+// How often an idle stream gets a comment, so proxies don't time it out
+const eventKeepAlive = 30 * time.Second
+
+// Events a subscriber can fall behind by before it misses some
+const eventBuffer = 64
+
+type Event struct {
+	ID   int64
+	Type string
+	Data interface{} // Sent as JSON
+}
+
+// Payloads of the events
+type (
+	DeletedEvent struct {
+		Path   string `json:"path"` // Relative to the image root
+		Size   int64  `json:"size"`
+		Action string `json:"action"` // "external" if removed outside the tool
+	}
+	ResolvedEvent struct {
+		Idx        int      `json:"idx"`
+		Key        string   `json:"key"`
+		Kept       []string `json:"kept"`
+		Deleted    []string `json:"deleted"`
+		Hardlinked []string `json:"hardlinked"`
+	}
+	StatusEvent struct {
+		Idx    int    `json:"idx"`
+		Key    string `json:"key"`
+		Status string `json:"status"` // Empty when cleared
+	}
+	ConvertedEvent struct {
+		Path string `json:"path"` // Relative to the image root
+	}
+)
+
+var (
+	eventsMu    sync.Mutex
+	eventNext   int64 = 1
+	subscribers       = make(map[chan Event]bool)
+)
+
+// Send an event to every open /api/events stream. A subscriber too far
+// behind misses it rather than holding up the caller.
+func publish(typ string, data interface{}) {
+	eventsMu.Lock()
+	defer eventsMu.Unlock()
+	e := Event{ID: eventNext, Type: typ, Data: data}
+	eventNext++
+	for ch := range subscribers {
+		select {
+		case ch <- e:
+		default:
+		}
+	}
+}
+
+// Let open streams know group idx was decided
+func publishResolved(idx int, result DecideResult) {
+	group, err := currentGroups().Group(idx)
+	if err != nil {
+		return
+	}
+	relative := func(paths []string) []string {
+		list := []string{}
+		for _, path := range paths {
+			list = append(list, getRelativeImagePath(path))
+		}
+		return list
+	}
+	publish(eventResolved, ResolvedEvent{Idx: idx, Key: groupKey(group),
+		Kept: relative(result.Kept), Deleted: relative(result.Deleted), Hardlinked: relative(result.Hardlinked)})
+}
+
+func subscribe() chan Event {
+	ch := make(chan Event, eventBuffer)
+	eventsMu.Lock()
+	subscribers[ch] = true
+	eventsMu.Unlock()
+	return ch
+}
+
+func unsubscribe(ch chan Event) {
+	eventsMu.Lock()
+	defer eventsMu.Unlock()
+	if subscribers[ch] {
+		delete(subscribers, ch)
+		close(ch)
+	}
+}
+
+// End every open stream, so server.Shutdown doesn't wait for them
+func closeEventStreams() {
+	eventsMu.Lock()
+	defer eventsMu.Unlock()
+	for ch := range subscribers {
+		delete(subscribers, ch)
+		close(ch)
+	}
+}
+
+// GET /api/events streams deletions, decided groups, status changes and
+// finished conversions as server-sent events, so open tabs can follow what
+// other tabs and reviewers do without polling
+func eventsHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		http.Error(w, "Method not allowed", 405)
+		return
+	}
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "Streaming not supported", 500)
+		return
+	}
+	ch := subscribe()
+	defer unsubscribe(ch)
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-store")
+	w.Header().Set("X-Accel-Buffering", "no") // Keep nginx from buffering the stream
+	fmt.Fprint(w, ": connected\n\n")
+	flusher.Flush()
+
+	keepAlive := time.NewTicker(eventKeepAlive)
+	defer keepAlive.Stop()
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case <-keepAlive.C:
+			fmt.Fprint(w, ": keep-alive\n\n")
+		case e, ok := <-ch:
+			if !ok {
+				return // Shutting down
+			}
+			data, _ := json.Marshal(e.Data)
+			fmt.Fprintf(w, "id: %d\nevent: %s\ndata: %s\n\n", e.ID, e.Type, data)
+		}
+		flusher.Flush()
+	}
+}
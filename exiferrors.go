@@ -0,0 +1,101 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/dsoprea/go-exif/v3"
+)
+
+// Why a file's EXIF couldn't be read, as reported in exif_error. A file that
+// simply has no EXIF gets none of these.
+const (
+	exifUnreadable = "unreadable" // The file itself couldn't be read
+	exifTruncated  = "truncated"  // The file or its EXIF block ends early
+	exifCorrupt    = "corrupt"    // The EXIF structure is damaged
+	exifMakerNote  = "unsupported-maker-note"
+	exifInternal   = "internal" // The EXIF library failed to set up
+)
+
+// The last EXIF failure seen for each file, for /api/exif-errors
+type exifFailureRecord struct {
+	Path   string `json:"path"`
+	Kind   string `json:"kind"`
+	Detail string `json:"detail"`
+}
+
+var (
+	exifFailuresMu sync.Mutex
+	exifFailures   = make(map[string]exifFailureRecord)
+)
+
+// Classify an EXIF parse error, looking at the raw file data for signs of
+// truncation
+func classifyExifError(err error, data []byte) string {
+	msg := strings.ToLower(err.Error())
+	switch {
+	case strings.Contains(msg, "makernote") || strings.Contains(msg, "maker note"):
+		return exifMakerNote
+	case errors.Is(err, io.EOF), errors.Is(err, io.ErrUnexpectedEOF), errors.Is(err, exif.ErrOffsetInvalid),
+		strings.Contains(msg, "eof"), strings.Contains(msg, "bounds"), strings.Contains(msg, "truncat"):
+		return exifTruncated
+	case bytes.HasPrefix(data, []byte{0xFF, 0xD8}) && !bytes.HasSuffix(bytes.TrimRight(data, "\x00"), []byte{0xFF, 0xD9}):
+		return exifTruncated // A JPEG without its end-of-image marker
+	}
+	return exifCorrupt
+}
+
+// Record an EXIF failure and return the ExifData to serve for the file
+func exifFailure(path, kind string, err error) ExifData {
+	exifFailuresMu.Lock()
+	if _, seen := exifFailures[path]; !seen {
+		logFor("exif").Warn("cannot read EXIF", "path", path, "kind", kind, "err", err)
+	}
+	exifFailures[path] = exifFailureRecord{Path: path, Kind: kind, Detail: err.Error()}
+	exifFailuresMu.Unlock()
+	return ExifData{HasExif: false, ExifError: kind, ExifErrorDetail: err.Error()}
+}
+
+func forgetExifFailure(path string) {
+	exifFailuresMu.Lock()
+	delete(exifFailures, path)
+	exifFailuresMu.Unlock()
+}
+
+// Number of files with EXIF failures, by kind
+func exifErrorCounts() map[string]int {
+	exifFailuresMu.Lock()
+	defer exifFailuresMu.Unlock()
+	counts := make(map[string]int)
+	for _, f := range exifFailures {
+		counts[f.Kind]++
+	}
+	return counts
+}
+
+// GET /api/exif-errors lists the files whose EXIF couldn't be read since the
+// server started, optionally only one ?kind=
+func exifErrorsHandler(w http.ResponseWriter, r *http.Request) {
+	kind := r.URL.Query().Get("kind")
+	exifFailuresMu.Lock()
+	files := []exifFailureRecord{}
+	for _, f := range exifFailures {
+		if kind == "" || f.Kind == kind {
+			f.Path = getRelativeImagePath(f.Path)
+			files = append(files, f)
+		}
+	}
+	exifFailuresMu.Unlock()
+	sort.Slice(files, func(i, j int) bool { return files[i].Path < files[j].Path })
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"counts": exifErrorCounts(),
+		"files":  files,
+	})
+}
@@ -0,0 +1,185 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+// Largest export accepted by POST /api/session/import
+const maxImportSize = 256 << 20
+
+// Buckets of the state database that make up the review state. The caches
+// (quality, hashes, EXIF, integrity) are rebuilt from the files, the budget
+// and quarantine belong to the machine, and the history has its own file, so
+// they stay behind.
+var reviewBuckets = []string{bucketStaged, bucketStatus, bucketQueues, bucketSessions, bucketSnapshotRules, bucketDecisions}
+
+// The review state of a dataset as one file
+type StateExport struct {
+	Version  int                                   `json:"version"`
+	Exported time.Time                             `json:"exported"`
+	Buckets  map[string]map[string]json.RawMessage `json:"buckets"` // Bucket -> key -> value
+	Journal  []JournalEntry                        `json:"journal"`
+}
+
+const stateExportVersion = 1
+
+func exportState() (StateExport, error) {
+	export := StateExport{Version: stateExportVersion, Exported: time.Now(), Buckets: make(map[string]map[string]json.RawMessage), Journal: []JournalEntry{}}
+	err := stateDB.View(func(tx *bolt.Tx) error {
+		for _, name := range reviewBuckets {
+			values := make(map[string]json.RawMessage)
+			err := tx.Bucket([]byte(name)).ForEach(func(k, v []byte) error {
+				values[string(k)] = append(json.RawMessage{}, v...)
+				return nil
+			})
+			if err != nil {
+				return err
+			}
+			export.Buckets[name] = values
+		}
+		return nil
+	})
+	if err != nil {
+		return export, err
+	}
+	journalMu.Lock()
+	if journalFile != nil {
+		journalFile.Sync()
+	}
+	journalMu.Unlock()
+	if entries, err := readJournal(journalPath()); err == nil {
+		export.Journal = append(export.Journal, entries...)
+	} else if !os.IsNotExist(err) {
+		return export, err
+	}
+	return export, nil
+}
+
+func checkImport(export StateExport) error {
+	if export.Version != stateExportVersion {
+		return fmt.Errorf("unsupported export version %d", export.Version)
+	}
+	known := make(map[string]bool, len(reviewBuckets))
+	for _, name := range reviewBuckets {
+		known[name] = true
+	}
+	for name := range export.Buckets {
+		if !known[name] {
+			return fmt.Errorf("unknown bucket %q", name)
+		}
+	}
+	return nil
+}
+
+// Merge an export into the state database, replacing entries with the same
+// key (or, with replace, everything in the review buckets), and append the
+// journal entries this dataset doesn't have yet
+func importState(export StateExport, replace bool) (map[string]int, error) {
+	counts := make(map[string]int)
+	err := stateDB.Update(func(tx *bolt.Tx) error {
+		for _, name := range reviewBuckets {
+			if replace {
+				if err := tx.DeleteBucket([]byte(name)); err != nil {
+					return err
+				}
+				if _, err := tx.CreateBucket([]byte(name)); err != nil {
+					return err
+				}
+			}
+			b := tx.Bucket([]byte(name))
+			for k, v := range export.Buckets[name] {
+				if err := b.Put([]byte(k), v); err != nil {
+					return err
+				}
+				counts[name]++
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	statusMu.Lock()
+	statusCount++
+	statusMu.Unlock()
+
+	have := make(map[string]bool)
+	if entries, err := readJournal(journalPath()); err == nil {
+		for _, e := range entries {
+			have[e.Time.String()+e.Kind+e.Group] = true
+		}
+	}
+	journalMu.Lock()
+	defer journalMu.Unlock()
+	for _, e := range export.Journal {
+		if have[e.Time.String()+e.Kind+e.Group] || journalFile == nil {
+			continue
+		}
+		line, _ := json.Marshal(e)
+		if _, err := journalFile.Write(append(line, '\n')); err != nil {
+			return counts, err
+		}
+		counts["journal"]++
+	}
+	if journalFile != nil {
+		journalFile.Sync()
+	}
+	return counts, nil
+}
+
+// GET /api/session/export downloads the review state (staged decisions,
+// group statuses, queues, sessions, snapshot rules, what was decided about
+// each file's content and the decisions journal) as one JSON file
+func stateExportHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		http.Error(w, "Method not allowed", 405)
+		return
+	}
+	export, err := exportState()
+	if err != nil {
+		reqLog(r, "state").Error("failed to export review state", "err", err)
+		http.Error(w, "Failed to export review state: "+err.Error(), 500)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Content-Disposition", fmt.Sprintf(`attachment; filename="review-state-%s.json"`, export.Exported.Format("2006-01-02")))
+	json.NewEncoder(w).Encode(export)
+}
+
+// POST /api/session/import[?replace=1] restores an export, merged into the
+// current review state or, with replace, instead of it
+func stateImportHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		http.Error(w, "Method not allowed", 405)
+		return
+	}
+	var export StateExport
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxImportSize)).Decode(&export); err != nil {
+		http.Error(w, "Invalid JSON", 400)
+		return
+	}
+	if err := checkImport(export); err != nil {
+		http.Error(w, err.Error(), 400)
+		return
+	}
+	replace := r.URL.Query().Get("replace") == "1"
+	backupBefore("import")
+	counts, err := importState(export, replace)
+	if err != nil {
+		reqLog(r, "state").Error("failed to import review state", "err", err)
+		http.Error(w, "Failed to import review state: "+err.Error(), 500)
+		return
+	}
+	reqLog(r, "state").Info("imported review state", "replace", replace, "exported", export.Exported, "imported", counts)
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"success":  true,
+		"imported": counts,
+	})
+}
@@ -0,0 +1,93 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"path/filepath"
+	"regexp"
+	"strings"
+)
+
+// The line fdupes and jdupes put before each group with -S
+var bytesEachLine = regexp.MustCompile(`^\d+ bytes? each:$`)
+
+// Whether a (decompressed) duplicates file holds fdupes or jdupes output:
+// one path per line, groups separated by a blank line
+func isFdupesResults(r *bufio.Reader) bool {
+	head, err := r.Peek(textResultsSniff)
+	if err == nil {
+		// Only whole lines can be judged
+		if last := bytes.LastIndexByte(head, '\n'); last >= 0 {
+			head = head[:last]
+		}
+	}
+	head = bytes.TrimLeft(head, "\ufeff \t\r\n")
+	if len(head) == 0 || head[0] == '[' || head[0] == '{' {
+		return false
+	}
+	run, groups := 0, 0
+	for _, raw := range bytes.Split(head, []byte("\n")) {
+		line := string(bytes.TrimSpace(raw))
+		switch {
+		case line == "":
+			run = 0
+		case bytesEachLine.MatchString(line):
+		case strings.ContainsAny(line, `/\`):
+			if run++; run == 2 {
+				groups++
+			}
+		default:
+			return false
+		}
+	}
+	return groups > 0
+}
+
+// Groups of fdupes or jdupes output. Neither says anything about the files
+// but their paths, so size and modified date come from disk (the dimensions
+// are read when a group is shown). Relative paths, from running fdupes in
+// the library, are taken to be below the image root.
+type fdupesParser struct {
+	lines *bufio.Scanner
+	line  int
+}
+
+func newFdupesParser(r io.Reader) *fdupesParser {
+	lines := bufio.NewScanner(r)
+	lines.Buffer(nil, 1<<20)
+	return &fdupesParser{lines: lines}
+}
+
+func (p *fdupesParser) group() ([]Image, error) {
+	var group []Image
+	for p.lines.Scan() {
+		p.line++
+		line := strings.TrimRight(p.lines.Text(), "\r")
+		switch {
+		case strings.TrimSpace(line) == "":
+			if len(group) > 1 {
+				return group, nil
+			}
+			group = nil // A lone file is no duplicate
+		case bytesEachLine.MatchString(strings.TrimSpace(line)):
+		default:
+			group = append(group, fdupesImage(line))
+		}
+	}
+	if err := p.lines.Err(); err != nil {
+		return nil, fmt.Errorf("line %d: %v", p.line, err)
+	}
+	if len(group) > 1 {
+		return group, nil
+	}
+	return nil, io.EOF
+}
+
+func fdupesImage(path string) Image {
+	if !filepath.IsAbs(path) && imageRoot != "" {
+		path = filepath.Join(imageRoot, path)
+	}
+	return statImage(path)
+}
@@ -0,0 +1,252 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"image"
+	"image/color"
+	"image/jpeg"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// One file of a synthetic library. Files with the same Seed show the same
+// picture, whatever their size, so they make a duplicate set.
+type fixtureImage struct {
+	Name          string // Relative to the library root
+	Width, Height int
+	Seed          int
+	Quality       int    // JPEG quality, 90 if unset
+	Make, Model   string // Camera EXIF, left out when empty
+	Taken         string // DateTimeOriginal, e.g. 2020:01:02 03:04:05
+	XMPSubject    string // Written as an XMP dc:subject
+	Raw           bool   // A CR2 stub instead of a JPEG
+	ModTime       time.Time
+}
+
+// A library on disk and the czkawka export describing its duplicate groups
+type fixtureLibrary struct {
+	Root           string
+	DuplicatesFile string
+}
+
+func (lib fixtureLibrary) path(name string) string {
+	return filepath.Join(lib.Root, name)
+}
+
+// Write every file of the given duplicate groups below a temporary
+// directory, plus a czkawka-format duplicates file for them
+func newFixtureLibrary(t *testing.T, groups [][]fixtureImage) fixtureLibrary {
+	t.Helper()
+	dir := t.TempDir()
+	lib := fixtureLibrary{Root: filepath.Join(dir, "library"), DuplicatesFile: filepath.Join(dir, "duplicates.json")}
+	var export [][]Image
+	for _, group := range groups {
+		var members []Image
+		for _, f := range group {
+			path := lib.path(f.Name)
+			if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+				t.Fatal(err)
+			}
+			data := fixtureJPEG(t, f)
+			if f.Raw {
+				data = fixtureRaw(f)
+			}
+			if err := os.WriteFile(path, data, 0644); err != nil {
+				t.Fatal(err)
+			}
+			mod := f.ModTime
+			if mod.IsZero() {
+				mod = time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+			}
+			if err := os.Chtimes(path, mod, mod); err != nil {
+				t.Fatal(err)
+			}
+			members = append(members, Image{
+				Path:         path,
+				Size:         int64(len(data)),
+				Width:        f.Width,
+				Height:       f.Height,
+				ModifiedDate: mod.Unix(),
+				Hash:         fixtureHash(f.Seed),
+			})
+		}
+		export = append(export, members)
+	}
+	data, err := json.Marshal(export)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(lib.DuplicatesFile, data, 0644); err != nil {
+		t.Fatal(err)
+	}
+	return lib
+}
+
+// An 8-byte perceptual hash as czkawka exports it, the same for one seed
+func fixtureHash(seed int) []int {
+	hash := make([]int, 8)
+	for i := range hash {
+		hash[i] = (seed*37 + i*11) & 0xFF
+	}
+	return hash
+}
+
+// A picture drawn from the seed, scaled to the requested size, as a JPEG
+// with the requested EXIF and XMP
+func fixtureJPEG(t *testing.T, f fixtureImage) []byte {
+	t.Helper()
+	img := image.NewRGBA(image.Rect(0, 0, f.Width, f.Height))
+	for y := 0; y < f.Height; y++ {
+		for x := 0; x < f.Width; x++ {
+			u, v := x*256/f.Width, y*256/f.Height
+			img.Set(x, y, color.RGBA{uint8(u + f.Seed*53), uint8(v + f.Seed*97), uint8((u ^ v) + f.Seed*29), 255})
+		}
+	}
+	quality := f.Quality
+	if quality == 0 {
+		quality = 90
+	}
+	var buf bytes.Buffer
+	if err := jpeg.Encode(&buf, img, &jpeg.Options{Quality: quality}); err != nil {
+		t.Fatal(err)
+	}
+	encoded := buf.Bytes()
+
+	// Metadata segments go straight after the start-of-image marker
+	out := append([]byte{}, encoded[:2]...)
+	var ifd0, exifIFD []tiffTag
+	if f.Make != "" {
+		ifd0 = append(ifd0, tiffTag{0x010F, f.Make})
+	}
+	if f.Model != "" {
+		ifd0 = append(ifd0, tiffTag{0x0110, f.Model})
+	}
+	if f.Taken != "" {
+		exifIFD = append(exifIFD, tiffTag{0x9003, f.Taken})
+	}
+	if len(ifd0) > 0 || len(exifIFD) > 0 {
+		out = appendAPP1(out, append([]byte("Exif\x00\x00"), tiffBlock(ifd0, exifIFD)...))
+	}
+	if f.XMPSubject != "" {
+		xmp := fmt.Sprintf(`<?xpacket begin="" id="W5M0MpCehiHzreSzNTczkc9d"?><x:xmpmeta xmlns:x="adobe:ns:meta/"><rdf:RDF xmlns:rdf="http://www.w3.org/1999/02/22-rdf-syntax-ns#"><rdf:Description xmlns:dc="http://purl.org/dc/elements/1.1/"><dc:subject><rdf:Bag><rdf:li>%s</rdf:li></rdf:Bag></dc:subject></rdf:Description></rdf:RDF></x:xmpmeta><?xpacket end="w"?>`, f.XMPSubject)
+		out = appendAPP1(out, append([]byte("http://ns.adobe.com/xap/1.0/\x00"), xmp...))
+	}
+	return append(out, encoded[2:]...)
+}
+
+// Just enough of a CR2 to be grouped: a TIFF with the camera's IFD0 and no
+// image data
+func fixtureRaw(f fixtureImage) []byte {
+	var ifd0 []tiffTag
+	if f.Make != "" {
+		ifd0 = append(ifd0, tiffTag{0x010F, f.Make})
+	}
+	if f.Model != "" {
+		ifd0 = append(ifd0, tiffTag{0x0110, f.Model})
+	}
+	return append(tiffBlock(ifd0, nil), bytes.Repeat([]byte{byte(f.Seed)}, 4096)...)
+}
+
+func appendAPP1(out, payload []byte) []byte {
+	out = append(out, 0xFF, 0xE1)
+	out = binary.BigEndian.AppendUint16(out, uint16(len(payload)+2))
+	return append(out, payload...)
+}
+
+// An ASCII TIFF tag
+type tiffTag struct {
+	id    uint16
+	value string
+}
+
+// A little-endian TIFF block with IFD0 and, if it has tags, an EXIF sub-IFD.
+// Tags must be given in ascending order.
+func tiffBlock(ifd0, exifIFD []tiffTag) []byte {
+	le := binary.LittleEndian
+	n0 := len(ifd0)
+	if len(exifIFD) > 0 {
+		n0++
+	}
+	exifAt := 8 + 2 + 12*n0 + 4
+	dataAt := exifAt
+	if len(exifIFD) > 0 {
+		dataAt += 2 + 12*len(exifIFD) + 4
+	}
+	out := []byte("II*\x00\x08\x00\x00\x00")
+	var data []byte
+	entry := func(id, typ uint16, count, value uint32) {
+		out = le.AppendUint16(out, id)
+		out = le.AppendUint16(out, typ)
+		out = le.AppendUint32(out, count)
+		out = le.AppendUint32(out, value)
+	}
+	ascii := func(tag tiffTag) {
+		v := append([]byte(tag.value), 0)
+		if len(v) <= 4 {
+			var inline [4]byte
+			copy(inline[:], v)
+			entry(tag.id, 2, uint32(len(v)), le.Uint32(inline[:]))
+			return
+		}
+		entry(tag.id, 2, uint32(len(v)), uint32(dataAt+len(data)))
+		data = append(data, v...)
+		if len(data)%2 == 1 {
+			data = append(data, 0)
+		}
+	}
+
+	out = le.AppendUint16(out, uint16(n0))
+	for _, tag := range ifd0 {
+		ascii(tag)
+	}
+	if len(exifIFD) > 0 {
+		entry(0x8769, 4, 1, uint32(exifAt))
+	}
+	out = le.AppendUint32(out, 0)
+	if len(exifIFD) > 0 {
+		out = le.AppendUint16(out, uint16(len(exifIFD)))
+		for _, tag := range exifIFD {
+			ascii(tag)
+		}
+		out = le.AppendUint32(out, 0)
+	}
+	return append(out, data...)
+}
+
+// Serve the API over a fixture library with fresh state, as main would
+func newTestServer(t *testing.T, lib fixtureLibrary) *httptest.Server {
+	t.Helper()
+	imageRoot = lib.Root
+	duplicatesFile = lib.DuplicatesFile
+	stateDir = t.TempDir()
+	tempDir = t.TempDir()
+	trashDirFlag, xdgTrash, quarantineDirFlag = "", false, ""
+	readOnlyMode, basePathFlag, debugMode = false, "", false
+	rateLimit, maxConcurrent = 0, 4
+	rateBuckets = make(map[string]*rateBucket)
+	workspacesFile, auditLogPath, readOnlyFlag = "", "", ""
+	apiToken, oidcIssuer, oidcClientID, oidcAllowed = "", "", "", ""
+	oidcDiscovery = nil
+	undoDepth = 50
+	if err := loadWorkspaces(); err != nil {
+		t.Fatal(err)
+	}
+	activeWorkspace = 0
+	workspaces[0].apply()
+	if err := openDataset(); err != nil {
+		t.Fatal(err)
+	}
+
+	server := httptest.NewServer(withRequestID(withBasePath(requireAuth(withWorkspace(newMux())))))
+	t.Cleanup(func() {
+		server.Close()
+		closeDataset()
+	})
+	return server
+}
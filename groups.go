@@ -0,0 +1,687 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+// Access to the loaded duplicate groups, either decoded into memory or
+// read on demand from the duplicates file (see -lazy)
+type groupStore interface {
+	Len() int
+	Group(idx int) ([]Image, error)
+}
+
+// All groups decoded into memory
+type memGroups [][]Image
+
+func (m memGroups) Len() int { return len(m) }
+
+func (m memGroups) Group(idx int) ([]Image, error) { return m[idx], nil }
+
+// Groups read lazily from an uncompressed duplicates file. The byte range
+// of every group is kept in an on-disk index (two little-endian int64s per
+// group) so memory use does not grow with the size of the export.
+type indexedGroups struct {
+	data     *os.File
+	index    *os.File
+	count    int
+	unpacked bool // data is a temp file of ours (see unpackDuplicatesFile)
+
+	mu      sync.Mutex
+	readers int  // Holders of acquireGroups
+	retired bool // Replaced, so close once the last reader is done
+	closed  bool
+}
+
+func (g *indexedGroups) Len() int { return g.count }
+
+func (g *indexedGroups) Group(idx int) ([]Image, error) {
+	var entry [16]byte
+	if _, err := g.index.ReadAt(entry[:], int64(idx)*16); err != nil {
+		return nil, err
+	}
+	start := int64(binary.LittleEndian.Uint64(entry[:8]))
+	end := int64(binary.LittleEndian.Uint64(entry[8:]))
+	raw := make([]byte, end-start)
+	if _, err := g.data.ReadAt(raw, start); err != nil {
+		return nil, err
+	}
+	// The range starts right after the previous value, so skip the separator
+	return decodeGroup(bytes.TrimLeft(raw, " \t\r\n,"))
+}
+
+func (g *indexedGroups) acquire() {
+	g.mu.Lock()
+	g.readers++
+	g.mu.Unlock()
+}
+
+func (g *indexedGroups) release() {
+	g.mu.Lock()
+	g.readers--
+	done := g.retired && g.readers == 0
+	g.mu.Unlock()
+	if done {
+		g.close()
+	}
+}
+
+// Close the store, or once the last reader has released it if any still
+// holds it
+func (g *indexedGroups) Close() error {
+	g.mu.Lock()
+	g.retired = true
+	done := g.readers == 0
+	g.mu.Unlock()
+	if !done {
+		return nil
+	}
+	return g.close()
+}
+
+func (g *indexedGroups) close() error {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if g.closed {
+		return nil
+	}
+	g.closed = true
+	g.index.Close()
+	os.Remove(g.index.Name())
+	err := g.data.Close()
+	if g.unpacked {
+		os.Remove(g.data.Name())
+	}
+	return err
+}
+
+// Build an on-disk index of a duplicates file by streaming through it once
+func indexGroups(path string) (*indexedGroups, error) {
+	// Compressed files can't be read at random offsets and other formats need
+	// converting, so unpack them first
+	unpacked := duplicatesCompression(path) != "" || convertedFormat(path) != ""
+	if unpacked {
+		tmp, err := unpackDuplicatesFile(path)
+		if err != nil {
+			return nil, err
+		}
+		path = tmp
+	}
+
+	data, err := os.Open(path)
+	if err != nil {
+		if unpacked {
+			os.Remove(path)
+		}
+		return nil, err
+	}
+	index, err := os.CreateTemp(tempDir, "groups-*.idx")
+	if err != nil {
+		data.Close()
+		if unpacked {
+			os.Remove(path)
+		}
+		return nil, err
+	}
+	g := &indexedGroups{data: data, index: index, unpacked: unpacked}
+
+	dec := json.NewDecoder(bufio.NewReader(data))
+	out := bufio.NewWriter(index)
+	if tok, err := dec.Token(); err != nil || tok != json.Delim('[') {
+		g.Close()
+		return nil, schemaError("not a JSON array of groups")
+	}
+	var entry [16]byte
+	for dec.More() {
+		start := dec.InputOffset()
+		var raw json.RawMessage
+		if err := dec.Decode(&raw); err != nil {
+			g.Close()
+			return nil, err
+		}
+		// Groups are only decoded when shown, so make sure of the first now
+		if g.count == 0 {
+			if _, err := decodeGroup(raw); err != nil {
+				g.Close()
+				return nil, err
+			}
+		}
+		binary.LittleEndian.PutUint64(entry[:8], uint64(start))
+		binary.LittleEndian.PutUint64(entry[8:], uint64(dec.InputOffset()))
+		out.Write(entry[:])
+		g.count++
+	}
+	if err := out.Flush(); err != nil {
+		g.Close()
+		return nil, err
+	}
+	return g, nil
+}
+
+// Decompress a duplicates file into the temp directory
+func unpackDuplicatesFile(path string) (string, error) {
+	in, err := openDuplicatesFile(path)
+	if err != nil {
+		return "", err
+	}
+	defer in.Close()
+	out, err := os.CreateTemp(tempDir, "duplicates-*.json")
+	if err != nil {
+		return "", err
+	}
+	defer out.Close()
+	if _, err := io.Copy(out, in); err != nil {
+		os.Remove(out.Name())
+		return "", err
+	}
+	return out.Name(), nil
+}
+
+// Open a duplicates file either in memory or lazily, depending on -lazy.
+// Several files (or a directory of them) are merged into one in the state
+// directory first.
+func openGroups(path string) (groupStore, error) {
+	files, err := duplicatesSources(path)
+	if err != nil {
+		return nil, err
+	}
+	if len(files) > 1 {
+		path = filepath.Join(stateDir, mergedDuplicates)
+		sources, err := mergeDuplicatesFiles(files, path)
+		if err != nil {
+			return nil, err
+		}
+		setGroupSources(sources)
+	} else {
+		if len(files) == 1 {
+			path = files[0]
+		}
+		setGroupSources(nil)
+	}
+	setDatasetFormat(detectFormat(path))
+	if !lazyGroups {
+		loaded, err := readGroups(path)
+		if err != nil {
+			return nil, err
+		}
+		return memGroups(loaded), nil
+	}
+	g, err := indexGroups(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to index %s: %v", path, err)
+	}
+	return g, nil
+}
+
+// Decode a czkawka duplicates file into groups of images
+func readGroups(path string) ([][]Image, error) {
+	f, err := openDuplicatesFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open %s: %v", path, err)
+	}
+	defer f.Close()
+	dec := json.NewDecoder(f)
+	if tok, err := dec.Token(); err != nil || tok != json.Delim('[') {
+		return nil, fmt.Errorf("failed to decode %s: %v", path, schemaError("not a JSON array of groups"))
+	}
+	loaded := [][]Image{}
+	for dec.More() {
+		var raw json.RawMessage
+		if err := dec.Decode(&raw); err != nil {
+			return nil, fmt.Errorf("failed to decode %s: %v", path, err)
+		}
+		group, err := decodeGroup(raw)
+		if err != nil {
+			return nil, fmt.Errorf("failed to decode %s, group %d: %v", path, len(loaded), err)
+		}
+		loaded = append(loaded, group)
+	}
+	return loaded, nil
+}
+
+// Replace the loaded groups (e.g. after a rescan). A lazily read store is
+// only closed once everyone reading it through acquireGroups is done.
+func setGroups(loaded groupStore) {
+	groupsMu.Lock()
+	old := groups
+	groups = loaded
+	groupsGen++
+	groupsMu.Unlock()
+	forgetRefreshed()
+	if closer, ok := old.(io.Closer); ok {
+		closer.Close()
+	}
+}
+
+// The loaded groups, for a quick look (the count, or a single group). A
+// store replaced meanwhile may already be closed, so anything going through
+// many groups uses acquireGroups instead.
+func currentGroups() groupStore {
+	groupsMu.RLock()
+	defer groupsMu.RUnlock()
+	return groups
+}
+
+// The loaded groups, kept open until release is called even if they are
+// replaced in the meantime
+func acquireGroups() (store groupStore, release func()) {
+	groupsMu.RLock()
+	defer groupsMu.RUnlock()
+	return groups, retainGroups(groups)
+}
+
+// Hold on to a store so replacing it doesn't close it under the caller.
+// Call with groupsMu held.
+func retainGroups(store groupStore) (release func()) {
+	shared, ok := store.(interface {
+		acquire()
+		release()
+	})
+	if !ok {
+		return func() {}
+	}
+	shared.acquire()
+	return shared.release
+}
+
+// Identity of a file's content as far as the duplicates file tells us: its
+// size and czkawka's hash, or the path for entries without a hash
+func fileKey(img Image) string {
+	if len(img.Hash) == 0 {
+		return img.Path
+	}
+	return fmt.Sprintf("%d:%v", img.Size, img.Hash)
+}
+
+// Stable identity of a group across reloads and rescans: a hash of its sorted
+// member file keys, so renaming or moving files doesn't change it
+func groupKey(group []Image) string {
+	keys := make([]string, len(group))
+	for i, img := range group {
+		keys[i] = fileKey(img)
+	}
+	sort.Strings(keys)
+	sum := sha256.Sum256([]byte(strings.Join(keys, "\x00")))
+	return hex.EncodeToString(sum[:16])
+}
+
+var (
+	groupsGen   int // Bumped whenever the groups are replaced
+	keyIndexMu  sync.Mutex
+	keyIndex    map[string]int
+	keyIndexGen = -1
+)
+
+// Current index of the group with the given key, or -1 if it is no longer loaded
+func groupIdxByKey(key string) int {
+	groupsMu.RLock()
+	store, gen := groups, groupsGen
+	release := retainGroups(store)
+	groupsMu.RUnlock()
+	defer release()
+
+	keyIndexMu.Lock()
+	defer keyIndexMu.Unlock()
+	if keyIndexGen != gen {
+		keyIndex = make(map[string]int, store.Len())
+		for idx := 0; idx < store.Len(); idx++ {
+			if group, err := store.Group(idx); err == nil {
+				keyIndex[groupKey(group)] = idx
+			}
+		}
+		keyIndexGen = gen
+	}
+	if idx, ok := keyIndex[key]; ok {
+		return idx
+	}
+	return -1
+}
+
+// Wraps a decompressor so closing it also closes the underlying file
+type decompressedFile struct {
+	io.Reader
+	closeFn func()
+	file    *os.File
+}
+
+func (d *decompressedFile) Close() error {
+	d.closeFn()
+	return d.file.Close()
+}
+
+// First bytes of the compressed formats a duplicates file may be in
+var (
+	gzipMagic = []byte{0x1f, 0x8b}
+	zstdMagic = []byte{0x28, 0xb5, 0x2f, 0xfd}
+)
+
+// How a duplicates file is compressed: "gzip", "zstd" or "" for plain JSON.
+// A .gz or .zst extension says so; otherwise the first bytes tell, so a
+// compressed export saved as .json (or without an extension) loads too.
+func duplicatesCompression(path string) string {
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".gz":
+		return "gzip"
+	case ".zst":
+		return "zstd"
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		return ""
+	}
+	defer f.Close()
+	magic := make([]byte, len(zstdMagic))
+	n, _ := io.ReadFull(f, magic)
+	switch {
+	case bytes.HasPrefix(magic[:n], gzipMagic):
+		return "gzip"
+	case bytes.HasPrefix(magic[:n], zstdMagic):
+		return "zstd"
+	}
+	return ""
+}
+
+// Open a duplicates file as JSON, transparently decompressing gzip and zstd
+// exports and converting czkawka's plain text results
+func openDuplicatesFile(path string) (io.ReadCloser, error) {
+	f, err := decompressDuplicates(path)
+	if err != nil {
+		return nil, err
+	}
+	r := bufio.NewReader(f)
+	switch sniffConverted(r) {
+	case formatCzkawkaText:
+		return &convertedResults{next: newTextParser(r).group, closer: f}, nil
+	case formatFdupes:
+		return &convertedResults{next: newFdupesParser(r).group, closer: f}, nil
+	case formatRmlint:
+		return &convertedResults{next: newRmlintParser(r).group, closer: f}, nil
+	case formatDupeguruXML:
+		return &convertedResults{next: newDupeguruXMLParser(r).group, closer: f}, nil
+	case formatDupeguruCSV:
+		return &convertedResults{next: newDupeguruCSVParser(r).group, closer: f}, nil
+	}
+	return &bufferedFile{Reader: r, Closer: f}, nil
+}
+
+// Formats other than czkawka's JSON export, read by converting them to it
+const (
+	formatCzkawkaText = "czkawka-similar-images-text"
+	formatFdupes      = "fdupes"
+	formatRmlint      = "rmlint"
+	formatDupeguruXML = "dupeguru-xml"
+	formatDupeguruCSV = "dupeguru-csv"
+)
+
+// Which of those a (decompressed) duplicates file is in, "" for JSON
+func sniffConverted(r *bufio.Reader) string {
+	switch {
+	case isTextResults(r):
+		return formatCzkawkaText
+	case isDupeguruXML(r):
+		return formatDupeguruXML
+	case isDupeguruCSV(r):
+		return formatDupeguruCSV
+	case isFdupesResults(r):
+		return formatFdupes
+	case isRmlintResults(r):
+		return formatRmlint
+	}
+	return ""
+}
+
+// Which format a duplicates file has to be converted from, "" for JSON
+func convertedFormat(path string) string {
+	f, err := decompressDuplicates(path)
+	if err != nil {
+		return ""
+	}
+	defer f.Close()
+	return sniffConverted(bufio.NewReader(f))
+}
+
+type bufferedFile struct {
+	io.Reader
+	io.Closer
+}
+
+// Open a duplicates file, decompressing it if need be
+func decompressDuplicates(path string) (io.ReadCloser, error) {
+	compression := duplicatesCompression(path)
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	switch compression {
+	case "gzip":
+		zr, err := gzip.NewReader(f)
+		if err != nil {
+			f.Close()
+			return nil, err
+		}
+		return &decompressedFile{Reader: zr, closeFn: func() { zr.Close() }, file: f}, nil
+	case "zstd":
+		zr, err := zstd.NewReader(f)
+		if err != nil {
+			f.Close()
+			return nil, err
+		}
+		return &decompressedFile{Reader: zr, closeFn: zr.Close, file: f}, nil
+	}
+	return f, nil
+}
+
+// One line of the streamed groups listing
+type GroupSummary struct {
+	Idx     int      `json:"idx"`
+	Pos     int      `json:"pos"` // Position in the listing's order, for the cursor
+	Count   int      `json:"count"`
+	Size    int64    `json:"size"`
+	Savings int64    `json:"savings"` // Bytes freed by keeping only the largest file
+	Status  string   `json:"status,omitempty"`
+	Source  string   `json:"source,omitempty"` // Results file, when several were merged
+	Paths   []string `json:"paths"`
+}
+
+// Which groups /api/groups lists; the zero value lets every group through
+type groupFilter struct {
+	status     string          // unresolved, resolved, skipped or flagged
+	minCount   int             // Members
+	minSavings int64           // Bytes
+	extensions map[string]bool // Lower case with the dot; any member matches
+	path       string          // Any member at or below this directory
+	source     string          // Results file it came from
+}
+
+func parseGroupFilter(q url.Values) (groupFilter, error) {
+	f := groupFilter{status: q.Get("status"), source: q.Get("source")}
+	switch f.status {
+	case "", "unresolved", statusResolved, statusSkipped, statusFlagged:
+	default:
+		return f, fmt.Errorf("status must be unresolved, resolved, skipped or flagged")
+	}
+	if v := q.Get("min_count"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 0 {
+			return f, fmt.Errorf("invalid min_count")
+		}
+		f.minCount = n
+	}
+	if v := q.Get("min_savings"); v != "" {
+		n, err := strconv.ParseInt(v, 10, 64)
+		if err != nil || n < 0 {
+			return f, fmt.Errorf("invalid min_savings")
+		}
+		f.minSavings = n
+	}
+	if v := q.Get("extension"); v != "" {
+		f.extensions = make(map[string]bool)
+		for _, ext := range strings.Split(v, ",") {
+			ext = strings.ToLower(strings.TrimSpace(ext))
+			if ext != "" && !strings.HasPrefix(ext, ".") {
+				ext = "." + ext
+			}
+			f.extensions[ext] = true
+		}
+	}
+	if v := q.Get("path"); v != "" {
+		if !filepath.IsAbs(v) {
+			v = filepath.Join(imageRoot, v)
+		}
+		f.path = filepath.Clean(v)
+	}
+	return f, nil
+}
+
+// Whether a group passes the filter; state supplies the review statuses
+func (f groupFilter) match(group []Image, state reviewState, idx int) bool {
+	if len(group) < f.minCount {
+		return false
+	}
+	if f.minSavings > 0 && groupSavings(group) < f.minSavings {
+		return false
+	}
+	switch f.status {
+	case "":
+	case "unresolved":
+		if state.resolved[idx] {
+			return false
+		}
+	case statusResolved:
+		if !state.resolved[idx] {
+			return false
+		}
+	default:
+		if state.status[idx] != f.status {
+			return false
+		}
+	}
+	if f.extensions != nil && !anyMember(group, func(img Image) bool { return f.extensions[strings.ToLower(filepath.Ext(img.Path))] }) {
+		return false
+	}
+	if f.path != "" && !anyMember(group, func(img Image) bool { return isBelow(filepath.Clean(img.Path), f.path) }) {
+		return false
+	}
+	if f.source != "" && groupSource(group) != f.source {
+		return false
+	}
+	return true
+}
+
+func anyMember(group []Image, pred func(Image) bool) bool {
+	for _, img := range group {
+		if pred(img) {
+			return true
+		}
+	}
+	return false
+}
+
+// Stream the groups as NDJSON, one GroupSummary per line. Clients resume an
+// interrupted listing by passing cursor=<last pos + 1>, and can page with limit.
+// status, min_count, min_savings, extension and path narrow it down to the
+// groups to work on; limit counts the groups that match. sort takes one of
+// the session orderPresets, e.g. savings for the biggest wins first.
+func groupsHandler(w http.ResponseWriter, r *http.Request) {
+	cursor := 0
+	if v := r.URL.Query().Get("cursor"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 0 {
+			http.Error(w, "Invalid cursor", 400)
+			return
+		}
+		cursor = n
+	}
+	limit := 0
+	if v := r.URL.Query().Get("limit"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 0 {
+			http.Error(w, "Invalid limit", 400)
+			return
+		}
+		limit = n
+	}
+	filter, err := parseGroupFilter(r.URL.Query())
+	if err != nil {
+		http.Error(w, err.Error(), 400)
+		return
+	}
+	sortBy := r.URL.Query().Get("sort")
+	if _, ok := orderPresets[sortBy]; sortBy != "" && !ok {
+		http.Error(w, "Unknown sort", 400)
+		return
+	}
+
+	// A reload or rescan meanwhile replaces the groups rather than changing
+	// them, and the store held here stays open until this is done
+	state := currentReviewState()
+	groupsMu.RLock()
+	store, gen := groups, groupsGen
+	release := retainGroups(store)
+	groupsMu.RUnlock()
+	defer release()
+	var order []int
+	if sortBy != "" && sortBy != "file" {
+		order = reviewOrder(store, gen, sortBy)
+	}
+
+	w.Header().Set("Content-Type", "application/x-ndjson")
+	flusher, _ := w.(http.Flusher)
+	buf := bufio.NewWriter(w)
+	enc := json.NewEncoder(buf)
+	sent := 0
+	for pos := cursor; pos < store.Len(); pos++ {
+		if limit > 0 && sent >= limit {
+			break
+		}
+		idx := pos
+		if order != nil {
+			idx = order[pos]
+		}
+		group, err := store.Group(idx)
+		if err != nil {
+			reqLog(r, "groups").Error("failed to read group", "group", idx, "err", err)
+			break
+		}
+		if idx >= len(state.resolved) {
+			break // Replaced since the review state was worked out
+		}
+		if !filter.match(group, state, idx) {
+			continue
+		}
+		summary := GroupSummary{Idx: idx, Pos: pos, Count: len(group), Savings: groupSavings(group), Status: state.status[idx], Source: groupSource(group)}
+		for _, img := range group {
+			summary.Size += img.Size
+			summary.Paths = append(summary.Paths, getRelativeImagePath(img.Path))
+		}
+		if err := enc.Encode(summary); err != nil {
+			return // Client went away
+		}
+		sent++
+		if sent%100 == 0 {
+			buf.Flush()
+			if flusher != nil {
+				flusher.Flush()
+			}
+		}
+	}
+	buf.Flush()
+}
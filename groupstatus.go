@@ -0,0 +1,122 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+// Review statuses a group can be marked with by hand
+const (
+	statusResolved = "resolved" // Dealt with, e.g. outside the UI; counts towards progress
+	statusSkipped  = "skipped"  // Put off; /api/group/next passes it by
+	statusFlagged  = "flagged"  // Needs another look
+)
+
+// A group's status, kept in the state database by group key so it survives
+// restarts and reloads of the same duplicates file
+type GroupStatus struct {
+	Key     string    `json:"key"`
+	Idx     int       `json:"idx"` // Current index, -1 if the group is gone
+	Status  string    `json:"status"`
+	Note    string    `json:"note,omitempty"`
+	Updated time.Time `json:"updated"`
+}
+
+var (
+	statusMu    sync.Mutex
+	statusCount int // Bumped on every change, so currentReviewState knows to refresh
+)
+
+// Every status set, by group key
+func loadGroupStatuses() map[string]GroupStatus {
+	statuses := make(map[string]GroupStatus)
+	stateDB.View(func(tx *bolt.Tx) error {
+		return tx.Bucket([]byte(bucketStatus)).ForEach(func(k, v []byte) error {
+			var s GroupStatus
+			if json.Unmarshal(v, &s) == nil {
+				statuses[string(k)] = s
+			}
+			return nil
+		})
+	})
+	return statuses
+}
+
+func statusChanges() int {
+	statusMu.Lock()
+	defer statusMu.Unlock()
+	return statusCount
+}
+
+// GET shows the status of group idx ("" if it has none), POST {"status":
+// "resolved"|"skipped"|"flagged", "note": ...} sets it and DELETE clears it
+func groupStatusHandler(w http.ResponseWriter, r *http.Request) {
+	idx, err := strconv.Atoi(r.PathValue("idx"))
+	store, release := acquireGroups()
+	defer release()
+	if err != nil || idx < 0 || idx >= store.Len() {
+		http.Error(w, "Group not found", 404)
+		return
+	}
+	group, err := store.Group(idx)
+	if err != nil {
+		http.Error(w, "Failed to read group", 500)
+		return
+	}
+	key := groupKey(group)
+
+	switch r.Method {
+	case "GET":
+		s := GroupStatus{Key: key}
+		dbGet(bucketStatus, key, &s)
+		s.Idx = idx
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(s)
+	case "POST":
+		var req struct {
+			Status string `json:"status"`
+			Note   string `json:"note"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, "Invalid JSON", 400)
+			return
+		}
+		switch req.Status {
+		case statusResolved, statusSkipped, statusFlagged:
+		default:
+			http.Error(w, "status must be resolved, skipped or flagged", 400)
+			return
+		}
+		s := GroupStatus{Key: key, Idx: idx, Status: req.Status, Note: req.Note, Updated: time.Now()}
+		statusMu.Lock()
+		err := dbPut(bucketStatus, key, s)
+		statusCount++
+		statusMu.Unlock()
+		if err != nil {
+			http.Error(w, "Failed to save group status: "+err.Error(), 500)
+			return
+		}
+		markContentResolved(group, key, s.Status == statusResolved)
+		writeJournal(JournalEntry{Kind: journalStatus, Group: key, Status: s.Status})
+		publish(eventStatus, StatusEvent{Idx: idx, Key: key, Status: s.Status})
+		reqLog(r, "review").Info("group status set", "group", idx, "status", s.Status)
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(s)
+	case "DELETE":
+		statusMu.Lock()
+		dbDelete(bucketStatus, key)
+		statusCount++
+		statusMu.Unlock()
+		markContentResolved(group, key, false)
+		writeJournal(JournalEntry{Kind: journalStatus, Group: key})
+		publish(eventStatus, StatusEvent{Idx: idx, Key: key})
+		w.WriteHeader(204)
+	default:
+		http.Error(w, "Method not allowed", 405)
+	}
+}
@@ -0,0 +1,220 @@
+package main
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"image"
+	"math/bits"
+	"net/http"
+	"os"
+	"path/filepath"
+)
+
+// Hashes of one file: czkawka's from the duplicates file, and optionally
+// freshly computed ones
+type FileHashes struct {
+	Path       string       `json:"path"`
+	Group      int          `json:"group"`                // -1 if the file is in no group
+	Czkawka    string       `json:"czkawka,omitempty"`    // Hex of czkawka's perceptual hash
+	HashBits   int          `json:"hash_bits,omitempty"`  // Length of that hash
+	Similarity int          `json:"similarity,omitempty"` // czkawka's distance to the group's reference image
+	Fresh      *FreshHashes `json:"fresh,omitempty"`
+}
+
+type FreshHashes struct {
+	SHA256 string `json:"sha256"`
+	AHash  string `json:"ahash,omitempty"` // 64-bit average hash
+	DHash  string `json:"dhash,omitempty"` // 64-bit difference hash
+	Error  string `json:"error,omitempty"` // Why the perceptual hashes are missing
+}
+
+// The group entry for a file, searching all groups
+func findImage(path string) (Image, int, bool) {
+	store, release := acquireGroups()
+	defer release()
+	for idx := 0; idx < store.Len(); idx++ {
+		group, err := store.Group(idx)
+		if err != nil {
+			continue
+		}
+		for _, img := range group {
+			if filepath.Clean(img.Path) == path {
+				return img, idx, true
+			}
+		}
+	}
+	return Image{}, -1, false
+}
+
+func czkawkaHashBytes(hash []int) []byte {
+	out := make([]byte, len(hash))
+	for i, v := range hash {
+		out[i] = byte(v)
+	}
+	return out
+}
+
+// Number of differing bits between two equally long hashes, or -1
+func hammingDistance(a, b []byte) int {
+	if len(a) != len(b) || len(a) == 0 {
+		return -1
+	}
+	d := 0
+	for i := range a {
+		d += bits.OnesCount8(a[i] ^ b[i])
+	}
+	return d
+}
+
+// Box-average a luma grid down to w x h
+func shrinkLuma(luma []float64, lw, lh, w, h int) []float64 {
+	out := make([]float64, w*h)
+	for y := 0; y < h; y++ {
+		for x := 0; x < w; x++ {
+			x0, x1 := x*lw/w, max((x+1)*lw/w, x*lw/w+1)
+			y0, y1 := y*lh/h, max((y+1)*lh/h, y*lh/h+1)
+			var sum float64
+			for yy := y0; yy < y1; yy++ {
+				for xx := x0; xx < x1; xx++ {
+					sum += luma[yy*lw+xx]
+				}
+			}
+			out[y*w+x] = sum / float64((x1-x0)*(y1-y0))
+		}
+	}
+	return out
+}
+
+// 64-bit average and difference hashes of an image
+func perceptualHashes(img image.Image) ([]byte, []byte) {
+	luma, lw, lh := lumaGrid(img)
+	if lw < 9 || lh < 8 {
+		return nil, nil
+	}
+	ahash := make([]byte, 8)
+	small := shrinkLuma(luma, lw, lh, 8, 8)
+	var mean float64
+	for _, v := range small {
+		mean += v / 64
+	}
+	for i, v := range small {
+		if v > mean {
+			ahash[i/8] |= 1 << (7 - i%8)
+		}
+	}
+	dhash := make([]byte, 8)
+	wide := shrinkLuma(luma, lw, lh, 9, 8)
+	for y := 0; y < 8; y++ {
+		for x := 0; x < 8; x++ {
+			if wide[y*9+x] < wide[y*9+x+1] {
+				i := y*8 + x
+				dhash[i/8] |= 1 << (7 - i%8)
+			}
+		}
+	}
+	return ahash, dhash
+}
+
+func freshHashes(path string) *FreshHashes {
+	fresh := &FreshHashes{}
+	var err error
+	if fresh.SHA256, err = contentHash(path); err != nil {
+		fresh.Error = err.Error()
+		return fresh
+	}
+	if isVideoFile(path) {
+		fresh.Error = "no perceptual hashes for videos"
+		return fresh
+	}
+	if dbGet(bucketPerceptual, fresh.SHA256, fresh) {
+		return fresh
+	}
+	source := path
+	if isCR2File(path) {
+		if source, err = convertCR2ToJPG(path); err != nil {
+			fresh.Error = err.Error()
+			return fresh
+		}
+	}
+	f, err := os.Open(source)
+	if err != nil {
+		fresh.Error = err.Error()
+		return fresh
+	}
+	defer f.Close()
+	img, _, err := image.Decode(f)
+	if err != nil {
+		fresh.Error = fmt.Sprintf("cannot decode %s: %v", filepath.Base(path), err)
+		return fresh
+	}
+	ahash, dhash := perceptualHashes(img)
+	fresh.AHash, fresh.DHash = hex.EncodeToString(ahash), hex.EncodeToString(dhash)
+	if err := dbPut(bucketPerceptual, fresh.SHA256, fresh); err != nil {
+		logFor("state").Error("failed to cache perceptual hashes", "path", path, "err", err)
+	}
+	return fresh
+}
+
+// Resolve a path parameter and collect its hashes
+func hashesFor(w http.ResponseWriter, raw string, fresh bool) (*FileHashes, bool) {
+	path, ok := requestedImage(w, raw)
+	if !ok {
+		return nil, false
+	}
+	h := &FileHashes{Path: getRelativeImagePath(path), Group: -1}
+	if img, idx, found := findImage(path); found {
+		h.Group = idx
+		h.Czkawka = hex.EncodeToString(czkawkaHashBytes(img.Hash))
+		h.HashBits = len(img.Hash) * 8
+		h.Similarity = img.Similarity
+	}
+	if fresh {
+		h.Fresh = freshHashes(path)
+	}
+	return h, true
+}
+
+// GET /api/hashes?path=P[&fresh=1] shows czkawka's hash for a file and,
+// with fresh=1, a SHA-256 and 64-bit aHash/dHash computed now
+func hashesHandler(w http.ResponseWriter, r *http.Request) {
+	h, ok := hashesFor(w, r.URL.Query().Get("path"), r.URL.Query().Get("fresh") == "1")
+	if !ok {
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(h)
+}
+
+// GET /api/hashes/compare?a=P&b=Q compares two arbitrary files: czkawka's
+// hash distance (if both are in the duplicates file), whether they share a
+// group, and distances between freshly computed hashes
+func hashCompareHandler(w http.ResponseWriter, r *http.Request) {
+	a, ok := hashesFor(w, r.URL.Query().Get("a"), true)
+	if !ok {
+		return
+	}
+	b, ok := hashesFor(w, r.URL.Query().Get("b"), true)
+	if !ok {
+		return
+	}
+
+	distance := func(x, y string) int {
+		xb, err1 := hex.DecodeString(x)
+		yb, err2 := hex.DecodeString(y)
+		if err1 != nil || err2 != nil {
+			return -1
+		}
+		return hammingDistance(xb, yb)
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"a":                a,
+		"b":                b,
+		"same_group":       a.Group >= 0 && a.Group == b.Group,
+		"identical":        a.Fresh.SHA256 != "" && a.Fresh.SHA256 == b.Fresh.SHA256,
+		"czkawka_distance": distance(a.Czkawka, b.Czkawka), // -1 when not comparable
+		"ahash_distance":   distance(a.Fresh.AHash, b.Fresh.AHash),
+		"dhash_distance":   distance(a.Fresh.DHash, b.Fresh.DHash),
+	})
+}
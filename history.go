@@ -0,0 +1,417 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+// Kinds of recorded actions
+const (
+	actionScored         = "scored"
+	actionDeleted        = "deleted"
+	actionRestored       = "restored"
+	actionHardlinked     = "hardlinked"
+	actionMetadataMerged = "metadata-merged"
+	actionTrashed        = "trashed"
+	actionDirRemoved     = "removed-empty-dir"
+	actionDeduped        = "deduped" // Shares its disk blocks with an identical file
+	actionQuarantined    = "quarantined"
+)
+
+// Action is one entry in the per-file operation history
+type Action struct {
+	Time   time.Time `json:"time"`
+	Path   string    `json:"path"`
+	Action string    `json:"action"`
+	Group  int       `json:"group"` // -1 when not tied to a group
+	Detail string    `json:"detail,omitempty"`
+	Hash   string    `json:"hash,omitempty"` // Content hash, which follows the file across renames and moves
+}
+
+var (
+	stateDir     string
+	historyMu    sync.Mutex
+	historyFile  *os.File
+	historyCount int   // Actions recorded, so figures derived from them know when to update
+	historySize  int64 // Length of the history file, all of it in bucketHistory
+)
+
+// Actions read from the history file per transaction while indexing it
+const historyBatch = 1000
+
+func historyPath() string {
+	return filepath.Join(stateDir, "history.jsonl")
+}
+
+// Open the history for appending. Actions are also kept in the state
+// database, indexed by path and content hash, so looking them up doesn't
+// mean holding the history in memory; whatever was added to the file
+// without making it there (e.g. by a version from before it did, or a crash)
+// is added now.
+func openHistory() error {
+	var indexed int64
+	known := dbGet(bucketMeta, "history_indexed", &indexed)
+	if f, err := os.Open(historyPath()); err == nil {
+		// A shorter file than was indexed is another one, e.g. restored from
+		// a backup, so it is indexed afresh, as it is when nothing says how
+		// much of it was
+		rebuild := !known
+		if info, err := f.Stat(); err == nil && info.Size() < indexed {
+			rebuild = true
+		}
+		if rebuild {
+			indexed = 0
+		} else if _, err := f.Seek(indexed, io.SeekStart); err != nil {
+			f.Close()
+			return fmt.Errorf("failed to read history %s: %v", historyPath(), err)
+		}
+		in := bufio.NewReader(f)
+		read := indexed
+		var batch []Action
+		for {
+			line, err := in.ReadBytes('\n')
+			if err != nil {
+				break // The end, or a torn last line from a crash
+			}
+			read += int64(len(line))
+			var a Action
+			if err := json.Unmarshal(line, &a); err != nil {
+				continue
+			}
+			if batch = append(batch, a); len(batch) == historyBatch {
+				if err := storeHistory(batch, read, rebuild); err != nil {
+					f.Close()
+					return fmt.Errorf("failed to index history %s: %v", historyPath(), err)
+				}
+				batch, rebuild = nil, false
+			}
+		}
+		f.Close()
+		if err := storeHistory(batch, read, rebuild); err != nil {
+			return fmt.Errorf("failed to index history %s: %v", historyPath(), err)
+		}
+	}
+
+	f, err := os.OpenFile(historyPath(), os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0644)
+	if err != nil {
+		return fmt.Errorf("failed to open history %s: %v", historyPath(), err)
+	}
+	if info, err := f.Stat(); err == nil {
+		historySize = info.Size()
+	}
+	stateDB.View(func(tx *bolt.Tx) error {
+		historyCount = int(tx.Bucket([]byte(bucketHistory)).Sequence())
+		return nil
+	})
+	historyFile = f
+	return nil
+}
+
+// Add actions to bucketHistory and its indexes, emptied first with rebuild,
+// and note that the history file is in them up to size
+func storeHistory(actions []Action, size int64, rebuild bool) error {
+	return stateDB.Update(func(tx *bolt.Tx) error {
+		if rebuild {
+			for _, name := range []string{bucketHistory, bucketHistoryPaths, bucketHistoryHashes} {
+				if err := tx.DeleteBucket([]byte(name)); err != nil {
+					return err
+				}
+				if _, err := tx.CreateBucket([]byte(name)); err != nil {
+					return err
+				}
+			}
+		}
+		b := tx.Bucket([]byte(bucketHistory))
+		paths, hashes := tx.Bucket([]byte(bucketHistoryPaths)), tx.Bucket([]byte(bucketHistoryHashes))
+		for _, a := range actions {
+			seq, _ := b.NextSequence()
+			key := binary.BigEndian.AppendUint64(nil, seq)
+			value, _ := json.Marshal(a)
+			if err := b.Put(key, value); err != nil {
+				return err
+			}
+			if err := paths.Put(append([]byte(a.Path+"\x00"), key...), nil); err != nil {
+				return err
+			}
+			if a.Hash != "" {
+				if err := hashes.Put(append([]byte(a.Hash+"\x00"), key...), nil); err != nil {
+					return err
+				}
+			}
+		}
+		return tx.Bucket([]byte(bucketMeta)).Put([]byte("history_indexed"), []byte(strconv.FormatInt(size, 10)))
+	})
+}
+
+// Walk the actions filed under name in one of the history's indexes, oldest
+// first or, with latest, newest first, until fn returns false
+func walkHistory(index, name string, latest bool, fn func(Action) bool) {
+	prefix := []byte(name + "\x00")
+	stateDB.View(func(tx *bolt.Tx) error {
+		actions := tx.Bucket([]byte(bucketHistory))
+		c := tx.Bucket([]byte(index)).Cursor()
+		var k []byte
+		if latest {
+			// Past the last key with the prefix, then back
+			if k, _ = c.Seek(append(bytes.Clone(prefix), bytes.Repeat([]byte{0xff}, 8)...)); k == nil {
+				k, _ = c.Last()
+			} else if !bytes.HasPrefix(k, prefix) {
+				k, _ = c.Prev()
+			}
+		} else {
+			k, _ = c.Seek(prefix)
+		}
+		for k != nil && bytes.HasPrefix(k, prefix) {
+			var a Action
+			if json.Unmarshal(actions.Get(k[len(prefix):]), &a) == nil && !fn(a) {
+				break
+			}
+			if latest {
+				k, _ = c.Prev()
+			} else {
+				k, _ = c.Next()
+			}
+		}
+		return nil
+	})
+}
+
+// Every action recorded for a path, oldest first
+func pathHistory(path string) []Action {
+	var actions []Action
+	walkHistory(bucketHistoryPaths, path, false, func(a Action) bool {
+		actions = append(actions, a)
+		return true
+	})
+	return actions
+}
+
+// The last action recorded for a path, if any
+func lastAction(path string) (Action, bool) {
+	var last Action
+	found := false
+	walkHistory(bucketHistoryPaths, path, true, func(a Action) bool {
+		last, found = a, true
+		return false
+	})
+	return last, found
+}
+
+// Every action recorded for a file's content, under any path, oldest first
+func historyByHash(hash string) []Action {
+	var actions []Action
+	walkHistory(bucketHistoryHashes, hash, false, func(a Action) bool {
+		actions = append(actions, a)
+		return true
+	})
+	return actions
+}
+
+// Append an action to the history
+func recordAction(path, action string, group int, detail string) {
+	a := Action{Time: time.Now(), Path: path, Action: action, Group: group, Detail: detail, Hash: knownContentHash(path)}
+	historyMu.Lock()
+	defer historyMu.Unlock()
+	if historyFile == nil {
+		return
+	}
+	line, _ := json.Marshal(a)
+	n, err := historyFile.Write(append(line, '\n'))
+	historySize += int64(n)
+	if err != nil {
+		logFor("history").Error("failed to write history", "err", err)
+		return
+	}
+	historyCount++
+	if err := storeHistory([]Action{a}, historySize, false); err != nil {
+		logFor("history").Error("failed to index history", "err", err)
+	}
+}
+
+func closeHistory() {
+	historyMu.Lock()
+	defer historyMu.Unlock()
+	if historyFile != nil {
+		historyFile.Sync()
+		historyFile.Close()
+		historyFile = nil
+	}
+}
+
+// Record a score, but only when it differs from the last one recorded for the file
+func recordScore(path string, group, score int) {
+	last := ""
+	walkHistory(bucketHistoryPaths, path, true, func(a Action) bool {
+		if a.Action == actionScored {
+			last = a.Detail
+			return false
+		}
+		return true
+	})
+	if last != strconv.Itoa(score) {
+		recordAction(path, actionScored, group, strconv.Itoa(score))
+	}
+}
+
+// Removals further apart than this start a new cleanup session in the summary
+const historySessionGap = 2 * time.Hour
+
+// Files removed and bytes reclaimed on one day, and by the end of it overall
+type HistoryDay struct {
+	Day             string `json:"day"` // YYYY-MM-DD
+	FilesRemoved    int    `json:"files_removed"`
+	BytesReclaimed  int64  `json:"bytes_reclaimed"`
+	CumulativeBytes int64  `json:"cumulative_bytes"`
+}
+
+// One sitting of cleaning up: removals without a long break between them
+type HistorySession struct {
+	Started        time.Time `json:"started"`
+	Ended          time.Time `json:"ended"`
+	Groups         int       `json:"groups"` // Groups files were removed from
+	FilesRemoved   int       `json:"files_removed"`
+	BytesReclaimed int64     `json:"bytes_reclaimed"`
+}
+
+type HistorySummary struct {
+	FilesRemoved   int              `json:"files_removed"`
+	BytesReclaimed int64            `json:"bytes_reclaimed"`
+	Days           []HistoryDay     `json:"days"`
+	Sessions       []HistorySession `json:"sessions"`
+}
+
+// Bytes an action freed, from the "N bytes" its detail starts with (not
+// recorded for hardlinks made by older versions)
+func actionBytes(a Action) int64 {
+	var n int64
+	fmt.Sscanf(a.Detail, "%d bytes", &n)
+	return n
+}
+
+// Savings over time from every deletion, trash and hardlink in the history,
+// with days in loc
+func historySummary(loc *time.Location) HistorySummary {
+	var removals []Action
+	stateDB.View(func(tx *bolt.Tx) error {
+		return tx.Bucket([]byte(bucketHistory)).ForEach(func(_, v []byte) error {
+			var a Action
+			if json.Unmarshal(v, &a) == nil && removedByHistory([]Action{a}) {
+				removals = append(removals, a)
+			}
+			return nil
+		})
+	})
+	sort.SliceStable(removals, func(i, j int) bool { return removals[i].Time.Before(removals[j].Time) })
+
+	summary := HistorySummary{Days: []HistoryDay{}, Sessions: []HistorySession{}}
+	var groups map[int]bool
+	for _, a := range removals {
+		bytes := actionBytes(a)
+		summary.FilesRemoved++
+		summary.BytesReclaimed += bytes
+
+		day := a.Time.In(loc).Format("2006-01-02")
+		if n := len(summary.Days); n == 0 || summary.Days[n-1].Day != day {
+			summary.Days = append(summary.Days, HistoryDay{Day: day})
+		}
+		d := &summary.Days[len(summary.Days)-1]
+		d.FilesRemoved++
+		d.BytesReclaimed += bytes
+		d.CumulativeBytes = summary.BytesReclaimed
+
+		if n := len(summary.Sessions); n == 0 || a.Time.Sub(summary.Sessions[n-1].Ended) > historySessionGap {
+			summary.Sessions = append(summary.Sessions, HistorySession{Started: a.Time})
+			groups = make(map[int]bool)
+		}
+		s := &summary.Sessions[len(summary.Sessions)-1]
+		s.Ended = a.Time
+		s.FilesRemoved++
+		s.BytesReclaimed += bytes
+		if a.Group >= 0 && !groups[a.Group] {
+			groups[a.Group] = true
+			s.Groups++
+		}
+	}
+	return summary
+}
+
+// Whether a path with these actions, oldest first, is gone without the tool
+// having removed it, i.e. its file was renamed or moved
+func movedAway(path string, actions []Action) bool {
+	if _, err := os.Lstat(path); err == nil {
+		return false
+	}
+	switch actions[len(actions)-1].Action {
+	case actionDeleted, actionTrashed, actionQuarantined:
+		return false
+	}
+	return true
+}
+
+// Every recorded action for one file, oldest first, including those recorded
+// for its content under earlier paths. Without a path, the savings over time
+// (with days in ?tz=, local time by default).
+func historyHandler(w http.ResponseWriter, r *http.Request) {
+	path := r.URL.Query().Get("path")
+	if path == "" {
+		loc := time.Local
+		if r.URL.Query().Has("tz") {
+			var err error
+			if loc, err = time.LoadLocation(r.URL.Query().Get("tz")); err != nil {
+				http.Error(w, "Unknown timezone: "+r.URL.Query().Get("tz"), 400)
+				return
+			}
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(historySummary(loc))
+		return
+	}
+	// Accept the relative paths used in group responses too
+	if !filepath.IsAbs(path) {
+		path = filepath.Join(imageRoot, path)
+	}
+
+	// Actions recorded for the same content under paths the file was renamed
+	// or moved away from belong to it too, but not those of its identical
+	// copies, still there or removed
+	hash := knownContentHash(path)
+	actions := pathHistory(path)
+	if hash != "" {
+		elsewhere := make(map[string][]Action)
+		var paths []string
+		for _, a := range historyByHash(hash) {
+			if a.Path == path {
+				continue
+			}
+			if elsewhere[a.Path] == nil {
+				paths = append(paths, a.Path)
+			}
+			elsewhere[a.Path] = append(elsewhere[a.Path], a)
+		}
+		for _, p := range paths {
+			if movedAway(p, elsewhere[p]) {
+				actions = append(actions, elsewhere[p]...)
+			}
+		}
+	}
+	sort.SliceStable(actions, func(i, j int) bool { return actions[i].Time.Before(actions[j].Time) })
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"path":    path,
+		"actions": actions,
+	})
+}
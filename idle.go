@@ -0,0 +1,52 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"sync/atomic"
+	"time"
+)
+
+var (
+	exitAfterIdle time.Duration
+	lastActivity  atomic.Int64 // Unix nanoseconds of the last request
+)
+
+// Note the time of every request so the idle timer can be reset
+func trackActivity(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		lastActivity.Store(time.Now().UnixNano())
+		next.ServeHTTP(w, r)
+	})
+}
+
+func scanRunning() bool {
+	scanMu.Lock()
+	defer scanMu.Unlock()
+	return lastScan != nil && lastScan.Status == "running"
+}
+
+// Shut the server down once nothing has happened for -exit-after-idle.
+// A running scan counts as activity.
+func exitWhenIdle(server *http.Server) {
+	lastActivity.Store(time.Now().UnixNano())
+	check := exitAfterIdle / 10
+	if check < time.Second {
+		check = time.Second
+	}
+	for range time.Tick(check) {
+		if scanRunning() {
+			lastActivity.Store(time.Now().UnixNano())
+			continue
+		}
+		idle := time.Since(time.Unix(0, lastActivity.Load()))
+		if idle < exitAfterIdle {
+			continue
+		}
+		logFor("server").Info("idle, shutting down", "idle", idle.Round(time.Second).String())
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		server.Shutdown(ctx)
+		cancel()
+		return
+	}
+}
@@ -0,0 +1,111 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"time"
+)
+
+// Who holds a duplicates file, written to <file>.lock next to it so a second
+// instance doesn't make conflicting deletions in the same library
+type InstanceLock struct {
+	PID     int       `json:"pid"`
+	Host    string    `json:"host"`
+	Port    string    `json:"port"`
+	Started time.Time `json:"started"`
+}
+
+var (
+	forceLock bool       // -force
+	heldLocks []heldLock // Lock files this instance holds
+)
+
+type heldLock struct {
+	path string
+	lock InstanceLock
+}
+
+func instanceLockPath(duplicates string) string {
+	return duplicates + ".lock"
+}
+
+func readInstanceLock(path string) (InstanceLock, error) {
+	var lock InstanceLock
+	data, err := os.ReadFile(path)
+	if err == nil {
+		err = json.Unmarshal(data, &lock)
+	}
+	return lock, err
+}
+
+// Whether the instance that wrote a lock has gone away. Locks from another
+// machine (a library on a network share) can't be checked, so they count as held.
+func (l InstanceLock) stale() bool {
+	host, _ := os.Hostname()
+	return l.Host == host && !processAlive(l.PID)
+}
+
+// Take the lock on every duplicates file named, taking over those left
+// behind by an instance that is no longer running, or any with -force
+func acquireInstanceLock(duplicates string) error {
+	for _, file := range splitDuplicates(duplicates) {
+		if err := lockDuplicates(file); err != nil {
+			releaseInstanceLock()
+			return err
+		}
+	}
+	return nil
+}
+
+func lockDuplicates(duplicates string) error {
+	path := instanceLockPath(duplicates)
+	host, _ := os.Hostname()
+	lock := InstanceLock{PID: os.Getpid(), Host: host, Port: port, Started: time.Now()}
+	data, _ := json.Marshal(lock)
+	for attempt := 0; ; attempt++ {
+		f, err := os.OpenFile(path, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0644)
+		if err == nil {
+			_, err = f.Write(append(data, '\n'))
+			if cerr := f.Close(); err == nil {
+				err = cerr
+			}
+			if err != nil {
+				os.Remove(path)
+				return fmt.Errorf("failed to write instance lock %s: %v", path, err)
+			}
+			heldLocks = append(heldLocks, heldLock{path, lock})
+			return nil
+		}
+		if !errors.Is(err, os.ErrExist) || attempt > 0 {
+			return fmt.Errorf("failed to create instance lock %s: %v", path, err)
+		}
+		other, err := readInstanceLock(path)
+		switch {
+		case forceLock:
+			logFor("server").Warn("taking over the instance lock", "file", path, "pid", other.PID, "host", other.Host, "port", other.Port)
+		case err != nil:
+			return fmt.Errorf("%s exists but can't be read (%v); remove it or start with -force", path, err)
+		case other.stale():
+			logFor("server").Info("taking over the lock of an instance that is gone", "file", path, "pid", other.PID)
+		default:
+			return fmt.Errorf("%s is in use by another instance (pid %d on %s, port %s, since %s); stop it or start with -force",
+				duplicates, other.PID, other.Host, other.Port, other.Started.Format(time.RFC3339))
+		}
+		if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+			return fmt.Errorf("failed to remove instance lock %s: %v", path, err)
+		}
+	}
+}
+
+// Remove this instance's locks, except those another instance took over
+// with -force
+func releaseInstanceLock() {
+	for _, held := range heldLocks {
+		if current, err := readInstanceLock(held.path); err == nil && current.PID == held.lock.PID && current.Started.Equal(held.lock.Started) {
+			os.Remove(held.path)
+		}
+	}
+	heldLocks = nil
+}
@@ -0,0 +1,16 @@
+//go:build !unix
+
+package main
+
+import "os"
+
+// Whether a process with this PID is running on this machine. On Windows
+// FindProcess opens the process, so it fails once it has exited.
+func processAlive(pid int) bool {
+	p, err := os.FindProcess(pid)
+	if err != nil {
+		return false
+	}
+	p.Release()
+	return true
+}
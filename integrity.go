@@ -0,0 +1,65 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"image/gif"
+	"image/jpeg"
+	"image/png"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// Outcome of a full decode of one file's content, cached by content hash
+type integrityCheck struct {
+	Problem string `json:"problem,omitempty"` // Empty when the file decoded cleanly
+}
+
+// Decode a JPEG, PNG or GIF in full and report why it looks damaged, or ""
+// if it is intact or of a format that isn't checked. JPEGs must also end
+// with their end-of-image marker, which decoders often don't insist on.
+func checkIntegrity(path string) string {
+	ext := strings.ToLower(filepath.Ext(path))
+	switch ext {
+	case ".jpg", ".jpeg", ".png", ".gif":
+	default:
+		return ""
+	}
+	hash, err := contentHash(path)
+	if err != nil {
+		return ""
+	}
+	var check integrityCheck
+	if dbGet(bucketIntegrity, hash, &check) {
+		return check.Problem
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return "" // Unreadable files are validation's business
+	}
+	switch ext {
+	case ".jpg", ".jpeg":
+		if !bytes.HasSuffix(bytes.TrimRight(data, "\x00"), []byte{0xFF, 0xD9}) {
+			check.Problem = "truncated: no JPEG end-of-image marker"
+		} else if _, err := jpeg.Decode(bytes.NewReader(data)); err != nil {
+			check.Problem = fmt.Sprintf("corrupt: %v", err)
+		}
+	case ".png":
+		if _, err := png.Decode(bytes.NewReader(data)); err != nil {
+			check.Problem = fmt.Sprintf("corrupt: %v", err)
+		}
+	case ".gif":
+		if _, err := gif.DecodeAll(bytes.NewReader(data)); err != nil {
+			check.Problem = fmt.Sprintf("corrupt: %v", err)
+		}
+	}
+	if check.Problem != "" {
+		logFor("integrity").Warn("suspected corrupt image", "path", path, "problem", check.Problem)
+	}
+	if err := dbPut(bucketIntegrity, hash, check); err != nil {
+		logFor("state").Error("failed to cache integrity check", "path", path, "err", err)
+	}
+	return check.Problem
+}
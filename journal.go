@@ -0,0 +1,262 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// Kinds of journal entries
+const (
+	journalDecide = "decide" // Files of a group kept, deleted or hardlinked
+	journalStatus = "status" // A group marked resolved, skipped or flagged, or cleared
+)
+
+// One review decision. Groups are identified by groupKey and files by their
+// path below the image root plus fileKey, so a journal can be replayed
+// against a fresh duplicates file, e.g. after the library moved to another
+// machine.
+type JournalEntry struct {
+	Time     time.Time     `json:"time"`
+	Kind     string        `json:"kind"`
+	Group    string        `json:"group"`
+	Keep     []JournalFile `json:"keep,omitempty"`
+	Delete   []JournalFile `json:"delete,omitempty"`
+	Hardlink []JournalFile `json:"hardlink,omitempty"`
+	Status   string        `json:"status,omitempty"` // Empty when cleared
+}
+
+type JournalFile struct {
+	Path string `json:"path"` // Relative to the image root
+	Key  string `json:"key"`  // fileKey
+}
+
+// What replaying a journal did
+type ReplayResult struct {
+	Entries   int      `json:"entries"`
+	Applied   int      `json:"applied"`
+	Satisfied int      `json:"satisfied"` // Already the case, nothing to do
+	Missing   int      `json:"missing"`   // The group isn't in the duplicates file
+	Failed    int      `json:"failed"`
+	Errors    []string `json:"errors,omitempty"`
+}
+
+var (
+	journalMu   sync.Mutex
+	journalFile *os.File
+	replayFile  string // -replay
+)
+
+func journalPath() string {
+	return filepath.Join(stateDir, "journal.jsonl")
+}
+
+func openJournal() error {
+	f, err := os.OpenFile(journalPath(), os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0644)
+	if err != nil {
+		return fmt.Errorf("failed to open decisions journal %s: %v", journalPath(), err)
+	}
+	journalMu.Lock()
+	journalFile = f
+	journalMu.Unlock()
+	return nil
+}
+
+func closeJournal() {
+	journalMu.Lock()
+	defer journalMu.Unlock()
+	if journalFile != nil {
+		journalFile.Sync()
+		journalFile.Close()
+		journalFile = nil
+	}
+}
+
+func writeJournal(e JournalEntry) {
+	e.Time = time.Now()
+	line, _ := json.Marshal(e)
+	journalMu.Lock()
+	defer journalMu.Unlock()
+	if journalFile == nil {
+		return
+	}
+	if _, err := journalFile.Write(append(line, '\n')); err != nil {
+		logFor("journal").Error("failed to write decisions journal", "err", err)
+		return
+	}
+	journalFile.Sync()
+}
+
+// Journal an applied decision on group idx
+func journalDecision(idx int, result DecideResult) {
+	group, err := currentGroups().Group(idx)
+	if err != nil {
+		return
+	}
+	keys := make(map[string]string, len(group))
+	for _, img := range group {
+		keys[filepath.Clean(img.Path)] = fileKey(img)
+	}
+	files := func(paths []string) []JournalFile {
+		var list []JournalFile
+		for _, path := range paths {
+			list = append(list, JournalFile{Path: getRelativeImagePath(path), Key: keys[filepath.Clean(path)]})
+		}
+		return list
+	}
+	writeJournal(JournalEntry{Kind: journalDecide, Group: groupKey(group),
+		Keep: files(result.Kept), Delete: files(result.Deleted), Hardlink: files(result.Hardlinked)})
+}
+
+// Read every entry of a journal, skipping a torn last line
+func readJournal(path string) ([]JournalEntry, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	var entries []JournalEntry
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		var e JournalEntry
+		if json.Unmarshal(scanner.Bytes(), &e) == nil {
+			entries = append(entries, e)
+		}
+	}
+	return entries, scanner.Err()
+}
+
+// Find the member of a group a journaled file was: by its path below the
+// image root, or else by its content if only one unclaimed member matches
+func journalMember(group []Image, f JournalFile, claimed map[string]bool) string {
+	for _, img := range group {
+		if path := filepath.Clean(img.Path); !claimed[path] && getRelativeImagePath(img.Path) == f.Path {
+			return path
+		}
+	}
+	match := ""
+	for _, img := range group {
+		if path := filepath.Clean(img.Path); !claimed[path] && fileKey(img) == f.Key {
+			if match != "" {
+				return ""
+			}
+			match = path
+		}
+	}
+	return match
+}
+
+// Redo a journaled decision on the group it was made for. Files already
+// gone (or already hardlinked to the keeper) are left alone, and members the
+// journal doesn't know are kept.
+func replayDecision(idx int, group []Image, e JournalEntry) (applied bool, err error) {
+	claimed := make(map[string]bool)
+	resolve := func(files []JournalFile) []string {
+		var paths []string
+		for _, f := range files {
+			if path := journalMember(group, f, claimed); path != "" {
+				claimed[path] = true
+				if _, err := os.Stat(path); err == nil {
+					paths = append(paths, path)
+				}
+			}
+		}
+		return paths
+	}
+	req := DecideRequest{Idx: idx, Keep: resolve(e.Keep), Delete: resolve(e.Delete), Hardlink: []string{}}
+	if len(req.Keep) == 0 {
+		return false, fmt.Errorf("none of the files it kept are left")
+	}
+	keepInfo, _ := os.Stat(req.Keep[0])
+	for _, path := range resolve(e.Hardlink) {
+		if info, err := os.Stat(path); err == nil && keepInfo != nil && os.SameFile(info, keepInfo) {
+			req.Keep = append(req.Keep, path)
+		} else {
+			req.Hardlink = append(req.Hardlink, path)
+		}
+	}
+	for _, img := range group {
+		path := filepath.Clean(img.Path)
+		if _, err := os.Stat(path); err == nil && !claimed[path] {
+			req.Keep = append(req.Keep, path)
+		}
+	}
+	if len(req.Delete)+len(req.Hardlink) == 0 {
+		return false, nil
+	}
+	if err := validateDecision(&req, group); err != nil {
+		return false, err
+	}
+	if result := applyDecision(nil, req); !result.Success {
+		return false, fmt.Errorf("%s", result.Error)
+	}
+	return true, nil
+}
+
+// Re-apply a journal against the loaded groups, skipping entries that are
+// already satisfied
+func replayJournal(path string) (ReplayResult, error) {
+	entries, err := readJournal(path)
+	if err != nil {
+		return ReplayResult{}, err
+	}
+	decideMu.Lock()
+	defer decideMu.Unlock()
+
+	result := ReplayResult{Entries: len(entries)}
+	store, release := acquireGroups()
+	defer release()
+	for _, e := range entries {
+		idx := groupIdxByKey(e.Group)
+		if idx < 0 {
+			result.Missing++
+			continue
+		}
+		group, err := store.Group(idx)
+		if err != nil {
+			result.Failed++
+			result.Errors = append(result.Errors, fmt.Sprintf("group %d: %v", idx, err))
+			continue
+		}
+		switch e.Kind {
+		case journalStatus:
+			var current GroupStatus
+			dbGet(bucketStatus, e.Group, &current)
+			if current.Status == e.Status {
+				result.Satisfied++
+				continue
+			}
+			statusMu.Lock()
+			if e.Status == "" {
+				err = dbDelete(bucketStatus, e.Group)
+			} else {
+				err = dbPut(bucketStatus, e.Group, GroupStatus{Key: e.Group, Idx: idx, Status: e.Status, Updated: e.Time})
+			}
+			statusCount++
+			statusMu.Unlock()
+			markContentResolved(group, e.Group, e.Status == statusResolved)
+		case journalDecide:
+			var applied bool
+			if applied, err = replayDecision(idx, group, e); err == nil && !applied {
+				result.Satisfied++
+				continue
+			}
+		default:
+			err = fmt.Errorf("unknown entry kind %q", e.Kind)
+		}
+		if err != nil {
+			result.Failed++
+			result.Errors = append(result.Errors, fmt.Sprintf("group %d: %v", idx, err))
+			continue
+		}
+		result.Applied++
+	}
+	logFor("journal").Info("replayed decisions journal", "file", path, "entries", result.Entries, "applied", result.Applied,
+		"satisfied", result.Satisfied, "missing", result.Missing, "failed", result.Failed)
+	return result, nil
+}
@@ -0,0 +1,77 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// Where the server listens: -host and -port, or -listen with either a TCP
+// address or unix:/path/to.sock for a reverse proxy on the same host
+var (
+	listenAddr string // -listen
+	socketMode string // -socket-mode, octal
+)
+
+// The socket path when listening on a unix domain socket, else ""
+func unixSocketPath() string {
+	path, _ := strings.CutPrefix(listenAddr, "unix:")
+	if path == listenAddr {
+		return ""
+	}
+	return path
+}
+
+func listen() (net.Listener, error) {
+	path := unixSocketPath()
+	if path == "" {
+		addr := listenAddr
+		if addr == "" {
+			addr = net.JoinHostPort(host, port)
+		}
+		return net.Listen("tcp", addr)
+	}
+
+	mode, err := strconv.ParseUint(socketMode, 8, 32)
+	if err != nil {
+		return nil, fmt.Errorf("-socket-mode %q is not an octal file mode", socketMode)
+	}
+	// A socket left behind by a crash would make Listen fail; one that still
+	// answers belongs to another running server
+	if info, err := os.Lstat(path); err == nil && info.Mode()&os.ModeSocket != 0 {
+		if conn, err := net.DialTimeout("unix", path, time.Second); err == nil {
+			conn.Close()
+			return nil, fmt.Errorf("%s is in use by another server", path)
+		}
+		os.Remove(path)
+	}
+	ln, err := net.Listen("unix", path)
+	if err != nil {
+		return nil, err
+	}
+	// The listener removes the socket file again when it is closed on shutdown
+	if err := os.Chmod(path, os.FileMode(mode)); err != nil {
+		ln.Close()
+		return nil, err
+	}
+	return ln, nil
+}
+
+// Shut the server down cleanly on Ctrl-C or SIGTERM, so state is saved and
+// temp files and the socket are removed like after -exit-after-idle
+func shutdownOnSignal(server *http.Server) {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+	sig := <-signals
+	logFor("server").Info("shutting down", "signal", sig.String())
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	server.Shutdown(ctx)
+}
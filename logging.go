@@ -0,0 +1,75 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os"
+)
+
+// Log entries are structured (log/slog), as text or JSON lines, and tagged
+// with the subsystem they come from ("delete", "convert", "exif", ...) and,
+// while serving a request, its ID
+var (
+	logLevel  string // -log-level
+	logFormat string // -log-format
+)
+
+func setupLogging() error {
+	var level slog.Level
+	if err := level.UnmarshalText([]byte(logLevel)); err != nil {
+		return fmt.Errorf("-log-level must be debug, info, warn or error")
+	}
+	opts := &slog.HandlerOptions{Level: level}
+	switch logFormat {
+	case "text":
+		slog.SetDefault(slog.New(slog.NewTextHandler(os.Stderr, opts)))
+	case "json":
+		slog.SetDefault(slog.New(slog.NewJSONHandler(os.Stderr, opts)))
+	default:
+		return fmt.Errorf("-log-format must be text or json")
+	}
+	return nil
+}
+
+// Logger for one subsystem's background work
+func logFor(subsystem string) *slog.Logger {
+	return slog.Default().With("subsystem", subsystem)
+}
+
+// Logger for one subsystem's work on behalf of a request (which may be nil)
+func reqLog(r *http.Request, subsystem string) *slog.Logger {
+	l := logFor(subsystem)
+	if r != nil {
+		if id, ok := r.Context().Value(requestIDKey{}).(string); ok {
+			l = l.With("request_id", id)
+		}
+	}
+	return l
+}
+
+// Log at error level and exit, for startup failures
+func fatal(msg string, args ...any) {
+	logFor("server").Error(msg, args...)
+	os.Exit(1)
+}
+
+type requestIDKey struct{}
+
+// Give every request an ID, or keep the one a reverse proxy assigned, and
+// send it back in X-Request-ID so a response can be matched to its log lines
+func withRequestID(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		id := r.Header.Get("X-Request-ID")
+		if id == "" || len(id) > 64 {
+			b := make([]byte, 8)
+			rand.Read(b)
+			id = hex.EncodeToString(b)
+		}
+		w.Header().Set("X-Request-ID", id)
+		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), requestIDKey{}, id)))
+	})
+}
@@ -0,0 +1,197 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"image"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"sync"
+)
+
+// Largest image accepted by POST /api/lookup
+const maxLookupUpload = 64 << 20
+
+// A library file that looks like the query image
+type LookupMatch struct {
+	Path      string `json:"path"`
+	Group     int    `json:"group"`
+	Distance  int    `json:"distance"` // Differing bits of the hash named by Method
+	Method    string `json:"method"`   // "czkawka" or "dhash"
+	Identical bool   `json:"identical"`
+}
+
+// Fresh hashes of every file in the duplicates file that is still on disk,
+// keyed by path, and the group of each. Hashes are cached by content in the
+// state database, so only the first lookup after a scan reads the library.
+func perceptualIndex() (map[string]*FreshHashes, map[string]int) {
+	store, release := acquireGroups()
+	defer release()
+	groupOf := make(map[string]int)
+	for idx := 0; idx < store.Len(); idx++ {
+		group, err := store.Group(idx)
+		if err != nil {
+			continue
+		}
+		for _, img := range group {
+			groupOf[filepath.Clean(img.Path)] = idx
+		}
+	}
+
+	index := make(map[string]*FreshHashes)
+	var mu sync.Mutex
+	jobs := make(chan string)
+	var wg sync.WaitGroup
+	for w := 0; w < validateWorkers; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for path := range jobs {
+				if h := freshHashes(path); h.DHash != "" {
+					mu.Lock()
+					index[path] = h
+					mu.Unlock()
+				}
+			}
+		}()
+	}
+	for path := range groupOf {
+		jobs <- path
+	}
+	close(jobs)
+	wg.Wait()
+	return index, groupOf
+}
+
+// Match a query image's dHash (and SHA-256, if known) against the library
+func lookupByDHash(query *FreshHashes, maxDistance int, exclude string) []LookupMatch {
+	qd, err := hex.DecodeString(query.DHash)
+	if err != nil {
+		return nil
+	}
+	var matches []LookupMatch
+	index, groupOf := perceptualIndex()
+	for path, h := range index {
+		if path == exclude {
+			continue
+		}
+		d, _ := hex.DecodeString(h.DHash)
+		if dist := hammingDistance(qd, d); dist >= 0 && dist <= maxDistance {
+			matches = append(matches, LookupMatch{Path: getRelativeImagePath(path), Group: groupOf[path], Distance: dist, Method: "dhash", Identical: query.SHA256 != "" && query.SHA256 == h.SHA256})
+		}
+	}
+	return matches
+}
+
+// Match a library file's czkawka hash against every other one in the
+// duplicates file. The distance limit is scaled from 64 bits to the hash size.
+func lookupByCzkawka(path string, hash []int, maxDistance int) []LookupMatch {
+	q := czkawkaHashBytes(hash)
+	limit := maxDistance * len(q) * 8 / 64
+	var matches []LookupMatch
+	seen := map[string]bool{path: true}
+	store, release := acquireGroups()
+	defer release()
+	for idx := 0; idx < store.Len(); idx++ {
+		group, err := store.Group(idx)
+		if err != nil {
+			continue
+		}
+		for _, img := range group {
+			p := filepath.Clean(img.Path)
+			if seen[p] {
+				continue
+			}
+			seen[p] = true
+			if _, err := os.Stat(p); err != nil {
+				continue
+			}
+			if dist := hammingDistance(q, czkawkaHashBytes(img.Hash)); dist >= 0 && dist <= limit {
+				matches = append(matches, LookupMatch{Path: getRelativeImagePath(p), Group: idx, Distance: dist, Method: "czkawka"})
+			}
+		}
+	}
+	return matches
+}
+
+// GET /api/lookup?path=P or POST /api/lookup with an image as the body lists
+// library files that look like it, closest first. A file from the
+// duplicates file is compared by czkawka's hash; anything else by a dHash
+// against every file in the duplicates file. max_distance (default 10 of 64
+// bits) sets how alike they must be.
+func lookupHandler(w http.ResponseWriter, r *http.Request) {
+	maxDistance := 10
+	if v := r.URL.Query().Get("max_distance"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 0 || n > 64 {
+			http.Error(w, "Invalid max_distance", 400)
+			return
+		}
+		maxDistance = n
+	}
+
+	var matches []LookupMatch
+	var query string
+	switch r.Method {
+	case "GET":
+		path, ok := requestedImage(w, r.URL.Query().Get("path"))
+		if !ok {
+			return
+		}
+		query = getRelativeImagePath(path)
+		if img, _, found := findImage(path); found && len(img.Hash) > 0 {
+			matches = lookupByCzkawka(path, img.Hash, maxDistance)
+			break
+		}
+		fresh := freshHashes(path)
+		if fresh.DHash == "" {
+			http.Error(w, "Cannot hash "+query+": "+fresh.Error, 415)
+			return
+		}
+		matches = lookupByDHash(fresh, maxDistance, path)
+	case "POST":
+		data, err := io.ReadAll(http.MaxBytesReader(w, r.Body, maxLookupUpload))
+		if err != nil {
+			http.Error(w, "Upload too large or incomplete", 413)
+			return
+		}
+		img, _, err := image.Decode(bytes.NewReader(data))
+		if err != nil {
+			http.Error(w, "Cannot decode uploaded image: "+err.Error(), 415)
+			return
+		}
+		ahash, dhash := perceptualHashes(img)
+		if dhash == nil {
+			http.Error(w, "Uploaded image is too small to compare", 415)
+			return
+		}
+		query = "upload"
+		sum := sha256.Sum256(data)
+		matches = lookupByDHash(&FreshHashes{SHA256: hex.EncodeToString(sum[:]), AHash: hex.EncodeToString(ahash), DHash: hex.EncodeToString(dhash)}, maxDistance, "")
+	default:
+		http.Error(w, "Method not allowed", 405)
+		return
+	}
+
+	if matches == nil {
+		matches = []LookupMatch{}
+	}
+	sort.Slice(matches, func(i, j int) bool {
+		if matches[i].Distance != matches[j].Distance {
+			return matches[i].Distance < matches[j].Distance
+		}
+		return matches[i].Path < matches[j].Path
+	})
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"query":        query,
+		"max_distance": maxDistance,
+		"matches":      matches,
+	})
+}
@@ -0,0 +1,215 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// Name of the merge of several duplicates files, in the state directory
+const mergedDuplicates = "duplicates-merged.json"
+
+var (
+	groupSourcesMu sync.Mutex
+	groupSources   map[string]string // File each group came from by group key, when several were merged
+)
+
+// The files a -duplicates value names: one, or several separated by commas
+// (the flag can also be given more than once)
+func splitDuplicates(value string) []string {
+	var files []string
+	for _, f := range strings.Split(value, ",") {
+		if f = strings.TrimSpace(f); f != "" {
+			files = append(files, f)
+		}
+	}
+	return files
+}
+
+// The first duplicates file named, next to which rescans are saved
+func primaryDuplicates(value string) string {
+	if files := splitDuplicates(value); len(files) > 0 {
+		return files[0]
+	}
+	return value
+}
+
+// Where state goes by default: the directory -duplicates names, or else the
+// directory of the (first) file
+func duplicatesDir(value string) string {
+	primary := primaryDuplicates(value)
+	if info, err := os.Stat(primary); err == nil && info.IsDir() {
+		return primary
+	}
+	return filepath.Dir(primary)
+}
+
+// Whether a file in a directory of scan results is one, rather than
+// something this tool wrote there or anything else
+func isResultsFile(path string) bool {
+	name := strings.ToLower(filepath.Base(path))
+	switch {
+	case strings.HasPrefix(name, "."), strings.Contains(name, ".tmp-"), strings.Contains(name, ".remaining."), strings.Contains(name, ".merged."),
+		name == mergedDuplicates, strings.HasPrefix(name, stdinSpool):
+		return false
+	}
+	if ext := filepath.Ext(name); ext == ".gz" || ext == ".zst" {
+		name = strings.TrimSuffix(name, ext)
+	}
+	if ext := filepath.Ext(name); ext != ".json" && ext != ".txt" {
+		return false
+	}
+	return detectFormat(path).Format != "unknown"
+}
+
+// Every results file -duplicates names, directories expanded to the results
+// files in them (not below them), in name order
+func duplicatesSources(value string) ([]string, error) {
+	var files []string
+	for _, entry := range splitDuplicates(value) {
+		info, err := os.Stat(entry)
+		if err != nil || !info.IsDir() {
+			files = append(files, entry) // Opening it reports the problem
+			continue
+		}
+		dirEntries, err := os.ReadDir(entry)
+		if err != nil {
+			return nil, err
+		}
+		found := 0
+		for _, e := range dirEntries {
+			if path := filepath.Join(entry, e.Name()); e.Type().IsRegular() && isResultsFile(path) {
+				files = append(files, path)
+				found++
+			}
+		}
+		if found == 0 {
+			return nil, fmt.Errorf("no czkawka results files in %s", entry)
+		}
+	}
+	return files, nil
+}
+
+func setGroupSources(sources map[string]string) {
+	groupSourcesMu.Lock()
+	groupSources = sources
+	groupSourcesMu.Unlock()
+}
+
+// The results file a group came from, "" unless several were merged
+func groupSource(group []Image) string {
+	groupSourcesMu.Lock()
+	sources := groupSources
+	groupSourcesMu.Unlock()
+	if sources == nil {
+		return ""
+	}
+	return sources[groupKey(group)]
+}
+
+// -duplicates, which may be given more than once
+type duplicatesFlag struct{ set bool }
+
+func (d *duplicatesFlag) String() string { return duplicatesFile }
+
+func (d *duplicatesFlag) Set(value string) error {
+	if d.set {
+		duplicatesFile += "," + value
+	} else {
+		duplicatesFile, d.set = value, true
+	}
+	return nil
+}
+
+// Identity of a group by the files in it, so the same group found by two
+// scans is only reviewed once
+func groupPaths(group []Image) string {
+	paths := make([]string, len(group))
+	for i, img := range group {
+		paths[i] = filepath.Clean(img.Path)
+	}
+	sort.Strings(paths)
+	return strings.Join(paths, "\x00")
+}
+
+// Stream several duplicates files into one at out, dropping groups an
+// earlier file already had, and return the file each group came from. Only
+// the keys of the groups are held in memory, so this works for -lazy sized
+// files too.
+func mergeDuplicatesFiles(files []string, out string) (map[string]string, error) {
+	tmp, err := os.CreateTemp(filepath.Dir(out), filepath.Base(out)+".tmp-*")
+	if err != nil {
+		return nil, err
+	}
+	defer os.Remove(tmp.Name()) // Fails harmlessly once renamed
+	w := bufio.NewWriter(tmp)
+	w.WriteString("[")
+	seen := make(map[string]bool)
+	sources := make(map[string]string)
+	written, dropped := 0, 0
+	for _, file := range files {
+		if format := detectFormat(file); format.Warning != "" {
+			logFor("groups").Warn(format.Warning, "file", file)
+		}
+		err := func() error {
+			f, err := openDuplicatesFile(file)
+			if err != nil {
+				return err
+			}
+			defer f.Close()
+			dec := json.NewDecoder(bufio.NewReader(f))
+			if tok, err := dec.Token(); err != nil || tok != json.Delim('[') {
+				return schemaError("not a JSON array of groups")
+			}
+			for dec.More() {
+				var raw json.RawMessage
+				if err := dec.Decode(&raw); err != nil {
+					return err
+				}
+				group, err := decodeGroup(raw)
+				if err != nil {
+					return err
+				}
+				if key := groupPaths(group); seen[key] {
+					dropped++
+					continue
+				} else {
+					seen[key] = true
+				}
+				if written > 0 {
+					w.WriteString(",")
+				}
+				w.WriteString("\n")
+				if groupVersion(raw) != 1 {
+					raw, _ = json.Marshal(group) // Every group of the merge in one schema
+				}
+				w.Write(raw) // As it was, so fields this build doesn't know survive
+				sources[groupKey(group)] = filepath.Base(file)
+				written++
+			}
+			return nil
+		}()
+		if err != nil {
+			tmp.Close()
+			return nil, fmt.Errorf("failed to merge %s: %v", file, err)
+		}
+	}
+	w.WriteString("\n]\n")
+	if err := w.Flush(); err != nil {
+		tmp.Close()
+		return nil, err
+	}
+	if err := tmp.Close(); err != nil {
+		return nil, err
+	}
+	if err := os.Rename(tmp.Name(), out); err != nil {
+		return nil, err
+	}
+	logFor("groups").Info("merged duplicates files", "files", len(files), "groups", written, "dropped", dropped, "file", out)
+	return sources, nil
+}
@@ -0,0 +1,267 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// EXIF date layout as written by cameras and exiftool
+const exifDateLayout = "2006:01:02 15:04:05"
+
+type GPSData struct {
+	Latitude  float64  `json:"latitude"`
+	Longitude float64  `json:"longitude"`
+	Altitude  *float64 `json:"altitude,omitempty"`
+	Source    string   `json:"source"` // File the coordinates were taken from
+}
+
+// Metadata of one file as reported by exiftool -json -n
+type exifToolRecord struct {
+	SourceFile       string
+	Keywords         interface{} // A string or a list, depending on the count
+	Subject          interface{}
+	DateTimeOriginal string
+	GPSLatitude      *float64
+	GPSLongitude     *float64
+	GPSAltitude      *float64
+}
+
+type MergeResult struct {
+	Success   bool     `json:"success"`
+	Error     string   `json:"error,omitempty"`
+	Keeper    string   `json:"keeper"`
+	Changed   bool     `json:"changed"` // False if the keeper already had everything
+	Keywords  []string `json:"keywords"`
+	DateTaken string   `json:"date_taken,omitempty"`
+	GPS       *GPSData `json:"gps,omitempty"`
+	UndoID    *int64   `json:"undo_id,omitempty"`
+}
+
+// Flatten an exiftool list value (which is a bare value when there's only one)
+func exifToolList(v interface{}) []string {
+	switch v := v.(type) {
+	case []interface{}:
+		var out []string
+		for _, item := range v {
+			out = append(out, exifToolList(item)...)
+		}
+		return out
+	case nil:
+		return nil
+	default:
+		if s := strings.TrimSpace(fmt.Sprint(v)); s != "" {
+			return []string{s}
+		}
+		return nil
+	}
+}
+
+func readExifToolMetadata(paths []string) ([]exifToolRecord, error) {
+	args := append([]string{"-json", "-n", "-Keywords", "-Subject", "-DateTimeOriginal",
+		"-GPSLatitude", "-GPSLongitude", "-GPSAltitude"}, paths...)
+	out, err := exec.Command("exiftool", args...).Output()
+	if err != nil && len(out) == 0 {
+		return nil, fmt.Errorf("exiftool failed: %v", err)
+	}
+	var records []exifToolRecord
+	if err := json.Unmarshal(out, &records); err != nil {
+		return nil, fmt.Errorf("cannot parse exiftool output: %v", err)
+	}
+	return records, nil
+}
+
+// Work out the merged metadata for the keeper: the union of all keywords,
+// the earliest capture date, and the keeper's own GPS position or else the
+// first one found in the group
+func mergeMetadata(keeper string, records []exifToolRecord) (MergeResult, []string) {
+	result := MergeResult{Keeper: keeper, Keywords: []string{}}
+	var own exifToolRecord
+	keywords := make(map[string]bool)
+	var earliest time.Time
+	for _, rec := range records {
+		if filepath.Clean(rec.SourceFile) == keeper {
+			own = rec
+		}
+		for _, k := range append(exifToolList(rec.Keywords), exifToolList(rec.Subject)...) {
+			keywords[k] = true
+		}
+		if len(rec.DateTimeOriginal) >= len(exifDateLayout) {
+			t, err := time.Parse(exifDateLayout, rec.DateTimeOriginal[:len(exifDateLayout)])
+			if err == nil && (earliest.IsZero() || t.Before(earliest)) {
+				earliest = t
+				result.DateTaken = rec.DateTimeOriginal[:len(exifDateLayout)]
+			}
+		}
+		if result.GPS == nil && rec.GPSLatitude != nil && rec.GPSLongitude != nil {
+			result.GPS = &GPSData{Latitude: *rec.GPSLatitude, Longitude: *rec.GPSLongitude, Altitude: rec.GPSAltitude, Source: rec.SourceFile}
+		}
+	}
+	if own.GPSLatitude != nil && own.GPSLongitude != nil {
+		result.GPS = &GPSData{Latitude: *own.GPSLatitude, Longitude: *own.GPSLongitude, Altitude: own.GPSAltitude, Source: keeper}
+	}
+	for k := range keywords {
+		result.Keywords = append(result.Keywords, k)
+	}
+	sort.Strings(result.Keywords)
+
+	// Only write what the keeper is missing
+	var args []string
+	ownKeywords := make(map[string]bool)
+	for _, k := range exifToolList(own.Keywords) {
+		ownKeywords[k] = true
+	}
+	ownSubject := make(map[string]bool)
+	for _, k := range exifToolList(own.Subject) {
+		ownSubject[k] = true
+	}
+	if len(ownKeywords) < len(keywords) || len(ownSubject) < len(keywords) {
+		for _, k := range result.Keywords {
+			args = append(args, "-Keywords="+k, "-XMP:Subject="+k)
+		}
+	}
+	if result.DateTaken != "" && !strings.HasPrefix(own.DateTimeOriginal, result.DateTaken) {
+		args = append(args, "-DateTimeOriginal="+result.DateTaken)
+	}
+	if result.GPS != nil && result.GPS.Source != keeper {
+		latRef, lonRef := "N", "E"
+		if result.GPS.Latitude < 0 {
+			latRef = "S"
+		}
+		if result.GPS.Longitude < 0 {
+			lonRef = "W"
+		}
+		args = append(args,
+			fmt.Sprintf("-GPSLatitude=%f", math.Abs(result.GPS.Latitude)), "-GPSLatitudeRef="+latRef,
+			fmt.Sprintf("-GPSLongitude=%f", math.Abs(result.GPS.Longitude)), "-GPSLongitudeRef="+lonRef)
+		if alt := result.GPS.Altitude; alt != nil {
+			ref := "0"
+			if *alt < 0 {
+				ref = "1"
+			}
+			args = append(args, fmt.Sprintf("-GPSAltitude=%f", math.Abs(*alt)), "-GPSAltitudeRef="+ref)
+		}
+	}
+	return result, args
+}
+
+// Write the merged metadata into the keeper, keeping a backup on the undo stack
+func applyMetadataMerge(idx int, keeper string, group []Image) MergeResult {
+	var paths []string
+	for _, img := range group {
+		if _, err := os.Stat(img.Path); err == nil {
+			paths = append(paths, filepath.Clean(img.Path))
+		}
+	}
+	records, err := readExifToolMetadata(paths)
+	if err != nil {
+		return MergeResult{Keeper: keeper, Error: err.Error()}
+	}
+	result, args := mergeMetadata(keeper, records)
+	if len(args) == 0 {
+		result.Success = true
+		return result
+	}
+
+	backupDir, err := newUndoBackupDir()
+	if err != nil {
+		result.Error = err.Error()
+		return result
+	}
+	backup, err := backupFile(backupDir, keeper)
+	if err != nil {
+		os.Remove(backupDir)
+		result.Error = fmt.Sprintf("cannot back up %s: %v", keeper, err)
+		return result
+	}
+	args = append([]string{"-n", "-P", "-overwrite_original"}, append(args, keeper)...)
+	if out, err := exec.Command("exiftool", args...).CombinedOutput(); err != nil {
+		os.Remove(backup)
+		os.Remove(backupDir)
+		result.Error = fmt.Sprintf("exiftool failed: %v: %s", err, strings.TrimSpace(string(out)))
+		return result
+	}
+
+	forgetConverted(keeper)
+	detail := fmt.Sprintf("%d keyword(s)", len(result.Keywords))
+	if result.DateTaken != "" {
+		detail += ", taken " + result.DateTaken
+	}
+	if result.GPS != nil {
+		detail += ", GPS from " + getRelativeImagePath(result.GPS.Source)
+	}
+	recordAction(keeper, actionMetadataMerged, idx, detail)
+	entry := pushUndo("metadata-merge", fmt.Sprintf("merged metadata of group %d into %s", idx, keeper), []FileChange{{Path: keeper, Backup: backup}})
+	result.UndoID = &entry.ID
+	result.Changed = true
+	result.Success = true
+	return result
+}
+
+// POST {"idx": N, "keeper": "path"} merges the keywords, earliest capture date
+// and GPS position of every file in group N into the keeper, so nothing is
+// lost when the rest of the group is deleted
+func mergeMetadataHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		http.Error(w, "Method not allowed", 405)
+		return
+	}
+	if !commandAvailable("exiftool") {
+		http.Error(w, "exiftool not found", 503)
+		return
+	}
+	var req struct {
+		Idx    int    `json:"idx"`
+		Keeper string `json:"keeper"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid JSON", 400)
+		return
+	}
+	store, release := acquireGroups()
+	defer release()
+	if req.Idx < 0 || req.Idx >= store.Len() {
+		http.Error(w, "Group not found", 404)
+		return
+	}
+	group, err := store.Group(req.Idx)
+	if err != nil {
+		http.Error(w, "Failed to read group", 500)
+		return
+	}
+	keeper := absImagePath(req.Keeper)
+	member := false
+	for _, img := range group {
+		member = member || filepath.Clean(img.Path) == keeper
+	}
+	if !member {
+		http.Error(w, fmt.Sprintf("%s is not a member of group %d", keeper, req.Idx), 400)
+		return
+	}
+	if err := checkWritable(keeper); err != nil {
+		http.Error(w, err.Error(), 403)
+		return
+	}
+
+	decideMu.Lock()
+	defer decideMu.Unlock()
+	result := applyMetadataMerge(req.Idx, keeper, group)
+	if result.Success {
+		reqLog(r, "metadata").Info("group metadata merged", "group", req.Idx, "keeper", keeper, "changed", result.Changed)
+	} else {
+		reqLog(r, "metadata").Error("group metadata merge failed", "group", req.Idx, "err", result.Error)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if !result.Success {
+		w.WriteHeader(500)
+	}
+	json.NewEncoder(w).Encode(result)
+}
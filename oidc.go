@@ -0,0 +1,376 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Optional OpenID Connect login (Authelia, Keycloak, authentik, ...) with the
+// authorization code flow. Logged in browsers get a session cookie.
+var (
+	oidcIssuer       string // -oidc-issuer
+	oidcClientID     string // -oidc-client-id
+	oidcClientSecret string // -oidc-client-secret
+	oidcRedirectURL  string // -oidc-redirect-url, "" = /auth/callback on the host the browser used
+	oidcAllowed      string // -oidc-allowed, comma-separated emails or usernames, "" = anyone the provider lets in
+)
+
+const (
+	sessionCookie   = "dupe_delete_session"
+	oidcStateCookie = "dupe_delete_oidc_state"
+	sessionTTL      = 24 * time.Hour
+	loginTTL        = 10 * time.Minute // To come back from the provider
+)
+
+var oidcClient = &http.Client{Timeout: 15 * time.Second}
+
+func oidcEnabled() bool {
+	return oidcIssuer != ""
+}
+
+// The provider's endpoints from its discovery document
+type oidcConfig struct {
+	Issuer                string `json:"issuer"`
+	AuthorizationEndpoint string `json:"authorization_endpoint"`
+	TokenEndpoint         string `json:"token_endpoint"`
+	EndSessionEndpoint    string `json:"end_session_endpoint"`
+}
+
+// A login started at /auth/login and not yet back at /auth/callback
+type pendingLogin struct {
+	nonce    string
+	verifier string // PKCE
+	next     string
+	expires  time.Time
+}
+
+// A logged in browser
+type LoginSession struct {
+	User    string    `json:"user"`
+	Subject string    `json:"sub"`
+	Expires time.Time `json:"expires"`
+}
+
+var (
+	oidcMu        sync.Mutex
+	oidcDiscovery *oidcConfig
+	pendingLogins = make(map[string]pendingLogin)
+	loginSessions = make(map[string]LoginSession)
+)
+
+// Fetch the discovery document on first use and keep it, so the server can
+// start while the provider is down
+func oidcProvider() (*oidcConfig, error) {
+	oidcMu.Lock()
+	defer oidcMu.Unlock()
+	if oidcDiscovery != nil {
+		return oidcDiscovery, nil
+	}
+	resp, err := oidcClient.Get(strings.TrimSuffix(oidcIssuer, "/") + "/.well-known/openid-configuration")
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != 200 {
+		return nil, fmt.Errorf("discovery document: %s", resp.Status)
+	}
+	var config oidcConfig
+	if err := json.NewDecoder(resp.Body).Decode(&config); err != nil {
+		return nil, fmt.Errorf("discovery document: %v", err)
+	}
+	if config.AuthorizationEndpoint == "" || config.TokenEndpoint == "" {
+		return nil, errors.New("discovery document lacks the authorization or token endpoint")
+	}
+	if strings.TrimSuffix(config.Issuer, "/") != strings.TrimSuffix(oidcIssuer, "/") {
+		return nil, fmt.Errorf("discovery document is for issuer %q", config.Issuer)
+	}
+	oidcDiscovery = &config
+	return oidcDiscovery, nil
+}
+
+func oidcCallbackURL(r *http.Request) string {
+	if oidcRedirectURL != "" {
+		return oidcRedirectURL
+	}
+	scheme := "http"
+	if r.TLS != nil || r.Header.Get("X-Forwarded-Proto") == "https" {
+		scheme = "https"
+	}
+	return scheme + "://" + r.Host + basePath(r) + "/auth/callback"
+}
+
+// The logged in session a request carries, if any
+func requestSession(r *http.Request) (LoginSession, bool) {
+	c, err := r.Cookie(sessionCookie)
+	if err != nil {
+		return LoginSession{}, false
+	}
+	oidcMu.Lock()
+	defer oidcMu.Unlock()
+	s, ok := loginSessions[c.Value]
+	if ok && time.Now().After(s.Expires) {
+		delete(loginSessions, c.Value)
+		return LoginSession{}, false
+	}
+	return s, ok
+}
+
+// Only ever go back to a path on this server after logging in
+func localRedirect(next string) string {
+	if !strings.HasPrefix(next, "/") || strings.HasPrefix(next, "//") || strings.HasPrefix(next, "/\\") {
+		return "/"
+	}
+	return next
+}
+
+// GET /auth/login[?next=/path] sends the browser to the identity provider
+func oidcLoginHandler(w http.ResponseWriter, r *http.Request) {
+	provider, err := oidcProvider()
+	if err != nil {
+		reqLog(r, "auth").Error("OIDC provider unavailable", "issuer", oidcIssuer, "err", err)
+		http.Error(w, "Identity provider unavailable", 502)
+		return
+	}
+	state, err := generateAPIToken()
+	if err != nil {
+		http.Error(w, "Failed to start login", 500)
+		return
+	}
+	nonce, _ := generateAPIToken()
+	verifier, _ := generateAPIToken()
+	challenge := sha256.Sum256([]byte(verifier))
+
+	oidcMu.Lock()
+	for s, p := range pendingLogins {
+		if time.Now().After(p.expires) {
+			delete(pendingLogins, s)
+		}
+	}
+	pendingLogins[state] = pendingLogin{nonce: nonce, verifier: verifier, next: localRedirect(r.URL.Query().Get("next")), expires: time.Now().Add(loginTTL)}
+	oidcMu.Unlock()
+
+	// Tie the login to this browser, so nobody can log it into their account
+	http.SetCookie(w, &http.Cookie{Name: oidcStateCookie, Value: state, Path: basePath(r) + "/auth/", MaxAge: int(loginTTL.Seconds()), HttpOnly: true, SameSite: http.SameSiteLaxMode, Secure: r.TLS != nil})
+	q := url.Values{
+		"response_type":         {"code"},
+		"client_id":             {oidcClientID},
+		"redirect_uri":          {oidcCallbackURL(r)},
+		"scope":                 {"openid profile email"},
+		"state":                 {state},
+		"nonce":                 {nonce},
+		"code_challenge":        {base64.RawURLEncoding.EncodeToString(challenge[:])},
+		"code_challenge_method": {"S256"},
+	}
+	sep := "?"
+	if strings.Contains(provider.AuthorizationEndpoint, "?") {
+		sep = "&"
+	}
+	http.Redirect(w, r, provider.AuthorizationEndpoint+sep+q.Encode(), http.StatusFound)
+}
+
+// The claims of an ID token we look at
+type idTokenClaims struct {
+	Issuer            string          `json:"iss"`
+	Subject           string          `json:"sub"`
+	Audience          json.RawMessage `json:"aud"` // A string or a list of them
+	Expires           int64           `json:"exp"`
+	Nonce             string          `json:"nonce"`
+	Email             string          `json:"email"`
+	PreferredUsername string          `json:"preferred_username"`
+}
+
+// Check an ID token received straight from the token endpoint. Its signature
+// isn't checked: the TLS connection to the provider vouches for it (OpenID
+// Connect Core 3.1.3.7).
+func verifyIDToken(provider *oidcConfig, token, nonce string) (*idTokenClaims, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return nil, errors.New("malformed ID token")
+	}
+	payload, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil {
+		return nil, errors.New("malformed ID token")
+	}
+	var claims idTokenClaims
+	if err := json.Unmarshal(payload, &claims); err != nil {
+		return nil, errors.New("malformed ID token")
+	}
+	var audience []string
+	if json.Unmarshal(claims.Audience, &audience) != nil {
+		var one string
+		json.Unmarshal(claims.Audience, &one)
+		audience = []string{one}
+	}
+	switch {
+	case claims.Issuer != provider.Issuer:
+		return nil, fmt.Errorf("ID token is from issuer %q", claims.Issuer)
+	case !slices.Contains(audience, oidcClientID):
+		return nil, errors.New("ID token is for another client")
+	case time.Now().Unix() > claims.Expires:
+		return nil, errors.New("ID token has expired")
+	case claims.Nonce != nonce:
+		return nil, errors.New("ID token nonce does not match")
+	case claims.Subject == "":
+		return nil, errors.New("ID token has no subject")
+	}
+	return &claims, nil
+}
+
+// Whether -oidc-allowed lets this user in
+func oidcUserAllowed(claims *idTokenClaims) bool {
+	if strings.TrimSpace(oidcAllowed) == "" {
+		return true
+	}
+	for _, allowed := range strings.Split(oidcAllowed, ",") {
+		allowed = strings.TrimSpace(allowed)
+		if allowed != "" && (strings.EqualFold(allowed, claims.Email) || allowed == claims.PreferredUsername) {
+			return true
+		}
+	}
+	return false
+}
+
+// Swap the authorization code for the ID token
+func exchangeCode(r *http.Request, provider *oidcConfig, code, verifier string) (string, error) {
+	form := url.Values{
+		"grant_type":    {"authorization_code"},
+		"code":          {code},
+		"redirect_uri":  {oidcCallbackURL(r)},
+		"code_verifier": {verifier},
+	}
+	req, err := http.NewRequest("POST", provider.TokenEndpoint, strings.NewReader(form.Encode()))
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("Accept", "application/json")
+	req.SetBasicAuth(url.QueryEscape(oidcClientID), url.QueryEscape(oidcClientSecret))
+	resp, err := oidcClient.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	var result struct {
+		IDToken     string `json:"id_token"`
+		Error       string `json:"error"`
+		Description string `json:"error_description"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		return "", fmt.Errorf("token endpoint: %s", resp.Status)
+	}
+	if result.Error != "" {
+		return "", fmt.Errorf("token endpoint: %s %s", result.Error, result.Description)
+	}
+	if result.IDToken == "" {
+		return "", errors.New("token endpoint returned no ID token")
+	}
+	return result.IDToken, nil
+}
+
+// GET /auth/callback is where the identity provider sends the browser back
+func oidcCallbackHandler(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	if e := q.Get("error"); e != "" {
+		http.Error(w, "Login failed: "+e+" "+q.Get("error_description"), 403)
+		return
+	}
+	state := q.Get("state")
+	c, err := r.Cookie(oidcStateCookie)
+	if err != nil || state == "" || c.Value != state {
+		http.Error(w, "Login failed: unknown or mismatched state, try again", 400)
+		return
+	}
+	http.SetCookie(w, &http.Cookie{Name: oidcStateCookie, Path: basePath(r) + "/auth/", MaxAge: -1})
+	oidcMu.Lock()
+	pending, ok := pendingLogins[state]
+	delete(pendingLogins, state)
+	oidcMu.Unlock()
+	if !ok || time.Now().After(pending.expires) {
+		http.Error(w, "Login failed: the login took too long, try again", 400)
+		return
+	}
+
+	provider, err := oidcProvider()
+	if err != nil {
+		http.Error(w, "Identity provider unavailable", 502)
+		return
+	}
+	token, err := exchangeCode(r, provider, q.Get("code"), pending.verifier)
+	if err != nil {
+		reqLog(r, "auth").Warn("OIDC login failed", "err", err)
+		http.Error(w, "Login failed", 502)
+		return
+	}
+	claims, err := verifyIDToken(provider, token, pending.nonce)
+	if err != nil {
+		reqLog(r, "auth").Warn("OIDC login failed", "err", err)
+		http.Error(w, "Login failed", 403)
+		return
+	}
+	user := claims.PreferredUsername
+	if claims.Email != "" {
+		user = claims.Email
+	}
+	if user == "" {
+		user = claims.Subject
+	}
+	if !oidcUserAllowed(claims) {
+		reqLog(r, "auth").Warn("OIDC login refused, not in -oidc-allowed", "user", user, "client", clientIP(r))
+		http.Error(w, "You are not allowed to use this server", 403)
+		return
+	}
+
+	id, err := generateAPIToken()
+	if err != nil {
+		http.Error(w, "Failed to create session", 500)
+		return
+	}
+	session := LoginSession{User: user, Subject: claims.Subject, Expires: time.Now().Add(sessionTTL)}
+	oidcMu.Lock()
+	for s, old := range loginSessions {
+		if time.Now().After(old.Expires) {
+			delete(loginSessions, s)
+		}
+	}
+	loginSessions[id] = session
+	oidcMu.Unlock()
+	http.SetCookie(w, &http.Cookie{Name: sessionCookie, Value: id, Path: "/", Expires: session.Expires, HttpOnly: true, SameSite: http.SameSiteLaxMode, Secure: r.TLS != nil || r.Header.Get("X-Forwarded-Proto") == "https"})
+	reqLog(r, "auth").Info("OIDC login", "user", user, "client", clientIP(r))
+	http.Redirect(w, r, basePath(r)+pending.next, http.StatusFound)
+}
+
+// GET /auth/logout ends the session here and, if it supports that, at the provider
+func oidcLogoutHandler(w http.ResponseWriter, r *http.Request) {
+	if c, err := r.Cookie(sessionCookie); err == nil {
+		oidcMu.Lock()
+		delete(loginSessions, c.Value)
+		oidcMu.Unlock()
+	}
+	http.SetCookie(w, &http.Cookie{Name: sessionCookie, Path: "/", MaxAge: -1})
+	if provider, err := oidcProvider(); err == nil && provider.EndSessionEndpoint != "" {
+		q := url.Values{"client_id": {oidcClientID}}
+		http.Redirect(w, r, provider.EndSessionEndpoint+"?"+q.Encode(), http.StatusFound)
+		return
+	}
+	http.Redirect(w, r, basePath(r)+"/", http.StatusFound)
+}
+
+// GET /auth/me: who is logged in
+func oidcMeHandler(w http.ResponseWriter, r *http.Request) {
+	session, ok := requestSession(r)
+	if !ok {
+		http.Error(w, "Not logged in", 401)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(session)
+}
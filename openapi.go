@@ -0,0 +1,471 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"reflect"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// GET /api/openapi.json describes every endpoint as an OpenAPI 3 document.
+// Request and response schemas are generated from the Go types the handlers
+// decode and encode, so they can't drift from what is actually served.
+
+// One endpoint and method. Request and Response are a value of the type the
+// handler decodes or encodes (only its type matters), a fields list for the
+// handlers that encode a map, or a jsonSchema written out by hand.
+type apiOperation struct {
+	Method      string
+	Path        string
+	Summary     string
+	Query       []apiParam
+	Request     any
+	Response    any
+	ContentType string // Of the response, if not JSON
+	Destructive bool   // Wrapped in destructive, so it needs the CSRF token
+}
+
+type apiParam struct {
+	Name        string
+	Description string
+}
+
+// Properties of an object, as alternating names and example values
+type fields []any
+
+type jsonSchema map[string]any
+
+var binaryBody = jsonSchema{"type": "string", "format": "binary"}
+
+func param(name, description string) apiParam {
+	return apiParam{Name: name, Description: description}
+}
+
+var apiOperations = []apiOperation{
+	{Method: "GET", Path: "/api/health", Summary: "Server health: storage, conversion cache space, EXIF errors and background jobs; 503 while storage is unavailable",
+		Response: fields{"status", "", "groups", 0, "storage", StorageStatus{}, "cache", CacheStatus{}, "exif_errors", map[string]int{}, "background", BackgroundStatus{}}},
+	{Method: "GET", Path: "/api/version", Summary: "Build information, available optional features and the detected duplicates file format",
+		Response: fields{"build", map[string]string{}, "features", map[string]any{}, "supported_schema", 0, "supported_schemas", []czkawkaSchema{}, "dataset", DatasetFormat{}}},
+	{Method: "GET", Path: "/api/openapi.json", Summary: "This document",
+		Response: jsonSchema{"type": "object"}},
+	{Method: "GET", Path: "/api/csrf", Summary: "This run's CSRF token and the header to send it in",
+		Response: fields{"token", "", "header", ""}},
+	{Method: "POST", Path: "/api/reload", Summary: "Read the duplicates file again; with idx, where that group is now. 409 while a scan is running",
+		Request: struct {
+			Idx *int `json:"idx"`
+		}{}, Response: ReloadResult{}},
+	{Method: "POST", Path: "/api/prune", Summary: "Drop the groups with fewer than two files left on disk; with idx, where that group is now",
+		Request: fields{"idx", 0}, Response: PruneResult{}},
+	{Method: "POST", Path: "/api/write-back", Summary: "Write the duplicates that are left now, as -write-back does after deletions; 409 without -write-back",
+		Response: WriteBackResult{}},
+	{Method: "GET", Path: "/api/workspaces", Summary: "The datasets this server hosts and which is active",
+		Response: workspacesResponse},
+	{Method: "POST", Path: "/api/workspaces", Summary: "Switch to another workspace",
+		Request: fields{"name", ""}, Response: workspacesResponse},
+	{Method: "GET", Path: "/api/validation", Summary: "Report of the last check of the files in the duplicates file",
+		Response: ValidationReport{}},
+	{Method: "POST", Path: "/api/validation", Summary: "Check the files again, all or a sample of them",
+		Request: fields{"mode", ""}, Response: fields{"running", true, "mode", ""}},
+	{Method: "GET", Path: "/api/exif-errors", Summary: "Files whose EXIF couldn't be read, by kind of failure",
+		Query:    []apiParam{param("kind", "Only this kind: unreadable, truncated, corrupt or unsupported-maker-note")},
+		Response: fields{"counts", map[string]int{}, "files", []exifFailureRecord{}}},
+	{Method: "GET", Path: "/api/group", Summary: "One group with EXIF data and scores, best keeper first",
+		Query: []apiParam{
+			param("idx", "Group index (default 0)"),
+			param("strategy", "Re-score with largest, oldest, raw-first, earliest-screenshot or default"),
+			param("compact", "1 drops hash and original_path"),
+			param("fields", "With compact, comma-separated fields to keep anyway"),
+			param("tz", "Timezone for dates, e.g. Europe/Dublin"),
+			param("locale", "Locale for formatted dates, e.g. en-US"),
+		},
+		Response: V1Group{}},
+	{Method: "GET", Path: "/api/groups", Summary: "Every group as NDJSON, one GroupSummary per line",
+		Query: []apiParam{
+			param("cursor", "First position in the listing's order"),
+			param("sort", "Order: file, savings, size, similarity, oldest, newest or path"),
+			param("limit", "Most matching groups to list (default all)"),
+			param("status", "unresolved, resolved, skipped or flagged"),
+			param("min_count", "Only groups with at least this many files"),
+			param("min_savings", "Only groups that free at least this many bytes"),
+			param("extension", "Only groups with a file of one of these comma-separated extensions, e.g. cr2"),
+			param("path", "Only groups with a file below this directory, absolute or relative to the image root"),
+			param("source", "Only groups from this results file, when several were merged"),
+		},
+		Response: GroupSummary{}, ContentType: "application/x-ndjson"},
+	{Method: "GET", Path: "/api/progress", Summary: "How many groups are resolved and remaining, and the bytes reclaimed so far",
+		Query: []apiParam{param("idx", "Current group index, echoed back")}, Response: Progress{}},
+	{Method: "GET", Path: "/api/group/next", Summary: "The next group that isn't resolved and still has two files on disk",
+		Query:    []apiParam{param("after", "Group index to start after (default -1)"), param("reverse", "1 to search backwards")},
+		Response: fields{"idx", 0, "skipped", 0}},
+	{Method: "GET", Path: "/api/group/{idx}/status", Summary: "A group's review status, empty if it has none",
+		Response: GroupStatus{}},
+	{Method: "POST", Path: "/api/group/{idx}/status", Summary: "Mark a group resolved, skipped or flagged, kept across restarts and reloads",
+		Request: fields{"status", statusFlagged, "note", ""}, Response: GroupStatus{}},
+	{Method: "DELETE", Path: "/api/group/{idx}/status", Summary: "Clear a group's review status"},
+	{Method: "POST", Path: "/api/refresh", Summary: "Read the size, modification date and dimensions of a group's files from disk again",
+		Query:    []apiParam{param("idx", "Group index")},
+		Response: fields{"idx", 0, "changed", 0, "files", []RefreshedFile{}}},
+	{Method: "GET", Path: "/api/group/{idx}/claim", Summary: "Who holds a group; 404 if nobody",
+		Response: GroupClaim{}},
+	{Method: "POST", Path: "/api/group/{idx}/claim", Summary: "Claim a group for a while (default 5 minutes, at most 30) or renew the claim; 409 with the claim if someone else holds it",
+		Request: fields{"ttl", 300}, Response: GroupClaim{}},
+	{Method: "DELETE", Path: "/api/group/{idx}/claim", Summary: "Release a claim; 409 if someone else holds it"},
+	{Method: "GET", Path: "/api/claims", Summary: "Every live claim on a group, soonest to expire first",
+		Response: []GroupClaim{}},
+	{Method: "GET", Path: "/api/events", Summary: "Server-sent events: deleted (a file deleted, trashed or quarantined), resolved (a group decided), status (a group's status set or cleared) and converted (a CR2 converted to JPG), each with a JSON payload",
+		Response: binaryBody, ContentType: "text/event-stream"},
+	{Method: "GET", Path: "/api/search", Summary: "Groups with a file whose path contains a substring, with the offsets of each match",
+		Query:    []apiParam{param("q", "Substring to look for, ignoring case"), param("limit", "Most groups to return (default 100)")},
+		Response: fields{"query", "", "groups", []SearchResult{}, "truncated", false}},
+	{Method: "GET", Path: "/api/sample", Summary: "A random sample of unreviewed groups, stratified by size and savings",
+		Query:    []apiParam{param("n", "Sample size (default 20)"), param("seed", "Seed, to get the same sample again")},
+		Response: fields{"seed", int64(0), "unreviewed", 0, "strata", []Stratum{}, "groups", []SampledGroup{}}},
+	{Method: "GET", Path: "/api/stats", Summary: "Duplicate waste in total and by top-level directory, owner, extension and camera",
+		Query:    []apiParam{param("owner", "Only this owner's files"), param("root", "Only files below this directory")},
+		Response: fields{"groups", 0, "total", WasteShare{}, "by_root", []WasteShare{}, "by_owner", []WasteShare{}, "by_extension", []WasteShare{}, "by_camera", []WasteShare{}}},
+	{Method: "POST", Path: "/api/simulate", Summary: "Project the deletions that resolving every group with these scoring rules would give",
+		Query:   []apiParam{param("sample", "Affected groups to list (default 20)")},
+		Request: ScoringRules{},
+		Response: fields{"rules", ScoringRules{}, "projected", Projection{}, "baseline", Projection{},
+			"changed_groups", 0, "sample", []SimulatedGroup{}}},
+	{Method: "GET", Path: "/api/queues", Summary: "Named queues of bookmarked groups and their sizes",
+		Response: map[string]int{}},
+	{Method: "GET", Path: "/api/queues/{name}", Summary: "One queue",
+		Response: Queue{}},
+	{Method: "POST", Path: "/api/queues/{name}", Summary: "Push a group onto a queue",
+		Request: fields{"idx", 0}, Response: Queue{}},
+	{Method: "DELETE", Path: "/api/queues/{name}", Summary: "Remove one group from a queue, or the whole queue",
+		Query: []apiParam{param("idx", "Group to remove")}, Response: Queue{}},
+	{Method: "GET", Path: "/api/queues/{name}/next", Summary: "The queued group after another; 404 at the end of the queue",
+		Query:    []apiParam{param("after", "Group index")},
+		Response: fields{"queue", "", "position", 0, "remaining", 0, "entry", QueueEntry{}}},
+	{Method: "GET", Path: "/api/sessions/{name}", Summary: "A review session and the order presets",
+		Response: sessionResponse},
+	{Method: "PUT", Path: "/api/sessions/{name}", Summary: "Create a review session or change its order",
+		Request: fields{"order", ""}, Response: sessionResponse},
+	{Method: "DELETE", Path: "/api/sessions/{name}", Summary: "Forget a review session"},
+	{Method: "GET", Path: "/api/sessions/{name}/next", Summary: "The next unreviewed group in the session's order; 410 with the run summary once its time is up",
+		Query:    []apiParam{param("after", "Group index"), param("reverse", "1 walks backwards")},
+		Response: fields{"session", "", "order", "", "idx", 0, "position", 0, "total", 0}},
+	{Method: "POST", Path: "/api/sessions/{name}/start", Summary: "Start a run in a session, optionally time-boxed",
+		Request: fields{"minutes", 0.0}, Response: ReviewSession{}},
+	{Method: "POST", Path: "/api/sessions/{name}/stop", Summary: "End the run and return its summary",
+		Response: SessionRun{}},
+	{Method: "POST", Path: "/api/delete", Summary: "Delete (or trash) one file", Destructive: true,
+		Request: fields{"path", ""}, Response: V1FileResult{}},
+	{Method: "POST", Path: "/api/delete-batch", Summary: "Delete (or trash) several files", Destructive: true,
+		Request: []string{}, Response: V1BatchResult{}},
+	{Method: "POST", Path: "/api/move", Summary: "Move a file to the quarantine directory", Destructive: true,
+		Request: fields{"path", ""}, Response: V1FileResult{}},
+	{Method: "POST", Path: "/api/group/decide", Summary: "Keep, delete and hardlink the members of a group, all or nothing", Destructive: true,
+		Request: DecideRequest{}, Response: V1DecideResult{}},
+	{Method: "POST", Path: "/api/resolve-group", Summary: "Keep one file and delete or hardlink every other member of its group", Destructive: true,
+		Request: fields{"idx", 0, "keep", "", "mode", ""}, Response: V1DecideResult{}},
+	{Method: "POST", Path: "/api/dedupe", Summary: "Make byte-identical members share disk blocks (btrfs, XFS)", Destructive: true,
+		Request:  fields{"idx", 0, "all", true},
+		Response: fields{"success", true, "deduped", 0, "bytes", int64(0), "results", []BlockDedupeResult{}}},
+	{Method: "GET", Path: "/api/stage", Summary: "The staged decisions and what they would free",
+		Response: fields{"staged", []StagedDecision{}, "files", 0, "bytes", int64(0)}},
+	{Method: "POST", Path: "/api/stage", Summary: "Stage a decision for later",
+		Request: DecideRequest{}, Response: StagedDecision{}},
+	{Method: "DELETE", Path: "/api/stage", Summary: "Unstage one group, or everything",
+		Query: []apiParam{param("idx", "Group to unstage")}},
+	{Method: "GET", Path: "/api/session/export", Summary: "Download the review state: staged decisions, group statuses, queues, sessions, snapshot rules and the decisions journal",
+		Response: StateExport{}},
+	{Method: "POST", Path: "/api/session/import", Summary: "Restore an exported review state, merged into the current one or, with replace=1, instead of it",
+		Query: []apiParam{param("replace", "1 to drop the current review state first")}, Request: StateExport{},
+		Response: fields{"success", true, "imported", map[string]int{}}},
+	{Method: "POST", Path: "/api/commit", Summary: "Apply every staged decision", Destructive: true,
+		Response: fields{"success", true, "committed", 0, "failed", 0, "reclaimed_bytes", int64(0), "results", []CommitResult{}}},
+	{Method: "GET", Path: "/api/plan/export", Summary: "The staged decisions as a shell script or JSON",
+		Query: []apiParam{
+			param("format", "sh (default) or json"),
+			param("auto", "1 adds the current rules' pick for every group not staged"),
+			param("cmd", "rm (default) or trash"),
+			param("root", "Where the image root is mounted on the machine running the script"),
+		},
+		Response: fields{"generated", time.Time{}, "groups", []PlannedGroup{}}},
+	{Method: "GET", Path: "/api/group/zip", Summary: "A group's files as a ZIP with a group.json",
+		Query:    []apiParam{param("idx", "Group index"), param("previews", "1 for JPG previews of CR2 files")},
+		Response: binaryBody, ContentType: "application/zip"},
+	{Method: "POST", Path: "/api/group/merge-metadata", Summary: "Copy the group's keywords, earliest date and GPS position into the keeper", Destructive: true,
+		Request: fields{"idx", 0, "keeper", ""}, Response: MergeResult{}},
+	{Method: "GET", Path: "/api/scan", Summary: "The last or running czkawka rescan",
+		Response: ScanJob{}},
+	{Method: "POST", Path: "/api/scan", Summary: "Start a czkawka rescan",
+		Request: ScanParams{}, Response: ScanJob{}},
+	{Method: "GET", Path: "/api/history", Summary: "Every recorded action for one file; without path, the files removed and bytes reclaimed in total, per day and per cleanup session",
+		Query:    []apiParam{param("path", "File path"), param("tz", "Timezone for the days of the summary (default local)")},
+		Response: fields{"path", "", "actions", []Action{}}},
+	{Method: "GET", Path: "/api/redundant-dirs", Summary: "Directories whose every file has a duplicate in one other directory",
+		Response: []RedundantDir{}},
+	{Method: "POST", Path: "/api/redundant-dirs", Summary: "Move a redundant directory to the trash", Destructive: true,
+		Request:  fields{"dir", ""},
+		Response: fields{"success", true, "trashed", RedundantDir{}, "removed_dirs", []string{}, "undo_id", int64(0), "trashed_files", 0}},
+	{Method: "GET", Path: "/api/screenshots", Summary: "Screenshot-only groups and those whose files are identical",
+		Response: screenshotsResponse},
+	{Method: "POST", Path: "/api/screenshots", Summary: "Resolve the identical screenshot groups, keeping the earliest", Destructive: true,
+		Query:    []apiParam{param("dry_run", "1 only lists them")},
+		Response: append(fields{"resolved", 0, "failed", []string{}}, screenshotsResponse...)},
+	{Method: "GET", Path: "/api/snapshot-rules", Summary: "Detected snapshot patterns and the saved rules",
+		Response: fields{"detected", []SnapshotPattern{}, "rules", []SnapshotRule{}}},
+	{Method: "POST", Path: "/api/snapshot-rules", Summary: "Save a rule and trash the snapshot copies it matches", Destructive: true,
+		Request: fields{"id", "", "snapshot", "", "live", "", "dry_run", true}, Response: SnapshotResult{}},
+	{Method: "DELETE", Path: "/api/snapshot-rules", Summary: "Forget a rule", Destructive: true,
+		Query: []apiParam{param("id", "Rule ID")}},
+	{Method: "GET", Path: "/api/empty-dirs", Summary: "Directories below the image root without any files",
+		Response: []string{}},
+	{Method: "POST", Path: "/api/empty-dirs", Summary: "Remove every empty directory", Destructive: true,
+		Response: fields{"success", true, "removed", []string{}}},
+	{Method: "GET", Path: "/api/crop", Summary: "A 1:1 crop of an image as a JPG",
+		Query:    append([]apiParam{param("path", "Image path")}, cropParams...),
+		Response: binaryBody, ContentType: "image/jpeg"},
+	{Method: "GET", Path: "/api/compare", Summary: "Matching crops of the same region of two images",
+		Query:    append([]apiParam{param("a", "First image path"), param("b", "Second image path")}, cropParams...),
+		Response: fields{"a", CompareSide{}, "b", CompareSide{}}},
+	{Method: "GET", Path: "/api/hashes", Summary: "The hashes czkawka stored for a file, optionally computed again",
+		Query:    []apiParam{param("path", "File path"), param("fresh", "1 also computes SHA-256, aHash and dHash")},
+		Response: FileHashes{}},
+	{Method: "GET", Path: "/api/hashes/compare", Summary: "Compare the hashes of any two files",
+		Query: []apiParam{param("a", "First file path"), param("b", "Second file path")},
+		Response: fields{"a", FileHashes{}, "b", FileHashes{}, "same_group", true, "identical", true,
+			"czkawka_distance", 0, "ahash_distance", 0, "dhash_distance", 0}},
+	{Method: "GET", Path: "/api/lookup", Summary: "Library files that look like a file, closest first",
+		Query:    []apiParam{param("path", "File path"), param("max_distance", "Most differing hash bits of 64 (default 10)")},
+		Response: lookupResponse},
+	{Method: "POST", Path: "/api/lookup", Summary: "Library files that look like an uploaded image, closest first",
+		Query:   []apiParam{param("max_distance", "Most differing hash bits of 64 (default 10)")},
+		Request: binaryBody, Response: lookupResponse},
+	{Method: "GET", Path: "/api/open-link", Summary: "A signed request for the companion agent to open a file",
+		Query: []apiParam{param("path", "File path")}, Response: OpenLink{}},
+	{Method: "GET", Path: "/api/recently-deleted", Summary: "Files deleted or trashed since the server started, newest first",
+		Query: []apiParam{param("limit", "Most entries to list (default 20)")}, Response: []RecentDeletion{}},
+	{Method: "GET", Path: "/api/recently-deleted/{id}/thumbnail", Summary: "The thumbnail kept for a deleted file",
+		Response: binaryBody, ContentType: "image/jpeg"},
+	{Method: "GET", Path: "/api/backups", Summary: "Automatic state backups, newest first",
+		Response: []Backup{}},
+	{Method: "POST", Path: "/api/backups", Summary: "Restore a state backup", Destructive: true,
+		Request: fields{"name", ""}, Response: fields{"success", true, "restored", Backup{}}},
+	{Method: "GET", Path: "/api/budget", Summary: "Today's usage of the daily deletion budget",
+		Response: BudgetStatus{}},
+	{Method: "GET", Path: "/api/undo-stack", Summary: "Reversible operations, newest first",
+		Response: []UndoEntry{}},
+	{Method: "POST", Path: "/api/undo-stack", Summary: "Roll back one entry", Destructive: true,
+		Request: fields{"id", int64(0)}, Response: fields{"success", true, "undone", UndoEntry{}}},
+	{Method: "POST", Path: "/api/undo", Summary: "Roll back the newest entry", Destructive: true,
+		Response: fields{"success", true, "undone", UndoEntry{}}},
+	{Method: "GET", Path: "/api/restore", Summary: "Trashed files that can still be put back, newest first",
+		Response: []Restorable{}},
+	{Method: "POST", Path: "/api/restore", Summary: "Put back the most recently trashed file at a path", Destructive: true,
+		Request: fields{"path", ""}, Response: fields{"success", true, "restored", Restorable{}}},
+	{Method: "GET", Path: "/api/debug/stats", Summary: "Runtime stats, with -debug",
+		Response: DebugStats{}},
+	{Method: "GET", Path: "/auth/login", Summary: "Log in with the OpenID Connect provider",
+		Query: []apiParam{param("next", "Local path to return to")}},
+	{Method: "GET", Path: "/auth/callback", Summary: "Where the OpenID Connect provider sends the browser back to"},
+	{Method: "GET", Path: "/auth/logout", Summary: "Log out"},
+	{Method: "GET", Path: "/auth/me", Summary: "The logged in user; 401 without a session",
+		Response: LoginSession{}},
+	{Method: "GET", Path: "/images/{path}", Summary: "An image below the image root, CR2 files converted to JPG",
+		Query:    []apiParam{param("still", "1 for the first frame of an animation as a PNG")},
+		Response: binaryBody, ContentType: "image/*"},
+}
+
+var (
+	workspacesResponse = fields{"active", "", "workspaces", []struct {
+		Workspace
+		Active bool `json:"active"`
+		Groups int  `json:"groups,omitempty"`
+	}{}}
+	sessionResponse     = fields{"session", ReviewSession{}, "presets", map[string]string{}}
+	screenshotsResponse = fields{"screenshot_groups", 0, "exact_groups", []ScreenshotGroup{}, "files", 0, "bytes", int64(0)}
+	lookupResponse      = fields{"query", "", "max_distance", 0, "matches", []LookupMatch{}}
+	cropParams          = []apiParam{
+		param("x", "Left edge, 0-1 of the width"), param("y", "Top edge, 0-1 of the height"),
+		param("w", "Width, 0-1 of the width"), param("h", "Height, 0-1 of the height"),
+	}
+)
+
+// Builds schemas, collecting named struct types under components
+type schemaBuilder struct {
+	schemas map[string]any
+}
+
+var timeType = reflect.TypeOf(time.Time{})
+
+func (b *schemaBuilder) schema(v any) any {
+	switch v := v.(type) {
+	case nil:
+		return nil
+	case jsonSchema:
+		return v
+	case fields:
+		props := make(map[string]any)
+		for i := 0; i+1 < len(v); i += 2 {
+			props[v[i].(string)] = b.schema(v[i+1])
+		}
+		return jsonSchema{"type": "object", "properties": props}
+	}
+	return b.typeSchema(reflect.TypeOf(v))
+}
+
+func (b *schemaBuilder) typeSchema(t reflect.Type) any {
+	switch {
+	case t == timeType:
+		return jsonSchema{"type": "string", "format": "date-time"}
+	case t == reflect.TypeOf(json.RawMessage{}):
+		return jsonSchema{}
+	}
+	switch t.Kind() {
+	case reflect.Pointer:
+		return b.typeSchema(t.Elem())
+	case reflect.Bool:
+		return jsonSchema{"type": "boolean"}
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return jsonSchema{"type": "integer"}
+	case reflect.Float32, reflect.Float64:
+		return jsonSchema{"type": "number"}
+	case reflect.String:
+		return jsonSchema{"type": "string"}
+	case reflect.Slice, reflect.Array:
+		return jsonSchema{"type": "array", "items": b.typeSchema(t.Elem())}
+	case reflect.Map:
+		return jsonSchema{"type": "object", "additionalProperties": b.typeSchema(t.Elem())}
+	case reflect.Struct:
+		if t.Name() == "" {
+			return b.structSchema(t)
+		}
+		if _, ok := b.schemas[t.Name()]; !ok {
+			b.schemas[t.Name()] = nil // Placeholder, for types that refer to themselves
+			b.schemas[t.Name()] = b.structSchema(t)
+		}
+		return jsonSchema{"$ref": "#/components/schemas/" + t.Name()}
+	}
+	return jsonSchema{} // Anything
+}
+
+func (b *schemaBuilder) structSchema(t reflect.Type) jsonSchema {
+	props := make(map[string]any)
+	b.addFields(t, props)
+	return jsonSchema{"type": "object", "properties": props}
+}
+
+// Add a struct's fields as encoding/json would encode them, embedded
+// structs' fields inline
+func (b *schemaBuilder) addFields(t reflect.Type, props map[string]any) {
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		tag := f.Tag.Get("json")
+		if tag == "-" {
+			continue
+		}
+		name, _, _ := strings.Cut(tag, ",")
+		if f.Anonymous && name == "" {
+			ft := f.Type
+			if ft.Kind() == reflect.Pointer {
+				ft = ft.Elem()
+			}
+			if ft.Kind() == reflect.Struct {
+				b.addFields(ft, props)
+				continue
+			}
+		}
+		if !f.IsExported() {
+			continue
+		}
+		if name == "" {
+			name = f.Name
+		}
+		props[name] = b.typeSchema(f.Type)
+	}
+}
+
+var pathParamPattern = regexp.MustCompile(`\{(\w+)\}`)
+
+func openAPIDocument(r *http.Request) map[string]any {
+	b := &schemaBuilder{schemas: make(map[string]any)}
+	errorResponse := jsonSchema{
+		"description": "Error",
+		"content":     jsonSchema{"text/plain": jsonSchema{"schema": jsonSchema{"type": "string"}}},
+	}
+	paths := make(map[string]map[string]any)
+	for _, op := range apiOperations {
+		operation := jsonSchema{"summary": op.Summary}
+		var params []any
+		for _, m := range pathParamPattern.FindAllStringSubmatch(op.Path, -1) {
+			params = append(params, jsonSchema{"name": m[1], "in": "path", "required": true, "schema": jsonSchema{"type": "string"}})
+		}
+		for _, p := range op.Query {
+			params = append(params, jsonSchema{"name": p.Name, "in": "query", "description": p.Description, "schema": jsonSchema{"type": "string"}})
+		}
+		if params != nil {
+			operation["parameters"] = params
+		}
+		if op.Request != nil {
+			mediaType := "application/json"
+			if reflect.DeepEqual(op.Request, binaryBody) {
+				mediaType = "application/octet-stream"
+			}
+			operation["requestBody"] = jsonSchema{
+				"required": true,
+				"content":  jsonSchema{mediaType: jsonSchema{"schema": b.schema(op.Request)}},
+			}
+		}
+		responses := jsonSchema{"default": errorResponse}
+		if op.Response == nil {
+			responses["2XX"] = jsonSchema{"description": "Success"}
+		} else {
+			contentType := op.ContentType
+			if contentType == "" {
+				contentType = "application/json"
+			}
+			responses["200"] = jsonSchema{
+				"description": "Success",
+				"content":     jsonSchema{contentType: jsonSchema{"schema": b.schema(op.Response)}},
+			}
+		}
+		operation["responses"] = responses
+		if op.Destructive {
+			operation["security"] = []any{jsonSchema{"csrfToken": []string{}}, jsonSchema{"apiToken": []string{}}}
+		}
+		// Documented under /api/v1 only; the unversioned aliases serve the same
+		path := op.Path
+		if rest, ok := strings.CutPrefix(path, "/api/"); ok {
+			path = apiV1 + "/" + rest
+		}
+		if paths[path] == nil {
+			paths[path] = make(map[string]any)
+		}
+		paths[path][strings.ToLower(op.Method)] = operation
+	}
+
+	server := basePath(r)
+	if server == "" {
+		server = "/"
+	}
+	return map[string]any{
+		"openapi": "3.0.3",
+		"info": jsonSchema{
+			"title":       "czkawka-webui",
+			"version":     version,
+			"description": "Every /api/v1 path is also served without the v1, as it was before versioning. Review endpoints answer with the V1 structs, whose fields are only ever added to.",
+		},
+		"servers": []any{jsonSchema{"url": server}},
+		"paths":   paths,
+		"components": jsonSchema{
+			"schemas": b.schemas,
+			"securitySchemes": jsonSchema{
+				"apiToken":  jsonSchema{"type": "http", "scheme": "bearer", "description": "The -api-token"},
+				"csrfToken": jsonSchema{"type": "apiKey", "in": "header", "name": csrfHeader, "description": "This run's token from /api/csrf"},
+			},
+		},
+	}
+}
+
+func openAPIHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(openAPIDocument(r))
+}
@@ -0,0 +1,164 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// One group's share of an exported deletion plan
+type PlannedGroup struct {
+	Idx      int      `json:"idx"`
+	Key      string   `json:"key"`
+	Source   string   `json:"source"` // "staged", or "auto" for the current scoring rules' pick
+	Keep     []string `json:"keep"`
+	Delete   []string `json:"delete"`
+	Hardlink []string `json:"hardlink"`
+	Bytes    int64    `json:"bytes"`
+}
+
+// The staged decisions and, with auto, what automatic resolution would do
+// with every other loaded group
+func buildPlan(auto bool) []PlannedGroup {
+	plan := []PlannedGroup{}
+	staged := make(map[string]bool)
+	for _, s := range loadStaged() {
+		staged[s.Key] = true
+		plan = append(plan, PlannedGroup{
+			Idx:      s.Decision.Idx,
+			Key:      s.Key,
+			Source:   "staged",
+			Keep:     s.Decision.Keep,
+			Delete:   nonNil(s.Decision.Delete),
+			Hardlink: nonNil(s.Decision.Hardlink),
+			Bytes:    s.Bytes,
+		})
+	}
+	if !auto {
+		return plan
+	}
+	store, release := acquireGroups()
+	defer release()
+	for idx := 0; idx < store.Len(); idx++ {
+		group, err := store.Group(idx)
+		if err != nil || staged[groupKey(group)] {
+			continue
+		}
+		imgs, originals := loadGroupImages(group)
+		if len(imgs) < 2 {
+			continue
+		}
+		sim := simulateGroup(idx, imgs, originals, defaultScoringRules)
+		if sim.Keep == "" {
+			continue
+		}
+		plan = append(plan, PlannedGroup{
+			Idx:      idx,
+			Key:      groupKey(group),
+			Source:   "auto",
+			Keep:     []string{sim.Keep},
+			Delete:   sim.Delete,
+			Hardlink: []string{},
+			Bytes:    sim.ReclaimedBytes,
+		})
+	}
+	return plan
+}
+
+func nonNil(list []string) []string {
+	if list == nil {
+		return []string{}
+	}
+	return list
+}
+
+// Rewrite paths below the image root to another root, for running the plan
+// on a machine that mounts the library elsewhere
+func rebasePlan(plan []PlannedGroup, root string) {
+	rebase := func(list []string) {
+		for i, path := range list {
+			if rel, err := filepath.Rel(imageRoot, path); err == nil && !strings.HasPrefix(rel, "..") {
+				list[i] = filepath.Join(root, rel)
+			}
+		}
+	}
+	for _, g := range plan {
+		rebase(g.Keep)
+		rebase(g.Delete)
+		rebase(g.Hardlink)
+	}
+}
+
+// Quote a string for a POSIX shell
+func shellQuote(s string) string {
+	return "'" + strings.ReplaceAll(s, "'", `'\''`) + "'"
+}
+
+// A shell script carrying out the plan. Each group only runs if its keeper
+// is still there; remove is the command given every file to delete.
+func planScript(plan []PlannedGroup, remove string) string {
+	var b strings.Builder
+	files, bytes := 0, int64(0)
+	for _, g := range plan {
+		files += len(g.Delete) + len(g.Hardlink)
+		bytes += g.Bytes
+	}
+	fmt.Fprintf(&b, "#!/bin/sh\n# Deletion plan exported by dupe_delete on %s\n", time.Now().Format(time.RFC3339))
+	fmt.Fprintf(&b, "# %d groups, %d files, %d bytes. Review it before running it.\nset -u\n", len(plan), files, bytes)
+	for _, g := range plan {
+		keeper := shellQuote(g.Keep[0])
+		fmt.Fprintf(&b, "\n# Group %d (%s)\nif [ -e %s ]; then\n", g.Idx, g.Source, keeper)
+		for _, path := range g.Delete {
+			fmt.Fprintf(&b, "\t%s -- %s\n", remove, shellQuote(path))
+		}
+		for _, path := range g.Hardlink {
+			fmt.Fprintf(&b, "\tln -f -- %s %s\n", keeper, shellQuote(path))
+		}
+		fmt.Fprintf(&b, "else\n\techo %s >&2\nfi\n", shellQuote(fmt.Sprintf("Skipping group %d: %s is missing", g.Idx, g.Keep[0])))
+	}
+	return b.String()
+}
+
+// GET /api/plan/export renders the staged decisions as a shell script
+// (format=sh, the default) or JSON (format=json) to review and run
+// elsewhere. auto=1 adds the automatic pick for every group not staged,
+// cmd=trash uses trash-cli's trash-put instead of rm, and root= rewrites
+// paths below the image root to where the library is mounted there.
+func planExportHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		http.Error(w, "Method not allowed", 405)
+		return
+	}
+	q := r.URL.Query()
+	remove := "rm -f"
+	switch q.Get("cmd") {
+	case "", "rm":
+	case "trash":
+		remove = "trash-put"
+	default:
+		http.Error(w, "cmd must be rm or trash", 400)
+		return
+	}
+	plan := buildPlan(q.Get("auto") == "1")
+	if root := q.Get("root"); root != "" {
+		rebasePlan(plan, root)
+	}
+
+	switch q.Get("format") {
+	case "", "sh":
+		w.Header().Set("Content-Type", "text/x-shellscript")
+		w.Header().Set("Content-Disposition", `attachment; filename="deletion-plan.sh"`)
+		fmt.Fprint(w, planScript(plan, remove))
+	case "json":
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"generated": time.Now(),
+			"groups":    plan,
+		})
+	default:
+		http.Error(w, "format must be sh or json", 400)
+	}
+}
@@ -0,0 +1,173 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"os"
+	"strconv"
+	"sync"
+)
+
+// How far the review of the loaded groups has got, for a progress bar
+type Progress struct {
+	TotalGroups    int   `json:"total_groups"`
+	Idx            *int  `json:"idx,omitempty"` // The group it came with, or ?idx=
+	Resolved       int   `json:"resolved"`      // Groups with a file deleted, trashed or hardlinked, or marked resolved
+	Remaining      int   `json:"remaining"`
+	ReclaimedBytes int64 `json:"reclaimed_bytes"` // By the files removed from those groups
+}
+
+// Which groups are resolved, worked out from the history and the group
+// statuses once per change to the groups, the history or a status
+type reviewState struct {
+	gen, actions, statuses int
+	resolved               []bool
+	status                 []string // Set with /api/group/{idx}/status
+	reclaimed              int64
+}
+
+var (
+	reviewStateMu sync.Mutex
+	reviewCache   reviewState
+)
+
+func removedByHistory(actions []Action) bool {
+	for _, a := range actions {
+		if a.Action == actionDeleted || a.Action == actionHardlinked || a.Action == actionTrashed {
+			return true
+		}
+	}
+	return false
+}
+
+func currentReviewState() reviewState {
+	groupsMu.RLock()
+	store, gen := groups, groupsGen
+	release := retainGroups(store)
+	groupsMu.RUnlock()
+	defer release()
+	historyMu.Lock()
+	actions := historyCount
+	historyMu.Unlock()
+	statuses := statusChanges()
+
+	reviewStateMu.Lock()
+	defer reviewStateMu.Unlock()
+	if reviewCache.resolved != nil && reviewCache.gen == gen && reviewCache.actions == actions && reviewCache.statuses == statuses {
+		return reviewCache
+	}
+	state := reviewState{gen: gen, actions: actions, statuses: statuses, resolved: make([]bool, store.Len()), status: make([]string, store.Len())}
+	marked := loadGroupStatuses()
+	for idx := range state.resolved {
+		group, err := store.Group(idx)
+		if err != nil {
+			continue
+		}
+		if s, ok := marked[groupKey(group)]; ok {
+			state.status[idx] = s.Status
+			state.resolved[idx] = s.Status == statusResolved
+		}
+		for _, img := range group {
+			if removedByHistory(pathHistory(img.Path)) {
+				state.resolved[idx] = true
+				state.reclaimed += img.Size
+			}
+		}
+	}
+	reviewCache = state
+	return state
+}
+
+func reviewProgress(idx *int) Progress {
+	state := currentReviewState()
+	p := Progress{TotalGroups: len(state.resolved), Idx: idx, ReclaimedBytes: state.reclaimed}
+	for _, resolved := range state.resolved {
+		if resolved {
+			p.Resolved++
+		}
+	}
+	p.Remaining = p.TotalGroups - p.Resolved
+	return p
+}
+
+// GET /api/progress[?idx=N] reports the progress /api/group includes with every group
+func progressHandler(w http.ResponseWriter, r *http.Request) {
+	var idx *int
+	if v := r.URL.Query().Get("idx"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil {
+			http.Error(w, "Invalid idx", 400)
+			return
+		}
+		idx = &n
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(reviewProgress(idx))
+}
+
+// How many members of a group are still on disk
+func survivors(group []Image) int {
+	n := 0
+	for _, img := range group {
+		if _, err := os.Stat(img.Path); err == nil && !fileGone(img.Path) {
+			n++
+		}
+	}
+	return n
+}
+
+// The first group after (or with reverse, before) idx that isn't resolved
+// or skipped and still has two files on disk, and how many were skipped to get there.
+// -1 if there is none.
+func nextUnresolved(after int, reverse bool) (int, int) {
+	state := currentReviewState()
+	store, release := acquireGroups()
+	defer release()
+	step := 1
+	if reverse {
+		step = -1
+	}
+	skipped := 0
+	for idx := after + step; idx >= 0 && idx < len(state.resolved) && idx < store.Len(); idx += step {
+		if state.resolved[idx] || state.status[idx] == statusSkipped {
+			skipped++
+			continue
+		}
+		group, err := store.Group(idx)
+		if err != nil || survivors(group) < 2 {
+			skipped++
+			continue
+		}
+		return idx, skipped
+	}
+	return -1, skipped
+}
+
+// GET /api/group/next?after=N[&reverse=1] finds the next group left to
+// review, so the UI doesn't have to fetch every group on the way
+func nextGroupHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		http.Error(w, "Method not allowed", 405)
+		return
+	}
+	after := -1
+	if v := r.URL.Query().Get("after"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil {
+			http.Error(w, "Invalid after", 400)
+			return
+		}
+		after = n
+	}
+	reverse := r.URL.Query().Get("reverse") == "1"
+	if reverse && after < 0 {
+		after = currentGroups().Len()
+	}
+	idx, skipped := nextUnresolved(after, reverse)
+	if idx < 0 {
+		http.Error(w, "No unresolved groups left", 404)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]int{"idx": idx, "skipped": skipped})
+}
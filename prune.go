@@ -0,0 +1,133 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"sync"
+)
+
+// Groups with whole groups left out, e.g. ones pruned after an external
+// cleanup. Unlike filteredGroups the indexes change: idx N is the Nth kept group.
+type prunedGroups struct {
+	groupStore
+	keep []int // Index in the underlying store of each kept group
+}
+
+func (p *prunedGroups) Len() int { return len(p.keep) }
+
+func (p *prunedGroups) Group(idx int) ([]Image, error) {
+	return p.groupStore.Group(p.keep[idx])
+}
+
+func (p *prunedGroups) Close() error {
+	if closer, ok := p.groupStore.(io.Closer); ok {
+		return closer.Close()
+	}
+	return nil
+}
+
+// What pruning dropped
+type PruneResult struct {
+	Checked int  `json:"checked"` // Groups looked at
+	Pruned  int  `json:"pruned"`  // Of those, groups with fewer than two files left
+	Groups  int  `json:"groups"`  // Groups loaded now
+	Idx     *int `json:"idx,omitempty"`
+}
+
+// Drop the groups that fewer than two of their files still exist for, e.g.
+// after files were deleted outside the UI. Review state is kept by group
+// key, so it follows the groups that stay to their new indexes. idx, if not
+// negative, is a group index to translate as for reloadGroups.
+func pruneGroups(idx int) PruneResult {
+	decideMu.Lock()
+	defer decideMu.Unlock()
+
+	groupsMu.RLock()
+	store, gen := groups, groupsGen
+	release := retainGroups(store)
+	groupsMu.RUnlock()
+	defer release()
+
+	// Stat every file, spread over workers as validation does
+	n := store.Len()
+	alive := make([]bool, n)
+	keys := make([]string, n)
+	jobs := make(chan int)
+	var wg sync.WaitGroup
+	for w := 0; w < validateWorkers; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range jobs {
+				group, err := store.Group(i)
+				if err != nil {
+					alive[i] = true // Unreadable rather than gone, leave it be
+					continue
+				}
+				keys[i] = groupKey(group)
+				alive[i] = survivors(group) >= 2
+			}
+		}()
+	}
+	for i := 0; i < n; i++ {
+		jobs <- i
+	}
+	close(jobs)
+	wg.Wait()
+
+	result := PruneResult{Checked: n}
+	var keep []int
+	for i, ok := range alive {
+		if ok {
+			keep = append(keep, i)
+		} else {
+			result.Pruned++
+		}
+	}
+	result.Groups = n
+	if result.Pruned > 0 {
+		groupsMu.Lock()
+		if groupsGen == gen { // Unless the groups were replaced meanwhile
+			groups = &prunedGroups{groupStore: store, keep: keep}
+			groupsGen++
+			result.Groups = len(keep)
+		} else {
+			result.Pruned = 0
+		}
+		groupsMu.Unlock()
+	}
+	if idx >= 0 {
+		now := -1
+		if idx < n && keys[idx] != "" {
+			now = groupIdxByKey(keys[idx])
+		}
+		result.Idx = &now
+	}
+	logFor("groups").Info("pruned stale groups", "checked", result.Checked, "pruned", result.Pruned, "groups", result.Groups)
+	return result
+}
+
+// POST /api/prune [{"idx": N}] drops the groups with fewer than two files
+// left on disk. With idx, the response says where that group is now.
+func pruneHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		http.Error(w, "Method not allowed", 405)
+		return
+	}
+	req := struct {
+		Idx *int `json:"idx"`
+	}{}
+	if r.ContentLength != 0 {
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, "Invalid JSON", 400)
+			return
+		}
+	}
+	idx := -1
+	if req.Idx != nil {
+		idx = *req.Idx
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(pruneGroups(idx))
+}
@@ -0,0 +1,135 @@
+package main
+
+import (
+	"fmt"
+	"image"
+	_ "image/gif"
+	_ "image/jpeg"
+	_ "image/png"
+	"math"
+	"os"
+	"path/filepath"
+)
+
+// Longest side images are sampled down to before measuring
+const qualitySampleSize = 1024
+
+// Perceptual quality signals for one image, cached by content hash
+type QualityMetrics struct {
+	Sharpness  float64 `json:"sharpness"`          // Variance of the Laplacian; higher is sharper
+	Noise      float64 `json:"noise"`              // Estimated noise sigma (Immerkær); lower is cleaner
+	Brightness float64 `json:"brightness"`         // Mean luma, 0-255
+	Contrast   float64 `json:"contrast"`           // Standard deviation of luma
+	Shadows    float64 `json:"shadows_clipped"`    // Fraction of pixels crushed to black
+	Highlights float64 `json:"highlights_clipped"` // Fraction of pixels blown to white
+}
+
+// Sample an image down to a grayscale luma grid
+func lumaGrid(img image.Image) ([]float64, int, int) {
+	b := img.Bounds()
+	step := 1
+	if longest := max(b.Dx(), b.Dy()); longest > qualitySampleSize {
+		step = (longest + qualitySampleSize - 1) / qualitySampleSize
+	}
+	w, h := b.Dx()/step, b.Dy()/step
+	luma := make([]float64, w*h)
+	ycc, isYCbCr := img.(*image.YCbCr)
+	for y := 0; y < h; y++ {
+		for x := 0; x < w; x++ {
+			px, py := b.Min.X+x*step, b.Min.Y+y*step
+			if isYCbCr {
+				// JPEGs already carry luma, no need to convert
+				luma[y*w+x] = float64(ycc.Y[ycc.YOffset(px, py)])
+				continue
+			}
+			r, g, bl, _ := img.At(px, py).RGBA()
+			luma[y*w+x] = (0.299*float64(r) + 0.587*float64(g) + 0.114*float64(bl)) / 257
+		}
+	}
+	return luma, w, h
+}
+
+func measureQuality(img image.Image) QualityMetrics {
+	luma, w, h := lumaGrid(img)
+	var m QualityMetrics
+	if w < 3 || h < 3 {
+		return m
+	}
+
+	// Histogram statistics
+	var sum, sumSq float64
+	var dark, bright int
+	for _, v := range luma {
+		sum += v
+		sumSq += v * v
+		if v <= 2 {
+			dark++
+		} else if v >= 253 {
+			bright++
+		}
+	}
+	n := float64(len(luma))
+	m.Brightness = sum / n
+	m.Contrast = math.Sqrt(math.Max(sumSq/n-m.Brightness*m.Brightness, 0))
+	m.Shadows = float64(dark) / n
+	m.Highlights = float64(bright) / n
+
+	// Laplacian variance for sharpness, and Immerkær's mask for noise
+	var lapSum, lapSumSq, noiseSum float64
+	for y := 1; y < h-1; y++ {
+		for x := 1; x < w-1; x++ {
+			at := func(dx, dy int) float64 { return luma[(y+dy)*w+x+dx] }
+			lap := at(-1, 0) + at(1, 0) + at(0, -1) + at(0, 1) - 4*at(0, 0)
+			lapSum += lap
+			lapSumSq += lap * lap
+			noise := at(-1, -1) - 2*at(0, -1) + at(1, -1) -
+				2*at(-1, 0) + 4*at(0, 0) - 2*at(1, 0) +
+				at(-1, 1) - 2*at(0, 1) + at(1, 1)
+			noiseSum += math.Abs(noise)
+		}
+	}
+	inner := float64((w - 2) * (h - 2))
+	lapMean := lapSum / inner
+	m.Sharpness = lapSumSq/inner - lapMean*lapMean
+	m.Noise = math.Sqrt(math.Pi/2) * noiseSum / (6 * inner)
+	return m
+}
+
+// Quality metrics for a file, computed once per distinct content and then
+// served from the state database
+func qualityFor(path string) (*QualityMetrics, error) {
+	if isVideoFile(path) {
+		return nil, nil
+	}
+	hash, err := contentHash(path)
+	if err != nil {
+		return nil, err
+	}
+	var m QualityMetrics
+	if dbGet(bucketQuality, hash, &m) {
+		return &m, nil
+	}
+
+	// RAW files are measured on their JPG preview
+	source := path
+	if isCR2File(path) {
+		if source, err = convertCR2ToJPG(path); err != nil {
+			return nil, err
+		}
+	}
+	f, err := os.Open(source)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	img, _, err := image.Decode(f)
+	if err != nil {
+		return nil, fmt.Errorf("cannot decode %s: %v", filepath.Base(path), err)
+	}
+
+	m = measureQuality(img)
+	if err := dbPut(bucketQuality, hash, m); err != nil {
+		logFor("state").Error("failed to cache quality metrics", "path", path, "err", err)
+	}
+	return &m, nil
+}
@@ -0,0 +1,120 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// Files moved out of the library to be decided on later: a middle ground
+// between keeping and deleting
+var quarantineDirFlag string // -quarantine-dir
+
+func quarantineDir() string {
+	if quarantineDirFlag != "" {
+		return quarantineDirFlag
+	}
+	return filepath.Join(stateDir, "quarantine")
+}
+
+// A group member that was moved to the quarantine
+type MovedFile struct {
+	Path    string    `json:"path"`
+	MovedTo string    `json:"moved_to"`
+	Time    time.Time `json:"time"`
+}
+
+// Move one file below the image root into the quarantine, keeping its path
+// below the root, and return where it went
+func quarantineFile(r *http.Request, path string) (string, error) {
+	path = absImagePath(path)
+	rel, err := filepath.Rel(imageRoot, path)
+	if err != nil || !withinImageRoot(path) {
+		reqLog(r, "delete").Warn("security violation: attempted to move file outside image root", "path", path, "client", clientIP(r))
+		return "", errors.New("File is outside allowed directory")
+	}
+	if err := checkWritable(path); err != nil {
+		return "", err
+	}
+	info, err := os.Stat(path)
+	if err != nil {
+		return "", errors.New("File does not exist")
+	}
+
+	dst := filepath.Join(quarantineDir(), rel)
+	if _, err := os.Stat(dst); err == nil {
+		dst += fmt.Sprintf(".%d", time.Now().UnixNano())
+	}
+	if err := os.MkdirAll(filepath.Dir(dst), 0755); err != nil {
+		return "", err
+	}
+	checksum := auditChecksum(path)
+	if err := moveFile(path, dst); err != nil {
+		reqLog(r, "delete").Error("failed to move file to quarantine", "path", path, "err", err)
+		return "", err
+	}
+	audit(r, actionQuarantined, path, checksum, info.Size(), -1, "moved to "+dst)
+	forgetConverted(path)
+	recordAction(path, actionQuarantined, -1, fmt.Sprintf("%d bytes, moved to %s", info.Size(), dst))
+	if err := dbPut(bucketQuarantine, path, MovedFile{Path: path, MovedTo: dst, Time: time.Now()}); err != nil {
+		reqLog(r, "state").Error("failed to record quarantine", "path", path, "err", err)
+	}
+	entry := pushUndo("move", "moved "+path+" to the quarantine", []FileChange{{Path: dst, MovedFrom: path}})
+	noteDeletion(path, info.Size(), actionQuarantined, "", &entry.ID)
+	pruneAfterRemoval(r, path)
+	reqLog(r, "delete").Info("moved file to quarantine", "path", path, "to", dst)
+	return dst, nil
+}
+
+// Members of a group that are in the quarantine now, by their original path
+func movedMembers(group []Image) []MovedFile {
+	moved := []MovedFile{}
+	for _, img := range group {
+		if _, err := os.Stat(img.Path); err == nil {
+			continue // Still (or again) in the library
+		}
+		var m MovedFile
+		if dbGet(bucketQuarantine, img.Path, &m) {
+			if _, err := os.Stat(m.MovedTo); err == nil {
+				m.Path = getRelativeImagePath(m.Path)
+				moved = append(moved, m)
+			}
+		}
+	}
+	return moved
+}
+
+// POST /api/move {"path": ...} moves a file to the quarantine directory. It
+// drops out of its group like a deleted file, and the undo stack can put it
+// back.
+func moveHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		http.Error(w, "Method not allowed", 405)
+		return
+	}
+	var req struct {
+		Path string `json:"path"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid JSON", 400)
+		return
+	}
+	if req.Path == "" {
+		http.Error(w, "Path is required", 400)
+		return
+	}
+
+	decideMu.Lock()
+	defer decideMu.Unlock()
+	w.Header().Set("Content-Type", "application/json")
+	dst, err := quarantineFile(r, req.Path)
+	if err != nil {
+		json.NewEncoder(w).Encode(V1FileResult{Error: err.Error()})
+		return
+	}
+	json.NewEncoder(w).Encode(V1FileResult{Success: true, MovedTo: dst})
+}
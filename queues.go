@@ -0,0 +1,172 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"regexp"
+	"strconv"
+	"sync"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+var (
+	queueNamePattern = regexp.MustCompile(`^[A-Za-z0-9_-]{1,64}$`)
+	queuesMu         sync.Mutex // Serialises read-modify-write of queues
+)
+
+type QueueEntry struct {
+	Key   string    `json:"key"` // groupKey, so entries survive reloads
+	Idx   int       `json:"idx"` // Current index, -1 if the group is gone
+	Added time.Time `json:"added"`
+}
+
+type Queue struct {
+	Name    string       `json:"name"`
+	Entries []QueueEntry `json:"entries"`
+}
+
+func loadQueue(name string) Queue {
+	q := Queue{Name: name, Entries: []QueueEntry{}}
+	dbGet(bucketQueues, name, &q)
+	for i := range q.Entries {
+		q.Entries[i].Idx = groupIdxByKey(q.Entries[i].Key)
+	}
+	return q
+}
+
+// GET /api/queues lists all queues with their sizes
+func queuesHandler(w http.ResponseWriter, r *http.Request) {
+	counts := make(map[string]int)
+	stateDB.View(func(tx *bolt.Tx) error {
+		return tx.Bucket([]byte(bucketQueues)).ForEach(func(k, v []byte) error {
+			var q Queue
+			if json.Unmarshal(v, &q) == nil {
+				counts[string(k)] = len(q.Entries)
+			}
+			return nil
+		})
+	})
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(counts)
+}
+
+// GET lists a queue, POST {"idx": N} pushes a group onto it, DELETE ?idx=N
+// removes one group (or the whole queue without idx)
+func queueHandler(w http.ResponseWriter, r *http.Request) {
+	name := r.PathValue("name")
+	if !queueNamePattern.MatchString(name) {
+		http.Error(w, "Queue names may only contain letters, digits, - and _", 400)
+		return
+	}
+
+	queuesMu.Lock()
+	defer queuesMu.Unlock()
+	switch r.Method {
+	case "GET":
+	case "POST":
+		var req struct {
+			Idx int `json:"idx"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, "Invalid JSON", 400)
+			return
+		}
+		store, release := acquireGroups()
+		defer release()
+		if req.Idx < 0 || req.Idx >= store.Len() {
+			http.Error(w, "Group not found", 404)
+			return
+		}
+		group, err := store.Group(req.Idx)
+		if err != nil {
+			http.Error(w, "Failed to read group", 500)
+			return
+		}
+		q := loadQueue(name)
+		key := groupKey(group)
+		queued := false
+		for _, e := range q.Entries {
+			queued = queued || e.Key == key
+		}
+		if !queued {
+			q.Entries = append(q.Entries, QueueEntry{Key: key, Idx: req.Idx, Added: time.Now()})
+			if err := dbPut(bucketQueues, name, q); err != nil {
+				http.Error(w, "Failed to save queue", 500)
+				return
+			}
+		}
+	case "DELETE":
+		if r.URL.Query().Get("idx") == "" {
+			stateDB.Update(func(tx *bolt.Tx) error {
+				return tx.Bucket([]byte(bucketQueues)).Delete([]byte(name))
+			})
+			w.WriteHeader(204)
+			return
+		}
+		idx, err := strconv.Atoi(r.URL.Query().Get("idx"))
+		if err != nil {
+			http.Error(w, "Invalid idx", 400)
+			return
+		}
+		q := loadQueue(name)
+		kept := []QueueEntry{}
+		for _, e := range q.Entries {
+			if e.Idx != idx {
+				kept = append(kept, e)
+			}
+		}
+		q.Entries = kept
+		if err := dbPut(bucketQueues, name, q); err != nil {
+			http.Error(w, "Failed to save queue", 500)
+			return
+		}
+	default:
+		http.Error(w, "Method not allowed", 405)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(loadQueue(name))
+}
+
+// GET /api/queues/{name}/next?after=N returns the queued group following
+// group N in queue order (or the first one without after), skipping groups
+// that are no longer loaded. Each queue is walked independently.
+func queueNextHandler(w http.ResponseWriter, r *http.Request) {
+	q := loadQueue(r.PathValue("name"))
+	after := -1
+	if v := r.URL.Query().Get("after"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil {
+			http.Error(w, "Invalid after", 400)
+			return
+		}
+		after = n
+	}
+
+	start := 0
+	if after >= 0 {
+		start = len(q.Entries)
+		for i, e := range q.Entries {
+			if e.Idx == after {
+				start = i + 1
+				break
+			}
+		}
+	}
+	for i := start; i < len(q.Entries); i++ {
+		if q.Entries[i].Idx >= 0 {
+			w.Header().Set("Content-Type", "application/json")
+			json.NewEncoder(w).Encode(map[string]interface{}{
+				"queue":     q.Name,
+				"position":  i,
+				"remaining": len(q.Entries) - i - 1,
+				"entry":     q.Entries[i],
+			})
+			return
+		}
+	}
+	http.Error(w, "End of queue", 404)
+}
@@ -0,0 +1,99 @@
+package main
+
+import (
+	"math"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Limits on requests that delete, move or change files, so a runaway script
+// or frontend loop can't hammer the filesystem: per client over time, and
+// how many may run at once across all clients
+var (
+	rateLimit     int // -rate-limit, requests per minute per client, 0 = no limit
+	maxConcurrent int // -max-concurrent, 0 = no limit
+)
+
+// A token bucket per client: it holds up to a minute's worth of requests and
+// refills at rateLimit per minute
+type rateBucket struct {
+	tokens float64
+	last   time.Time
+}
+
+var (
+	rateMu      sync.Mutex
+	rateBuckets = make(map[string]*rateBucket)
+	rateSwept   time.Time
+	running     int // Limited requests being handled now
+)
+
+// Take a request from the client's bucket, or say how long until one is there
+func takeRateToken(client string, now time.Time) (bool, time.Duration) {
+	rateMu.Lock()
+	defer rateMu.Unlock()
+	perSecond := float64(rateLimit) / 60
+	if now.Sub(rateSwept) > time.Minute {
+		for c, b := range rateBuckets {
+			if now.Sub(b.last) > 2*time.Minute {
+				delete(rateBuckets, c) // Full again by now anyway
+			}
+		}
+		rateSwept = now
+	}
+	b, ok := rateBuckets[client]
+	if !ok {
+		b = &rateBucket{tokens: float64(rateLimit), last: now}
+		rateBuckets[client] = b
+	}
+	b.tokens = math.Min(float64(rateLimit), b.tokens+now.Sub(b.last).Seconds()*perSecond)
+	b.last = now
+	if b.tokens >= 1 {
+		b.tokens--
+		return true, 0
+	}
+	return false, time.Duration((1 - b.tokens) / perSecond * float64(time.Second))
+}
+
+func tooManyRequests(w http.ResponseWriter, retry time.Duration, msg string) {
+	w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(retry.Seconds()))))
+	http.Error(w, msg, 429)
+}
+
+// Refuse writes over the client's rate limit or while maxConcurrent others
+// are running, with 429 and a Retry-After
+func rateLimited(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == "GET" || r.Method == "HEAD" {
+			next(w, r)
+			return
+		}
+		if rateLimit > 0 {
+			if ok, retry := takeRateToken(clientIP(r), time.Now()); !ok {
+				reqLog(r, "server").Warn("rate limit exceeded", "method", r.Method, "path", r.URL.Path, "client", clientIP(r))
+				tooManyRequests(w, retry, "Too many requests: the limit is "+strconv.Itoa(rateLimit)+" per minute (-rate-limit)")
+				return
+			}
+		}
+		if maxConcurrent > 0 {
+			rateMu.Lock()
+			full := running >= maxConcurrent
+			if !full {
+				running++
+			}
+			rateMu.Unlock()
+			if full {
+				tooManyRequests(w, time.Second, "Too many requests: "+strconv.Itoa(maxConcurrent)+" are already running (-max-concurrent)")
+				return
+			}
+			defer func() {
+				rateMu.Lock()
+				running--
+				rateMu.Unlock()
+			}()
+		}
+		next(w, r)
+	}
+}
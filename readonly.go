@@ -0,0 +1,60 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"path/filepath"
+	"strings"
+)
+
+// Directories whose files may be viewed and scored but never changed
+var (
+	readOnlyFlag  string // -readonly, as given
+	readOnlyRoots []string
+)
+
+func parseReadOnlyRoots(list string) {
+	for _, dir := range strings.Split(list, ",") {
+		if dir = strings.TrimSpace(dir); dir != "" {
+			readOnlyRoots = append(readOnlyRoots, absImagePath(dir))
+		}
+	}
+}
+
+func readOnly(path string) bool {
+	path = filepath.Clean(path)
+	for _, root := range readOnlyRoots {
+		if path == root || strings.HasPrefix(path, root+string(filepath.Separator)) {
+			return true
+		}
+	}
+	return false
+}
+
+// Error for the first of paths that is read-only, if any
+func checkWritable(paths ...string) error {
+	for _, path := range paths {
+		if readOnly(path) {
+			return fmt.Errorf("%s is on a read-only root", path)
+		}
+	}
+	return nil
+}
+
+// With -read-only nothing can be deleted, moved or changed at all: groups can
+// be browsed, scored, staged and exported as a plan for someone else to review
+var readOnlyMode bool
+
+// Guard an endpoint that changes files (or restores state over the current
+// one): refuse everything but reads while in read-only mode, and writes
+// without the CSRF token or over the rate limits at any time
+func destructive(next http.HandlerFunc) http.HandlerFunc {
+	guarded := requireCSRF(rateLimited(next))
+	return func(w http.ResponseWriter, r *http.Request) {
+		if readOnlyMode && r.Method != "GET" && r.Method != "HEAD" {
+			http.Error(w, "The server is in read-only review mode (-read-only)", 403)
+			return
+		}
+		guarded(w, r)
+	}
+}
@@ -0,0 +1,168 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"image"
+	"image/jpeg"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const (
+	recentLimit   = 100 // Deletions remembered per session
+	thumbnailSize = 256 // Longest side of cached thumbnails
+)
+
+// One file removed during this session
+type RecentDeletion struct {
+	ID        int64     `json:"id"`
+	Time      time.Time `json:"time"`
+	Path      string    `json:"path"`
+	Size      int64     `json:"size"`
+	Action    string    `json:"action"`              // deleted, trashed or quarantined
+	Thumbnail string    `json:"thumbnail,omitempty"` // URL of a thumbnail taken before removal
+	UndoID    *int64    `json:"undo_id,omitempty"`   // Undo stack entry that brings it back, if any
+	thumbPath string
+}
+
+var (
+	recentMu        sync.Mutex
+	recentDeletions []RecentDeletion // Oldest first
+	recentNext      int64
+)
+
+// Keep a small JPG of an image that is about to be removed, so the UI can
+// still show what it was. current is where the file is right now (it may
+// have been staged or trashed already). CR2 files use their converted
+// preview if there is one; videos and undecodable files get no thumbnail.
+func cacheThumbnail(path, current string) string {
+	source := current
+	if isCR2File(path) {
+		jpgPath, ok := cr2Cache[path]
+		if !ok {
+			return ""
+		}
+		source = jpgPath
+	}
+	if isVideoFile(path) {
+		return ""
+	}
+	f, err := os.Open(source)
+	if err != nil {
+		return ""
+	}
+	defer f.Close()
+	img, _, err := image.Decode(f)
+	if err != nil {
+		return ""
+	}
+
+	// Nearest-neighbour downscale is plenty for a thumbnail
+	b := img.Bounds()
+	scale := float64(thumbnailSize) / float64(max(b.Dx(), b.Dy()))
+	if scale > 1 {
+		scale = 1
+	}
+	w, h := max(int(float64(b.Dx())*scale), 1), max(int(float64(b.Dy())*scale), 1)
+	thumb := image.NewRGBA(image.Rect(0, 0, w, h))
+	for y := 0; y < h; y++ {
+		for x := 0; x < w; x++ {
+			thumb.Set(x, y, img.At(b.Min.X+int(float64(x)/scale), b.Min.Y+int(float64(y)/scale)))
+		}
+	}
+
+	out, err := os.CreateTemp(tempDir, "thumb-*.jpg")
+	if err != nil {
+		return ""
+	}
+	defer out.Close()
+	if err := jpeg.Encode(out, thumb, &jpeg.Options{Quality: 80}); err != nil {
+		os.Remove(out.Name())
+		return ""
+	}
+	return out.Name()
+}
+
+// Remember a removed file for the recently deleted list
+func noteDeletion(path string, size int64, action, thumb string, undoID *int64) {
+	publish(eventDeleted, DeletedEvent{Path: getRelativeImagePath(path), Size: size, Action: action})
+	scheduleWriteBack()
+	recentMu.Lock()
+	defer recentMu.Unlock()
+	d := RecentDeletion{ID: recentNext, Time: time.Now(), Path: path, Size: size, Action: action, UndoID: undoID, thumbPath: thumb}
+	if thumb != "" {
+		d.Thumbnail = fmt.Sprintf("%s/recently-deleted/%d/thumbnail", apiV1, d.ID)
+	}
+	recentNext++
+	recentDeletions = append(recentDeletions, d)
+	for len(recentDeletions) > recentLimit {
+		if recentDeletions[0].thumbPath != "" {
+			os.Remove(recentDeletions[0].thumbPath)
+		}
+		recentDeletions = recentDeletions[1:]
+	}
+}
+
+// GET /api/recently-deleted?limit=N lists this session's deletions, newest first
+func recentlyDeletedHandler(w http.ResponseWriter, r *http.Request) {
+	limit := 20
+	if v := r.URL.Query().Get("limit"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 {
+			http.Error(w, "Invalid limit", 400)
+			return
+		}
+		limit = n
+	}
+
+	recentMu.Lock()
+	entries := []RecentDeletion{}
+	for i := len(recentDeletions) - 1; i >= 0 && len(entries) < limit; i-- {
+		entries = append(entries, recentDeletions[i])
+	}
+	recentMu.Unlock()
+
+	// Entries that have since been undone no longer offer an undo
+	undoMu.Lock()
+	onStack := make(map[int64]bool)
+	for _, entry := range undoStack {
+		onStack[entry.ID] = true
+	}
+	undoMu.Unlock()
+	for i := range entries {
+		if entries[i].UndoID != nil && !onStack[*entries[i].UndoID] {
+			entries[i].UndoID = nil
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(entries)
+}
+
+// GET /api/recently-deleted/{id}/thumbnail serves the thumbnail kept for a deletion
+func recentThumbnailHandler(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.ParseInt(r.PathValue("id"), 10, 64)
+	if err != nil {
+		http.Error(w, "Invalid id", 400)
+		return
+	}
+	recentMu.Lock()
+	thumb := ""
+	for _, d := range recentDeletions {
+		if d.ID == id {
+			thumb = d.thumbPath
+		}
+	}
+	recentMu.Unlock()
+	if thumb == "" {
+		http.Error(w, "No thumbnail", 404)
+		return
+	}
+	w.Header().Set("Content-Type", "image/jpeg")
+	http.ServeFile(w, r, filepath.Clean(thumb))
+}
@@ -0,0 +1,232 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// A directory whose every file has a duplicate in another directory
+type RedundantDir struct {
+	Dir         string `json:"dir"`
+	DuplicateOf string `json:"duplicate_of"`
+	Files       int    `json:"files"`
+	Bytes       int64  `json:"bytes"`
+}
+
+// Files that don't count as unique content when judging a directory
+func ignorableFile(name string) bool {
+	switch strings.ToLower(name) {
+	case "thumbs.db", "desktop.ini":
+		return true
+	}
+	return strings.HasPrefix(name, ".")
+}
+
+// For every file that appears in a group, its duplicates grouped by the
+// directory they live in
+func duplicateDirs() map[string]map[string][]string {
+	dupes := make(map[string]map[string][]string)
+	store, release := acquireGroups()
+	defer release()
+	for idx := 0; idx < store.Len(); idx++ {
+		group, err := store.Group(idx)
+		if err != nil {
+			continue
+		}
+		for _, img := range group {
+			path := filepath.Clean(img.Path)
+			for _, other := range group {
+				copyPath := filepath.Clean(other.Path)
+				dir := filepath.Dir(copyPath)
+				if dir == filepath.Dir(path) {
+					continue
+				}
+				if dupes[path] == nil {
+					dupes[path] = make(map[string][]string)
+				}
+				dupes[path][dir] = append(dupes[path][dir], copyPath)
+			}
+		}
+	}
+	return dupes
+}
+
+// Check whether dir is fully duplicated in one other directory. Only files
+// currently on disk count, on both sides, so a directory whose copies were
+// already removed is no longer reported.
+func checkRedundant(dir string, dupes map[string]map[string][]string) (RedundantDir, bool) {
+	finding := RedundantDir{Dir: dir}
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return finding, false
+	}
+	var candidates map[string]bool
+	for _, e := range entries {
+		if ignorableFile(e.Name()) {
+			continue
+		}
+		if e.IsDir() {
+			return finding, false // Subdirectories may hold unique files
+		}
+		path := filepath.Join(dir, e.Name())
+		info, err := e.Info()
+		if err != nil {
+			return finding, false
+		}
+		found := make(map[string]bool)
+		for other, copies := range dupes[path] {
+			if candidates != nil && !candidates[other] {
+				continue
+			}
+			for _, copyPath := range copies {
+				if _, err := os.Stat(copyPath); err == nil {
+					found[other] = true
+					break
+				}
+			}
+		}
+		if len(found) == 0 {
+			return finding, false
+		}
+		candidates = found
+		finding.Files++
+		finding.Bytes += info.Size()
+	}
+	if finding.Files == 0 {
+		return finding, false
+	}
+
+	var dirs []string
+	for other := range candidates {
+		dirs = append(dirs, other)
+	}
+	sort.Strings(dirs)
+	finding.DuplicateOf = dirs[0]
+	return finding, true
+}
+
+func findRedundantDirs() []RedundantDir {
+	dupes := duplicateDirs()
+	seen := make(map[string]bool)
+	var dirs []string
+	for path := range dupes {
+		if dir := filepath.Dir(path); !seen[dir] {
+			seen[dir] = true
+			dirs = append(dirs, dir)
+		}
+	}
+	sort.Strings(dirs)
+
+	findings := []RedundantDir{}
+	for _, dir := range dirs {
+		if readOnly(dir) {
+			continue // Can't be trashed anyway
+		}
+		if finding, ok := checkRedundant(dir, dupes); ok {
+			findings = append(findings, finding)
+		}
+	}
+	return findings
+}
+
+// GET lists directories whose every file has a duplicate in one other
+// directory; POST {"dir": D} moves such a directory's files to the trash in
+// one undoable step and removes the directories left empty
+func redundantDirsHandler(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case "GET":
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(findRedundantDirs())
+	case "POST":
+		var req struct {
+			Dir string `json:"dir"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.Dir == "" {
+			http.Error(w, "Invalid JSON", 400)
+			return
+		}
+		dir := absImagePath(req.Dir)
+		if !withinImageRoot(dir) || dir == filepath.Clean(imageRoot) {
+			http.Error(w, "Directory is outside allowed directory", 403)
+			return
+		}
+		if err := checkWritable(dir); err != nil {
+			http.Error(w, err.Error(), 403)
+			return
+		}
+
+		decideMu.Lock()
+		defer decideMu.Unlock()
+		finding, ok := checkRedundant(dir, duplicateDirs())
+		if !ok {
+			http.Error(w, dir+" is not redundant (it has files without a copy elsewhere)", 409)
+			return
+		}
+
+		if err := checkBudget(r, finding.Files, finding.Bytes); err != nil {
+			http.Error(w, err.Error(), 429)
+			return
+		}
+		if finding.Files >= largeBatch {
+			backupBefore("trash-dir")
+		}
+		// Only the files checked for a copy are trashed: hidden files and
+		// the like are left, so the directory itself stays if it has any
+		var changes []FileChange
+		kept := []string{}
+		files := 0
+		entries, _ := os.ReadDir(dir)
+		for _, e := range entries {
+			if e.IsDir() {
+				continue
+			}
+			if ignorableFile(e.Name()) {
+				kept = append(kept, e.Name())
+				continue
+			}
+			files++
+			change, err := moveToTrash(r, filepath.Join(dir, e.Name()), -1)
+			if err != nil {
+				reqLog(r, "delete").Error("failed to trash file", "path", filepath.Join(dir, e.Name()), "err", err)
+				break
+			}
+			changes = append(changes, change)
+		}
+		if len(changes) < files {
+			// Put back what was already moved rather than leaving a half-trashed
+			// directory, and what can't be put back now stays undoable
+			partial := UndoEntry{Changes: changes}
+			if err := revertUndoEntry(&partial); err != nil {
+				reqLog(r, "delete").Error("failed to restore directory", "dir", dir, "err", err, "left", len(partial.Changes))
+				pushUndo("trash-dir", "partly trashed "+dir, partial.Changes)
+			}
+			http.Error(w, "Failed to trash "+dir, 500)
+			return
+		}
+		removed := removeEmptyDirs(r, dir)
+		entry := pushUndo("trash-dir", fmt.Sprintf("trashed %s (duplicate of %s)", dir, finding.DuplicateOf), changes)
+		for _, change := range changes {
+			if info, err := os.Stat(change.Path); err == nil {
+				noteDeletion(change.MovedFrom, info.Size(), actionTrashed, cacheThumbnail(change.MovedFrom, change.Path), &entry.ID)
+			}
+		}
+		reqLog(r, "delete").Info("trashed redundant directory", "dir", dir, "files", len(changes), "duplicate_of", finding.DuplicateOf)
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"success":       true,
+			"trashed":       finding,
+			"removed_dirs":  removed,
+			"undo_id":       entry.ID,
+			"trashed_files": len(changes),
+			"kept_files":    kept,
+		})
+	default:
+		http.Error(w, "Method not allowed", 405)
+	}
+}
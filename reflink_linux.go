@@ -0,0 +1,75 @@
+//go:build linux
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"syscall"
+
+	"golang.org/x/sys/unix"
+)
+
+// Make dst share src's extents with the FIDEDUPERANGE ioctl. The kernel
+// compares the contents itself and refuses ranges that differ. Returns the
+// number of bytes deduped.
+func dedupeRange(src, dst string) (int64, error) {
+	s, err := os.Open(src)
+	if err != nil {
+		return 0, err
+	}
+	defer s.Close()
+	info, err := s.Stat()
+	if err != nil {
+		return 0, err
+	}
+	// The destination must be open for writing unless we own it
+	d, err := os.OpenFile(dst, os.O_WRONLY, 0)
+	if errors.Is(err, os.ErrPermission) {
+		d, err = os.Open(dst)
+	}
+	if err != nil {
+		return 0, err
+	}
+	defer d.Close()
+
+	size := uint64(info.Size())
+	var done uint64
+	for done < size {
+		// Filesystems cap how much one call dedupes, so go round until it is all done
+		req := unix.FileDedupeRange{
+			Src_offset: done,
+			Src_length: size - done,
+			Info:       []unix.FileDedupeRangeInfo{{Dest_fd: int64(d.Fd()), Dest_offset: done}},
+		}
+		if err := unix.IoctlFileDedupeRange(int(s.Fd()), &req); err != nil {
+			return int64(done), err
+		}
+		switch status := req.Info[0].Status; {
+		case status == unix.FILE_DEDUPE_RANGE_DIFFERS:
+			return int64(done), errContentDiffers
+		case status < 0:
+			return int64(done), syscall.Errno(-status)
+		}
+		if req.Info[0].Bytes_deduped == 0 {
+			return int64(done), fmt.Errorf("no progress deduping at offset %d", done)
+		}
+		done += req.Info[0].Bytes_deduped
+	}
+	return int64(done), nil
+}
+
+// Whether path is on a filesystem that can share extents, going by its type
+// alone: XFS only can when made with reflink support
+func dedupeFilesystem(path string) error {
+	var st unix.Statfs_t
+	if err := unix.Statfs(path, &st); err != nil {
+		return err
+	}
+	switch st.Type {
+	case unix.BTRFS_SUPER_MAGIC, unix.XFS_SUPER_MAGIC:
+		return nil
+	}
+	return fmt.Errorf("not btrfs or XFS (filesystem type %#x)", st.Type)
+}
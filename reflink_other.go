@@ -0,0 +1,13 @@
+//go:build !linux
+
+package main
+
+import "errors"
+
+func dedupeRange(src, dst string) (int64, error) {
+	return 0, errors.New("block-level dedupe needs Linux")
+}
+
+func dedupeFilesystem(path string) error {
+	return errors.New("block-level dedupe needs Linux")
+}
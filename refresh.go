@@ -0,0 +1,119 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"os"
+	"strconv"
+	"sync"
+)
+
+// A file's size, modification date and dimensions as read from disk, in
+// place of the ones in the duplicates file, which go stale when files are
+// edited during a review
+type RefreshedFile struct {
+	Path         string `json:"path"` // Relative to the image root
+	Size         int64  `json:"size"`
+	ModifiedDate int64  `json:"modified_date"`
+	Width        int    `json:"width"`
+	Height       int    `json:"height"`
+	Changed      bool   `json:"changed"` // Differs from what was shown before
+}
+
+var (
+	refreshedMu sync.Mutex
+	refreshed   = make(map[string]RefreshedFile) // By full path, until the groups are replaced
+)
+
+// Overlay what was last read from disk for a file, if it was refreshed
+func applyRefreshed(img *Image) {
+	refreshedMu.Lock()
+	fresh, ok := refreshed[img.Path]
+	refreshedMu.Unlock()
+	if ok {
+		img.Size, img.ModifiedDate = fresh.Size, fresh.ModifiedDate
+		img.Width, img.Height = fresh.Width, fresh.Height
+	}
+}
+
+func forgetRefreshed() {
+	refreshedMu.Lock()
+	refreshed = make(map[string]RefreshedFile)
+	refreshedMu.Unlock()
+}
+
+// Read a file's metadata from disk again and drop what was derived from
+// its old content (the converted CR2, the video metadata)
+func refreshFile(img Image) (RefreshedFile, error) {
+	info, err := os.Stat(img.Path)
+	if err != nil {
+		return RefreshedFile{}, err
+	}
+	before := img
+	applyRefreshed(&before)
+	fresh := RefreshedFile{
+		Path:         getRelativeImagePath(img.Path),
+		Size:         info.Size(),
+		ModifiedDate: info.ModTime().Unix(),
+		Width:        before.Width,
+		Height:       before.Height,
+	}
+	forgetConverted(img.Path)
+	delete(videoMetaCache, img.Path)
+	if isVideoFile(img.Path) {
+		if _, _, _, _, width, height := getVideoMetadata(img.Path); width > 0 && height > 0 {
+			fresh.Width, fresh.Height = width, height
+		}
+	} else if width, height, err := imageDimensions(img.Path); err == nil {
+		fresh.Width, fresh.Height = width, height
+	}
+	fresh.Changed = fresh.Size != before.Size || fresh.ModifiedDate != before.ModifiedDate ||
+		fresh.Width != before.Width || fresh.Height != before.Height
+
+	refreshedMu.Lock()
+	refreshed[img.Path] = fresh
+	refreshedMu.Unlock()
+	return fresh, nil
+}
+
+// POST /api/refresh?idx=N reads the size, modification date and dimensions
+// of group N's files from disk again; /api/group shows and scores those from
+// then on, until the duplicates file is reloaded. Files gone from disk are
+// left out.
+func refreshHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		http.Error(w, "Method not allowed", 405)
+		return
+	}
+	idx, err := strconv.Atoi(r.URL.Query().Get("idx"))
+	store, release := acquireGroups()
+	defer release()
+	if err != nil || idx < 0 || idx >= store.Len() {
+		http.Error(w, "Group not found", 404)
+		return
+	}
+	group, err := store.Group(idx)
+	if err != nil {
+		http.Error(w, "Failed to read group", 500)
+		return
+	}
+	files := []RefreshedFile{}
+	changed := 0
+	for _, img := range group {
+		fresh, err := refreshFile(img)
+		if err != nil {
+			continue
+		}
+		if fresh.Changed {
+			changed++
+		}
+		files = append(files, fresh)
+	}
+	reqLog(r, "groups").Info("refreshed group metadata", "group", idx, "files", len(files), "changed", changed)
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"idx":     idx,
+		"changed": changed,
+		"files":   files,
+	})
+}
@@ -0,0 +1,129 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"os"
+	"os/signal"
+	"syscall"
+)
+
+var errScanRunning = errors.New("a scan is running and will load its own results")
+
+// What reloading the duplicates file changed
+type ReloadResult struct {
+	File      string `json:"file"`
+	Previous  int    `json:"previous"`  // Groups loaded before
+	Groups    int    `json:"groups"`    // Groups loaded now
+	Unchanged int    `json:"unchanged"` // Of those, groups with the same members as before
+	Idx       *int   `json:"idx,omitempty"`
+}
+
+// Keys of every group in a store, by index
+func storeKeys(store groupStore) []string {
+	keys := make([]string, store.Len())
+	for idx := range keys {
+		if group, err := store.Group(idx); err == nil {
+			keys[idx] = groupKey(group)
+		}
+	}
+	return keys
+}
+
+// Read the duplicates file again, e.g. after czkawka was re-run outside the
+// UI. Review state (staged decisions, queues, sessions, ...) is kept by group
+// key, so it carries over to every group whose members haven't changed. idx,
+// if not negative, is a group index from before to translate to its index
+// now (-1 if it is gone). Call with workspaceMu held.
+func reloadGroups(idx int) (ReloadResult, error) {
+	if scanRunning() {
+		return ReloadResult{}, errScanRunning
+	}
+	decideMu.Lock()
+	defer decideMu.Unlock()
+
+	old, release := acquireGroups()
+	defer release()
+	oldKeys := storeKeys(old)
+	key := ""
+	if idx >= 0 && idx < len(oldKeys) {
+		key = oldKeys[idx]
+	}
+	loaded, err := openGroups(duplicatesFile)
+	if err != nil {
+		return ReloadResult{}, err
+	}
+	backupBefore("reload")
+	setGroups(loaded)
+
+	result := ReloadResult{File: duplicatesFile, Previous: len(oldKeys), Groups: loaded.Len()}
+	before := make(map[string]bool, len(oldKeys))
+	for _, k := range oldKeys {
+		before[k] = true
+	}
+	for _, k := range storeKeys(loaded) {
+		if before[k] {
+			result.Unchanged++
+		}
+	}
+	if idx >= 0 {
+		now := -1
+		if key != "" {
+			now = groupIdxByKey(key)
+		}
+		result.Idx = &now
+	}
+	logFor("groups").Info("reloaded duplicates file", "file", duplicatesFile, "groups", result.Groups, "previous", result.Previous, "unchanged", result.Unchanged)
+	if validateMode == "sample" || validateMode == "all" {
+		go validateGroups(validateMode)
+	}
+	return result, nil
+}
+
+// Reload the duplicates file on SIGHUP
+func reloadOnSignal() {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGHUP)
+	for range signals {
+		workspaceMu.RLock()
+		if _, err := reloadGroups(-1); err != nil {
+			logFor("groups").Error("reload on SIGHUP failed", "err", err)
+		}
+		workspaceMu.RUnlock()
+	}
+}
+
+// POST /api/reload [{"idx": N}] reads the duplicates file again without a
+// restart. With idx, the response says where that group is now.
+func reloadHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		http.Error(w, "Method not allowed", 405)
+		return
+	}
+	req := struct {
+		Idx *int `json:"idx"`
+	}{}
+	if r.ContentLength != 0 {
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, "Invalid JSON", 400)
+			return
+		}
+	}
+	idx := -1
+	if req.Idx != nil {
+		idx = *req.Idx
+	}
+	result, err := reloadGroups(idx)
+	if err != nil {
+		if errors.Is(err, errScanRunning) {
+			http.Error(w, "Reload failed: "+err.Error(), 409)
+			return
+		}
+		reqLog(r, "groups").Error("reload failed", "err", err)
+		http.Error(w, "Reload failed: "+err.Error(), 500)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(result)
+}
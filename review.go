@@ -0,0 +1,310 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Orders the review queue can be walked in
+var orderPresets = map[string]string{
+	"file":       "as listed in the duplicates file",
+	"savings":    "most space freed first",
+	"size":       "largest groups first",
+	"oldest":     "oldest capture date first",
+	"newest":     "most recently modified file first",
+	"path":       "by path of the first file",
+	"similarity": "tightest matches first",
+}
+
+// A named review session: the order it walks the groups in and where it got to
+type ReviewSession struct {
+	Name    string    `json:"name"`
+	Order   string    `json:"order"`
+	Current string    `json:"current,omitempty"` // groupKey of the last group handed out
+	Idx     int       `json:"idx"`               // Its current index, -1 if none
+	Updated time.Time `json:"updated"`
+
+	Run  *SessionRun  `json:"run,omitempty"`  // The time box in progress, if any
+	Runs []SessionRun `json:"runs,omitempty"` // Finished ones, newest last
+}
+
+// Serialises read-modify-write of sessions
+var sessionsMu sync.Mutex
+
+func loadSession(name string) ReviewSession {
+	s := ReviewSession{Name: name, Order: "file"}
+	dbGet(bucketSessions, name, &s)
+	s.Idx = -1
+	if s.Current != "" {
+		s.Idx = groupIdxByKey(s.Current)
+	}
+	if s.Run != nil {
+		end := time.Now()
+		if s.Run.expired(end) {
+			end = *s.Run.Deadline
+		}
+		s.Run.Seconds = end.Sub(s.Run.Started).Seconds()
+	}
+	return s
+}
+
+// Orderings are computed once per set of loaded groups
+type cachedOrder struct {
+	gen  int
+	idxs []int
+}
+
+var (
+	ordersMu sync.Mutex
+	orders   = make(map[string]cachedOrder)
+)
+
+// Earliest capture date in a group, falling back to the modification date
+// for files without one
+func groupCaptureTime(group []Image) int64 {
+	var oldest int64
+	for _, img := range group {
+		t := img.ModifiedDate
+		if !isVideoFile(img.Path) {
+			exif := getExif(img.Path)
+			recordCamera(img.Path, exif)
+			if taken, err := time.Parse(exifDateLayout, exif.DateTaken); err == nil {
+				t = taken.Unix()
+			}
+		}
+		if oldest == 0 || t < oldest {
+			oldest = t
+		}
+	}
+	return oldest
+}
+
+// Largest distance between members as reported by czkawka; 0 is identical
+func groupSpread(group []Image) int {
+	spread := 0
+	for _, img := range group {
+		spread = max(spread, img.Similarity)
+	}
+	return spread
+}
+
+// Indexes of the groups in store, generation gen, in the order of a preset.
+// Ties keep file order. Callers hold on to the store they pass, so the
+// indexes are always for the groups they go on to read.
+func reviewOrder(store groupStore, gen int, preset string) []int {
+	ordersMu.Lock()
+	defer ordersMu.Unlock()
+	if cached, ok := orders[preset]; ok && cached.gen == gen {
+		return cached.idxs
+	}
+
+	n := store.Len()
+	idxs := make([]int, n)
+	keys := make([]int64, n) // Sort key per group, ascending
+	paths := make([]string, n)
+	for i := range idxs {
+		idxs[i] = i
+	}
+	if preset == "oldest" {
+		// Reads the EXIF of every file, so spread it over workers as validation does
+		jobs := make(chan int)
+		var wg sync.WaitGroup
+		for w := 0; w < validateWorkers; w++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				for idx := range jobs {
+					if group, err := store.Group(idx); err == nil {
+						keys[idx] = groupCaptureTime(group)
+					}
+				}
+			}()
+		}
+		for idx := 0; idx < n; idx++ {
+			jobs <- idx
+		}
+		close(jobs)
+		wg.Wait()
+	} else if preset != "file" {
+		for idx := 0; idx < n; idx++ {
+			group, err := store.Group(idx)
+			if err != nil || len(group) == 0 {
+				continue
+			}
+			switch preset {
+			case "savings":
+				keys[idx] = -groupSavings(group)
+			case "size":
+				keys[idx] = -int64(len(group))
+			case "newest":
+				for _, img := range group {
+					keys[idx] = min(keys[idx], -img.ModifiedDate)
+				}
+			case "similarity":
+				keys[idx] = int64(groupSpread(group))
+			case "path":
+				paths[idx] = group[0].Path
+				for _, img := range group[1:] {
+					paths[idx] = min(paths[idx], img.Path)
+				}
+			}
+		}
+	}
+	sort.SliceStable(idxs, func(i, j int) bool {
+		a, b := idxs[i], idxs[j]
+		if preset == "path" {
+			return paths[a] < paths[b]
+		}
+		return keys[a] < keys[b]
+	})
+	orders[preset] = cachedOrder{gen: gen, idxs: idxs}
+	return idxs
+}
+
+// GET shows a session, PUT {"order": "savings"} selects its order (and starts
+// it from the top), DELETE forgets it
+func sessionHandler(w http.ResponseWriter, r *http.Request) {
+	name := r.PathValue("name")
+	if !queueNamePattern.MatchString(name) {
+		http.Error(w, "Session names may only contain letters, digits, - and _", 400)
+		return
+	}
+
+	switch r.Method {
+	case "GET":
+	case "PUT":
+		var req struct {
+			Order string `json:"order"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, "Invalid JSON", 400)
+			return
+		}
+		if _, ok := orderPresets[req.Order]; !ok {
+			http.Error(w, "Unknown order "+req.Order, 400)
+			return
+		}
+		sessionsMu.Lock()
+		s := loadSession(name)
+		s.Order, s.Current, s.Updated = req.Order, "", time.Now()
+		err := dbPut(bucketSessions, name, s)
+		sessionsMu.Unlock()
+		if err != nil {
+			http.Error(w, "Failed to save session", 500)
+			return
+		}
+	case "DELETE":
+		sessionsMu.Lock()
+		err := dbDelete(bucketSessions, name)
+		sessionsMu.Unlock()
+		if err != nil {
+			http.Error(w, "Failed to delete session", 500)
+			return
+		}
+		w.WriteHeader(204)
+		return
+	default:
+		http.Error(w, "Method not allowed", 405)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"session": loadSession(name),
+		"presets": orderPresets,
+	})
+}
+
+// GET /api/sessions/{name}/next?after=N returns the unreviewed group following
+// group N in the session's order, or following where the session left off
+// without after. With reverse=1 it walks backwards. The group handed out is
+// remembered as the session's position. Once a time box runs out, the next
+// call returns 410 with its summary instead.
+func sessionNextHandler(w http.ResponseWriter, r *http.Request) {
+	name := r.PathValue("name")
+	if !queueNamePattern.MatchString(name) {
+		http.Error(w, "Session names may only contain letters, digits, - and _", 400)
+		return
+	}
+	sessionsMu.Lock()
+	s := loadSession(name)
+	summary := expireRun(&s)
+	if summary != nil {
+		dbPut(bucketSessions, name, s)
+	}
+	sessionsMu.Unlock()
+	if summary != nil {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(410)
+		json.NewEncoder(w).Encode(map[string]interface{}{"time_up": true, "summary": summary})
+		return
+	}
+
+	after := s.Idx
+	if v := r.URL.Query().Get("after"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil {
+			http.Error(w, "Invalid after", 400)
+			return
+		}
+		after = n
+	}
+	reverse := r.URL.Query().Get("reverse") == "1"
+
+	groupsMu.RLock()
+	store, gen := groups, groupsGen
+	release := retainGroups(store)
+	groupsMu.RUnlock()
+	defer release()
+	order := reviewOrder(store, gen, s.Order)
+	start := 0
+	if reverse {
+		start = len(order) - 1
+	}
+	if after >= 0 {
+		for i, idx := range order {
+			if idx == after {
+				start = i + 1
+				if reverse {
+					start = i - 1
+				}
+				break
+			}
+		}
+	}
+	step := 1
+	if reverse {
+		step = -1
+	}
+
+	for i := start; i >= 0 && i < len(order); i += step {
+		group, err := store.Group(order[i])
+		if err != nil || len(group) < 2 || groupReviewed(group) {
+			continue
+		}
+		sessionsMu.Lock()
+		s = loadSession(name)
+		s.Current = groupKey(group)
+		s.Idx = order[i]
+		s.Updated = time.Now()
+		if s.Run != nil {
+			s.Run.GroupsSeen++
+		}
+		dbPut(bucketSessions, name, s)
+		sessionsMu.Unlock()
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"session":  s.Name,
+			"order":    s.Order,
+			"idx":      order[i],
+			"position": i,
+			"total":    len(order),
+		})
+		return
+	}
+	http.Error(w, "End of session", 404)
+}
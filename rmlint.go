@@ -0,0 +1,88 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+)
+
+// Whether a (decompressed) duplicates file is rmlint's JSON output
+// (-o json), which starts with a header object describing itself
+func isRmlintResults(r *bufio.Reader) bool {
+	head, _ := r.Peek(textResultsSniff)
+	head = bytes.TrimLeft(head, "\ufeff \t\r\n")
+	if !bytes.HasPrefix(head, []byte("[")) {
+		return false
+	}
+	return bytes.HasPrefix(bytes.TrimLeft(head[1:], " \t\r\n"), []byte("{")) &&
+		bytes.Contains(head, []byte("rmlint json-dump"))
+}
+
+// One entry of rmlint's JSON output. Besides duplicates it lists other lint
+// (empty files, bad links, duplicate directories...), and a header and a
+// footer with no type.
+type rmlintEntry struct {
+	Type       string  `json:"type"`
+	Digest     string  `json:"digest"`
+	Path       string  `json:"path"`
+	Size       int64   `json:"size"`
+	Mtime      float64 `json:"mtime"`
+	IsOriginal bool    `json:"is_original"`
+}
+
+// Groups of rmlint's duplicate files: a run of entries with the same
+// digest. The file rmlint would keep is marked original, which the
+// "original" scoring rule makes the suggested keeper.
+type rmlintParser struct {
+	dec     *json.Decoder
+	started bool
+	pending *rmlintEntry // First member of the next group, already read
+}
+
+func newRmlintParser(r io.Reader) *rmlintParser {
+	return &rmlintParser{dec: json.NewDecoder(r)}
+}
+
+func (p *rmlintParser) group() ([]Image, error) {
+	if !p.started {
+		if tok, err := p.dec.Token(); err != nil || tok != json.Delim('[') {
+			return nil, fmt.Errorf("expected a JSON array of rmlint entries")
+		}
+		p.started = true
+	}
+	var group []Image
+	digest := ""
+	if p.pending != nil {
+		group = append(group, p.pending.image())
+		digest = p.pending.Digest
+		p.pending = nil
+	}
+	for p.dec.More() {
+		var entry rmlintEntry
+		if err := p.dec.Decode(&entry); err != nil {
+			return nil, err
+		}
+		if entry.Type != "duplicate_file" {
+			continue
+		}
+		if len(group) > 0 && entry.Digest != digest {
+			if len(group) > 1 {
+				p.pending = &entry
+				return group, nil
+			}
+			group = nil // A lone file is no duplicate
+		}
+		group = append(group, entry.image())
+		digest = entry.Digest
+	}
+	if len(group) > 1 {
+		return group, nil
+	}
+	return nil, io.EOF
+}
+
+func (e rmlintEntry) image() Image {
+	return Image{Path: e.Path, Size: e.Size, ModifiedDate: int64(e.Mtime), Original: e.IsOriginal}
+}
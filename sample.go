@@ -0,0 +1,165 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"math/rand"
+	"net/http"
+	"sort"
+	"strconv"
+	"time"
+)
+
+type SampledGroup struct {
+	Idx     int    `json:"idx"`
+	Count   int    `json:"count"`
+	Savings int64  `json:"savings"` // Bytes freed by keeping only the largest file
+	Stratum string `json:"stratum"`
+}
+
+type Stratum struct {
+	Name       string `json:"name"`
+	Population int    `json:"population"`
+	Sampled    int    `json:"sampled"`
+}
+
+// A group counts as reviewed once any of its files was acted on through the tool
+func groupReviewed(group []Image) bool {
+	for _, img := range group {
+		if removedByHistory(pathHistory(img.Path)) {
+			return true
+		}
+	}
+	return false
+}
+
+func groupSavings(group []Image) int64 {
+	var total, largest int64
+	for _, img := range group {
+		total += img.Size
+		if img.Size > largest {
+			largest = img.Size
+		}
+	}
+	return total - largest
+}
+
+func sizeClass(count int) string {
+	switch {
+	case count <= 2:
+		return "2 files"
+	case count <= 4:
+		return "3-4 files"
+	default:
+		return "5+ files"
+	}
+}
+
+// GET /api/sample?n=20&seed=1 returns a random sample of unreviewed groups,
+// stratified by group size and savings quartile so small and large wins are
+// both represented
+func sampleHandler(w http.ResponseWriter, r *http.Request) {
+	n := 20
+	if v := r.URL.Query().Get("n"); v != "" {
+		parsed, err := strconv.Atoi(v)
+		if err != nil || parsed < 1 {
+			http.Error(w, "Invalid n", 400)
+			return
+		}
+		n = parsed
+	}
+	seed := time.Now().UnixNano()
+	if v := r.URL.Query().Get("seed"); v != "" {
+		parsed, err := strconv.ParseInt(v, 10, 64)
+		if err != nil {
+			http.Error(w, "Invalid seed", 400)
+			return
+		}
+		seed = parsed
+	}
+
+	store, release := acquireGroups()
+	defer release()
+	var candidates []SampledGroup
+	for idx := 0; idx < store.Len(); idx++ {
+		group, err := store.Group(idx)
+		if err != nil || len(group) < 2 || groupReviewed(group) {
+			continue
+		}
+		candidates = append(candidates, SampledGroup{Idx: idx, Count: len(group), Savings: groupSavings(group)})
+	}
+
+	// Savings quartile boundaries across all candidates
+	savings := make([]int64, len(candidates))
+	for i, c := range candidates {
+		savings[i] = c.Savings
+	}
+	sort.Slice(savings, func(i, j int) bool { return savings[i] < savings[j] })
+	quartile := func(s int64) int {
+		q := 0
+		for i := 1; i < 4; i++ {
+			if s > savings[len(savings)*i/4] {
+				q = i
+			}
+		}
+		return q
+	}
+
+	strata := make(map[string][]SampledGroup)
+	var names []string
+	for _, c := range candidates {
+		c.Stratum = fmt.Sprintf("%s, savings Q%d", sizeClass(c.Count), quartile(c.Savings)+1)
+		if _, ok := strata[c.Stratum]; !ok {
+			names = append(names, c.Stratum)
+		}
+		strata[c.Stratum] = append(strata[c.Stratum], c)
+	}
+	sort.Strings(names)
+
+	// Allocate the sample proportionally, then hand out what rounding left over:
+	// first to strata that got nothing, then by largest remainder
+	rng := rand.New(rand.NewSource(seed))
+	if n > len(candidates) {
+		n = len(candidates)
+	}
+	quota := make(map[string]int)
+	remainder := make(map[string]int)
+	allocated := 0
+	for _, name := range names {
+		quota[name] = n * len(strata[name]) / len(candidates)
+		remainder[name] = n * len(strata[name]) % len(candidates)
+		allocated += quota[name]
+	}
+	order := append([]string{}, names...)
+	sort.SliceStable(order, func(i, j int) bool {
+		if (quota[order[i]] == 0) != (quota[order[j]] == 0) {
+			return quota[order[i]] == 0
+		}
+		return remainder[order[i]] > remainder[order[j]]
+	})
+	for _, name := range order {
+		if allocated >= n {
+			break
+		}
+		quota[name]++
+		allocated++
+	}
+
+	sample := []SampledGroup{}
+	summary := []Stratum{}
+	for _, name := range names {
+		members := strata[name]
+		rng.Shuffle(len(members), func(i, j int) { members[i], members[j] = members[j], members[i] })
+		take := min(quota[name], len(members))
+		sample = append(sample, members[:take]...)
+		summary = append(summary, Stratum{Name: name, Population: len(members), Sampled: take})
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"seed":       seed,
+		"unreviewed": len(candidates),
+		"strata":     summary,
+		"groups":     sample,
+	})
+}
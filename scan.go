@@ -0,0 +1,453 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"reflect"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Values accepted by czkawka_cli for the tunable scan parameters
+var (
+	similarityPresets = []string{"Original", "VeryHigh", "High", "Medium", "Small", "VerySmall", "Minimal"}
+	hashSizes         = []int{8, 16, 32, 64}
+	hashAlgs          = []string{"Mean", "Gradient", "Blockhash", "VertGradient", "DoubleGradient", "Median"}
+)
+
+type ScanParams struct {
+	Directories      []string `json:"directories"`
+	SimilarityPreset string   `json:"similarity_preset,omitempty"`
+	HashSize         int      `json:"hash_size,omitempty"`
+	HashAlg          string   `json:"hash_alg,omitempty"`
+}
+
+// A scan is split into one hashing pass per subdirectory (which fills
+// czkawka's hash cache) followed by a final pass over all directories that
+// only has to compare cached hashes. The job is checkpointed after every
+// pass, so an interrupted or failed scan picks up at the first unfinished
+// directory.
+type ScanJob struct {
+	ID         string     `json:"id"`
+	Params     ScanParams `json:"params"`
+	Status     string     `json:"status"` // running, completed or failed
+	Error      string     `json:"error,omitempty"`
+	OutputFile string     `json:"output_file"`
+	Groups     int        `json:"groups"`
+	Kept       int        `json:"kept,omitempty"` // Groups from before kept by a scan of some directories
+	Pending    []string   `json:"pending"`        // Directories still to be hashed
+	Completed  []string   `json:"completed"`      // Directories already hashed
+	Resumed    bool       `json:"resumed"`
+	Started    time.Time  `json:"started"`
+	Updated    time.Time  `json:"updated"`
+	Finished   *time.Time `json:"finished,omitempty"`
+
+	checkpoint string // Where the job is saved, fixed when it starts
+}
+
+var (
+	czkawkaCmd string
+	scanMu     sync.Mutex
+	lastScan   *ScanJob // Most recent scan, running or not
+)
+
+func containsString(list []string, s string) bool {
+	for _, v := range list {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
+
+// Validate scan parameters and resolve directories to absolute paths under imageRoot
+func validateScanParams(p *ScanParams) error {
+	if p.SimilarityPreset != "" && !containsString(similarityPresets, p.SimilarityPreset) {
+		return fmt.Errorf("invalid similarity_preset %q (allowed: %s)", p.SimilarityPreset, strings.Join(similarityPresets, ", "))
+	}
+	if p.HashSize != 0 {
+		valid := false
+		for _, size := range hashSizes {
+			if p.HashSize == size {
+				valid = true
+			}
+		}
+		if !valid {
+			return fmt.Errorf("invalid hash_size %d (allowed: 8, 16, 32, 64)", p.HashSize)
+		}
+	}
+	if p.HashAlg != "" && !containsString(hashAlgs, p.HashAlg) {
+		return fmt.Errorf("invalid hash_alg %q (allowed: %s)", p.HashAlg, strings.Join(hashAlgs, ", "))
+	}
+
+	// Default to scanning the whole image root
+	if len(p.Directories) == 0 {
+		p.Directories = []string{imageRoot}
+	}
+	for i, dir := range p.Directories {
+		dir = absImagePath(dir)
+		if !withinImageRoot(dir) {
+			return fmt.Errorf("directory %s is outside the image root", dir)
+		}
+		if info, err := os.Stat(dir); err != nil || !info.IsDir() {
+			return fmt.Errorf("directory %s does not exist", dir)
+		}
+		p.Directories[i] = dir
+	}
+	return nil
+}
+
+// Build the czkawka_cli argument list for a scan
+func scanArgs(p ScanParams, outputFile string) []string {
+	args := []string{"image"}
+	for _, dir := range p.Directories {
+		args = append(args, "--directories", dir)
+	}
+	if p.SimilarityPreset != "" {
+		args = append(args, "--similarity-preset", p.SimilarityPreset)
+	}
+	if p.HashSize != 0 {
+		args = append(args, "--hash-size", fmt.Sprint(p.HashSize))
+	}
+	if p.HashAlg != "" {
+		args = append(args, "--hash-alg", p.HashAlg)
+	}
+	return append(args, "--compact-file-to-save", outputFile)
+}
+
+// List the hashing passes for a scan: the immediate subdirectories of each
+// scanned directory. Only that first level is split up, so files directly in
+// a scanned directory are hashed by the final pass, and a subdirectory
+// holding most of the library is one pass that starts over if interrupted.
+func scanUnits(dirs []string) []string {
+	var units []string
+	for _, dir := range dirs {
+		entries, err := os.ReadDir(dir)
+		if err != nil {
+			continue
+		}
+		for _, entry := range entries {
+			if entry.IsDir() {
+				units = append(units, filepath.Join(dir, entry.Name()))
+			}
+		}
+	}
+	return units
+}
+
+// Whether a scan left part of the image root out
+func partialScan(p ScanParams) bool {
+	root := filepath.Clean(imageRoot)
+	for _, dir := range p.Directories {
+		if filepath.Clean(dir) == root {
+			return false
+		}
+	}
+	return true
+}
+
+// Put the results of a scan of some directories in place of the loaded
+// groups it covers, i.e. those with every file in a scanned directory. Any
+// other group is kept, since the scan couldn't have found it. Written next
+// to the scan's output as <output>.merged.json; returns that path and how
+// many groups were kept.
+func mergeScanResults(job *ScanJob) (string, int, error) {
+	below := func(path string) bool {
+		for _, dir := range job.Params.Directories {
+			if isBelow(filepath.Clean(path), filepath.Clean(dir)) {
+				return true
+			}
+		}
+		return false
+	}
+	out := strings.TrimSuffix(job.OutputFile, ".json") + ".merged.json"
+	tmp, err := os.CreateTemp(filepath.Dir(out), filepath.Base(out)+".tmp-*")
+	if err != nil {
+		return "", 0, err
+	}
+	defer os.Remove(tmp.Name()) // Fails harmlessly once renamed
+	w := bufio.NewWriter(tmp)
+	w.WriteString("[")
+	written := 0
+	add := func(group []Image) {
+		if written > 0 {
+			w.WriteString(",")
+		}
+		w.WriteString("\n")
+		raw, _ := json.Marshal(group)
+		w.Write(raw)
+		written++
+	}
+
+	store, release := acquireGroups()
+	defer release()
+	seen := make(map[string]bool)
+	for idx := 0; idx < store.Len(); idx++ {
+		group, err := store.Group(idx)
+		if err != nil {
+			tmp.Close()
+			return "", 0, err
+		}
+		if !slices.ContainsFunc(group, func(img Image) bool { return !below(img.Path) }) {
+			continue // Covered by the scan
+		}
+		seen[groupPaths(group)] = true
+		add(group)
+	}
+	kept := written
+	err = func() error {
+		f, err := openDuplicatesFile(job.OutputFile)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		dec := json.NewDecoder(bufio.NewReader(f))
+		if tok, err := dec.Token(); err != nil || tok != json.Delim('[') {
+			return schemaError("not a JSON array of groups")
+		}
+		for dec.More() {
+			var raw json.RawMessage
+			if err := dec.Decode(&raw); err != nil {
+				return err
+			}
+			group, err := decodeGroup(raw)
+			if err != nil {
+				return err
+			}
+			if !seen[groupPaths(group)] {
+				add(group)
+			}
+		}
+		return nil
+	}()
+	if err != nil {
+		tmp.Close()
+		return "", 0, fmt.Errorf("failed to read %s: %v", job.OutputFile, err)
+	}
+	w.WriteString("\n]\n")
+	if err := w.Flush(); err != nil {
+		tmp.Close()
+		return "", 0, err
+	}
+	if err := tmp.Close(); err != nil {
+		return "", 0, err
+	}
+	return out, kept, os.Rename(tmp.Name(), out)
+}
+
+func scanCheckpointPath() string {
+	return filepath.Join(stateDir, "scan.checkpoint.json")
+}
+
+// Persist the scan job so it can be resumed (caller must hold scanMu)
+func saveScanCheckpoint(job *ScanJob) {
+	job.Updated = time.Now()
+	data, err := json.MarshalIndent(job, "", "  ")
+	if err != nil {
+		logFor("scan").Error("failed to encode scan checkpoint", "err", err)
+		return
+	}
+	tmp := job.checkpoint + ".tmp"
+	if err := os.WriteFile(tmp, data, 0644); err != nil {
+		logFor("scan").Error("failed to write scan checkpoint", "err", err)
+		return
+	}
+	if err := os.Rename(tmp, job.checkpoint); err != nil {
+		logFor("scan").Error("failed to write scan checkpoint", "err", err)
+	}
+}
+
+// Run czkawka_cli once, treating its "duplicates found" exit code as success
+func runCzkawka(p ScanParams, outputFile string) error {
+	cmd := exec.Command(czkawkaCmd, scanArgs(p, outputFile)...)
+	output, err := cmd.CombinedOutput()
+
+	// czkawka_cli exits with code 11 when it found duplicates
+	var exitErr *exec.ExitError
+	if errors.As(err, &exitErr) && exitErr.ExitCode() == 11 {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("%v: %s", err, strings.TrimSpace(string(output)))
+	}
+	return nil
+}
+
+func runScan(job *ScanJob) {
+	var err error
+	for err == nil {
+		scanMu.Lock()
+		if len(job.Pending) == 0 {
+			scanMu.Unlock()
+			break
+		}
+		dir := job.Pending[0]
+		scanMu.Unlock()
+		waitForBackgroundSlot("scan " + job.ID)
+
+		// Hash one directory; the results are discarded, we only want czkawka's cache filled
+		params := job.Params
+		params.Directories = []string{dir}
+		passOutput := filepath.Join(tempDir, "scan-pass.json")
+		err = runCzkawka(params, passOutput)
+		os.Remove(passOutput)
+		if err == nil {
+			scanMu.Lock()
+			job.Pending = job.Pending[1:]
+			job.Completed = append(job.Completed, dir)
+			saveScanCheckpoint(job)
+			scanMu.Unlock()
+			logFor("scan").Info("hashed directory", "scan", job.ID, "dir", dir)
+		}
+	}
+
+	var loaded groupStore
+	if err == nil {
+		waitForBackgroundSlot("scan " + job.ID)
+		err = runCzkawka(job.Params, job.OutputFile)
+	}
+	results := job.OutputFile
+	kept := 0
+	if err == nil && partialScan(job.Params) {
+		results, kept, err = mergeScanResults(job)
+	}
+	if err == nil {
+		backupBefore("rescan")
+		loaded, err = openGroups(results)
+	}
+
+	scanMu.Lock()
+	defer scanMu.Unlock()
+	finished := time.Now()
+	job.Finished = &finished
+	if err != nil {
+		// The checkpoint stays, so running the scan again carries on from
+		// the directories already hashed
+		job.Status = "failed"
+		job.Error = err.Error()
+		saveScanCheckpoint(job)
+		logFor("scan").Error("scan failed", "scan", job.ID, "err", err, "hashed", len(job.Completed), "dirs", len(job.Completed)+len(job.Pending))
+		return
+	}
+	os.Remove(job.checkpoint)
+	setGroups(loaded)
+	job.Status = "completed"
+	job.Groups = loaded.Len()
+	job.Kept = kept
+	logFor("scan").Info("scan completed", "scan", job.ID, "groups", loaded.Len(), "file", job.OutputFile)
+}
+
+// Resume a scan that was interrupted by a restart, if a checkpoint was left
+// behind. One that failed is only shown, for POST /api/scan to carry on.
+func resumeScan() {
+	data, err := os.ReadFile(scanCheckpointPath())
+	if err != nil {
+		return
+	}
+	var job ScanJob
+	if err := json.Unmarshal(data, &job); err != nil || (job.Status != "running" && job.Status != "failed") {
+		logFor("scan").Warn("ignoring unusable scan checkpoint", "file", scanCheckpointPath())
+		os.Remove(scanCheckpointPath())
+		return
+	}
+	if job.Status == "failed" {
+		job.checkpoint = scanCheckpointPath()
+		scanMu.Lock()
+		lastScan = &job
+		scanMu.Unlock()
+		return
+	}
+	if err := validateScanParams(&job.Params); err != nil {
+		logFor("scan").Error("cannot resume scan", "scan", job.ID, "err", err)
+		os.Remove(scanCheckpointPath())
+		return
+	}
+	if _, err := exec.LookPath(czkawkaCmd); err != nil {
+		logFor("scan").Error("cannot resume scan, czkawka not found", "scan", job.ID, "cmd", czkawkaCmd)
+		return
+	}
+
+	scanMu.Lock()
+	job.Resumed = true
+	job.checkpoint = scanCheckpointPath()
+	lastScan = &job
+	scanMu.Unlock()
+	logFor("scan").Info("resuming scan", "scan", job.ID, "hashed", len(job.Completed), "dirs", len(job.Completed)+len(job.Pending))
+	go runScan(&job)
+}
+
+// GET returns the status of the last scan, POST starts a new one
+func scanHandler(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case "GET":
+		scanMu.Lock()
+		defer scanMu.Unlock()
+		if lastScan == nil {
+			http.Error(w, "No scan has been run", 404)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(lastScan)
+	case "POST":
+		var params ScanParams
+		if err := json.NewDecoder(r.Body).Decode(&params); err != nil {
+			http.Error(w, "Invalid JSON", 400)
+			return
+		}
+		if err := validateScanParams(&params); err != nil {
+			http.Error(w, err.Error(), 400)
+			return
+		}
+		if _, err := exec.LookPath(czkawkaCmd); err != nil {
+			http.Error(w, fmt.Sprintf("%s not found", czkawkaCmd), 503)
+			return
+		}
+
+		scanMu.Lock()
+		defer scanMu.Unlock()
+		if lastScan != nil && lastScan.Status == "running" {
+			http.Error(w, "A scan is already running", 409)
+			return
+		}
+		// The same scan again after it failed carries on where it stopped
+		if failed := lastScan; failed != nil && failed.Status == "failed" && reflect.DeepEqual(failed.Params, params) {
+			failed.Status, failed.Error, failed.Finished, failed.Resumed = "running", "", nil, true
+			saveScanCheckpoint(failed)
+			reqLog(r, "scan").Info("resuming failed scan", "scan", failed.ID, "hashed", len(failed.Completed), "dirs", len(failed.Completed)+len(failed.Pending))
+			go runScan(failed)
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(202)
+			json.NewEncoder(w).Encode(failed)
+			return
+		}
+		now := time.Now()
+		id := now.Format("20060102-150405")
+		job := &ScanJob{
+			ID:         id,
+			Params:     params,
+			Status:     "running",
+			OutputFile: filepath.Join(filepath.Dir(primaryDuplicates(duplicatesFile)), "scan-"+id+".json"),
+			Pending:    scanUnits(params.Directories),
+			Started:    now,
+			checkpoint: scanCheckpointPath(),
+		}
+		lastScan = job
+		saveScanCheckpoint(job)
+		reqLog(r, "scan").Info("starting scan", "scan", id, "cmd", czkawkaCmd+" "+strings.Join(scanArgs(params, job.OutputFile), " "))
+		go runScan(job)
+
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(202)
+		json.NewEncoder(w).Encode(job)
+	default:
+		http.Error(w, "Method not allowed", 405)
+	}
+}
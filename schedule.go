@@ -0,0 +1,152 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Heavy background work (rescan hashing, file validation) can be held back
+// to off-hours and to when the machine isn't busy, so a NAS stays responsive
+// for its other services during the day
+var (
+	backgroundHours   string  // -background-hours, e.g. "01:00-06:00,22:00-23:30"
+	backgroundMaxLoad float64 // -background-max-load, 0 = no limit
+	backgroundWindows []timeWindow
+)
+
+// How often paused background work checks whether it may carry on
+const backgroundPoll = time.Minute
+
+// A daily window in minutes since midnight; from > to wraps past midnight
+type timeWindow struct {
+	from, to int
+}
+
+func (w timeWindow) contains(minute int) bool {
+	if w.from <= w.to {
+		return minute >= w.from && minute < w.to
+	}
+	return minute >= w.from || minute < w.to
+}
+
+func parseClock(s string) (int, error) {
+	t, err := time.Parse("15:04", strings.TrimSpace(s))
+	if err != nil {
+		return 0, fmt.Errorf("invalid time %q, expected HH:MM", s)
+	}
+	return t.Hour()*60 + t.Minute(), nil
+}
+
+func parseBackgroundHours(spec string) ([]timeWindow, error) {
+	var windows []timeWindow
+	for _, part := range strings.Split(spec, ",") {
+		if part = strings.TrimSpace(part); part == "" {
+			continue
+		}
+		from, to, ok := strings.Cut(part, "-")
+		if !ok {
+			return nil, fmt.Errorf("invalid window %q, expected HH:MM-HH:MM", part)
+		}
+		var w timeWindow
+		var err error
+		if w.from, err = parseClock(from); err != nil {
+			return nil, err
+		}
+		if w.to, err = parseClock(to); err != nil {
+			return nil, err
+		}
+		windows = append(windows, w)
+	}
+	return windows, nil
+}
+
+var (
+	scheduleMu  sync.Mutex
+	waitingJobs = make(map[string]time.Time) // Paused background jobs, since when
+	loadChecked time.Time
+	loadAverage float64
+	loadKnown   bool
+)
+
+// The 1-minute load average, re-read at most every few seconds. Only known
+// on Linux.
+func currentLoad() (float64, bool) {
+	scheduleMu.Lock()
+	defer scheduleMu.Unlock()
+	if time.Since(loadChecked) < 5*time.Second {
+		return loadAverage, loadKnown
+	}
+	loadChecked = time.Now()
+	loadKnown = false
+	if data, err := os.ReadFile("/proc/loadavg"); err == nil {
+		if fields := strings.Fields(string(data)); len(fields) > 0 {
+			loadAverage, err = strconv.ParseFloat(fields[0], 64)
+			loadKnown = err == nil
+		}
+	}
+	return loadAverage, loadKnown
+}
+
+// Why background work may not run at the given time, or "" if it may
+func backgroundBlocked(now time.Time) string {
+	if len(backgroundWindows) > 0 {
+		minute := now.Hour()*60 + now.Minute()
+		inside := false
+		for _, w := range backgroundWindows {
+			inside = inside || w.contains(minute)
+		}
+		if !inside {
+			return "outside the background hours " + backgroundHours
+		}
+	}
+	if backgroundMaxLoad > 0 {
+		if load, ok := currentLoad(); ok && load > backgroundMaxLoad {
+			return fmt.Sprintf("load average %.2f is above %.2f", load, backgroundMaxLoad)
+		}
+	}
+	return ""
+}
+
+// Block until background work may run. Call it between units of work so a
+// job pauses where it can pick up again.
+func waitForBackgroundSlot(job string) {
+	reason := backgroundBlocked(time.Now())
+	if reason == "" {
+		return
+	}
+	logFor("schedule").Info("pausing background job", "job", job, "reason", reason)
+	scheduleMu.Lock()
+	waitingJobs[job] = time.Now()
+	scheduleMu.Unlock()
+	for backgroundBlocked(time.Now()) != "" {
+		time.Sleep(backgroundPoll)
+	}
+	scheduleMu.Lock()
+	delete(waitingJobs, job)
+	scheduleMu.Unlock()
+	logFor("schedule").Info("resuming background job", "job", job)
+}
+
+// The background policy as reported by /api/health
+type BackgroundStatus struct {
+	Hours   string               `json:"hours,omitempty"`
+	MaxLoad float64              `json:"max_load,omitempty"`
+	Allowed bool                 `json:"allowed"`
+	Reason  string               `json:"reason,omitempty"`
+	Waiting map[string]time.Time `json:"waiting"` // Paused jobs, since when
+}
+
+func backgroundStatus() BackgroundStatus {
+	reason := backgroundBlocked(time.Now())
+	status := BackgroundStatus{Hours: backgroundHours, MaxLoad: backgroundMaxLoad, Allowed: reason == "", Reason: reason, Waiting: make(map[string]time.Time)}
+	scheduleMu.Lock()
+	for job, since := range waitingJobs {
+		status.Waiting[job] = since
+	}
+	scheduleMu.Unlock()
+	return status
+}
@@ -0,0 +1,121 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"strings"
+)
+
+// A layout of czkawka's similar-images export that this build decodes
+type czkawkaSchema struct {
+	Version     int    `json:"version"`
+	Description string `json:"description"`
+}
+
+// Every layout czkawka has written that this build reads, oldest first
+var czkawkaSchemas = []czkawkaSchema{
+	{1, "groups of entries with path, size, width, height, modified_date, hash and similarity"},
+	{2, "groups of a reference file and its matches, from scans with reference folders"},
+}
+
+// Newest duplicates file schema this build understands
+var supportedSchema = czkawkaSchemas[len(czkawkaSchemas)-1].Version
+
+// A duplicates file this build can't make sense of, with what it can
+func schemaError(reason string) error {
+	var versions []string
+	for _, s := range czkawkaSchemas {
+		versions = append(versions, fmt.Sprintf("schema %d (%s)", s.Version, s.Description))
+	}
+	return fmt.Errorf("unsupported czkawka similar-images layout: %s; this build reads %s, as well as czkawka's text results, fdupes, rmlint and dupeGuru output",
+		reason, strings.Join(versions, " and "))
+}
+
+// Which schema wrote a group, from its shape: a reference and the array of
+// its matches, or just entries
+func groupSchema(items []json.RawMessage) (czkawkaSchema, error) {
+	isArray := func(raw json.RawMessage) bool { return bytes.HasPrefix(bytes.TrimSpace(raw), []byte("[")) }
+	isObject := func(raw json.RawMessage) bool { return bytes.HasPrefix(bytes.TrimSpace(raw), []byte("{")) }
+	if len(items) == 2 && isObject(items[0]) && isArray(items[1]) {
+		return czkawkaSchemas[1], nil
+	}
+	for _, item := range items {
+		if !isObject(item) {
+			return czkawkaSchema{}, schemaError("a group holds something other than file entries")
+		}
+	}
+	return czkawkaSchemas[0], nil
+}
+
+// The schema of one undecoded group, 0 if none fits
+func groupVersion(raw []byte) int {
+	var items []json.RawMessage
+	if json.Unmarshal(raw, &items) != nil {
+		return 0
+	}
+	schema, _ := groupSchema(items)
+	return schema.Version
+}
+
+// Decode one group of a czkawka export, whichever schema wrote it
+func decodeGroup(raw []byte) ([]Image, error) {
+	var items []json.RawMessage
+	if err := json.Unmarshal(raw, &items); err != nil {
+		return nil, schemaError("a group is not an array")
+	}
+	schema, err := groupSchema(items)
+	if err != nil {
+		return nil, err
+	}
+	return schema.decode(items)
+}
+
+// Decode one group, split into its elements, the way this schema lays it out
+func (s czkawkaSchema) decode(items []json.RawMessage) ([]Image, error) {
+	if s.Version == 2 {
+		return decodeReferenced(items)
+	}
+	return decodeEntries(items)
+}
+
+func decodeEntries(items []json.RawMessage) ([]Image, error) {
+	group := make([]Image, len(items))
+	for i, item := range items {
+		if err := decodeEntry(item, &group[i]); err != nil {
+			return nil, err
+		}
+	}
+	return group, nil
+}
+
+// The reference comes first and is marked original, so it is the suggested
+// keeper like rmlint's originals
+func decodeReferenced(items []json.RawMessage) ([]Image, error) {
+	var ref Image
+	if err := decodeEntry(items[0], &ref); err != nil {
+		return nil, err
+	}
+	ref.Original = true
+	var matches []json.RawMessage
+	if err := json.Unmarshal(items[1], &matches); err != nil {
+		return nil, schemaError("a reference's matches are not an array")
+	}
+	rest, err := decodeEntries(matches)
+	if err != nil {
+		return nil, err
+	}
+	return append([]Image{ref}, rest...), nil
+}
+
+// An entry without a path (fields renamed by some czkawka version) would
+// otherwise load as a file that is never there
+func decodeEntry(raw json.RawMessage, img *Image) error {
+	if err := json.Unmarshal(raw, img); err != nil {
+		return schemaError("unreadable file entry (" + err.Error() + ")")
+	}
+	if img.Path == "" {
+		return schemaError(`file entries have no "path" field`)
+	}
+	return nil
+}
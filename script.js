@@ -1,12 +1,20 @@
 let currentGroupIdx = 0;
 let totalGroups = 0;
 let navigationDirection = 'next'; // Track direction: 'next' or 'prev'
+let readOnlyMode = false; // Server started with -read-only: nothing can be deleted
+let currentPaths = new Set(); // Paths of the group on screen, to match live events against
+// Sent with every request that changes files, so other sites can't forge them
+const csrfToken = document.querySelector('meta[name="csrf-token"]')?.content || '';
+// Names this tab to the server, so two tabs don't resolve the same group at once
+const reviewerId = sessionStorage.getItem('reviewer') || `tab-${Math.random().toString(36).slice(2, 10)}`;
+sessionStorage.setItem('reviewer', reviewerId);
 
 function deleteImage(filePath, wrapper) {
-    fetch('/api/delete', {
+    fetch('api/v1/delete', {
         method: 'POST',
         headers: {
             'Content-Type': 'application/json',
+            'X-CSRF-Token': csrfToken,
         },
         body: JSON.stringify({ path: filePath })
     })
@@ -34,6 +42,27 @@ function deleteImage(filePath, wrapper) {
     });
 }
 
+function openLocally(filePath) {
+    // Get a signed link from the server and hand it to the companion agent
+    fetch(`api/v1/open-link?path=${encodeURIComponent(filePath)}`)
+    .then(res => {
+        if (!res.ok) {
+            throw new Error(`open-link: ${res.status}`);
+        }
+        return res.json();
+    })
+    .then(link => fetch(`${link.agent}/open`, {
+        method: 'POST',
+        headers: {
+            'Content-Type': 'application/json',
+        },
+        body: JSON.stringify({ path: link.path, expires: link.expires, sig: link.sig })
+    }))
+    .catch(err => {
+        console.error('Error opening file locally:', err);
+    });
+}
+
 function fetchGroup(idx, callback) {
     // Show loading indicator if not using callback
     if (!callback) {
@@ -41,7 +70,7 @@ function fetchGroup(idx, callback) {
         document.getElementById('group-score').textContent = 'Loading group...';
     }
     
-    fetch(`/api/group?idx=${idx}`)
+    fetch(`api/v1/group?idx=${idx}`)
         .then(res => {
             if (!res.ok) {
                 // Group doesn't exist, has no images, or error
@@ -66,64 +95,68 @@ function fetchGroup(idx, callback) {
         });
 }
 
-function navigateToValidGroup(direction) {
+function showAllDone() {
+    currentGroupIdx = -1;
+    document.getElementById('images-grid').innerHTML = '<div style="text-align: center; padding: 40px;"><h2>🎉 All Done!</h2><p>No more duplicate groups found with multiple files.</p></div>';
+    document.getElementById('group-score').textContent = 'Deduplication complete!';
+}
+
+function navigateToValidGroup(direction, turnedAround = false) {
     navigationDirection = direction;
+    const reverse = direction === 'prev' ? '&reverse=1' : '';
     
-    function tryGroup(idx, searchLimit = 1000) {
-        if (idx < 0) {
-            // Went too far back, try going forward instead
-            if (direction === 'prev') {
-                navigateToValidGroup('next');
-            } else {
-                // No valid groups found at all
-                currentGroupIdx = -1;
-                document.getElementById('images-grid').innerHTML = '<div style="text-align: center; padding: 40px;"><h2>🎉 All Done!</h2><p>No more duplicate groups found with multiple files.</p></div>';
-                document.getElementById('group-score').textContent = 'Deduplication complete!';
-            }
-            return;
-        }
-        
-        if (idx >= searchLimit) {
-            // Reached search limit going forward
-            if (direction === 'next') {
-                // Try going backwards instead
-                if (currentGroupIdx > 0) {
-                    navigateToValidGroup('prev');
+    // The server skips resolved groups and those with fewer than two files left
+    fetch(`api/v1/group/next?after=${currentGroupIdx}${reverse}`)
+        .then(res => res.ok ? res.json() : null)
+        .then(next => {
+            if (!next) {
+                // Nothing left this way, try the other way once
+                if (!turnedAround && (direction === 'prev' || currentGroupIdx > 0)) {
+                    navigateToValidGroup(direction === 'next' ? 'prev' : 'next', true);
                 } else {
-                    document.getElementById('images-grid').innerHTML = '<div style="text-align: center; padding: 40px;"><h2>🎉 All Done!</h2><p>No more duplicate groups found with multiple files.</p></div>';
-                    document.getElementById('group-score').textContent = 'Deduplication complete!';
+                    showAllDone();
                 }
-            } else {
-                // Going backwards and hit the limit, try going forward
-                navigateToValidGroup('next');
-            }
-            return;
-        }
-        
-        fetchGroup(idx, (data) => {
-            if (!data) {
-                // This group doesn't exist or has no valid images, continue searching
-                console.log(`Group ${idx} not available, continuing search...`);
-                const nextIdx = direction === 'next' ? idx + 1 : idx - 1;
-                tryGroup(nextIdx, searchLimit);
                 return;
             }
-            
-            if (data.images && data.images.length > 1) {
-                // Found a valid group with multiple images
-                currentGroupIdx = idx;
-                renderGroup(data, idx);
-            } else {
-                // This group has only one image, skip it
-                console.log(`Group ${idx} has only ${data.images ? data.images.length : 0} images, skipping...`);
-                const nextIdx = direction === 'next' ? idx + 1 : idx - 1;
-                tryGroup(nextIdx, searchLimit);
-            }
-        });
-    }
-    
-    const startIdx = direction === 'next' ? currentGroupIdx + 1 : currentGroupIdx - 1;
-    tryGroup(startIdx);
+            fetchGroup(next.idx, (data) => {
+                if (data && data.images && data.images.length > 1) {
+                    currentGroupIdx = next.idx;
+                    renderGroup(data, next.idx);
+                } else {
+                    // Changed on disk since, keep looking past it
+                    console.log(`Group ${next.idx} not available, continuing search...`);
+                    currentGroupIdx = next.idx;
+                    navigateToValidGroup(direction, turnedAround);
+                }
+            });
+        })
+        .catch(err => console.error('Error finding next group:', err));
+}
+
+function renderProgress(progress) {
+    totalGroups = progress.total_groups;
+    const bar = document.getElementById('review-progress');
+    bar.max = Math.max(progress.total_groups, 1);
+    bar.value = progress.resolved;
+    const reclaimedMB = (progress.reclaimed_bytes / (1024*1024)).toFixed(1);
+    document.getElementById('progress-text').textContent =
+        `${progress.resolved} resolved, ${progress.remaining} to go, ${reclaimedMB} MB reclaimed`;
+}
+
+// Claim a group while it's on screen; warn if someone else is reviewing it
+function claimGroup(idx) {
+    fetch(`api/v1/group/${idx}/claim`, {
+        method: 'POST',
+        headers: { 'X-CSRF-Token': csrfToken, 'X-Reviewer': reviewerId },
+    })
+    .then(res => res.status === 409 ? res.json() : null)
+    .then(claim => {
+        if (claim && idx === currentGroupIdx) {
+            const until = new Date(claim.expires).toLocaleTimeString();
+            document.getElementById('group-score').textContent += ` (being reviewed by ${claim.reviewer} until ${until})`;
+        }
+    })
+    .catch(err => console.error('Error claiming group:', err));
 }
 
 function renderGroup(data, idx) {
@@ -139,7 +172,12 @@ function renderGroup(data, idx) {
         mediaTypeText = ` (${imageCount} images)`;
     }
     
-    document.getElementById('group-score').textContent = `Group ${idx + 1}: Similarity Score ${data.group_similarity_score.toFixed(2)}${mediaTypeText}`;
+    if (data.progress) renderProgress(data.progress);
+    const saveText = data.reclaimable_bytes > 0 ? `, save ${(data.reclaimable_bytes / (1024*1024)).toFixed(1)} MB` : '';
+    const sourceText = data.source ? ` [${data.source}]` : '';
+    document.getElementById('group-score').textContent = `Group ${idx + 1} of ${totalGroups}: Similarity Score ${data.group_similarity_score.toFixed(2)}${mediaTypeText}${saveText}${sourceText}`;
+    claimGroup(idx);
+    currentPaths = new Set(data.images.map(img => img.path));
     const grid = document.getElementById('images-grid');
     grid.innerHTML = '';
     
@@ -167,11 +205,11 @@ function renderGroup(data, idx) {
         if (isVideo) {
             media.controls = true;
             media.preload = 'metadata';
-            media.src = '/images/' + img.path.replace(/^\/+/, '');
+            media.src = 'images/' + img.path.replace(/^\/+/, '');
             // Add poster frame if available (you could generate thumbnails)
-            // media.poster = '/thumbnails/' + img.path.replace(/^\/+/, '').replace(/\.[^.]+$/, '.jpg');
+            // media.poster = 'thumbnails/' + img.path.replace(/^\/+/, '').replace(/\.[^.]+$/, '.jpg');
         } else {
-            media.src = '/images/' + img.path.replace(/^\/+/, '');
+            media.src = 'images/' + img.path.replace(/^\/+/, '');
         }
         
         media.style.width = '100%';
@@ -226,6 +264,8 @@ function renderGroup(data, idx) {
         media.onclick = () => {
             console.log('Media clicked:', img.original_path || img.path);
         };
+        // Double click opens the original in a local viewer via the companion agent
+        media.ondblclick = () => openLocally(img.original_path || img.path);
         // Info
         const info = document.createElement('div');
         info.style.textAlign = 'center';
@@ -234,6 +274,10 @@ function renderGroup(data, idx) {
         // Filename with extension
         const filename = (img.original_path || img.path).split('/').pop();
         infoHtml += `<div style='color:#444;font-size:1em;font-weight:bold;margin-bottom:4px;'>${filename}</div>`;
+        // The file rmlint or dupeGuru would keep, or a czkawka reference
+        if (img.original) {
+            infoHtml += `<div style='color:#2a7;font-size:0.95em;'>Marked original</div>`;
+        }
         // Subject (should be EXIF Subject, not ImageDescription)
         if (img.subject) {
             infoHtml += `<div style='color:#333;font-size:1.1em;font-weight:bold;'>Subject: ${img.subject}</div>`;
@@ -289,7 +333,7 @@ function renderGroup(data, idx) {
         info.innerHTML = infoHtml;
         wrapper.appendChild(media);
         wrapper.appendChild(info);
-        wrapper.appendChild(trash);
+        if (!readOnlyMode) wrapper.appendChild(trash);
         grid.appendChild(wrapper);
     });
 }
@@ -305,50 +349,76 @@ function dedupeGroup() {
         // Sort images by score (highest first)
         const sortedImages = data.images.sort((a, b) => b.score - a.score);
         
-        // Keep the best image (highest score), delete the rest
-        const imagesToDelete = sortedImages.slice(1); // All except the first (best) one
-        
-        if (imagesToDelete.length === 0) {
-            // Only one image, move to next group
+        // Keep the best image (highest score); the server deletes the rest, or
+        // replaces them with hardlinks to it when started with -hardlink
+        const keep = sortedImages[0];
+        fetch('api/v1/resolve-group', {
+            method: 'POST',
+            headers: {
+                'Content-Type': 'application/json',
+                'X-CSRF-Token': csrfToken,
+                'X-Reviewer': reviewerId,
+            },
+            body: JSON.stringify({ idx: currentGroupIdx, keep: keep.original_path || keep.path })
+        })
+        .then(res => res.ok || res.status === 409 ? res.json() : res.text().then(text => ({ success: false, error: text })))
+        .then(result => {
+            if (result.success) {
+                (result.deleted || []).forEach(path => console.log(`Deleted: ${path}`));
+                (result.hardlinked || []).forEach(path => console.log(`Hardlinked: ${path}`));
+            } else {
+                console.error(`Failed to de-dupe group ${currentGroupIdx}: ${result.error}`);
+            }
+            navigateToValidGroup('next');
+        })
+        .catch(err => {
+            console.error('Error deleting files:', err);
             navigateToValidGroup('next');
-            return;
-        }
-        
-        let deletedCount = 0;
-        const totalToDelete = imagesToDelete.length;
-        
-        // Delete images one by one
-        imagesToDelete.forEach((img, index) => {
-            const fullPath = img.original_path || img.path;
-            fetch('/api/delete', {
-                method: 'POST',
-                headers: {
-                    'Content-Type': 'application/json',
-                },
-                body: JSON.stringify({ path: fullPath })
-            })
-            .then(res => res.json())
-            .then(deleteData => {
-                if (deleteData.success) {
-                    console.log(`Deleted: ${fullPath}`);
-                    deletedCount++;
-                    // After all deletions complete, move to next valid group
-                    if (deletedCount === totalToDelete) {
-                        navigateToValidGroup('next');
-                    }
-                }
-            })
-            .catch(err => {
-                console.error('Error deleting file:', err);
-                deletedCount++;
-                if (deletedCount === totalToDelete) {
-                    navigateToValidGroup('next');
-                }
-            });
         });
     });
 }
 
+// Follow what other tabs and reviewers do: redraw the group on screen when
+// one of its files goes, and keep the progress bar current
+let refreshTimer = null;
+function refreshCurrentGroup() {
+    clearTimeout(refreshTimer);
+    refreshTimer = setTimeout(() => {
+        const idx = currentGroupIdx;
+        if (idx < 0) return;
+        fetchGroup(idx, (data) => {
+            if (idx !== currentGroupIdx) return;
+            if (data && data.images && data.images.length > 1) {
+                renderGroup(data, idx);
+            } else {
+                navigateToValidGroup('next');
+            }
+        });
+    }, 300);
+}
+
+function refreshProgress() {
+    fetch('api/v1/progress')
+        .then(res => res.ok ? res.json() : null)
+        .then(progress => { if (progress) renderProgress(progress); })
+        .catch(err => console.error('Error fetching progress:', err));
+}
+
+if (window.EventSource) {
+    const events = new EventSource('api/v1/events');
+    events.addEventListener('deleted', e => {
+        if (currentPaths.has(JSON.parse(e.data).path)) refreshCurrentGroup();
+    });
+    events.addEventListener('converted', e => {
+        if (currentPaths.has(JSON.parse(e.data).path)) refreshCurrentGroup();
+    });
+    events.addEventListener('resolved', e => {
+        if (JSON.parse(e.data).idx === currentGroupIdx) refreshCurrentGroup();
+        refreshProgress();
+    });
+    events.addEventListener('status', refreshProgress);
+}
+
 document.getElementById('prev-group').onclick = () => {
     navigateToValidGroup('prev');
 };
@@ -362,7 +432,17 @@ document.getElementById('next-group').onclick = () => {
 };
 
 window.onload = () => {
-    // Start by checking the first group (index 0)
-    currentGroupIdx = -1; // Start at -1 so navigateToValidGroup('next') will check index 0
-    navigateToValidGroup('next');
+    // In read-only review mode there is nothing to press that would delete
+    fetch('api/v1/version')
+    .then(res => res.json())
+    .then(version => {
+        readOnlyMode = !!version.features.read_only;
+        document.getElementById('dedupe-button').style.display = readOnlyMode ? 'none' : '';
+    })
+    .catch(err => console.error('Error reading server features:', err))
+    .finally(() => {
+        // Start by checking the first group (index 0)
+        currentGroupIdx = -1; // Start at -1 so navigateToValidGroup('next') will check index 0
+        navigateToValidGroup('next');
+    });
 };
\ No newline at end of file
@@ -0,0 +1,85 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"regexp"
+	"strconv"
+)
+
+// Most groups /api/search returns unless limit says otherwise
+const defaultSearchLimit = 100
+
+// A group with at least one file whose path contains the query
+type SearchResult struct {
+	Idx     int         `json:"idx"`
+	Count   int         `json:"count"`
+	Matches []PathMatch `json:"matches"`
+}
+
+type PathMatch struct {
+	Path    string   `json:"path"`    // Relative to the image root
+	Offsets [][2]int `json:"offsets"` // Byte offsets [start, end) of each match in path
+}
+
+// GET /api/search?q=substring[&limit=N] finds the groups with a file whose
+// path contains q, ignoring case, in file order
+func searchHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		http.Error(w, "Method not allowed", 405)
+		return
+	}
+	q := r.URL.Query().Get("q")
+	if q == "" {
+		http.Error(w, "Missing q", 400)
+		return
+	}
+	limit := defaultSearchLimit
+	if v := r.URL.Query().Get("limit"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n <= 0 {
+			http.Error(w, "Invalid limit", 400)
+			return
+		}
+		limit = n
+	}
+	pattern := regexp.MustCompile("(?i)" + regexp.QuoteMeta(q))
+
+	store, release := acquireGroups()
+	defer release()
+	results := []SearchResult{}
+	truncated := false
+	for idx := 0; idx < store.Len(); idx++ {
+		group, err := store.Group(idx)
+		if err != nil {
+			reqLog(r, "groups").Error("failed to read group", "group", idx, "err", err)
+			break
+		}
+		var matches []PathMatch
+		for _, img := range group {
+			rel := getRelativeImagePath(img.Path)
+			if found := pattern.FindAllStringIndex(rel, -1); found != nil {
+				m := PathMatch{Path: rel}
+				for _, f := range found {
+					m.Offsets = append(m.Offsets, [2]int{f[0], f[1]})
+				}
+				matches = append(matches, m)
+			}
+		}
+		if matches == nil {
+			continue
+		}
+		if len(results) == limit {
+			truncated = true
+			break
+		}
+		results = append(results, SearchResult{Idx: idx, Count: len(group), Matches: matches})
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"query":     q,
+		"groups":    results,
+		"truncated": truncated,
+	})
+}
@@ -0,0 +1,131 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"strconv"
+)
+
+// Outcome of auto-resolving one group under a set of rules
+type SimulatedGroup struct {
+	Idx            int      `json:"idx"`
+	Keep           string   `json:"keep,omitempty"` // Empty if the group would be left for manual review
+	Delete         []string `json:"delete"`
+	ReclaimedBytes int64    `json:"reclaimed_bytes"`
+	BaselineKeep   string   `json:"baseline_keep,omitempty"` // Keeper under the current rules
+}
+
+// Projected totals for one set of rules
+type Projection struct {
+	Resolved       int   `json:"resolved"`
+	Skipped        int   `json:"skipped"`
+	Deletions      int   `json:"deletions"`
+	ReclaimedBytes int64 `json:"reclaimed_bytes"`
+}
+
+func (p *Projection) add(g SimulatedGroup) {
+	if g.Keep == "" {
+		p.Skipped++
+		return
+	}
+	p.Resolved++
+	p.Deletions += len(g.Delete)
+	p.ReclaimedBytes += g.ReclaimedBytes
+}
+
+// Work out which file auto-resolution would keep and what it would delete.
+// Ties go to the first top-scoring file unless the rules say to skip them.
+func simulateGroup(idx int, imgs []ImageWithExif, originals []string, rules ScoringRules) SimulatedGroup {
+	result := SimulatedGroup{Idx: idx, Delete: []string{}}
+	scored := scoreImages(append([]ImageWithExif(nil), imgs...), rules)
+	best, ties := 0, 0
+	for i := range scored {
+		if scored[i].Score > scored[best].Score {
+			best, ties = i, 0
+		} else if i != best && scored[i].Score == scored[best].Score {
+			ties++
+		}
+	}
+	if ties > 0 && rules.SkipTies {
+		return result
+	}
+	result.Keep = originals[best]
+	for i := range scored {
+		if i != best {
+			result.Delete = append(result.Delete, originals[i])
+			result.ReclaimedBytes += scored[i].Size
+		}
+	}
+	return result
+}
+
+// POST a ScoringRules object (omitted fields keep their current values) to
+// project what automatic resolution of every group would do under those
+// rules, compared with the current ones. Nothing is deleted or recorded.
+func simulateHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		http.Error(w, "Method not allowed", 405)
+		return
+	}
+	rules := defaultScoringRules
+	if err := json.NewDecoder(r.Body).Decode(&rules); err != nil {
+		http.Error(w, "Invalid JSON", 400)
+		return
+	}
+	sampleSize := 20
+	if v := r.URL.Query().Get("sample"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 0 {
+			http.Error(w, "Invalid sample", 400)
+			return
+		}
+		sampleSize = n
+	}
+
+	var projected, baseline Projection
+	changed := 0
+	var changedSample, otherSample []SimulatedGroup
+	store, release := acquireGroups()
+	defer release()
+	for idx := 0; idx < store.Len(); idx++ {
+		group, err := store.Group(idx)
+		if err != nil {
+			continue
+		}
+		imgs, originals := loadGroupImages(group)
+		if len(imgs) < 2 {
+			continue
+		}
+		sim := simulateGroup(idx, imgs, originals, rules)
+		base := simulateGroup(idx, imgs, originals, defaultScoringRules)
+		sim.BaselineKeep = base.Keep
+		projected.add(sim)
+		baseline.add(base)
+
+		// Groups whose outcome changes are the interesting ones to show
+		if sim.Keep != base.Keep {
+			changed++
+			if len(changedSample) < sampleSize {
+				changedSample = append(changedSample, sim)
+			}
+		} else if len(otherSample) < sampleSize {
+			otherSample = append(otherSample, sim)
+		}
+	}
+
+	sample := append(changedSample, otherSample...)
+	if len(sample) > sampleSize {
+		sample = sample[:sampleSize]
+	}
+	if sample == nil {
+		sample = []SimulatedGroup{}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"rules":          rules,
+		"projected":      projected,
+		"baseline":       baseline,
+		"changed_groups": changed,
+		"sample":         sample,
+	})
+}
@@ -0,0 +1,341 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+var (
+	// Path components that vary from one snapshot to the next: dates and
+	// times, Windows shadow copies, rotated rsnapshot-style directories
+	snapshotVarying = regexp.MustCompile(`(?i)^(\d{4}([-_.]?\d{2}){0,2}([T_ -]?\d{2}[-:.]?\d{2}([-:.]?\d{2})?)?|@GMT-[\d.-]+|(hourly|daily|weekly|monthly)\.\d+)$`)
+	// Fixed components that mark a backup tree
+	snapshotNamed = regexp.MustCompile(`(?i)^\.?(snapshots?|backups?|bak|time ?machine)$`)
+)
+
+// A prefix pattern of snapshot copies and the live tree they copy, e.g.
+// "backup/*" and "photos". * stands for one varying component.
+type SnapshotRule struct {
+	ID       string    `json:"id"`
+	Snapshot string    `json:"snapshot"`
+	Live     string    `json:"live"`
+	Created  time.Time `json:"created,omitzero"`
+}
+
+// A detected pattern and how much applying it would remove
+type SnapshotPattern struct {
+	SnapshotRule
+	Groups   int      `json:"groups"`
+	Files    int      `json:"files"` // Snapshot copies that would go
+	Bytes    int64    `json:"bytes"`
+	Examples []string `json:"examples"` // A few snapshot copies
+	Saved    bool     `json:"saved"`
+}
+
+func snapshotRuleID(snapshot, live string) string {
+	sum := sha256.Sum256([]byte(snapshot + "\x00" + live))
+	return hex.EncodeToString(sum[:6])
+}
+
+func pathComponents(path string) []string {
+	var parts []string
+	for _, p := range strings.Split(filepath.ToSlash(getRelativeImagePath(path)), "/") {
+		if p != "" {
+			parts = append(parts, p)
+		}
+	}
+	return parts
+}
+
+// The snapshot pattern for a prefix, or "" if it doesn't look like a snapshot
+func snapshotPattern(prefix []string) string {
+	pattern := make([]string, len(prefix))
+	snapshot := false
+	for i, c := range prefix {
+		pattern[i] = c
+		if snapshotVarying.MatchString(c) {
+			pattern[i] = "*"
+			snapshot = true
+		} else if snapshotNamed.MatchString(c) {
+			snapshot = true
+		}
+	}
+	if !snapshot {
+		return ""
+	}
+	return strings.Join(pattern, "/")
+}
+
+// If a and b differ only by their leading directories and exactly one of them
+// is under a snapshot-style prefix, return that rule with a first
+func snapshotPair(a, b []string) (SnapshotRule, bool) {
+	common := 0
+	for common < len(a) && common < len(b) && a[len(a)-1-common] == b[len(b)-1-common] {
+		common++
+	}
+	if common == 0 {
+		return SnapshotRule{}, false
+	}
+	pa, pb := a[:len(a)-common], b[:len(b)-common]
+	sa, sb := snapshotPattern(pa), snapshotPattern(pb)
+	if sa == "" || sb != "" {
+		return SnapshotRule{}, false
+	}
+	live := strings.Join(pb, "/")
+	return SnapshotRule{ID: snapshotRuleID(sa, live), Snapshot: sa, Live: live}, true
+}
+
+// Members of a group that are snapshot copies under the rule with their live
+// copy also in the group and still on disk
+func snapshotCopies(group []Image, rule SnapshotRule) []Image {
+	var copies []Image
+	for i, a := range group {
+		pa := pathComponents(a.Path)
+		for j, b := range group {
+			if i == j {
+				continue
+			}
+			if r, ok := snapshotPair(pa, pathComponents(b.Path)); ok && r.ID == rule.ID {
+				if _, err := os.Stat(b.Path); err == nil {
+					copies = append(copies, a)
+					break
+				}
+			}
+		}
+	}
+	return copies
+}
+
+func loadSnapshotRules() []SnapshotRule {
+	rules := []SnapshotRule{}
+	stateDB.View(func(tx *bolt.Tx) error {
+		return tx.Bucket([]byte(bucketSnapshotRules)).ForEach(func(k, v []byte) error {
+			var rule SnapshotRule
+			if json.Unmarshal(v, &rule) == nil {
+				rules = append(rules, rule)
+			}
+			return nil
+		})
+	})
+	return rules
+}
+
+// Every snapshot/live pattern found among the loaded groups, most files first
+func findSnapshotPatterns() []SnapshotPattern {
+	saved := make(map[string]bool)
+	for _, rule := range loadSnapshotRules() {
+		saved[rule.ID] = true
+	}
+	found := make(map[string]*SnapshotPattern)
+	store, release := acquireGroups()
+	defer release()
+	for idx := 0; idx < store.Len(); idx++ {
+		group, err := store.Group(idx)
+		if err != nil || len(group) < 2 {
+			continue
+		}
+		copies := make(map[string]map[string]Image) // Rule -> snapshot copies in this group
+		for i, a := range group {
+			pa := pathComponents(a.Path)
+			for j, b := range group {
+				if i == j {
+					continue
+				}
+				rule, ok := snapshotPair(pa, pathComponents(b.Path))
+				if !ok {
+					continue
+				}
+				if found[rule.ID] == nil {
+					found[rule.ID] = &SnapshotPattern{SnapshotRule: rule, Examples: []string{}, Saved: saved[rule.ID]}
+				}
+				if copies[rule.ID] == nil {
+					copies[rule.ID] = make(map[string]Image)
+				}
+				copies[rule.ID][a.Path] = a
+			}
+		}
+		for id, files := range copies {
+			p := found[id]
+			counted := false
+			for path, img := range files {
+				if _, err := os.Stat(path); err != nil {
+					continue // Already gone
+				}
+				if !counted {
+					p.Groups++
+					counted = true
+				}
+				p.Files++
+				p.Bytes += img.Size
+				if len(p.Examples) < 5 {
+					p.Examples = append(p.Examples, getRelativeImagePath(path))
+				}
+			}
+		}
+	}
+	patterns := []SnapshotPattern{}
+	for _, p := range found {
+		if p.Files > 0 {
+			patterns = append(patterns, *p)
+		}
+	}
+	sort.Slice(patterns, func(i, j int) bool {
+		if patterns[i].Files != patterns[j].Files {
+			return patterns[i].Files > patterns[j].Files
+		}
+		return patterns[i].ID < patterns[j].ID
+	})
+	return patterns
+}
+
+// Outcome of applying a snapshot rule
+type SnapshotResult struct {
+	Rule    SnapshotRule `json:"rule"`
+	DryRun  bool         `json:"dry_run"`
+	Files   int          `json:"files"` // Snapshot copies found
+	Bytes   int64        `json:"bytes"`
+	Trashed int          `json:"trashed"`
+	Failed  []string     `json:"failed"`
+	UndoID  *int64       `json:"undo_id,omitempty"`
+}
+
+// Trash the snapshot copies of every group matching the rule, as one undo entry
+func applySnapshotRule(r *http.Request, rule SnapshotRule, dryRun bool) SnapshotResult {
+	store, release := acquireGroups()
+	defer release()
+	var targets []string
+	groupOf := make(map[string]int)
+	result := SnapshotResult{Rule: rule, DryRun: dryRun, Failed: []string{}}
+	for idx := 0; idx < store.Len(); idx++ {
+		group, err := store.Group(idx)
+		if err != nil || len(group) < 2 {
+			continue
+		}
+		for _, img := range snapshotCopies(group, rule) {
+			if _, err := os.Stat(img.Path); err != nil || readOnly(img.Path) {
+				continue
+			}
+			if _, dup := groupOf[img.Path]; !dup {
+				targets = append(targets, img.Path)
+				groupOf[img.Path] = idx
+				result.Bytes += img.Size
+			}
+		}
+	}
+	result.Files = len(targets)
+	if dryRun || len(targets) == 0 {
+		return result
+	}
+
+	if len(targets) >= largeBatch {
+		backupBefore("snapshot-rule")
+	}
+	var changes []FileChange
+	for _, path := range targets {
+		change, err := moveToTrash(r, path, groupOf[path])
+		if err != nil {
+			reqLog(r, "delete").Error("failed to trash file", "path", path, "err", err)
+			result.Failed = append(result.Failed, path)
+			continue
+		}
+		changes = append(changes, change)
+		pruneAfterRemoval(r, path)
+	}
+	if len(changes) > 0 {
+		entry := pushUndo("snapshot-rule", fmt.Sprintf("trashed %d snapshot copies under %s (live tree %s)", len(changes), rule.Snapshot, rule.Live), changes)
+		for _, change := range changes {
+			if info, err := os.Stat(change.Path); err == nil {
+				noteDeletion(change.MovedFrom, info.Size(), actionTrashed, cacheThumbnail(change.MovedFrom, change.Path), &entry.ID)
+			}
+		}
+		result.UndoID = &entry.ID
+	}
+	result.Trashed = len(changes)
+	reqLog(r, "delete").Info("applied snapshot rule", "snapshot", rule.Snapshot, "live", rule.Live, "trashed", len(changes), "failed", len(result.Failed))
+	return result
+}
+
+// GET lists detected snapshot patterns and saved rules. POST {"id": ...} (a
+// detected pattern) or {"snapshot": ..., "live": ...} saves the rule and trashes
+// the snapshot copies in every matching group, keeping the live ones; add
+// "dry_run": true to only count them. Posting a saved rule again applies it
+// to the groups loaded now, e.g. after a rescan. DELETE ?id= forgets a rule.
+func snapshotRulesHandler(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case "GET":
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"detected": findSnapshotPatterns(),
+			"rules":    loadSnapshotRules(),
+		})
+	case "POST":
+		var req struct {
+			ID       string `json:"id"`
+			Snapshot string `json:"snapshot"`
+			Live     string `json:"live"`
+			DryRun   bool   `json:"dry_run"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, "Invalid JSON", 400)
+			return
+		}
+		var rule SnapshotRule
+		if req.ID == "" {
+			if req.Snapshot == "" {
+				http.Error(w, "Give a detected pattern's id or a snapshot and live prefix", 400)
+				return
+			}
+			rule = SnapshotRule{ID: snapshotRuleID(req.Snapshot, req.Live), Snapshot: req.Snapshot, Live: req.Live}
+		} else if !dbGet(bucketSnapshotRules, req.ID, &rule) {
+			for _, p := range findSnapshotPatterns() {
+				if p.ID == req.ID {
+					rule = p.SnapshotRule
+				}
+			}
+			if rule.ID == "" {
+				http.Error(w, "No snapshot pattern "+req.ID, 404)
+				return
+			}
+		}
+
+		decideMu.Lock()
+		defer decideMu.Unlock()
+		if !req.DryRun {
+			planned := applySnapshotRule(r, rule, true)
+			if err := checkBudget(r, planned.Files, planned.Bytes); err != nil {
+				http.Error(w, err.Error(), 429)
+				return
+			}
+			if rule.Created.IsZero() {
+				rule.Created = time.Now()
+			}
+			if err := dbPut(bucketSnapshotRules, rule.ID, rule); err != nil {
+				http.Error(w, "Failed to save rule", 500)
+				return
+			}
+		}
+		result := applySnapshotRule(r, rule, req.DryRun)
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(result)
+	case "DELETE":
+		id := r.URL.Query().Get("id")
+		if err := dbDelete(bucketSnapshotRules, id); err != nil {
+			http.Error(w, "Failed to delete rule", 500)
+			return
+		}
+		w.WriteHeader(204)
+	default:
+		http.Error(w, "Method not allowed", 405)
+	}
+}
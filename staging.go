@@ -0,0 +1,200 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+// A group decision put aside to be applied later with the others, kept in
+// the state database so a long review can be interrupted and resumed
+type StagedDecision struct {
+	Key      string        `json:"key"` // groupKey, so the decision follows its group across reloads
+	Decision DecideRequest `json:"decision"`
+	Bytes    int64         `json:"bytes"` // Freed when it is committed
+	Staged   time.Time     `json:"staged"`
+}
+
+// Outcome of committing one staged decision
+type CommitResult struct {
+	Idx    int           `json:"idx"` // -1 if the group is no longer loaded
+	Key    string        `json:"key"`
+	Result *DecideResult `json:"result,omitempty"`
+	Error  string        `json:"error,omitempty"`
+}
+
+// Staged decisions, oldest first, with the current index of each group
+func loadStaged() []StagedDecision {
+	staged := []StagedDecision{}
+	stateDB.View(func(tx *bolt.Tx) error {
+		return tx.Bucket([]byte(bucketStaged)).ForEach(func(k, v []byte) error {
+			var s StagedDecision
+			if json.Unmarshal(v, &s) == nil {
+				s.Decision.Idx = groupIdxByKey(s.Key)
+				staged = append(staged, s)
+			}
+			return nil
+		})
+	})
+	sort.Slice(staged, func(i, j int) bool { return staged[i].Staged.Before(staged[j].Staged) })
+	return staged
+}
+
+// GET lists the staged decisions. POST a decision as for /api/group/decide
+// to stage it (replacing any staged before for that group); nothing is
+// touched until /api/commit. DELETE ?idx=N unstages one group, or all of
+// them without idx.
+func stageHandler(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case "GET":
+		staged := loadStaged()
+		var bytes int64
+		files := 0
+		for _, s := range staged {
+			bytes += s.Bytes
+			files += len(s.Decision.Delete) + len(s.Decision.Hardlink)
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"staged": staged,
+			"files":  files,
+			"bytes":  bytes,
+		})
+	case "POST":
+		var req DecideRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, "Invalid JSON", 400)
+			return
+		}
+		store, release := acquireGroups()
+		defer release()
+		if req.Idx < 0 || req.Idx >= store.Len() {
+			http.Error(w, "Group not found", 404)
+			return
+		}
+		group, err := store.Group(req.Idx)
+		if err != nil {
+			http.Error(w, "Failed to read group", 500)
+			return
+		}
+		if err := checkClaim(r, group); err != nil {
+			http.Error(w, err.Error(), 423)
+			return
+		}
+		if err := validateDecision(&req, group); err != nil {
+			http.Error(w, err.Error(), 400)
+			return
+		}
+		s := StagedDecision{Key: groupKey(group), Decision: req, Staged: time.Now()}
+		for _, path := range append(append([]string{}, req.Delete...), req.Hardlink...) {
+			if info, err := os.Stat(path); err == nil {
+				s.Bytes += info.Size()
+			}
+		}
+		if err := dbPut(bucketStaged, s.Key, s); err != nil {
+			http.Error(w, "Failed to save staged decision: "+err.Error(), 500)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(s)
+	case "DELETE":
+		v := r.URL.Query().Get("idx")
+		if v == "" {
+			for _, s := range loadStaged() {
+				dbDelete(bucketStaged, s.Key)
+			}
+			w.WriteHeader(204)
+			return
+		}
+		idx, err := strconv.Atoi(v)
+		store, release := acquireGroups()
+		defer release()
+		if err != nil || idx < 0 || idx >= store.Len() {
+			http.Error(w, "Group not found", 404)
+			return
+		}
+		group, err := store.Group(idx)
+		if err != nil {
+			http.Error(w, "Failed to read group", 500)
+			return
+		}
+		dbDelete(bucketStaged, groupKey(group))
+		w.WriteHeader(204)
+	default:
+		http.Error(w, "Method not allowed", 405)
+	}
+}
+
+// POST /api/commit applies every staged decision, each one all or nothing.
+// Applied decisions are unstaged; ones that no longer fit their group (files
+// gone or the group no longer loaded) stay staged with the reason.
+func commitHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		http.Error(w, "Method not allowed", 405)
+		return
+	}
+
+	decideMu.Lock()
+	defer decideMu.Unlock()
+	staged := loadStaged()
+	var bytes int64
+	files := 0
+	for _, s := range staged {
+		bytes += s.Bytes
+		files += len(s.Decision.Delete) + len(s.Decision.Hardlink)
+	}
+	if err := checkBudget(r, files, bytes); err != nil {
+		http.Error(w, err.Error(), 429)
+		return
+	}
+	if files >= largeBatch {
+		backupBefore("commit")
+	}
+
+	results := []CommitResult{}
+	committed, failed := 0, 0
+	var reclaimed int64
+	for _, s := range staged {
+		res := CommitResult{Idx: s.Decision.Idx, Key: s.Key}
+		var group []Image
+		err := fmt.Errorf("group is no longer loaded")
+		if res.Idx >= 0 {
+			group, err = currentGroups().Group(res.Idx)
+		}
+		if err != nil {
+			res.Error = err.Error()
+		} else if err := validateDecision(&s.Decision, group); err != nil {
+			res.Error = err.Error()
+		} else {
+			result := applyDecision(r, s.Decision)
+			res.Result = &result
+			if !result.Success {
+				res.Error = result.Error
+			}
+		}
+		if res.Error != "" {
+			failed++
+		} else {
+			committed++
+			reclaimed += res.Result.ReclaimedBytes
+			dbDelete(bucketStaged, s.Key)
+		}
+		results = append(results, res)
+	}
+	reqLog(r, "delete").Info("committed staged decisions", "committed", committed, "failed", failed, "bytes", reclaimed)
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"success":         failed == 0,
+		"committed":       committed,
+		"failed":          failed,
+		"reclaimed_bytes": reclaimed,
+		"results":         results,
+	})
+}
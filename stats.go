@@ -0,0 +1,221 @@
+package main
+
+import (
+	"encoding/json"
+	"maps"
+	"net/http"
+	"os"
+	"os/user"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// Duplicate waste of one root directory or one owner. In every group the
+// largest file counts as the one to keep and all other copies as waste, as
+// for savings elsewhere.
+type WasteShare struct {
+	Name        string `json:"name"`
+	Files       int    `json:"files"` // Files of theirs in any group
+	Bytes       int64  `json:"bytes"`
+	WastedFiles int    `json:"wasted_files"`
+	WastedBytes int64  `json:"wasted_bytes"`
+	Groups      []int  `json:"groups,omitempty"` // With ?owner= or ?root=: groups where they have waste
+}
+
+// Name of the top-level directory below the image root a file is in
+func rootOf(path string) string {
+	rel := getRelativeImagePath(path)
+	if i := strings.IndexByte(rel, '/'); i > 0 {
+		return rel[:i]
+	}
+	return "."
+}
+
+var (
+	ownerNamesMu sync.Mutex
+	ownerNames   = make(map[string]string)
+)
+
+// User name for a numeric owner, or the number if it has no account here
+// (common for files written by a NAS under another uid)
+func ownerName(uid string) string {
+	ownerNamesMu.Lock()
+	defer ownerNamesMu.Unlock()
+	if name, ok := ownerNames[uid]; ok {
+		return name
+	}
+	name := uid
+	if u, err := user.LookupId(uid); err == nil {
+		name = u.Username
+	}
+	ownerNames[uid] = name
+	return name
+}
+
+var (
+	camerasMu sync.Mutex
+	cameras   = make(map[string]string) // Path -> camera, for files whose EXIF was read
+)
+
+// Remember the camera of a file once its EXIF has been read for review, so
+// /api/stats can break waste down by camera without reading every file
+func recordCamera(path string, exif ExifData) {
+	camera := strings.TrimSpace(exif.CameraModel)
+	if maker := strings.TrimSpace(exif.CameraMake); maker != "" && !strings.HasPrefix(strings.ToLower(camera), strings.ToLower(maker)) {
+		camera = strings.TrimSpace(maker + " " + camera)
+	}
+	if camera == "" {
+		camera = "unknown"
+	}
+	camerasMu.Lock()
+	cameras[filepath.Clean(path)] = camera
+	camerasMu.Unlock()
+}
+
+// Extension of a file for the stats, lower case without the dot
+func extensionOf(path string) string {
+	if ext := strings.TrimPrefix(strings.ToLower(filepath.Ext(path)), "."); ext != "" {
+		return ext
+	}
+	return "none"
+}
+
+type statFile struct {
+	size   int64
+	owner  string
+	exists bool
+}
+
+// Stat every file of every group, spread over workers as validation does
+func statGroups(store groupStore) [][]statFile {
+	stats := make([][]statFile, store.Len())
+	jobs := make(chan int)
+	var wg sync.WaitGroup
+	for w := 0; w < validateWorkers; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for idx := range jobs {
+				group, err := store.Group(idx)
+				if err != nil {
+					continue
+				}
+				files := make([]statFile, len(group))
+				for i, img := range group {
+					info, err := os.Stat(img.Path)
+					if err != nil {
+						continue
+					}
+					files[i] = statFile{size: info.Size(), owner: "unknown", exists: true}
+					if uid, ok := fileOwner(info); ok {
+						files[i].owner = ownerName(uid)
+					}
+				}
+				stats[idx] = files
+			}
+		}()
+	}
+	for idx := 0; idx < store.Len(); idx++ {
+		jobs <- idx
+	}
+	close(jobs)
+	wg.Wait()
+	return stats
+}
+
+func sortedShares(shares map[string]*WasteShare) []*WasteShare {
+	list := make([]*WasteShare, 0, len(shares))
+	for _, s := range shares {
+		list = append(list, s)
+	}
+	sort.Slice(list, func(i, j int) bool {
+		if list[i].WastedBytes != list[j].WastedBytes {
+			return list[i].WastedBytes > list[j].WastedBytes
+		}
+		return list[i].Name < list[j].Name
+	})
+	return list
+}
+
+// GET /api/stats breaks duplicate waste down by top-level directory below
+// the image root, by file owner (for shared NAS setups), by extension and by
+// camera, the last only for files whose EXIF has been read so far. ?owner=NAME
+// or ?root=DIR narrows the report to one of them and lists the groups where
+// they have copies to clean up.
+func statsHandler(w http.ResponseWriter, r *http.Request) {
+	ownerFilter, rootFilter := r.URL.Query().Get("owner"), filepath.Clean(r.URL.Query().Get("root"))
+	if rootFilter == "." {
+		rootFilter = ""
+	}
+	store, release := acquireGroups()
+	defer release()
+	stats := statGroups(store)
+
+	byRoot := make(map[string]*WasteShare)
+	byOwner := make(map[string]*WasteShare)
+	byExt := make(map[string]*WasteShare)
+	byCamera := make(map[string]*WasteShare)
+	share := func(shares map[string]*WasteShare, name string) *WasteShare {
+		if shares[name] == nil {
+			shares[name] = &WasteShare{Name: name}
+		}
+		return shares[name]
+	}
+	var total WasteShare
+	total.Name = "all"
+	groupCount := 0 // Groups with waste left
+	camerasMu.Lock()
+	known := maps.Clone(cameras)
+	camerasMu.Unlock()
+	for idx := 0; idx < store.Len(); idx++ {
+		group, err := store.Group(idx)
+		if err != nil || stats[idx] == nil {
+			continue
+		}
+		keep := -1
+		for i, f := range stats[idx] {
+			if f.exists && (keep == -1 || f.size > stats[idx][keep].size) {
+				keep = i
+			}
+		}
+		counted := false
+		for i, f := range stats[idx] {
+			root := rootOf(group[i].Path)
+			if !f.exists || (ownerFilter != "" && f.owner != ownerFilter) || (rootFilter != "" && root != rootFilter) {
+				continue
+			}
+			wasted := i != keep
+			shares := []*WasteShare{share(byRoot, root), share(byOwner, f.owner), share(byExt, extensionOf(group[i].Path)), &total}
+			if camera, ok := known[filepath.Clean(group[i].Path)]; ok {
+				shares = append(shares, share(byCamera, camera))
+			}
+			if wasted && !counted {
+				groupCount++
+				counted = true
+			}
+			for _, s := range shares {
+				s.Files++
+				s.Bytes += f.size
+				if wasted {
+					s.WastedFiles++
+					s.WastedBytes += f.size
+					if (ownerFilter != "" || rootFilter != "") && s != &total && (len(s.Groups) == 0 || s.Groups[len(s.Groups)-1] != idx) {
+						s.Groups = append(s.Groups, idx)
+					}
+				}
+			}
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"groups":       groupCount,
+		"total":        total,
+		"by_root":      sortedShares(byRoot),
+		"by_owner":     sortedShares(byOwner),
+		"by_extension": sortedShares(byExt),
+		"by_camera":    sortedShares(byCamera),
+	})
+}
@@ -0,0 +1,52 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+)
+
+// -duplicates value that reads the groups from stdin
+const stdinDuplicates = "-"
+
+// Name of the copy of the groups read from stdin, in the state directory
+const stdinSpool = "duplicates-stdin.json"
+
+// Copy piped-in groups (e.g. straight from czkawka_cli) to a file in dir, so
+// -lazy, reloading, -write-back and the instance lock work as with any
+// duplicates file. gzip and zstd input keep their compression.
+func spoolDuplicates(in io.Reader, dir string) (string, error) {
+	r := bufio.NewReader(in)
+	name := stdinSpool
+	magic, _ := r.Peek(4)
+	switch {
+	case bytes.HasPrefix(magic, gzipMagic):
+		name += ".gz"
+	case bytes.Equal(magic, zstdMagic):
+		name += ".zst"
+	}
+	path := filepath.Join(dir, name)
+	tmp, err := os.CreateTemp(dir, name+".tmp-*")
+	if err != nil {
+		return "", err
+	}
+	n, err := io.Copy(tmp, r)
+	if cerr := tmp.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil && n == 0 {
+		err = fmt.Errorf("nothing was piped in")
+	}
+	if err == nil {
+		err = os.Rename(tmp.Name(), path)
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
+		return "", err
+	}
+	logFor("groups").Info("read duplicates from stdin", "bytes", n, "file", path)
+	return path, nil
+}
@@ -0,0 +1,195 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const (
+	storageProbeInterval = 10 * time.Second
+	storageProbeTimeout  = 3 * time.Second
+	storageMaxBackoff    = time.Minute
+)
+
+type StorageStatus struct {
+	Available bool       `json:"available"`
+	Error     string     `json:"error,omitempty"`
+	Since     time.Time  `json:"since"`                // When the current state began
+	NextRetry *time.Time `json:"next_retry,omitempty"` // Only while unavailable
+}
+
+var (
+	storageMu      sync.Mutex
+	storageState   = StorageStatus{Available: true, Since: time.Now()}
+	storageMonitor *storageProbe // Probing the open dataset's image root
+)
+
+// The probing of one image root, for as long as its dataset is open
+type storageProbe struct {
+	root     string
+	stop     chan struct{} // Closed to stop it
+	inFlight bool          // A check hasn't returned yet, e.g. hanging on a dead mount
+}
+
+// Check that the image root is reachable. A dropped NFS/SMB mount either
+// hangs, errors, or leaves an empty mount point behind, so all three count
+// as down.
+func (p *storageProbe) check() error {
+	storageMu.Lock()
+	if p.inFlight {
+		storageMu.Unlock()
+		return fmt.Errorf("previous storage check still hanging")
+	}
+	p.inFlight = true
+	storageMu.Unlock()
+
+	result := make(chan error, 1)
+	go func() {
+		defer func() {
+			storageMu.Lock()
+			p.inFlight = false
+			storageMu.Unlock()
+		}()
+		dir, err := os.Open(p.root)
+		if err != nil {
+			result <- err
+			return
+		}
+		defer dir.Close()
+		if _, err := dir.Readdirnames(1); err != nil {
+			result <- fmt.Errorf("image root is empty or unreadable (is it mounted?): %v", err)
+			return
+		}
+		result <- nil
+	}()
+
+	select {
+	case err := <-result:
+		return err
+	case <-time.After(storageProbeTimeout):
+		return fmt.Errorf("timed out after %s reading %s", storageProbeTimeout, p.root)
+	}
+}
+
+// Start probing the open dataset's image root, in place of the monitor of
+// the one open before. The monitor is given the root rather than reading
+// imageRoot, which changes under it when switching workspaces, and a check
+// of the old root still hanging is none of its business.
+func startStorageMonitor() {
+	stopStorageMonitor()
+	p := &storageProbe{root: imageRoot, stop: make(chan struct{})}
+	storageMu.Lock()
+	storageMonitor = p
+	storageState = StorageStatus{Available: true, Since: time.Now()}
+	storageMu.Unlock()
+	go p.monitor()
+}
+
+func stopStorageMonitor() {
+	storageMu.Lock()
+	if storageMonitor != nil {
+		close(storageMonitor.stop)
+		storageMonitor = nil
+	}
+	storageMu.Unlock()
+}
+
+// Probe the image root periodically, backing off exponentially while it is
+// down, until stopped
+func (p *storageProbe) monitor() {
+	backoff := time.Second
+	for {
+		err := p.check()
+		select {
+		case <-p.stop:
+			return // The result is for a root no longer open
+		default:
+		}
+		wait := storageProbeInterval
+
+		storageMu.Lock()
+		if err != nil {
+			if storageState.Available {
+				logFor("storage").Error("storage unavailable", "err", err)
+				storageState.Since = time.Now()
+				backoff = time.Second
+			}
+			wait = backoff
+			next := time.Now().Add(wait)
+			storageState.Available = false
+			storageState.Error = err.Error()
+			storageState.NextRetry = &next
+			backoff *= 2
+			if backoff > storageMaxBackoff {
+				backoff = storageMaxBackoff
+			}
+		} else if !storageState.Available {
+			logFor("storage").Info("storage available again", "down_for", time.Since(storageState.Since).Round(time.Second).String())
+			storageState = StorageStatus{Available: true, Since: time.Now()}
+		}
+		storageMu.Unlock()
+
+		select {
+		case <-p.stop:
+			return
+		case <-time.After(wait):
+		}
+	}
+}
+
+func storageStatus() StorageStatus {
+	storageMu.Lock()
+	defer storageMu.Unlock()
+	return storageState
+}
+
+// Fail fast with 503 instead of letting handlers hang or 500 on a dead mount
+func requireStorage(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		status := storageStatus()
+		if !status.Available {
+			if status.NextRetry != nil {
+				retry := int(time.Until(*status.NextRetry).Seconds()) + 1
+				w.Header().Set("Retry-After", strconv.Itoa(retry))
+			}
+			http.Error(w, "Storage unavailable: "+status.Error, 503)
+			return
+		}
+		next(w, r)
+	}
+}
+
+func healthHandler(w http.ResponseWriter, r *http.Request) {
+	storage := storageStatus()
+	resp := struct {
+		Status  string        `json:"status"`
+		Groups  int           `json:"groups"`
+		Storage StorageStatus `json:"storage"`
+		Cache   CacheStatus   `json:"cache"`
+		// Files whose EXIF couldn't be read, by kind; see /api/exif-errors
+		ExifErrors map[string]int `json:"exif_errors"`
+		// Whether heavy background work may run now, and what is paused
+		Background BackgroundStatus `json:"background"`
+	}{
+		Status:     "ok",
+		Groups:     currentGroups().Len(),
+		Storage:    storage,
+		Cache:      cacheStatus(),
+		ExifErrors: exifErrorCounts(),
+		Background: backgroundStatus(),
+	}
+	w.Header().Set("Content-Type", "application/json")
+	if !resp.Cache.Sufficient {
+		resp.Status = "conversion cache low on space" // Degraded, but still serving
+	}
+	if !storage.Available {
+		resp.Status = "storage unavailable"
+		w.WriteHeader(503)
+	}
+	json.NewEncoder(w).Encode(resp)
+}
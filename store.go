@@ -0,0 +1,154 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+// Buckets in the embedded state database
+const (
+	bucketQuality       = "quality"        // content hash -> QualityMetrics
+	bucketQueues        = "queues"         // queue name -> Queue
+	bucketSessions      = "sessions"       // session name -> ReviewSession
+	bucketSnapshotRules = "snapshot_rules" // rule id -> SnapshotRule
+	bucketBudget        = "budget"         // day -> BudgetUsage
+	bucketPerceptual    = "perceptual"     // content hash -> FreshHashes
+	bucketStaged        = "staged"         // group key -> StagedDecision
+	bucketIntegrity     = "integrity"      // content hash -> integrityCheck
+	bucketQuarantine    = "quarantine"     // original path -> MovedFile
+	bucketStatus        = "group_status"   // group key -> GroupStatus
+	bucketExif          = "exif"           // content hash -> ExifData
+	bucketDecisions     = "decisions"      // content hash, path -> FileDecision
+	bucketHistory       = "history"        // sequence -> Action
+	bucketHistoryPaths  = "history_paths"  // path, sequence -> nothing, to look up a path's actions
+	bucketHistoryHashes = "history_hashes" // content hash, sequence -> nothing, to look up a content's actions
+	bucketMeta          = "meta"           // name -> value, e.g. how much of the history is in bucketHistory
+)
+
+var stateDB *bolt.DB
+
+func openStateDB() error {
+	path := filepath.Join(stateDir, "state.db")
+	db, err := bolt.Open(path, 0644, &bolt.Options{Timeout: 2 * time.Second})
+	if err != nil {
+		return fmt.Errorf("failed to open state database %s (is another instance running?): %v", path, err)
+	}
+	err = db.Update(func(tx *bolt.Tx) error {
+		for _, name := range []string{bucketQuality, bucketQueues, bucketSessions, bucketSnapshotRules, bucketBudget, bucketPerceptual, bucketStaged, bucketIntegrity, bucketQuarantine, bucketStatus, bucketExif, bucketDecisions, bucketHistory, bucketHistoryPaths, bucketHistoryHashes, bucketMeta} {
+			if _, err := tx.CreateBucketIfNotExists([]byte(name)); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		db.Close()
+		return err
+	}
+	stateDB = db
+	return nil
+}
+
+func closeStateDB() {
+	if stateDB != nil {
+		stateDB.Close()
+		stateDB = nil
+	}
+}
+
+// Decode a JSON value from the state database, reporting whether it was found
+func dbGet(bucket, key string, v interface{}) bool {
+	found := false
+	stateDB.View(func(tx *bolt.Tx) error {
+		data := tx.Bucket([]byte(bucket)).Get([]byte(key))
+		if data != nil {
+			found = json.Unmarshal(data, v) == nil
+		}
+		return nil
+	})
+	return found
+}
+
+// Store a value in the state database as JSON
+func dbPut(bucket, key string, v interface{}) error {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	return stateDB.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket([]byte(bucket)).Put([]byte(key), data)
+	})
+}
+
+func dbDelete(bucket, key string) error {
+	return stateDB.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket([]byte(bucket)).Delete([]byte(key))
+	})
+}
+
+// Content hashes are cached per path and invalidated when size or mtime change
+type cachedHash struct {
+	size    int64
+	modTime time.Time
+	hash    string
+}
+
+var (
+	hashMu    sync.Mutex
+	hashCache = make(map[string]cachedHash)
+)
+
+// Content hash of a file for recording with its history: computed for
+// existing images, or the last one seen for files that are gone. Videos are
+// left out rather than read in full.
+func knownContentHash(path string) string {
+	if _, err := os.Stat(path); err != nil {
+		hashMu.Lock()
+		defer hashMu.Unlock()
+		return hashCache[path].hash
+	}
+	if isVideoFile(path) {
+		return ""
+	}
+	hash, _ := contentHash(path)
+	return hash
+}
+
+// SHA-256 of a file's content, which identifies it across renames and rescans
+func contentHash(path string) (string, error) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return "", err
+	}
+	hashMu.Lock()
+	cached, ok := hashCache[path]
+	hashMu.Unlock()
+	if ok && cached.size == info.Size() && cached.modTime.Equal(info.ModTime()) {
+		return cached.hash, nil
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return "", err
+	}
+	sum := hex.EncodeToString(h.Sum(nil))
+
+	hashMu.Lock()
+	hashCache[path] = cachedHash{size: info.Size(), modTime: info.ModTime(), hash: sum}
+	hashMu.Unlock()
+	return sum, nil
+}
@@ -0,0 +1,255 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// How far into a file to look for the start of czkawka's plain text results
+const textResultsSniff = 4096
+
+// czkawka writes similarity as a level rather than a distance in its text
+// results. Each level is read as the largest distance it stands for at hash
+// size 8, which is near enough for sorting and scoring.
+var similarityLevels = map[string]int{
+	"original": 0, "very high": 1, "high": 2, "medium": 5,
+	"small": 7, "very small": 14, "minimal": 20,
+}
+
+// Whether a (decompressed) duplicates file holds czkawka's plain text
+// results (--file-to-save) rather than JSON
+func isTextResults(r *bufio.Reader) bool {
+	head, _ := r.Peek(textResultsSniff)
+	head = bytes.TrimLeft(head, "\ufeff \t\r\n")
+	if len(head) == 0 || head[0] == '[' || head[0] == '{' {
+		return false
+	}
+	if bytes.HasPrefix(head, []byte("Results of searching")) {
+		return true
+	}
+	for _, line := range bytes.Split(head, []byte("\n")) {
+		if isTextGroupHeader(string(bytes.TrimSpace(line))) {
+			return true
+		}
+	}
+	return false
+}
+
+// "Found 3 images which have similar friends"
+func isTextGroupHeader(line string) bool {
+	return strings.HasPrefix(line, "Found ") && strings.HasSuffix(line, "similar friends")
+}
+
+// Reads results in another format as the equivalent czkawka JSON export,
+// one group at a time, so everything past openDuplicatesFile only knows JSON
+type convertedResults struct {
+	next    func() ([]Image, error) // The next group, io.EOF after the last
+	closer  io.Closer
+	buf     bytes.Buffer
+	started bool
+	groups  int
+	done    bool
+}
+
+func (c *convertedResults) Read(p []byte) (int, error) {
+	if !c.started {
+		c.buf.WriteString("[")
+		c.started = true
+	}
+	for c.buf.Len() == 0 && !c.done {
+		group, err := c.next()
+		if err == io.EOF {
+			c.buf.WriteString("\n]\n")
+			c.done = true
+			break
+		}
+		if err != nil {
+			return 0, err
+		}
+		raw, err := json.Marshal(group)
+		if err != nil {
+			return 0, err
+		}
+		if c.groups > 0 {
+			c.buf.WriteString(",")
+		}
+		c.buf.WriteString("\n")
+		c.buf.Write(raw)
+		c.groups++
+	}
+	if c.buf.Len() == 0 {
+		return 0, io.EOF
+	}
+	return c.buf.Read(p)
+}
+
+func (c *convertedResults) Close() error { return c.closer.Close() }
+
+// Groups of czkawka's plain text results
+type textParser struct {
+	lines   *bufio.Scanner
+	inGroup bool // Past a group's header
+	line    int
+}
+
+func newTextParser(r io.Reader) *textParser {
+	lines := bufio.NewScanner(r)
+	lines.Buffer(nil, 1<<20)
+	return &textParser{lines: lines}
+}
+
+// The next group, which ends at a blank line or at the next group's header
+func (p *textParser) group() ([]Image, error) {
+	var group []Image
+	for p.lines.Scan() {
+		p.line++
+		line := strings.TrimRight(p.lines.Text(), "\r")
+		switch trimmed := strings.TrimSpace(line); {
+		case isTextGroupHeader(trimmed):
+			p.inGroup = true
+			if len(group) > 0 {
+				return group, nil
+			}
+		case trimmed == "":
+			p.inGroup = false
+			if len(group) > 0 {
+				return group, nil
+			}
+		case p.inGroup:
+			img, err := parseTextEntry(line)
+			if err != nil {
+				return nil, fmt.Errorf("line %d: %v", p.line, err)
+			}
+			group = append(group, img)
+		}
+		// Anything outside a group is the summary at the top
+	}
+	if err := p.lines.Err(); err != nil {
+		return nil, err
+	}
+	if len(group) > 0 {
+		return group, nil
+	}
+	return nil, io.EOF
+}
+
+// One file of a group: "<path> - <width>x<height> - <size> - <similarity>",
+// the path quoted and escaped by newer czkawka versions. Size and modified
+// date come from the file itself while it is still there, since the text
+// only has a rounded size.
+func parseTextEntry(line string) (Image, error) {
+	var img Image
+	fields := make([]string, 3)
+	rest := line
+	for i := 2; i >= 0; i-- {
+		sep := strings.LastIndex(rest, " - ")
+		if sep < 0 {
+			return img, fmt.Errorf("unrecognised entry %q", line)
+		}
+		fields[i] = strings.TrimSpace(rest[sep+3:])
+		rest = rest[:sep]
+	}
+	path := strings.TrimSpace(rest)
+	if strings.HasPrefix(path, `"`) {
+		unquoted, err := unquoteRust(path)
+		if err != nil {
+			return img, fmt.Errorf("bad path %s: %v", path, err)
+		}
+		path = unquoted
+	}
+	img.Path = path
+	if w, h, ok := strings.Cut(fields[0], "x"); ok {
+		img.Width, _ = strconv.Atoi(strings.TrimSpace(w))
+		img.Height, _ = strconv.Atoi(strings.TrimSpace(h))
+	}
+	if info, err := os.Stat(path); err == nil {
+		img.Size = info.Size()
+		img.ModifiedDate = info.ModTime().Unix()
+	} else {
+		img.Size = parseHumanSize(fields[1])
+	}
+	level := strings.ToLower(fields[2])
+	if similarity, ok := similarityLevels[level]; ok {
+		img.Similarity = similarity
+	} else {
+		img.Similarity, _ = strconv.Atoi(level)
+	}
+	return img, nil
+}
+
+// "1.21 MiB" and the like, as czkawka formats sizes
+func parseHumanSize(s string) int64 {
+	number, unit, _ := strings.Cut(strings.TrimSpace(s), " ")
+	value, err := strconv.ParseFloat(number, 64)
+	if err != nil {
+		return 0
+	}
+	multipliers := map[string]float64{
+		"b": 1, "kib": 1 << 10, "mib": 1 << 20, "gib": 1 << 30, "tib": 1 << 40,
+		"kb": 1e3, "mb": 1e6, "gb": 1e9, "tb": 1e12,
+	}
+	if m, ok := multipliers[strings.ToLower(unit)]; ok {
+		value *= m
+	}
+	return int64(value)
+}
+
+// Undo the escaping of a path printed by Rust's {:?}
+func unquoteRust(s string) (string, error) {
+	if len(s) < 2 || s[0] != '"' || s[len(s)-1] != '"' {
+		return "", fmt.Errorf("not quoted")
+	}
+	s = s[1 : len(s)-1]
+	var out strings.Builder
+	for i := 0; i < len(s); i++ {
+		if s[i] != '\\' {
+			out.WriteByte(s[i])
+			continue
+		}
+		if i++; i >= len(s) {
+			return "", fmt.Errorf("trailing backslash")
+		}
+		switch s[i] {
+		case 'n':
+			out.WriteByte('\n')
+		case 'r':
+			out.WriteByte('\r')
+		case 't':
+			out.WriteByte('\t')
+		case '0':
+			out.WriteByte(0)
+		case '\\', '"', '\'':
+			out.WriteByte(s[i])
+		case 'x': // A byte of a path that isn't valid UTF-8
+			if i+2 >= len(s) {
+				return "", fmt.Errorf("short \\x escape")
+			}
+			b, err := strconv.ParseUint(s[i+1:i+3], 16, 8)
+			if err != nil {
+				return "", err
+			}
+			out.WriteByte(byte(b))
+			i += 2
+		case 'u': // \u{1f600}
+			end := strings.IndexByte(s[i:], '}')
+			if end < 0 || i+1 >= len(s) || s[i+1] != '{' {
+				return "", fmt.Errorf("bad \\u escape")
+			}
+			r, err := strconv.ParseUint(s[i+2:i+end], 16, 32)
+			if err != nil {
+				return "", err
+			}
+			out.WriteRune(rune(r))
+			i += end
+		default:
+			return "", fmt.Errorf("unknown escape \\%c", s[i])
+		}
+	}
+	return out.String(), nil
+}
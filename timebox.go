@@ -0,0 +1,157 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"slices"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+// Finished runs kept per session
+const sessionRunsKept = 20
+
+// One stretch of reviewing in a session, optionally time-boxed. Everything
+// removed while it runs counts towards it, whichever endpoint did it.
+type SessionRun struct {
+	Started        time.Time  `json:"started"`
+	Deadline       *time.Time `json:"deadline,omitempty"`
+	Stopped        *time.Time `json:"stopped,omitempty"`
+	Seconds        float64    `json:"seconds"`         // Time spent, up to now while running
+	GroupsSeen     int        `json:"groups_seen"`     // Handed out by next
+	GroupsHandled  []int      `json:"groups_handled"`  // Groups files were removed from
+	FilesRemoved   int        `json:"files_removed"`   // Deleted, trashed or hardlinked
+	BytesReclaimed int64      `json:"bytes_reclaimed"` // Freed by those files
+}
+
+func (run *SessionRun) expired(now time.Time) bool {
+	return run.Deadline != nil && now.After(*run.Deadline)
+}
+
+// End the session's run at the given time and file it with the finished ones
+func finishRun(s *ReviewSession, at time.Time) SessionRun {
+	run := *s.Run
+	run.Stopped = &at
+	run.Seconds = at.Sub(run.Started).Seconds()
+	s.Runs = append(s.Runs, run)
+	if len(s.Runs) > sessionRunsKept {
+		s.Runs = s.Runs[len(s.Runs)-sessionRunsKept:]
+	}
+	s.Run = nil
+	logFor("review").Info("session run ended", "session", s.Name, "duration", time.Duration(run.Seconds*float64(time.Second)).Round(time.Second).String(),
+		"groups", len(run.GroupsHandled), "files_removed", run.FilesRemoved, "bytes_reclaimed", run.BytesReclaimed)
+	return run
+}
+
+// Finish a run whose time box has passed, returning its summary
+func expireRun(s *ReviewSession) *SessionRun {
+	if s.Run == nil || !s.Run.expired(time.Now()) {
+		return nil
+	}
+	run := finishRun(s, *s.Run.Deadline)
+	return &run
+}
+
+// Count a removed file towards every running session
+func noteSessionAction(group int, bytes int64) {
+	sessionsMu.Lock()
+	defer sessionsMu.Unlock()
+	var running []string
+	stateDB.View(func(tx *bolt.Tx) error {
+		return tx.Bucket([]byte(bucketSessions)).ForEach(func(k, v []byte) error {
+			var s ReviewSession
+			if json.Unmarshal(v, &s) == nil && s.Run != nil {
+				running = append(running, string(k))
+			}
+			return nil
+		})
+	})
+	for _, name := range running {
+		s := loadSession(name)
+		if expireRun(&s) == nil {
+			s.Run.FilesRemoved++
+			s.Run.BytesReclaimed += bytes
+			if group >= 0 && !slices.Contains(s.Run.GroupsHandled, group) {
+				s.Run.GroupsHandled = append(s.Run.GroupsHandled, group)
+			}
+		}
+		if err := dbPut(bucketSessions, name, s); err != nil {
+			logFor("review").Error("failed to update session", "session", name, "err", err)
+		}
+	}
+}
+
+// POST {"minutes": N} starts a run in a session, time-boxed to N minutes
+// unless N is 0
+func sessionStartHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		http.Error(w, "Method not allowed", 405)
+		return
+	}
+	name := r.PathValue("name")
+	if !queueNamePattern.MatchString(name) {
+		http.Error(w, "Session names may only contain letters, digits, - and _", 400)
+		return
+	}
+	var req struct {
+		Minutes float64 `json:"minutes"`
+	}
+	if r.ContentLength != 0 {
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.Minutes < 0 {
+			http.Error(w, "Invalid JSON", 400)
+			return
+		}
+	}
+
+	sessionsMu.Lock()
+	defer sessionsMu.Unlock()
+	s := loadSession(name)
+	expireRun(&s)
+	if s.Run != nil {
+		http.Error(w, "Session "+name+" is already running", 409)
+		return
+	}
+	now := time.Now()
+	s.Run = &SessionRun{Started: now, GroupsHandled: []int{}}
+	if req.Minutes > 0 {
+		deadline := now.Add(time.Duration(req.Minutes * float64(time.Minute)))
+		s.Run.Deadline = &deadline
+	}
+	s.Updated = now
+	if err := dbPut(bucketSessions, name, s); err != nil {
+		http.Error(w, "Failed to save session", 500)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(s)
+}
+
+// POST ends the session's run and returns its summary
+func sessionStopHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		http.Error(w, "Method not allowed", 405)
+		return
+	}
+	name := r.PathValue("name")
+
+	sessionsMu.Lock()
+	defer sessionsMu.Unlock()
+	s := loadSession(name)
+	var summary SessionRun
+	if expired := expireRun(&s); expired != nil {
+		summary = *expired
+	} else if s.Run != nil {
+		summary = finishRun(&s, time.Now())
+	} else {
+		http.Error(w, "Session "+name+" is not running", 409)
+		return
+	}
+	s.Updated = time.Now()
+	if err := dbPut(bucketSessions, name, s); err != nil {
+		http.Error(w, "Failed to save session", 500)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(summary)
+}
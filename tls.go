@@ -0,0 +1,38 @@
+package main
+
+import (
+	"net"
+	"net/http"
+)
+
+// Serve HTTPS directly instead of relying on a reverse proxy
+var (
+	tlsCert      string // -tls-cert
+	tlsKey       string // -tls-key
+	redirectPort string // -http-redirect-port, "" = no plain HTTP listener
+)
+
+func tlsEnabled() bool {
+	return tlsCert != ""
+}
+
+// Answer plain HTTP on redirectPort with a permanent redirect to the same URL
+// over HTTPS on port. Nothing else is served without TLS.
+func redirectToHTTPS() {
+	redirect := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		name, _, err := net.SplitHostPort(r.Host)
+		if err != nil {
+			name = r.Host
+		}
+		target := "https://" + name
+		if port != "443" {
+			target = "https://" + net.JoinHostPort(name, port)
+		}
+		http.Redirect(w, r, target+r.URL.RequestURI(), http.StatusMovedPermanently)
+	})
+	addr := net.JoinHostPort(host, redirectPort)
+	logFor("server").Info("redirecting plain HTTP to HTTPS", "addr", addr, "https_port", port)
+	if err := http.ListenAndServe(addr, redirect); err != nil {
+		logFor("server").Error("HTTP redirect listener failed", "err", err)
+	}
+}
@@ -0,0 +1,76 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// With -trash-dir set, deleting a file moves it there instead
+var trashDirFlag string
+
+// Whether deleting a file moves it to a trash rather than removing it
+func trashEnabled() bool {
+	return trashDirFlag != "" || xdgTrash
+}
+
+// Trashed files are kept under -trash-dir or else the state directory,
+// mirroring their path below the image root
+func trashDir() string {
+	if trashDirFlag != "" {
+		return trashDirFlag
+	}
+	return filepath.Join(stateDir, "trash")
+}
+
+// Move a file into the trash and return the change needed to undo it
+func moveToTrash(r *http.Request, path string, group int) (FileChange, error) {
+	return trashFile(r, path, path, group)
+}
+
+// Move src into the trash under the name of path, where it was found (src
+// differs while a decision has it staged)
+func trashFile(r *http.Request, src, path string, group int) (FileChange, error) {
+	info, err := os.Stat(src)
+	if err != nil {
+		return FileChange{}, err
+	}
+	var dst, trashInfo string
+	if xdgTrash {
+		trash, infoPath, err := xdgTrashFor(src, path)
+		if err != nil {
+			return FileChange{}, err
+		}
+		if dst, trashInfo, err = reserveXDGTrashName(trash, infoPath); err != nil {
+			return FileChange{}, err
+		}
+	} else {
+		rel, err := filepath.Rel(imageRoot, path)
+		if err != nil || strings.HasPrefix(rel, "..") {
+			rel = filepath.Base(path)
+		}
+		dst = filepath.Join(trashDir(), rel)
+		if _, err := os.Stat(dst); err == nil {
+			dst += fmt.Sprintf(".%d", time.Now().UnixNano())
+		}
+		if err := os.MkdirAll(filepath.Dir(dst), 0755); err != nil {
+			return FileChange{}, err
+		}
+	}
+	checksum := auditChecksum(src)
+	if err := moveFile(src, dst); err != nil {
+		if trashInfo != "" {
+			os.Remove(trashInfo)
+		}
+		return FileChange{}, err
+	}
+	audit(r, actionTrashed, path, checksum, info.Size(), group, "moved to "+dst)
+	forgetConverted(path)
+	recordAction(path, actionTrashed, group, fmt.Sprintf("%d bytes, moved to %s", info.Size(), dst))
+	noteSessionAction(group, info.Size())
+	spendBudget(info.Size())
+	return FileChange{Path: dst, MovedFrom: path, TrashInfo: trashInfo}, nil
+}
@@ -0,0 +1,380 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// FileChange describes how one file was changed by an operation, and
+// therefore how to put it back
+type FileChange struct {
+	Path      string `json:"path"`                 // Location of the file after the operation
+	MovedFrom string `json:"moved_from,omitempty"` // Original location, if the operation moved or renamed it
+	Backup    string `json:"backup,omitempty"`     // Copy of the original content, if the operation rewrote or replaced it
+	TrashInfo string `json:"trash_info,omitempty"` // .trashinfo file written for the desktop trash, see -xdg-trash
+}
+
+// UndoEntry is one reversible operation on the undo stack
+type UndoEntry struct {
+	ID          int64        `json:"id"`
+	Time        time.Time    `json:"time"`
+	Op          string       `json:"op"` // e.g. move, rename, hardlink, metadata-merge
+	Description string       `json:"description"`
+	Changes     []FileChange `json:"changes"`
+}
+
+var (
+	undoDepth int
+	undoMu    sync.Mutex
+	undoStack []UndoEntry // Oldest first
+	undoNext  int64
+)
+
+func undoDir() string {
+	return filepath.Join(stateDir, "undo")
+}
+
+func undoStackPath() string {
+	return filepath.Join(undoDir(), "stack.json")
+}
+
+func loadUndoStack() error {
+	if err := os.MkdirAll(undoDir(), 0755); err != nil {
+		return fmt.Errorf("failed to create undo directory: %v", err)
+	}
+	data, err := os.ReadFile(undoStackPath())
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if err := json.Unmarshal(data, &undoStack); err != nil {
+		return fmt.Errorf("failed to decode %s: %v", undoStackPath(), err)
+	}
+	for _, entry := range undoStack {
+		if entry.ID >= undoNext {
+			undoNext = entry.ID + 1
+		}
+	}
+	return nil
+}
+
+// Persist the stack (caller must hold undoMu)
+func saveUndoStack() {
+	data, _ := json.MarshalIndent(undoStack, "", "  ")
+	tmp := undoStackPath() + ".tmp"
+	if err := os.WriteFile(tmp, data, 0644); err != nil {
+		logFor("undo").Error("failed to save undo stack", "err", err)
+		return
+	}
+	os.Rename(tmp, undoStackPath())
+}
+
+// Reserve a directory for the backups of a new operation
+func newUndoBackupDir() (string, error) {
+	return os.MkdirTemp(undoDir(), "op-*")
+}
+
+// Keep a copy of a file's current content in backupDir before it is modified
+func backupFile(backupDir, path string) (string, error) {
+	src, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer src.Close()
+	dst, err := os.CreateTemp(backupDir, filepath.Base(path)+".*")
+	if err != nil {
+		return "", err
+	}
+	defer dst.Close()
+	if _, err := io.Copy(dst, src); err != nil {
+		os.Remove(dst.Name())
+		return "", err
+	}
+	if info, err := src.Stat(); err == nil {
+		os.Chtimes(dst.Name(), info.ModTime(), info.ModTime())
+	}
+	return dst.Name(), nil
+}
+
+// Rename a file, falling back to copy and remove across filesystems
+func moveFile(src, dst string) error {
+	err := os.Rename(src, dst)
+	if err == nil || !errors.Is(err, syscall.EXDEV) {
+		return err
+	}
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	info, err := in.Stat()
+	if err != nil {
+		return err
+	}
+	tmp := dst + ".moving"
+	out, err := os.OpenFile(tmp, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, info.Mode().Perm())
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(out, in); err != nil {
+		out.Close()
+		os.Remove(tmp)
+		return err
+	}
+	if err := out.Close(); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	os.Chtimes(tmp, info.ModTime(), info.ModTime())
+	if err := os.Rename(tmp, dst); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	return os.Remove(src)
+}
+
+// Push a completed operation onto the stack, dropping the oldest entries
+// (and their backups) beyond -undo-depth
+func pushUndo(op, description string, changes []FileChange) UndoEntry {
+	undoMu.Lock()
+	defer undoMu.Unlock()
+	entry := UndoEntry{ID: undoNext, Time: time.Now(), Op: op, Description: description, Changes: changes}
+	undoNext++
+	undoStack = append(undoStack, entry)
+	for len(undoStack) > undoDepth {
+		discardUndoEntry(undoStack[0])
+		undoStack = undoStack[1:]
+	}
+	saveUndoStack()
+	return entry
+}
+
+func discardUndoEntry(entry UndoEntry) {
+	for _, change := range entry.Changes {
+		if change.Backup != "" {
+			os.Remove(change.Backup)
+			os.Remove(filepath.Dir(change.Backup)) // Only succeeds once the op dir is empty
+		}
+	}
+}
+
+// Put back one file changed by an operation. A change half put back (moved
+// back but its content not restored) is updated to say what is left.
+func revertChange(change *FileChange) error {
+	if change.MovedFrom != "" {
+		if _, err := os.Stat(change.MovedFrom); err == nil {
+			return fmt.Errorf("cannot move %s back: %s already exists", change.Path, change.MovedFrom)
+		}
+		if err := os.MkdirAll(filepath.Dir(change.MovedFrom), 0755); err != nil {
+			return err
+		}
+		if err := moveFile(change.Path, change.MovedFrom); err != nil {
+			return err
+		}
+		recordAction(change.MovedFrom, actionRestored, -1, "moved back from "+change.Path)
+		if change.TrashInfo != "" {
+			os.Remove(change.TrashInfo)
+		}
+		change.Path, change.MovedFrom, change.TrashInfo = change.MovedFrom, "", ""
+	}
+	if change.Backup != "" {
+		if err := moveFile(change.Backup, change.Path); err != nil {
+			return err
+		}
+		recordAction(change.Path, actionRestored, -1, "original content restored")
+		change.Backup = ""
+	}
+	return nil
+}
+
+// Revert an operation's changes, last change first. If one fails, entry is
+// left with just the changes still to be put back, so retrying carries on
+// where this stopped rather than tripping over what is already back.
+func revertUndoEntry(entry *UndoEntry) error {
+	all := slices.Clone(entry.Changes)
+	for i := len(entry.Changes) - 1; i >= 0; i-- {
+		if err := revertChange(&entry.Changes[i]); err != nil {
+			return err
+		}
+		entry.Changes = entry.Changes[:i]
+	}
+	discardUndoEntry(UndoEntry{Changes: all})
+	return nil
+}
+
+// Roll back the entry at pos and take it off the stack (caller must hold
+// undoMu). On failure the entry stays, with what was put back taken out.
+func undoAt(pos int) (UndoEntry, error) {
+	entry := undoStack[pos]
+	entry.Changes = slices.Clone(entry.Changes)
+	if err := revertUndoEntry(&entry); err != nil {
+		logFor("undo").Error("failed to undo", "op", entry.Op, "id", entry.ID, "err", err, "left", len(entry.Changes))
+		undoStack[pos] = entry
+		saveUndoStack()
+		return entry, err
+	}
+	entry.Changes = undoStack[pos].Changes // As it was, for the caller
+	undoStack = append(undoStack[:pos], undoStack[pos+1:]...)
+	saveUndoStack()
+	logFor("undo").Info("rolled back", "op", entry.Op, "id", entry.ID, "description", entry.Description)
+	return entry, nil
+}
+
+// GET lists the undo stack (newest first); POST {"id": N} rolls back one entry
+func undoStackHandler(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case "GET":
+		undoMu.Lock()
+		entries := make([]UndoEntry, 0, len(undoStack))
+		for i := len(undoStack) - 1; i >= 0; i-- {
+			entries = append(entries, undoStack[i])
+		}
+		undoMu.Unlock()
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(entries)
+	case "POST":
+		var req struct {
+			ID int64 `json:"id"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, "Invalid JSON", 400)
+			return
+		}
+
+		undoMu.Lock()
+		defer undoMu.Unlock()
+		pos := -1
+		for i, entry := range undoStack {
+			if entry.ID == req.ID {
+				pos = i
+			}
+		}
+		if pos == -1 {
+			http.Error(w, "No undo entry "+strconv.FormatInt(req.ID, 10), 404)
+			return
+		}
+		entry, err := undoAt(pos)
+		if err != nil {
+			http.Error(w, "Undo failed: "+err.Error(), 409)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"success": true,
+			"undone":  entry,
+		})
+	default:
+		http.Error(w, "Method not allowed", 405)
+	}
+}
+
+// POST /api/undo rolls back the most recent operation on the undo stack
+func undoHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		http.Error(w, "Method not allowed", 405)
+		return
+	}
+	undoMu.Lock()
+	defer undoMu.Unlock()
+	if len(undoStack) == 0 {
+		http.Error(w, "Nothing to undo", 404)
+		return
+	}
+	entry, err := undoAt(len(undoStack) - 1)
+	if err != nil {
+		http.Error(w, "Undo failed: "+err.Error(), 409)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"success": true,
+		"undone":  entry,
+	})
+}
+
+// A removed file that can still be put back
+type Restorable struct {
+	Path      string    `json:"path"`       // Where it was
+	TrashPath string    `json:"trash_path"` // Where it is now
+	Time      time.Time `json:"time"`
+	Op        string    `json:"op"`
+	UndoID    int64     `json:"undo_id"`
+}
+
+// Trashed files on the undo stack, newest first (caller must hold undoMu)
+func restorableFiles() []Restorable {
+	files := []Restorable{}
+	for i := len(undoStack) - 1; i >= 0; i-- {
+		entry := undoStack[i]
+		for _, change := range entry.Changes {
+			if change.MovedFrom != "" && change.Backup == "" {
+				files = append(files, Restorable{Path: change.MovedFrom, TrashPath: change.Path, Time: entry.Time, Op: entry.Op, UndoID: entry.ID})
+			}
+		}
+	}
+	return files
+}
+
+// GET /api/restore lists trashed files that can be put back. POST
+// {"path": P} puts back the most recently trashed file that was at P,
+// leaving the rest of its operation on the undo stack.
+func restoreHandler(w http.ResponseWriter, r *http.Request) {
+	undoMu.Lock()
+	defer undoMu.Unlock()
+	switch r.Method {
+	case "GET":
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(restorableFiles())
+	case "POST":
+		var req struct {
+			Path string `json:"path"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.Path == "" {
+			http.Error(w, "Invalid JSON", 400)
+			return
+		}
+		path := filepath.Clean(req.Path)
+		for _, file := range restorableFiles() {
+			if file.Path != path {
+				continue
+			}
+			pos := slices.IndexFunc(undoStack, func(e UndoEntry) bool { return e.ID == file.UndoID })
+			entry := &undoStack[pos]
+			j := slices.IndexFunc(entry.Changes, func(c FileChange) bool { return c.MovedFrom == path && c.Backup == "" })
+			change := entry.Changes[j]
+			if err := revertChange(&change); err != nil {
+				reqLog(r, "undo").Error("failed to restore file", "path", path, "err", err)
+				http.Error(w, "Restore failed: "+err.Error(), 409)
+				return
+			}
+			entry.Changes = slices.Delete(entry.Changes, j, j+1)
+			if len(entry.Changes) == 0 {
+				undoStack = slices.Delete(undoStack, pos, pos+1)
+			}
+			saveUndoStack()
+			reqLog(r, "undo").Info("restored file", "path", path, "from", file.TrashPath)
+			w.Header().Set("Content-Type", "application/json")
+			json.NewEncoder(w).Encode(map[string]interface{}{
+				"success":  true,
+				"restored": file,
+			})
+			return
+		}
+		http.Error(w, "No trashed file was at "+path, 404)
+	default:
+		http.Error(w, "Method not allowed", 405)
+	}
+}
@@ -0,0 +1,227 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"io/fs"
+	"math/rand"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+)
+
+const (
+	validateWorkers  = 16 // Parallel checks, to hide network filesystem latency
+	validateExamples = 20 // Paths listed per problem in the report
+)
+
+var (
+	validateMode   string // -validate: none, sample or all
+	validateSample int    // -validate-sample
+	dropMissing    bool   // -drop-missing
+)
+
+// Result of checking the files referenced by the duplicates file
+type ValidationReport struct {
+	Running         bool       `json:"running"`
+	Mode            string     `json:"mode"`
+	Total           int        `json:"total"`   // Distinct paths in the groups
+	Checked         int        `json:"checked"` // Less than total when sampling
+	Missing         int        `json:"missing"`
+	Unreadable      int        `json:"unreadable"`
+	MissingDirs     []string   `json:"missing_dirs"`     // Directories that are gone altogether
+	UnreadableDirs  []string   `json:"unreadable_dirs"`  // Directories we may not read
+	MissingFiles    []string   `json:"missing_files"`    // First few missing paths
+	UnreadableFiles []string   `json:"unreadable_files"` // First few unreadable paths
+	Dropped         bool       `json:"dropped"`          // Missing entries are hidden from the groups
+	Started         time.Time  `json:"started"`
+	Finished        *time.Time `json:"finished,omitempty"`
+}
+
+var (
+	validationMu sync.Mutex
+	validation   ValidationReport
+)
+
+// Groups with some entries hidden, e.g. files found missing on load. Group
+// indexes stay the same, only members are dropped.
+type filteredGroups struct {
+	groupStore
+	hidden map[string]bool
+}
+
+func (f *filteredGroups) Group(idx int) ([]Image, error) {
+	group, err := f.groupStore.Group(idx)
+	if err != nil {
+		return nil, err
+	}
+	kept := make([]Image, 0, len(group))
+	for _, img := range group {
+		if !f.hidden[img.Path] {
+			kept = append(kept, img)
+		}
+	}
+	return kept, nil
+}
+
+func (f *filteredGroups) Close() error {
+	if closer, ok := f.groupStore.(io.Closer); ok {
+		return closer.Close()
+	}
+	return nil
+}
+
+// Check that the files referenced by the loaded groups exist and can be
+// read, a random sample of them or all, and optionally hide missing ones
+func validateGroups(mode string) ValidationReport {
+	report := ValidationReport{Running: true, Mode: mode, Started: time.Now(),
+		MissingDirs: []string{}, UnreadableDirs: []string{}, MissingFiles: []string{}, UnreadableFiles: []string{}}
+	validationMu.Lock()
+	validation = report
+	validationMu.Unlock()
+
+	// Only this snapshot of the groups is checked, so a workspace switch or
+	// reload meanwhile doesn't mix datasets
+	groupsMu.RLock()
+	store, gen := groups, groupsGen
+	release := retainGroups(store)
+	groupsMu.RUnlock()
+	defer release()
+	seen := make(map[string]bool)
+	var paths []string
+	for idx := 0; idx < store.Len(); idx++ {
+		group, err := store.Group(idx)
+		if err != nil {
+			continue
+		}
+		for _, img := range group {
+			if !seen[img.Path] {
+				seen[img.Path] = true
+				paths = append(paths, img.Path)
+			}
+		}
+	}
+	report.Total = len(paths)
+	if mode == "sample" && len(paths) > validateSample {
+		rand.Shuffle(len(paths), func(i, j int) { paths[i], paths[j] = paths[j], paths[i] })
+		paths = paths[:validateSample]
+	}
+	report.Checked = len(paths)
+
+	// Each path is checked once by one of the workers
+	var mu sync.Mutex
+	missing := make(map[string]bool)
+	missingDirs := make(map[string]bool)
+	unreadableDirs := make(map[string]bool)
+	jobs := make(chan string)
+	var wg sync.WaitGroup
+	for i := 0; i < validateWorkers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for path := range jobs {
+				f, err := os.Open(path)
+				if err == nil {
+					f.Close()
+					continue
+				}
+				mu.Lock()
+				dir := filepath.Dir(path)
+				if errors.Is(err, fs.ErrNotExist) {
+					missing[path] = true
+					report.Missing++
+					if len(report.MissingFiles) < validateExamples {
+						report.MissingFiles = append(report.MissingFiles, path)
+					}
+					if _, err := os.Stat(dir); errors.Is(err, fs.ErrNotExist) {
+						missingDirs[dir] = true
+					}
+				} else {
+					report.Unreadable++
+					if len(report.UnreadableFiles) < validateExamples {
+						report.UnreadableFiles = append(report.UnreadableFiles, path)
+					}
+					if _, err := os.ReadDir(dir); err != nil {
+						unreadableDirs[dir] = true
+					}
+				}
+				mu.Unlock()
+			}
+		}()
+	}
+	for _, path := range paths {
+		waitForBackgroundSlot("validation")
+		jobs <- path
+	}
+	close(jobs)
+	wg.Wait()
+
+	for dir := range missingDirs {
+		report.MissingDirs = append(report.MissingDirs, dir)
+	}
+	for dir := range unreadableDirs {
+		report.UnreadableDirs = append(report.UnreadableDirs, dir)
+	}
+	sort.Strings(report.MissingDirs)
+	sort.Strings(report.UnreadableDirs)
+
+	if dropMissing && len(missing) > 0 {
+		groupsMu.Lock()
+		if groupsGen == gen { // Unless the groups were replaced meanwhile
+			groups = &filteredGroups{groupStore: store, hidden: missing}
+			groupsGen++
+			report.Dropped = true
+		}
+		groupsMu.Unlock()
+	}
+
+	finished := time.Now()
+	report.Finished = &finished
+	report.Running = false
+	validationMu.Lock()
+	validation = report
+	validationMu.Unlock()
+	logFor("validate").Info("validated referenced files", "checked", report.Checked, "total", report.Total,
+		"took", finished.Sub(report.Started).Round(time.Millisecond).String(), "missing", report.Missing, "unreadable", report.Unreadable)
+	return report
+}
+
+// GET shows the last validation report; POST {"mode": "all"|"sample"} runs a new one
+func validationHandler(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case "GET":
+	case "POST":
+		var req struct {
+			Mode string `json:"mode"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil || (req.Mode != "all" && req.Mode != "sample") {
+			http.Error(w, `mode must be "all" or "sample"`, 400)
+			return
+		}
+		validationMu.Lock()
+		if validation.Running {
+			validationMu.Unlock()
+			http.Error(w, "Validation already running", 409)
+			return
+		}
+		validation.Running = true
+		validationMu.Unlock()
+		go validateGroups(req.Mode)
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(202)
+		json.NewEncoder(w).Encode(map[string]interface{}{"running": true, "mode": req.Mode})
+		return
+	default:
+		http.Error(w, "Method not allowed", 405)
+		return
+	}
+	validationMu.Lock()
+	report := validation
+	validationMu.Unlock()
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(report)
+}
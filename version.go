@@ -0,0 +1,162 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os/exec"
+	"runtime"
+	"runtime/debug"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// Set at build time with -ldflags "-X main.version=1.2.3"
+var version = "dev"
+
+// Fields of one entry in czkawka's similar-images export (schema 1)
+var knownImageFields = map[string]bool{
+	"path": true, "size": true, "width": true, "height": true,
+	"modified_date": true, "hash": true, "similarity": true,
+	"original": true, // Converted from rmlint or dupeGuru
+}
+
+// What we could tell about the loaded duplicates file
+type DatasetFormat struct {
+	File          string   `json:"file"`
+	Format        string   `json:"format"`
+	Compression   string   `json:"compression,omitempty"`
+	Schema        int      `json:"schema"` // 0 when unknown
+	UnknownFields []string `json:"unknown_fields,omitempty"`
+	Warning       string   `json:"warning,omitempty"`
+}
+
+var (
+	datasetMu     sync.Mutex
+	datasetFormat DatasetFormat
+)
+
+// Inspect the first group of a duplicates file to find out which czkawka schema wrote it
+func detectFormat(path string) DatasetFormat {
+	format := DatasetFormat{File: path, Format: "czkawka-similar-images", Compression: duplicatesCompression(path)}
+	if converted := convertedFormat(path); converted != "" {
+		format.Format = converted
+	}
+
+	f, err := openDuplicatesFile(path)
+	if err != nil {
+		format.Warning = err.Error()
+		return format
+	}
+	defer f.Close()
+	dec := json.NewDecoder(f)
+	var items []json.RawMessage
+	if tok, err := dec.Token(); err != nil || tok != json.Delim('[') {
+		format.Format = "unknown"
+		format.Warning = "not a czkawka similar-images export (expected an array of groups)"
+		return format
+	}
+	if !dec.More() {
+		format.Schema = supportedSchema // Empty, nothing to disagree with
+		return format
+	}
+	if err := dec.Decode(&items); err != nil {
+		format.Format = "unknown"
+		format.Warning = "not a czkawka similar-images export (expected an array of groups)"
+		return format
+	}
+	schema, err := groupSchema(items)
+	if err != nil {
+		format.Format = "unknown"
+		format.Warning = err.Error()
+		return format
+	}
+	if len(items) == 0 {
+		format.Schema = schema.Version
+		return format
+	}
+	if _, err := schema.decode(items); err != nil {
+		format.Warning = err.Error()
+		return format
+	}
+
+	var first map[string]json.RawMessage
+	json.Unmarshal(items[0], &first)
+	for field := range first {
+		if !knownImageFields[field] {
+			format.UnknownFields = append(format.UnknownFields, field)
+		}
+	}
+	sort.Strings(format.UnknownFields)
+	if len(format.UnknownFields) > 0 {
+		format.Schema = supportedSchema + 1
+		format.Warning = fmt.Sprintf("file looks newer than this build understands (unknown fields: %s); some information will be ignored", strings.Join(format.UnknownFields, ", "))
+	} else {
+		format.Schema = schema.Version
+	}
+	return format
+}
+
+// Record the format of a newly loaded duplicates file, warning loudly about surprises
+func setDatasetFormat(format DatasetFormat) {
+	datasetMu.Lock()
+	datasetFormat = format
+	datasetMu.Unlock()
+	if format.Warning != "" {
+		logFor("groups").Warn(format.Warning, "file", format.File)
+	}
+}
+
+func buildInfo() map[string]string {
+	info := map[string]string{
+		"version": version,
+		"go":      runtime.Version(),
+	}
+	if bi, ok := debug.ReadBuildInfo(); ok {
+		for _, setting := range bi.Settings {
+			switch setting.Key {
+			case "vcs.revision", "vcs.time", "vcs.modified":
+				info[setting.Key] = setting.Value
+			}
+		}
+	}
+	return info
+}
+
+func commandAvailable(names ...string) bool {
+	for _, name := range names {
+		if _, err := exec.LookPath(name); err == nil {
+			return true
+		}
+	}
+	return false
+}
+
+func versionHandler(w http.ResponseWriter, r *http.Request) {
+	datasetMu.Lock()
+	dataset := datasetFormat
+	datasetMu.Unlock()
+
+	resp := map[string]interface{}{
+		"build": buildInfo(),
+		"features": map[string]interface{}{
+			"scan":            commandAvailable(czkawkaCmd),
+			"raw_conversion":  commandAvailable("magick", "convert"),
+			"video_metadata":  commandAvailable("ffprobe"),
+			"metadata_merge":  commandAvailable("exiftool"),
+			"read_only_roots": readOnlyRoots,
+			"read_only":       readOnlyMode,
+			"lazy_groups":     lazyGroups,
+			"compression":     []string{"gzip", "zstd"},
+			"undo_depth":      undoDepth,
+			"exit_after_idle": exitAfterIdle.String(),
+			"block_dedupe":    blockDedupeAvailable(),
+		},
+		"supported_schema":  supportedSchema,
+		"supported_schemas": czkawkaSchemas,
+		"dataset":           dataset,
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(resp)
+}
@@ -0,0 +1,214 @@
+package main
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+)
+
+// Action of a DeletedEvent for a file removed or renamed outside the tool
+const removedExternally = "external"
+
+var watchFiles bool // -watch
+
+var (
+	watchMu     sync.Mutex
+	watcher     *fsnotify.Watcher
+	watchedDirs = make(map[string]bool)
+
+	goneMu sync.Mutex
+	gone   = make(map[string]bool) // Group members removed or renamed outside the tool, until they come back
+
+	pathIndexMu  sync.Mutex
+	pathIndex    map[string]pathEntry
+	pathIndexGen = -1
+)
+
+type pathEntry struct {
+	idx  int
+	size int64
+}
+
+// Every group member by path, rebuilt when the groups are replaced
+func groupMembers() map[string]pathEntry {
+	groupsMu.RLock()
+	store, gen := groups, groupsGen
+	release := retainGroups(store)
+	groupsMu.RUnlock()
+	defer release()
+
+	pathIndexMu.Lock()
+	defer pathIndexMu.Unlock()
+	if pathIndexGen != gen {
+		pathIndex = make(map[string]pathEntry)
+		for idx := 0; idx < store.Len(); idx++ {
+			group, err := store.Group(idx)
+			if err != nil {
+				continue
+			}
+			for _, img := range group {
+				pathIndex[filepath.Clean(img.Path)] = pathEntry{idx: idx, size: img.Size}
+			}
+		}
+		pathIndexGen = gen
+	}
+	return pathIndex
+}
+
+// Whether the watcher saw a file go. Only a hint: a file that isn't marked
+// may still be gone, so callers check the disk as well.
+func fileGone(path string) bool {
+	goneMu.Lock()
+	defer goneMu.Unlock()
+	return gone[filepath.Clean(path)]
+}
+
+// Whether the tool itself just deleted, trashed or moved a file, so its
+// removal showing up on the watcher isn't announced twice
+func removedByTool(path string) bool {
+	last, ok := lastAction(path)
+	if !ok {
+		return false
+	}
+	switch last.Action {
+	case actionDeleted, actionTrashed, actionQuarantined, actionHardlinked:
+		return time.Since(last.Time) < time.Minute
+	}
+	return false
+}
+
+// Mark the group members at or below path gone and tell the event streams
+func markGone(path string, dir bool) {
+	members := groupMembers()
+	var removed []string
+	if _, ok := members[path]; ok {
+		removed = append(removed, path)
+	}
+	if dir {
+		for p := range members {
+			if p != path && isBelow(p, path) {
+				removed = append(removed, p)
+			}
+		}
+	}
+	for _, p := range removed {
+		goneMu.Lock()
+		already := gone[p]
+		gone[p] = true
+		goneMu.Unlock()
+		if already || removedByTool(p) {
+			continue
+		}
+		logFor("watch").Info("file removed outside the tool", "path", p, "group", members[p].idx)
+		publish(eventDeleted, DeletedEvent{Path: getRelativeImagePath(p), Size: members[p].size, Action: removedExternally})
+		scheduleWriteBack()
+	}
+}
+
+// Forget that the files at or below path were gone, now it is back
+func unmarkGone(path string) {
+	goneMu.Lock()
+	defer goneMu.Unlock()
+	for p := range gone {
+		if isBelow(p, path) {
+			delete(gone, p)
+		}
+	}
+}
+
+// Watch a directory and everything below it. Running out of watches (see
+// fs.inotify.max_user_watches on Linux) leaves the rest to the checks made
+// per request.
+func watchTree(w *fsnotify.Watcher, root string) {
+	err := filepath.WalkDir(root, func(path string, d os.DirEntry, err error) error {
+		if err != nil || !d.IsDir() {
+			return nil
+		}
+		if err := w.Add(path); err != nil {
+			return err
+		}
+		watchMu.Lock()
+		watchedDirs[path] = true
+		watchMu.Unlock()
+		return nil
+	})
+	if err != nil && !errors.Is(err, fsnotify.ErrClosed) {
+		logFor("watch").Warn("failed to watch the whole image root, files removed from the rest are only noticed when their group is shown", "root", root, "err", err)
+	}
+}
+
+func handleWatchEvent(w *fsnotify.Watcher, ev fsnotify.Event) {
+	path := filepath.Clean(ev.Name)
+	if ev.Has(fsnotify.Create) {
+		if info, err := os.Lstat(path); err == nil {
+			if info.IsDir() {
+				watchTree(w, path)
+			}
+			unmarkGone(path)
+		}
+		return
+	}
+	if !ev.Has(fsnotify.Remove) && !ev.Has(fsnotify.Rename) {
+		return
+	}
+	if _, err := os.Lstat(path); err == nil {
+		return // Replaced already, e.g. saved by renaming a temp file over it
+	}
+	watchMu.Lock()
+	dir := watchedDirs[path]
+	delete(watchedDirs, path)
+	watchMu.Unlock()
+	markGone(path, dir)
+}
+
+// With -watch, follow the image root for files deleted or renamed outside
+// the tool
+func startWatcher() {
+	if !watchFiles || imageRoot == "" {
+		return
+	}
+	w, err := fsnotify.NewWatcher()
+	if err != nil {
+		logFor("watch").Warn("failed to watch the image root", "err", err)
+		return
+	}
+	watchMu.Lock()
+	watcher = w
+	watchMu.Unlock()
+	root := filepath.Clean(imageRoot)
+	go watchTree(w, root) // Takes a while on a big library
+	go func() {
+		for {
+			select {
+			case ev, ok := <-w.Events:
+				if !ok {
+					return
+				}
+				handleWatchEvent(w, ev)
+			case err, ok := <-w.Errors:
+				if !ok {
+					return
+				}
+				logFor("watch").Warn("watch error", "err", err)
+			}
+		}
+	}()
+	logFor("watch").Info("watching the image root", "root", root)
+}
+
+func stopWatcher() {
+	watchMu.Lock()
+	if watcher != nil {
+		watcher.Close()
+		watcher = nil
+	}
+	watchedDirs = make(map[string]bool)
+	watchMu.Unlock()
+	goneMu.Lock()
+	gone = make(map[string]bool)
+	goneMu.Unlock()
+}
@@ -0,0 +1,269 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"sync"
+)
+
+// One dataset the server can review: its own library, duplicates file and
+// state directory (history, undo stack, staged decisions, queues, budget...).
+// Without -workspaces there is just one, made from the command line flags.
+type Workspace struct {
+	Name       string          `json:"name"`
+	ImagePath  string          `json:"imagepath"`
+	Duplicates string          `json:"duplicates"`
+	StateDir   string          `json:"state_dir,omitempty"` // Default: the duplicates file's directory
+	ReadOnly   string          `json:"readonly,omitempty"`  // As for -readonly
+	Rules      json.RawMessage `json:"rules,omitempty"`     // ScoringRules overriding the built-in ones
+}
+
+// The scoring rules workspaces start from
+var builtinScoringRules = defaultScoringRules
+
+var (
+	workspacesFile  string // -workspaces
+	workspaces      []Workspace
+	activeWorkspace int
+	// Every request holds this for reading, so switching workspaces waits
+	// for requests in flight and no request sees a half-switched dataset
+	workspaceMu sync.RWMutex
+)
+
+// Read the workspaces from -workspaces, or make the single one the flags describe
+func loadWorkspaces() error {
+	if workspacesFile == "" {
+		workspaces = []Workspace{{Name: "default", ImagePath: imageRoot, Duplicates: duplicatesFile, StateDir: stateDir, ReadOnly: readOnlyFlag}}
+		return nil
+	}
+	data, err := os.ReadFile(workspacesFile)
+	if err != nil {
+		return fmt.Errorf("failed to read workspaces: %v", err)
+	}
+	var loaded []Workspace
+	if err := json.Unmarshal(data, &loaded); err != nil {
+		return fmt.Errorf("failed to decode %s: %v", workspacesFile, err)
+	}
+	if len(loaded) == 0 {
+		return fmt.Errorf("%s lists no workspaces", workspacesFile)
+	}
+	seen := make(map[string]bool)
+	for _, ws := range loaded {
+		if ws.Name == "" || ws.ImagePath == "" || ws.Duplicates == "" {
+			return fmt.Errorf("every workspace in %s needs a name, imagepath and duplicates", workspacesFile)
+		}
+		if seen[ws.Name] {
+			return fmt.Errorf("workspace %s is listed twice in %s", ws.Name, workspacesFile)
+		}
+		seen[ws.Name] = true
+		rules := builtinScoringRules
+		if len(ws.Rules) > 0 && json.Unmarshal(ws.Rules, &rules) != nil {
+			return fmt.Errorf("workspace %s has invalid rules", ws.Name)
+		}
+	}
+	workspaces = loaded
+	return nil
+}
+
+// Point the dataset globals at a workspace
+func (ws Workspace) apply() {
+	imageRoot = ws.ImagePath
+	duplicatesFile = ws.Duplicates
+	stateDir = ws.StateDir
+	if stateDir == "" {
+		stateDir = duplicatesDir(duplicatesFile)
+	}
+	readOnlyFlag = ws.ReadOnly
+	readOnlyRoots = nil
+	parseReadOnlyRoots(readOnlyFlag)
+	defaultScoringRules = builtinScoringRules
+	if len(ws.Rules) > 0 {
+		json.Unmarshal(ws.Rules, &defaultScoringRules) // Checked by loadWorkspaces
+	}
+}
+
+// Open the state of the dataset the globals point at and load its groups
+func openDataset() error {
+	if err := acquireInstanceLock(duplicatesFile); err != nil {
+		return err
+	}
+	// The history is indexed in the state database, so that goes first
+	err := openStateDB()
+	if err == nil {
+		err = openHistory()
+	}
+	if err == nil {
+		err = openAuditLog()
+	}
+	if err == nil {
+		err = openJournal()
+	}
+	if err == nil {
+		err = loadUndoStack()
+	}
+	if err == nil {
+		var loaded groupStore
+		if loaded, err = openGroups(duplicatesFile); err == nil {
+			setGroups(loaded)
+			logFor("groups").Info("loaded groups", "groups", loaded.Len(), "file", duplicatesFile)
+		}
+	}
+	if err != nil {
+		resetDataset()
+		return err
+	}
+	startWatcher()
+	startStorageMonitor()
+	return nil
+}
+
+// Save and close the state of the open dataset
+func closeDataset() {
+	flushWriteBack()
+	undoMu.Lock()
+	saveUndoStack()
+	undoMu.Unlock()
+	resetDataset()
+}
+
+// Close the dataset's files and forget what was read from them, without
+// saving anything
+func resetDataset() {
+	stopWatcher()
+	stopStorageMonitor()
+	closeHistory()
+	closeAuditLog()
+	closeJournal()
+	closeStateDB()
+	resetBlockDedupe()
+	historyMu.Lock()
+	historySize, historyCount = 0, 0
+	historyMu.Unlock()
+	undoMu.Lock()
+	undoStack, undoNext = nil, 0
+	undoMu.Unlock()
+	exifFailuresMu.Lock()
+	exifFailures = make(map[string]exifFailureRecord)
+	exifFailuresMu.Unlock()
+	recentMu.Lock()
+	for _, d := range recentDeletions {
+		if d.thumbPath != "" {
+			os.Remove(d.thumbPath)
+		}
+	}
+	recentDeletions = nil
+	recentMu.Unlock()
+	releaseInstanceLock()
+}
+
+// Close the active workspace and open another, going back to the old one if
+// the new one can't be opened
+func switchWorkspace(idx int) error {
+	workspaceMu.Lock()
+	defer workspaceMu.Unlock()
+	if idx == activeWorkspace {
+		return nil
+	}
+	scanMu.Lock()
+	scanning := lastScan != nil && lastScan.Status == "running"
+	scanMu.Unlock()
+	if scanning {
+		return fmt.Errorf("a scan is running in workspace %s", workspaces[activeWorkspace].Name)
+	}
+
+	// A rescan may have replaced the duplicates file
+	workspaces[activeWorkspace].Duplicates = duplicatesFile
+	closeDataset()
+	workspaces[idx].apply()
+	if err := openDataset(); err != nil {
+		logFor("workspace").Error("failed to open workspace, staying in the current one", "workspace", workspaces[idx].Name, "current", workspaces[activeWorkspace].Name, "err", err)
+		workspaces[activeWorkspace].apply()
+		if err := openDataset(); err != nil {
+			fatal("failed to reopen workspace", "workspace", workspaces[activeWorkspace].Name, "err", err)
+		}
+		return err
+	}
+	activeWorkspace = idx
+	scanMu.Lock()
+	lastScan = nil
+	scanMu.Unlock()
+	logFor("workspace").Info("switched workspace", "workspace", workspaces[idx].Name)
+	if validateMode == "sample" || validateMode == "all" {
+		go validateGroups(validateMode)
+	}
+	resumeScan()
+	return nil
+}
+
+// Hold workspaceMu for reading while a request is served, except for the
+// request that switches workspaces and the event stream, which stays open
+// across switches
+func withWorkspace(next http.Handler) http.Handler {
+	unlocked := map[string]bool{
+		"/api/workspaces": true, apiV1 + "/workspaces": true,
+		"/api/events": true, apiV1 + "/events": true,
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !unlocked[r.URL.Path] {
+			workspaceMu.RLock()
+			defer workspaceMu.RUnlock()
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// GET lists the workspaces and which one is active. POST {"name": ...}
+// makes another one active; its groups, history and review state replace
+// the current one's, which stay on disk for when it is selected again.
+func workspacesHandler(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case "GET":
+	case "POST":
+		var req struct {
+			Name string `json:"name"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, "Invalid JSON", 400)
+			return
+		}
+		idx := -1
+		for i, ws := range workspaces {
+			if ws.Name == req.Name {
+				idx = i
+			}
+		}
+		if idx < 0 {
+			http.Error(w, "No workspace "+req.Name, 404)
+			return
+		}
+		if err := switchWorkspace(idx); err != nil {
+			http.Error(w, "Failed to switch workspace: "+err.Error(), 409)
+			return
+		}
+	default:
+		http.Error(w, "Method not allowed", 405)
+		return
+	}
+
+	workspaceMu.RLock()
+	defer workspaceMu.RUnlock()
+	type listed struct {
+		Workspace
+		Active bool `json:"active"`
+		Groups int  `json:"groups,omitempty"` // Only known for the active workspace
+	}
+	list := make([]listed, len(workspaces))
+	for i, ws := range workspaces {
+		list[i] = listed{Workspace: ws, Active: i == activeWorkspace}
+		if i == activeWorkspace {
+			list[i].Groups = currentGroups().Len()
+		}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"active":     workspaces[activeWorkspace].Name,
+		"workspaces": list,
+	})
+}
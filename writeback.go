@@ -0,0 +1,218 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Values of -write-back
+const (
+	writeBackRemaining = "remaining" // To <name>.remaining.json next to the duplicates file
+	writeBackInPlace   = "in-place"  // Over the duplicates file itself
+)
+
+// How long after a deletion the remaining duplicates are written, so a run
+// of deletions leads to one write
+const writeBackDelay = 2 * time.Second
+
+var writeBackMode string // -write-back
+
+var (
+	writeBackMu    sync.Mutex
+	writeBackTimer *time.Timer
+)
+
+// What writing the remaining duplicates did
+type WriteBackResult struct {
+	File   string `json:"file"`
+	Groups int    `json:"groups"`
+	Files  int    `json:"files"`
+}
+
+// The file the remaining duplicates of a duplicates file go to
+func remainingPath(path string) (string, error) {
+	base := filepath.Base(path)
+	ext := strings.ToLower(filepath.Ext(base))
+	if writeBackMode == writeBackInPlace {
+		if duplicatesCompression(path) != "" {
+			return "", fmt.Errorf("-write-back in-place needs an uncompressed duplicates file, not %s", base)
+		}
+		if converted := convertedFormat(path); converted != "" {
+			return "", fmt.Errorf("-write-back in-place needs a JSON duplicates file, not %s (%s)", base, converted)
+		}
+		return path, nil
+	}
+	if ext == ".gz" || ext == ".zst" {
+		base = base[:len(base)-len(ext)]
+	}
+	if ext := filepath.Ext(base); ext == ".json" || ext == ".txt" {
+		base = strings.TrimSuffix(base, ext)
+	}
+	base = strings.TrimSuffix(base, ".remaining")
+	return filepath.Join(filepath.Dir(path), base+".remaining.json"), nil
+}
+
+// Whether the last thing done to a file took it out of its group
+func removedLast(path string) bool {
+	last, ok := lastAction(path)
+	if !ok {
+		return false
+	}
+	switch last.Action {
+	case actionDeleted, actionTrashed, actionHardlinked, actionQuarantined:
+		return true
+	}
+	return false
+}
+
+// The loaded groups without the files deleted, trashed, hardlinked or
+// otherwise gone, and without the groups that leaves with fewer than two
+func remainingGroups() [][]Image {
+	store, release := acquireGroups()
+	defer release()
+	remaining := [][]Image{}
+	for idx := 0; idx < store.Len(); idx++ {
+		group, err := store.Group(idx)
+		if err != nil {
+			continue
+		}
+		var left []Image
+		for _, img := range group {
+			if _, err := os.Stat(img.Path); err != nil || fileGone(img.Path) || removedLast(img.Path) {
+				continue
+			}
+			left = append(left, img)
+		}
+		if len(left) > 1 {
+			remaining = append(remaining, left)
+		}
+	}
+	return remaining
+}
+
+// Write the remaining duplicates in czkawka's format, through a temp file so
+// a crash never leaves half a file behind
+func writeRemaining() (WriteBackResult, error) {
+	datasetMu.Lock()
+	source := datasetFormat.File
+	datasetMu.Unlock()
+	path, err := remainingPath(source)
+	if err != nil {
+		return WriteBackResult{}, err
+	}
+	remaining := remainingGroups()
+	result := WriteBackResult{File: path, Groups: len(remaining)}
+	for _, group := range remaining {
+		result.Files += len(group)
+	}
+
+	tmp, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".tmp-*")
+	if err != nil {
+		return result, err
+	}
+	out := bufio.NewWriter(tmp)
+	err = json.NewEncoder(out).Encode(remaining)
+	if err == nil {
+		err = out.Flush()
+	}
+	if err == nil {
+		err = tmp.Sync()
+	}
+	if cerr := tmp.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Rename(tmp.Name(), path)
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
+		return result, err
+	}
+	logFor("groups").Info("wrote remaining duplicates", "file", path, "groups", result.Groups, "files", result.Files)
+	return result, nil
+}
+
+// With -write-back, write the remaining duplicates shortly after a file is
+// removed from its group
+func scheduleWriteBack() {
+	if writeBackMode == "" {
+		return
+	}
+	writeBackMu.Lock()
+	defer writeBackMu.Unlock()
+	if writeBackTimer != nil {
+		return // Already due
+	}
+	var timer *time.Timer
+	timer = time.AfterFunc(writeBackDelay, func() {
+		// Like a request, hold the workspace while writing so a switch
+		// can't change the dataset underneath
+		workspaceMu.RLock()
+		defer workspaceMu.RUnlock()
+		writeBackMu.Lock()
+		mine := writeBackTimer == timer
+		if mine {
+			writeBackTimer = nil
+		}
+		writeBackMu.Unlock()
+		if !mine {
+			return // Flushed meanwhile, e.g. when the dataset was closed
+		}
+		if _, err := writeRemaining(); err != nil {
+			logFor("groups").Error("failed to write remaining duplicates", "err", err)
+		}
+	})
+	writeBackTimer = timer
+}
+
+// Write the remaining duplicates now if a write is due, e.g. before the
+// dataset is closed. A timer that has fired but not yet started writing
+// leaves the write to this.
+func flushWriteBack() {
+	writeBackMu.Lock()
+	due := writeBackTimer != nil
+	if due {
+		writeBackTimer.Stop()
+	}
+	writeBackTimer = nil
+	writeBackMu.Unlock()
+	if due {
+		if _, err := writeRemaining(); err != nil {
+			logFor("groups").Error("failed to write remaining duplicates", "err", err)
+		}
+	}
+}
+
+// POST /api/write-back writes the remaining duplicates now rather than after
+// the next deletion
+func writeBackHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		http.Error(w, "Method not allowed", 405)
+		return
+	}
+	if writeBackMode == "" {
+		http.Error(w, "Start with -write-back remaining or -write-back in-place to write the remaining duplicates", 409)
+		return
+	}
+	writeBackMu.Lock()
+	if writeBackTimer != nil {
+		writeBackTimer.Stop()
+		writeBackTimer = nil
+	}
+	writeBackMu.Unlock()
+	result, err := writeRemaining()
+	if err != nil {
+		reqLog(r, "groups").Error("failed to write remaining duplicates", "err", err)
+		http.Error(w, "Failed to write remaining duplicates: "+err.Error(), 500)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(result)
+}
@@ -0,0 +1,131 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// With -xdg-trash, deleting a file moves it to the desktop trash following
+// the freedesktop.org Trash specification, so file managers and tools like
+// gio trash can list and restore it
+var xdgTrash bool
+
+// The home trash, $XDG_DATA_HOME/Trash
+func xdgHomeTrash() (string, error) {
+	if data := os.Getenv("XDG_DATA_HOME"); data != "" {
+		return filepath.Join(data, "Trash"), nil
+	}
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(home, ".local", "share", "Trash"), nil
+}
+
+// The mount point holding path: the last ancestor on the same device
+func mountPoint(path string) (string, error) {
+	dev, err := deviceOf(path)
+	if err != nil {
+		return "", err
+	}
+	dir := path
+	for {
+		parent := filepath.Dir(dir)
+		if parent == dir {
+			return dir, nil
+		}
+		if d, err := deviceOf(parent); err != nil || d != dev {
+			return dir, nil
+		}
+		dir = parent
+	}
+}
+
+// The trash directory for a file and the path to record for it in the
+// .trashinfo file. Files on the home trash's device go to the home trash,
+// recorded by absolute path; others go to $topdir/.Trash/$uid if an
+// administrator set up a sticky .Trash there, or else to $topdir/.Trash-$uid,
+// recorded relative to $topdir. src is where the file is now, path where it
+// was found.
+func xdgTrashFor(src, path string) (trash, infoPath string, err error) {
+	home, err := xdgHomeTrash()
+	if err != nil {
+		return "", "", err
+	}
+	if err := os.MkdirAll(home, 0700); err != nil {
+		return "", "", err
+	}
+	fileDev, err := deviceOf(src)
+	if err != nil {
+		return "", "", err
+	}
+	if homeDev, err := deviceOf(home); err == nil && homeDev == fileDev {
+		return home, path, nil
+	}
+
+	top, err := mountPoint(src)
+	if err != nil {
+		return "", "", err
+	}
+	rel, err := filepath.Rel(top, path)
+	if err != nil || strings.HasPrefix(rel, "..") {
+		rel = path
+	}
+	uid := strconv.Itoa(os.Getuid())
+	shared := filepath.Join(top, ".Trash")
+	if info, err := os.Lstat(shared); err == nil && info.IsDir() && info.Mode()&os.ModeSticky != 0 {
+		trash = filepath.Join(shared, uid)
+		if err := os.MkdirAll(trash, 0700); err == nil {
+			return trash, rel, nil
+		}
+	}
+	trash = filepath.Join(top, ".Trash-"+uid)
+	if err := os.MkdirAll(trash, 0700); err != nil {
+		return "", "", fmt.Errorf("no usable trash on %s: %v", top, err)
+	}
+	return trash, rel, nil
+}
+
+// Pick a free name in the trash by creating its .trashinfo file, which the
+// spec uses to claim the name. Returns where the file itself must go.
+func reserveXDGTrashName(trash, infoPath string) (dst, info string, err error) {
+	for _, dir := range []string{"files", "info"} {
+		if err := os.MkdirAll(filepath.Join(trash, dir), 0700); err != nil {
+			return "", "", err
+		}
+	}
+	content := fmt.Sprintf("[Trash Info]\nPath=%s\nDeletionDate=%s\n",
+		(&url.URL{Path: infoPath}).EscapedPath(), time.Now().Format("2006-01-02T15:04:05"))
+	base := filepath.Base(infoPath)
+	ext := filepath.Ext(base)
+	for n := 1; n < 1000; n++ {
+		name := base
+		if n > 1 {
+			name = fmt.Sprintf("%s.%d%s", strings.TrimSuffix(base, ext), n, ext)
+		}
+		info = filepath.Join(trash, "info", name+".trashinfo")
+		f, err := os.OpenFile(info, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0600)
+		if errors.Is(err, os.ErrExist) {
+			continue
+		}
+		if err != nil {
+			return "", "", err
+		}
+		_, err = f.WriteString(content)
+		if cerr := f.Close(); err == nil {
+			err = cerr
+		}
+		if err != nil {
+			os.Remove(info)
+			return "", "", err
+		}
+		return filepath.Join(trash, "files", name), info, nil
+	}
+	return "", "", fmt.Errorf("no free name for %s in %s", base, trash)
+}
@@ -0,0 +1,102 @@
+package main
+
+import (
+	"archive/zip"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// GET /api/group/zip?idx=N streams a ZIP of the group's files for inspection
+// in other tools. With previews=1, CR2 files are replaced by their JPG
+// previews. A group.json with the duplicates file's entries is included.
+func groupZipHandler(w http.ResponseWriter, r *http.Request) {
+	idx, err := strconv.Atoi(r.URL.Query().Get("idx"))
+	if err != nil {
+		http.Error(w, "Invalid idx", 400)
+		return
+	}
+	store, release := acquireGroups()
+	defer release()
+	if idx < 0 || idx >= store.Len() {
+		http.Error(w, "Group not found", 404)
+		return
+	}
+	group, err := store.Group(idx)
+	if err != nil {
+		http.Error(w, "Failed to read group", 500)
+		return
+	}
+	previews := r.URL.Query().Get("previews") == "1"
+
+	var present []Image
+	for _, img := range group {
+		if _, err := os.Stat(img.Path); err == nil {
+			present = append(present, img)
+		}
+	}
+	if len(present) == 0 {
+		http.Error(w, "No files found in group", 404)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/zip")
+	w.Header().Set("Content-Disposition", fmt.Sprintf(`attachment; filename="group-%d.zip"`, idx))
+	zw := zip.NewWriter(w)
+	defer zw.Close()
+
+	for i, img := range present {
+		source, name := img.Path, getRelativeImagePath(img.Path)
+		if filepath.IsAbs(name) {
+			name = fmt.Sprintf("%d-%s", i, filepath.Base(name))
+		}
+		if previews && isCR2File(img.Path) {
+			if jpgPath, err := convertCR2ToJPG(img.Path); err == nil {
+				source = jpgPath
+				name = strings.TrimSuffix(name, filepath.Ext(name)) + ".preview.jpg"
+			}
+		}
+		if err := addToZip(zw, source, filepath.ToSlash(name)); err != nil {
+			// Headers are already sent, so all we can do is cut the archive short
+			reqLog(r, "zip").Error("failed to add file to ZIP", "path", source, "group", idx, "err", err)
+			return
+		}
+	}
+
+	manifest, err := zw.Create("group.json")
+	if err == nil {
+		enc := json.NewEncoder(manifest)
+		enc.SetIndent("", "  ")
+		enc.Encode(map[string]interface{}{"idx": idx, "images": present})
+	}
+}
+
+// Images and videos are already compressed, so files are stored as-is
+func addToZip(zw *zip.Writer, path, name string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	header, err := zip.FileInfoHeader(info)
+	if err != nil {
+		return err
+	}
+	header.Name = name
+	header.Method = zip.Store
+	dst, err := zw.CreateHeader(header)
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(dst, f)
+	return err
+}